@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// userNameRegexp matches the user names useradd accepts by default
+var userNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]*\$?$`)
+
+var addCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add users, packages or ports to an OSBuild blueprint",
+	Long: `Adds a user, packages or firewall ports to an OSBuild blueprint (TOML, JSON or
+YAML, by file extension) in place, for quick edits. The additions are checked
+before the blueprint is written, comments and formatting of the file are lost.`,
+}
+
+var addUser struct {
+	Name    string
+	KeyFile string
+	Groups  []string
+	UID     int
+	Shell   string
+}
+
+var addUserCmd = &cobra.Command{
+	Use:   "user --name NAME [--key-file FILE] blueprint",
+	Short: "Add a user to an OSBuild blueprint",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !userNameRegexp.MatchString(addUser.Name) || len(addUser.Name) > 32 {
+			return fmt.Errorf("invalid user name %q", addUser.Name)
+		}
+		user := map[string]interface{}{"name": addUser.Name}
+		if addUser.KeyFile != "" {
+			key, err := os.ReadFile(addUser.KeyFile)
+			if err != nil {
+				return fmt.Errorf("error reading SSH key: %w", err)
+			}
+			if !strings.HasPrefix(string(key), "ssh-") && !strings.HasPrefix(string(key), "ecdsa-") && !strings.HasPrefix(string(key), "sk-") {
+				return fmt.Errorf("%s is not a public SSH key", addUser.KeyFile)
+			}
+			user["key"] = strings.TrimSpace(string(key))
+		}
+		if len(addUser.Groups) > 0 {
+			groups := make([]interface{}, len(addUser.Groups))
+			for i, group := range addUser.Groups {
+				groups[i] = group
+			}
+			user["groups"] = groups
+		}
+		if cmd.Flags().Changed("uid") {
+			user["uid"] = int64(addUser.UID)
+		}
+		if addUser.Shell != "" {
+			user["shell"] = addUser.Shell
+		}
+
+		return editBlueprintFile(args[0], nil, func(doc map[string]interface{}) error {
+			return addDocumentUser(doc, user)
+		})
+	},
+}
+
+var addPackageCmd = &cobra.Command{
+	Use:   "package NAME... blueprint",
+	Short: "Add packages to an OSBuild blueprint",
+	Long:  `Adds packages to an OSBuild blueprint. Packages already in it are skipped.`,
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, path := args[:len(args)-1], args[len(args)-1]
+		return editBlueprintFile(path, nil, func(doc map[string]interface{}) error {
+			return addDocumentPackages(doc, names)
+		})
+	},
+}
+
+var addPortCmd = &cobra.Command{
+	Use:   "port PORT... blueprint",
+	Short: "Open firewall ports in an OSBuild blueprint",
+	Long: `Adds firewall ports, such as 8443/tcp or 8000-8080/udp, to an OSBuild
+blueprint. Ports already in it are skipped.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ports, path := args[:len(args)-1], args[len(args)-1]
+		return editBlueprintFile(path, nil, func(doc map[string]interface{}) error {
+			return addDocumentPorts(doc, ports)
+		})
+	},
+}
+
+func init() {
+	addUserCmd.Flags().StringVar(&addUser.Name, "name", "", "name of the user")
+	addUserCmd.Flags().StringVar(&addUser.KeyFile, "key-file", "", "file with the public SSH key of the user")
+	addUserCmd.Flags().StringSliceVar(&addUser.Groups, "groups", nil, "groups of the user")
+	addUserCmd.Flags().IntVar(&addUser.UID, "uid", 0, "UID of the user")
+	addUserCmd.Flags().StringVar(&addUser.Shell, "shell", "", "login shell of the user")
+	_ = addUserCmd.MarkFlagRequired("name")
+
+	addCmd.AddCommand(addUserCmd, addPackageCmd, addPortCmd)
+	rootCmd.AddCommand(addCmd)
+}
+
+// addDocumentUser appends the user to the decoded blueprint, unless it has a user of
+// that name already.
+func addDocumentUser(doc map[string]interface{}, user map[string]interface{}) error {
+	customizations, _ := doc["customizations"].(map[string]interface{})
+	users, _ := customizations["user"].([]interface{})
+	for _, u := range users {
+		if existing, ok := u.(map[string]interface{}); ok && existing["name"] == user["name"] {
+			return fmt.Errorf("user %s is already in the blueprint", user["name"])
+		}
+	}
+	return appendDocumentKey(doc, "customizations.user", user)
+}
+
+// addDocumentPackages appends the packages missing from the decoded blueprint.
+func addDocumentPackages(doc map[string]interface{}, names []string) error {
+	packages, _ := doc["packages"].([]interface{})
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t\n") {
+			return fmt.Errorf("invalid package name %q", name)
+		}
+		if !slices.ContainsFunc(packages, func(pkg interface{}) bool {
+			p, ok := pkg.(map[string]interface{})
+			return ok && p["name"] == name
+		}) {
+			packages = append(packages, map[string]interface{}{"name": name})
+		}
+	}
+	doc["packages"] = packages
+	return nil
+}
+
+// addDocumentPorts appends the firewall ports missing from the decoded blueprint.
+func addDocumentPorts(doc map[string]interface{}, ports []string) error {
+	for _, port := range ports {
+		if err := validatePort(port); err != nil {
+			return err
+		}
+		customizations, _ := doc["customizations"].(map[string]interface{})
+		firewall, _ := customizations["firewall"].(map[string]interface{})
+		existing, _ := firewall["ports"].([]interface{})
+		if slices.Contains(existing, interface{}(port)) {
+			continue
+		}
+		if err := appendDocumentKey(doc, "customizations.firewall.ports", port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddDocumentUser(t *testing.T) {
+	doc := map[string]interface{}{"name": "edge"}
+	require.NoError(t, addDocumentUser(doc, map[string]interface{}{"name": "admin", "key": "ssh-ed25519 AAAA"}))
+	require.NoError(t, addDocumentUser(doc, map[string]interface{}{"name": "ops"}))
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "admin", "key": "ssh-ed25519 AAAA"},
+		map[string]interface{}{"name": "ops"},
+	}, doc["customizations"].(map[string]interface{})["user"])
+
+	err := addDocumentUser(doc, map[string]interface{}{"name": "admin"})
+	assert.EqualError(t, err, "user admin is already in the blueprint")
+}
+
+func TestAddDocumentPackages(t *testing.T) {
+	doc := map[string]interface{}{
+		"packages": []interface{}{map[string]interface{}{"name": "vim-enhanced", "version": "*"}},
+	}
+	require.NoError(t, addDocumentPackages(doc, []string{"nginx", "vim-enhanced", "nginx"}))
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "vim-enhanced", "version": "*"},
+		map[string]interface{}{"name": "nginx"},
+	}, doc["packages"])
+
+	assert.Error(t, addDocumentPackages(doc, []string{"two words"}))
+}
+
+func TestAddDocumentPorts(t *testing.T) {
+	doc := map[string]interface{}{}
+	require.NoError(t, addDocumentPorts(doc, []string{"22/tcp", "8443/tcp", "22/tcp"}))
+	assert.Equal(t, []interface{}{"22/tcp", "8443/tcp"},
+		doc["customizations"].(map[string]interface{})["firewall"].(map[string]interface{})["ports"])
+
+	assert.Error(t, addDocumentPorts(doc, []string{"http"}))
+	assert.Error(t, addDocumentPorts(doc, []string{"70000/tcp"}))
+}
+
+func TestUserNameRegexp(t *testing.T) {
+	for _, name := range []string{"admin", "_svc", "user-1", "machine$"} {
+		assert.True(t, userNameRegexp.MatchString(name), name)
+	}
+	for _, name := range []string{"", "Admin", "1user", "a b", "-x"} {
+		assert.False(t, userNameRegexp.MatchString(name), name)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// redactedValue replaces the secrets in anonymized blueprints
+const redactedValue = "REDACTED"
+
+// secretKeyRegexp matches the names of fields and environment variables holding
+// secrets, wherever they are in the blueprint
+var secretKeyRegexp = regexp.MustCompile(`(?i)(password|passphrase|passwd|secret|token|activation_?key|api_?key|private_?key)`)
+
+// anonymizedFields are the other fields anonymize redacts. List entries are written as
+// *, e.g. customizations.user.*.key.
+var anonymizedFields = []string{
+	"customizations.user.*.key",
+	"customizations.sshkey.*.key",
+	"customizations.files.*.data",
+	"customizations.installer.kickstart.contents",
+}
+
+// credentialURLFields are the fields holding URLs, whose passwords anonymize redacts
+var credentialURLFields = []string{
+	"customizations.proxy.http",
+	"customizations.proxy.https",
+}
+
+var anonymizeCmd = &cobra.Command{
+	Use:   "anonymize [blueprint]",
+	Short: "Print an OSBuild blueprint with its secrets removed",
+	Long: `Prints an OSBuild blueprint with its secrets replaced by REDACTED, so that it
+can be attached to bug reports. The structure of the blueprint is kept, so
+that the problem can be reproduced with it.
+
+Replaced are the passwords of users, keeping the hash algorithm of hashed
+ones, SSH keys, the data of files, kickstart contents, passwords in proxy URLs
+and every field or environment variable whose name looks like a secret, e.g.
+TOKEN, SECRET or ACTIVATION_KEY. Names of files and environment variables
+holding secrets are kept.
+
+The blueprint is printed in its format, taken from the file extension, in
+canonical form like fmt writes it.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		blueprintPath := defaultBlueprintPath
+		if len(args) > 0 {
+			blueprintPath = args[0]
+		}
+		format, err := blueprintFormat(blueprintPath)
+		if err != nil {
+			return err
+		}
+		data, err := readBlueprint(blueprintPath)
+		if err != nil {
+			return fmt.Errorf("error opening blueprint file %s: %w", blueprintPath, err)
+		}
+		doc, err := decodeDocument(data, format)
+		if err != nil {
+			return fmt.Errorf("error parsing blueprint %s: %w", blueprintPath, err)
+		}
+		anonymizeValue(doc, "")
+		out, err := encodeCanonicalDocument(doc, format)
+		if err != nil {
+			return fmt.Errorf("error encoding blueprint: %w", err)
+		}
+		fmt.Print(string(out))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(anonymizeCmd)
+}
+
+// isSecretKey returns whether the last element of the dotted key names a secret.
+// Fields naming the file or environment variable of a secret are no secrets.
+func isSecretKey(key string) bool {
+	name := key[strings.LastIndex(key, ".")+1:]
+	if strings.HasSuffix(name, "_file") || strings.HasSuffix(name, "_env") {
+		return false
+	}
+	return secretKeyRegexp.MatchString(name) || slices.Contains(anonymizedFields, key)
+}
+
+// redact returns the replacement of the secret at the dotted key.
+func redact(key, secret string) string {
+	// The hash algorithm of a password, like $6$, matters to reproduce problems
+	if strings.HasSuffix(key, ".password") && strings.HasPrefix(secret, "$") {
+		if i := strings.Index(secret[1:], "$"); i >= 0 {
+			return secret[:i+2] + redactedValue
+		}
+	}
+	return redactedValue
+}
+
+// redactURL returns the URL with its password redacted.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	u.User = url.UserPassword(u.User.Username(), redactedValue)
+	return u.String()
+}
+
+// anonymizeValue redacts the secrets in the decoded blueprint value at the dotted key,
+// with list entries as *, and returns the result. Tables and lists are changed in
+// place.
+func anonymizeValue(v interface{}, key string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			childKey := name
+			if key != "" {
+				childKey = key + "." + name
+			}
+			v[name] = anonymizeValue(child, childKey)
+		}
+		return v
+	case []interface{}:
+		for i, entry := range v {
+			// Strings in a list are secrets if the list is one
+			entryKey := key
+			if _, ok := entry.(map[string]interface{}); ok {
+				entryKey = key + ".*"
+			}
+			v[i] = anonymizeValue(entry, entryKey)
+		}
+		return v
+	case string:
+		if slices.Contains(credentialURLFields, key) {
+			return redactURL(v)
+		}
+		if isSecretKey(key) {
+			return redact(key, v)
+		}
+	}
+	return v
+}
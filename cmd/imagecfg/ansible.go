@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// ansibleTask is a task or handler of an Ansible role
+type ansibleTask struct {
+	Name   string
+	Module string
+	Args   interface{}
+	Loop   string
+	Notify string
+}
+
+// MarshalYAML encodes the task with the name first and the module right after it,
+// the way Ansible tasks are usually written.
+func (t ansibleTask) MarshalYAML() (interface{}, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	add := func(key string, value interface{}) error {
+		var v yaml.Node
+		if err := v.Encode(value); err != nil {
+			return err
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &v)
+		return nil
+	}
+	fields := []struct {
+		key   string
+		value interface{}
+		set   bool
+	}{
+		{"name", t.Name, true},
+		{t.Module, t.Args, true},
+		{"loop", t.Loop, t.Loop != ""},
+		{"notify", t.Notify, t.Notify != ""},
+	}
+	for _, field := range fields {
+		if !field.set {
+			continue
+		}
+		if err := add(field.key, field.value); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+type ansibleGroup struct {
+	Name string `yaml:"name"`
+	GID  *int   `yaml:"gid,omitempty"`
+}
+
+type ansibleUser struct {
+	Name     string   `yaml:"name"`
+	UID      *int     `yaml:"uid,omitempty"`
+	GID      *int     `yaml:"gid,omitempty"`
+	Groups   []string `yaml:"groups,omitempty"`
+	Comment  string   `yaml:"comment,omitempty"`
+	Home     string   `yaml:"home,omitempty"`
+	Shell    string   `yaml:"shell,omitempty"`
+	Password string   `yaml:"password,omitempty"`
+	SSHKeys  []string `yaml:"ssh_keys,omitempty"`
+}
+
+type ansibleFSNode struct {
+	Path  string      `yaml:"path"`
+	Src   string      `yaml:"src,omitempty"`
+	Mode  string      `yaml:"mode"`
+	Owner interface{} `yaml:"owner,omitempty"`
+	Group interface{} `yaml:"group,omitempty"`
+}
+
+var ansibleRoleOutputDir string
+
+var ansibleRoleCmd = &cobra.Command{
+	Use:   "ansible-role --output-dir DIR [blueprint.toml...]",
+	Short: "Translate an OSBuild blueprint to an Ansible role",
+	Long: `Translates an OSBuild blueprint (TOML format) into an Ansible role with
+tasks/, handlers/, templates/ and defaults/, which can be committed into an
+existing role repository.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+The values of the blueprint become the role defaults. The packages, groups,
+users, SSH keys, hostname, timezone, files, directories, firewall and services
+are configured by their modules, the files being templates. All other
+configurations are run as the same bash blocks the 'bash' command generates,
+using the shell module.
+
+The role uses the ansible.posix and community.general collections.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		role, err := generateAnsibleRole(bp)
+		if err != nil {
+			return fmt.Errorf("error generating Ansible role: %w", err)
+		}
+		if err := writeAnsibleRole(role, ansibleRoleOutputDir); err != nil {
+			return fmt.Errorf("error writing Ansible role: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	ansibleRoleCmd.Flags().StringVar(&ansibleRoleOutputDir, "output-dir", "", "directory to write the role to")
+	_ = ansibleRoleCmd.MarkFlagRequired("output-dir")
+	rootCmd.AddCommand(ansibleRoleCmd)
+}
+
+// ansibleTemplate returns the template of a file, which is written as is.
+func ansibleTemplate(path, data string) (string, error) {
+	if strings.Contains(data, "endraw") {
+		return "", fmt.Errorf("file %s: contents cannot be escaped for Jinja", path)
+	}
+	return "{% raw %}" + data + "{% endraw %}", nil
+}
+
+// ansibleYAML encodes a role file.
+func ansibleYAML(value interface{}) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return "---\n" + string(data), nil
+}
+
+// ansibleFSNodes returns the directories and files of the blueprint as role defaults,
+// along with the templates of the files.
+func ansibleFSNodes(bp *Blueprint) ([]ansibleFSNode, []ansibleFSNode, map[string]string, error) {
+	var dirs, files []ansibleFSNode
+	templates := make(map[string]string)
+	for _, dir := range bp.Customizations.GetDirectories() {
+		mode, err := fsNodeMode(dir.Mode, 0755)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("directory %s: %w", dir.Path, err)
+		}
+		dirs = append(dirs, ansibleFSNode{Path: dir.Path, Mode: fmt.Sprintf("%04o", mode), Owner: dir.User, Group: dir.Group})
+	}
+	for _, file := range bp.Customizations.GetFiles() {
+		mode, err := fsNodeMode(file.Mode, 0644)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("file %s: %w", file.Path, err)
+		}
+		src := strings.TrimPrefix(file.Path, "/") + ".j2"
+		template, err := ansibleTemplate(file.Path, file.Data)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		templates[src] = template
+		files = append(files, ansibleFSNode{Path: file.Path, Src: src, Mode: fmt.Sprintf("%04o", mode), Owner: file.User, Group: file.Group})
+	}
+	return dirs, files, templates, nil
+}
+
+// generateAnsibleRole generates the files of an Ansible role from the blueprint,
+// keyed by their path in the role. The tasks are in the order of the blocks they replace.
+func generateAnsibleRole(bp *Blueprint) (map[string]string, error) {
+	header, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return nil, err
+	}
+	dirs, files, templates, err := ansibleFSNodes(bp)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := make(map[string]interface{})
+	var tasks, handlers []ansibleTask
+	native := map[string]func(){
+		"Packages": func() {
+			defaults["imagecfg_packages"] = bp.GetPackages()
+			tasks = append(tasks, ansibleTask{Name: "Install packages", Module: "ansible.builtin.dnf", Args: map[string]string{
+				"name": "{{ imagecfg_packages }}", "state": "present",
+			}})
+		},
+		"Groups": func() {
+			var groups []ansibleGroup
+			for _, group := range bp.Customizations.GetGroups() {
+				groups = append(groups, ansibleGroup{Name: group.Name, GID: group.GID})
+			}
+			defaults["imagecfg_groups"] = groups
+			tasks = append(tasks, ansibleTask{Name: "Create groups", Module: "ansible.builtin.group", Loop: "{{ imagecfg_groups }}", Args: map[string]string{
+				"name": "{{ item.name }}", "gid": "{{ item.gid | default(omit) }}",
+			}})
+		},
+		"Users": func() {
+			var users []ansibleUser
+			for _, user := range bp.Customizations.GetUsers() {
+				u := ansibleUser{Name: user.Name, UID: user.UID, GID: user.GID, Groups: user.Groups}
+				if user.Description != nil {
+					u.Comment = *user.Description
+				}
+				if user.Home != nil {
+					u.Home = *user.Home
+				}
+				if user.Shell != nil {
+					u.Shell = *user.Shell
+				}
+				if user.Password != nil {
+					u.Password = *user.Password
+				}
+				if user.Key != nil {
+					for _, key := range strings.Split(strings.TrimSpace(*user.Key), "\n") {
+						if key = strings.TrimSpace(key); key != "" {
+							u.SSHKeys = append(u.SSHKeys, key)
+						}
+					}
+				}
+				users = append(users, u)
+			}
+			defaults["imagecfg_users"] = users
+			tasks = append(tasks,
+				ansibleTask{Name: "Create users", Module: "ansible.builtin.user", Loop: "{{ imagecfg_users }}", Args: map[string]interface{}{
+					"name":     "{{ item.name }}",
+					"uid":      "{{ item.uid | default(omit) }}",
+					"group":    "{{ item.gid | default(omit) }}",
+					"groups":   "{{ item.groups | default(omit) }}",
+					"append":   true,
+					"comment":  "{{ item.comment | default(omit) }}",
+					"home":     "{{ item.home | default(omit) }}",
+					"shell":    "{{ item.shell | default(omit) }}",
+					"password": "{{ item.password | default(omit) }}",
+				}},
+				ansibleTask{Name: "Add SSH keys", Module: "ansible.posix.authorized_key", Loop: "{{ imagecfg_users | subelements('ssh_keys', skip_missing=True) }}", Args: map[string]string{
+					"user": "{{ item.0.name }}", "key": "{{ item.1 }}",
+				}},
+			)
+		},
+		"Timezone": func() {
+			timezone, _ := bp.Customizations.GetTimezoneSettings()
+			defaults["imagecfg_timezone"] = *timezone
+			tasks = append(tasks, ansibleTask{Name: "Set timezone", Module: "community.general.timezone", Args: map[string]string{
+				"name": "{{ imagecfg_timezone }}",
+			}})
+		},
+		"Files and Directories": func() {
+			if len(dirs) > 0 {
+				defaults["imagecfg_directories"] = dirs
+				tasks = append(tasks, ansibleTask{Name: "Create directories", Module: "ansible.builtin.file", Loop: "{{ imagecfg_directories }}", Args: map[string]string{
+					"path": "{{ item.path }}", "state": "directory", "mode": "{{ item.mode }}",
+					"owner": "{{ item.owner | default(omit) }}", "group": "{{ item.group | default(omit) }}",
+				}})
+			}
+			if len(files) > 0 {
+				defaults["imagecfg_files"] = files
+				tasks = append(tasks, ansibleTask{Name: "Write files", Module: "ansible.builtin.template", Loop: "{{ imagecfg_files }}", Args: map[string]string{
+					"src": "{{ item.src }}", "dest": "{{ item.path }}", "mode": "{{ item.mode }}",
+					"owner": "{{ item.owner | default(omit) }}", "group": "{{ item.group | default(omit) }}",
+				}})
+			}
+		},
+		"Firewall": func() {
+			fw := bp.Customizations.GetFirewall()
+			if len(fw.Ports) > 0 {
+				defaults["imagecfg_firewall_ports"] = fw.Ports
+				tasks = append(tasks, ansibleTask{Name: "Open firewall ports", Module: "ansible.posix.firewalld", Loop: "{{ imagecfg_firewall_ports }}", Notify: "Reload firewalld", Args: map[string]interface{}{
+					"port": "{{ item }}", "permanent": true, "state": "enabled",
+				}})
+			}
+			if fw.Services != nil && len(fw.Services.Enabled) > 0 {
+				defaults["imagecfg_firewall_services"] = fw.Services.Enabled
+				tasks = append(tasks, ansibleTask{Name: "Allow firewall services", Module: "ansible.posix.firewalld", Loop: "{{ imagecfg_firewall_services }}", Notify: "Reload firewalld", Args: map[string]interface{}{
+					"service": "{{ item }}", "permanent": true, "state": "enabled",
+				}})
+			}
+			handlers = append(handlers, ansibleTask{Name: "Reload firewalld", Module: "ansible.builtin.systemd_service", Args: map[string]string{
+				"name": "firewalld", "state": "reloaded",
+			}})
+		},
+		"Services": func() {
+			svc := bp.Customizations.GetServices()
+			states := []struct {
+				name, variable, arg string
+				value               bool
+				services            []string
+			}{
+				{"Enable services", "imagecfg_services_enabled", "enabled", true, svc.Enabled},
+				{"Disable services", "imagecfg_services_disabled", "enabled", false, svc.Disabled},
+				{"Mask services", "imagecfg_services_masked", "masked", true, svc.Masked},
+			}
+			for _, state := range states {
+				if len(state.services) == 0 {
+					continue
+				}
+				defaults[state.variable] = state.services
+				tasks = append(tasks, ansibleTask{Name: state.name, Module: "ansible.builtin.systemd_service", Loop: "{{ " + state.variable + " }}", Args: map[string]interface{}{
+					"name": "{{ item }}", state.arg: state.value,
+				}})
+			}
+		},
+	}
+	// The imagecfg additions to the hostname have no module
+	if bp.Extensions.GetPrettyHostname() == "" && bp.Extensions.GetChassis() == "" && bp.Extensions.GetHostsEntry() == nil {
+		native["Hostname"] = func() {
+			defaults["imagecfg_hostname"] = *bp.Customizations.GetHostname()
+			tasks = append(tasks, ansibleTask{Name: "Set hostname", Module: "ansible.builtin.hostname", Args: map[string]string{
+				"name": "{{ imagecfg_hostname }}",
+			}})
+		}
+	}
+
+	shellHeader := strings.TrimPrefix(header, "#!/bin/bash\n")
+	for _, block := range namedBlocks {
+		if add, ok := native[block.Name]; ok {
+			add()
+			continue
+		}
+		tasks = append(tasks, ansibleTask{Name: block.Name, Module: "ansible.builtin.shell", Args: map[string]string{
+			"cmd": shellHeader + block.Commands, "executable": "/bin/bash",
+		}})
+	}
+
+	role := make(map[string]string)
+	for path, template := range templates {
+		role[filepath.Join("templates", path)] = template
+	}
+	for path, value := range map[string]interface{}{
+		"tasks/main.yml":    tasks,
+		"handlers/main.yml": handlers,
+		"defaults/main.yml": defaults,
+	} {
+		data, err := ansibleYAML(value)
+		if err != nil {
+			return nil, err
+		}
+		role[path] = data
+	}
+	return role, nil
+}
+
+// writeAnsibleRole writes the role files to dir, which is created if missing.
+func writeAnsibleRole(role map[string]string, dir string) error {
+	for path, content := range role {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestGenerateAnsibleRole(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[packages]]
+name = "vim"
+
+[customizations]
+hostname = "web1"
+
+[[customizations.user]]
+name = "admin"
+key = "ssh-ed25519 AAAA admin@example.com"
+groups = ["wheel"]
+
+[[customizations.files]]
+path = "/etc/motd"
+data = "Hello {{ world }}\n"
+
+[customizations.firewall]
+ports = ["8080/tcp"]
+
+[customizations.services]
+enabled = ["nginx"]
+
+[customizations.journald]
+storage = "persistent"
+`)
+	role, err := generateAnsibleRole(bp)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"defaults/main.yml", "handlers/main.yml", "tasks/main.yml", "templates/etc/motd.j2"}, slices.Sorted(maps.Keys(role)))
+
+	// The file contents are not templated
+	assert.Equal(t, "{% raw %}Hello {{ world }}\n{% endraw %}", role["templates/etc/motd.j2"])
+
+	var defaults map[string]interface{}
+	require.NoError(t, yaml.Unmarshal([]byte(role["defaults/main.yml"]), &defaults))
+	assert.Equal(t, "web1", defaults["imagecfg_hostname"])
+	assert.Equal(t, []interface{}{"vim", "kernel"}, defaults["imagecfg_packages"])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"name": "admin", "groups": []interface{}{"wheel"}, "ssh_keys": []interface{}{"ssh-ed25519 AAAA admin@example.com"},
+	}}, defaults["imagecfg_users"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"path": "/etc/motd", "src": "etc/motd.j2", "mode": "0644"}}, defaults["imagecfg_files"])
+
+	tasks := role["tasks/main.yml"]
+	assert.Contains(t, tasks, "---\n- name: Install packages\n  ansible.builtin.dnf:\n    name: '{{ imagecfg_packages }}'\n    state: present\n")
+	assert.Contains(t, tasks, "- name: Set hostname\n  ansible.builtin.hostname:\n")
+	assert.Contains(t, tasks, "- name: Open firewall ports\n  ansible.posix.firewalld:\n    permanent: true\n    port: '{{ item }}'\n    state: enabled\n  loop: '{{ imagecfg_firewall_ports }}'\n  notify: Reload firewalld\n")
+	assert.Contains(t, tasks, "- name: Journald\n  ansible.builtin.shell:\n")
+	assert.NotContains(t, tasks, "dnf install")
+	assert.Contains(t, role["handlers/main.yml"], "- name: Reload firewalld\n  ansible.builtin.systemd_service:\n")
+
+	dir := t.TempDir()
+	require.NoError(t, writeAnsibleRole(role, dir))
+	data, err := os.ReadFile(filepath.Join(dir, "templates/etc/motd.j2"))
+	require.NoError(t, err)
+	assert.Equal(t, role["templates/etc/motd.j2"], string(data))
+}
+
+func TestGenerateAnsibleRoleEmpty(t *testing.T) {
+	bp := mustParseBlueprint(t, "")
+	role, err := generateAnsibleRole(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "---\n[]\n", role["handlers/main.yml"])
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// applyContinueOnError and applyQuiet are set by --continue-on-error and --quiet
+var applyContinueOnError, applyQuiet bool
+
+// applyJobs is set by --jobs, the number of blocks apply runs at the same time
+var applyJobs int
+
+// applyOptions are the settings of applying blocks
+type applyOptions struct {
+	// Snapshot saves the files of the blocks to restore them if a block fails, if set
+	Snapshot *fileSnapshot
+	// ContinueOnError applies the remaining blocks when a block fails
+	ContinueOnError bool
+	// Quiet only shows the output of failing blocks
+	Quiet bool
+	// Jobs is the number of blocks run at the same time, one if it is not set
+	Jobs int
+	// Root is the tree the blocks are applied to in a chroot, the running system if
+	// it is empty
+	Root string
+	// Confine runs the blocks in a bwrap sandbox in Root instead of a chroot
+	Confine bool
+	// Verify runs the probes of every block after it succeeded, failing the block if
+	// any probe fails
+	Verify bool
+	// Timeout is the longest a block may run for, no limit if it is 0
+	Timeout time.Duration
+	// BlockTimeouts override Timeout for the blocks with these slugs
+	BlockTimeouts map[string]time.Duration
+	// Retries is how often a block failing transiently runs again, see
+	// runBlockWithRetries
+	Retries int
+	// RetryDelay is how long to wait before the first retry
+	RetryDelay time.Duration
+	// Sudo runs the blocks with sudo
+	Sudo bool
+	// Env are the environment variables the blocks read, kept when they run with
+	// sudo, see blockEnvironment
+	Env []string
+	// Sandbox runs the blocks as transient services, if set
+	Sandbox *systemdSandbox
+	// Report records the results and the output of the blocks, if set
+	Report *applyReport
+	// Journal is the journal the output of the blocks is sent to, if set, the log
+	// messages go to it with the logger
+	Journal slog.Handler
+}
+
+// blockTimeout returns the longest the block may run for, 0 if there is no limit.
+func (o applyOptions) blockTimeout(block string) time.Duration {
+	if timeout, ok := o.BlockTimeouts[blockSlug(block)]; ok {
+		return timeout
+	}
+	return o.Timeout
+}
+
+// States of the blocks while they are applied
+const (
+	blockPending = iota
+	blockRunning
+	blockApplied
+	blockFailed
+)
+
+// blockResult is the result of running a block
+type blockResult struct {
+	index    int
+	err      error
+	duration time.Duration
+}
+
+// applyBlocks applies the blocks with the header and returns the names of the applied
+// and the failed ones. Up to opts.Jobs blocks run at the same time, each as soon as the
+// blocks it has to run after are applied, see blockPrerequisites. With one job, the
+// blocks run in order.
+//
+// Unless opts.ContinueOnError is set, no more blocks are started once a block fails,
+// and when the running ones finished, the snapshot is restored if there is one and the
+// error of the block is returned. Otherwise, the blocks depending on a failed block,
+// see blockDependencies, fail as well.
+func applyBlocks(header string, blocks []NamedCommandBlock, opts applyOptions) (applied, failed []string, err error) {
+	var nonEmpty []NamedCommandBlock
+	for _, block := range blocks {
+		if strings.TrimSpace(block.Commands) != "" {
+			nonEmpty = append(nonEmpty, block)
+		}
+	}
+	jobs := max(opts.Jobs, 1)
+	prerequisites := blockPrerequisites(nonEmpty)
+
+	start := time.Now()
+	states := make([]int, len(nonEmpty))
+	logs := make([]*slog.Logger, len(nonEmpty))
+	results := make(chan blockResult)
+	started, running := 0, 0
+	var blockErr error
+	for {
+		for i, block := range nonEmpty {
+			if blockErr != nil || running >= jobs {
+				break
+			}
+			if states[i] != blockPending {
+				continue
+			}
+			ready := true
+			var failedDep string
+			for _, p := range prerequisites[i] {
+				switch states[p] {
+				case blockFailed:
+					// Blocks only ordered after the failed one, e.g. for changing the same files, still run
+					if dependsOn(block.Name, nonEmpty[p].Name) {
+						failedDep = nonEmpty[p].Name
+					}
+				case blockApplied:
+				default:
+					ready = false
+				}
+			}
+			if failedDep != "" {
+				states[i] = blockFailed
+				failed = append(failed, block.Name)
+				logger.Error("block skipped, a block it depends on failed", "block", block.Name, "result", "skipped", "failed", failedDep)
+				opts.Report.finish(block.Name, reportSkipped, 0, fmt.Errorf("block '%s' it depends on failed", failedDep))
+				continue
+			}
+			if !ready {
+				continue
+			}
+
+			started++
+			logs[i] = logger.With("block", block.Name, "progress", fmt.Sprintf("%d/%d", started, len(nonEmpty)))
+			logs[i].Info("applying block")
+			if block.Native == nil {
+				// runNative logs the operations instead
+				logs[i].Debug("block commands", "commands", block.Commands)
+			}
+			if opts.Snapshot != nil {
+				// Blocks changing the same files never run at the same time
+				if err := opts.Snapshot.Save(blockPaths(block.Commands)); err != nil {
+					blockErr = fmt.Errorf("error saving files for '%s': %w", block.Name, err)
+					break
+				}
+			}
+			states[i] = blockRunning
+			running++
+			go func(i int) {
+				blockStart := time.Now()
+				err := runBlockWithRetries(header, nonEmpty[i], logs[i], opts)
+				if err == nil && opts.Verify && nonEmpty[i].Probes != "" {
+					err = probeBlock(header, nonEmpty[i], logs[i], opts)
+				}
+				results <- blockResult{index: i, err: err, duration: time.Since(blockStart)}
+			}(i)
+		}
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+		block, log := nonEmpty[result.index], logs[result.index]
+		if result.err != nil {
+			states[result.index] = blockFailed
+			failed = append(failed, block.Name)
+			log.Error("block failed", "result", "failed", "duration", result.duration, "elapsed", time.Since(start), "error", result.err)
+			opts.Report.finish(block.Name, reportFailed, result.duration, result.err)
+			if !opts.ContinueOnError && blockErr == nil {
+				blockErr = result.err
+			}
+			continue
+		}
+		states[result.index] = blockApplied
+		applied = append(applied, block.Name)
+		log.Info("applied block", "result", "applied", "duration", result.duration, "elapsed", time.Since(start))
+		opts.Report.finish(block.Name, reportApplied, result.duration, nil)
+	}
+
+	if blockErr != nil && opts.Snapshot != nil {
+		restored, rollbackErr := opts.Snapshot.Restore()
+		if rollbackErr != nil {
+			return applied, failed, fmt.Errorf("%w, rollback failed: %w", blockErr, rollbackErr)
+		}
+		logger.Info("rolled back files and directories changed since the first block", "paths", restored)
+	}
+	return applied, failed, blockErr
+}
+
+// prefixWriter writes the lines written to it to w, each with prefix
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	// partial is the last line written without its newline
+	partial []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.partial = append(p.partial, data...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		if _, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.partial[:i]); err != nil {
+			return 0, err
+		}
+		p.partial = p.partial[i+1:]
+	}
+}
+
+// Flush writes the last line if it has no newline.
+func (p *prefixWriter) Flush() error {
+	if len(p.partial) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.partial)
+	p.partial = nil
+	return err
+}
+
+// blockCommand returns the command running the commands of a block as a script with
+// the header, on the running system or in the tree at opts.Root, confined with
+// opts.Confine, as a transient service with opts.Sandbox and with sudo if opts.Sudo is
+// set, and a function removing what it needs once it ran.
+func blockCommand(header string, block NamedCommandBlock, opts applyOptions, log *slog.Logger) (*exec.Cmd, func(), error) {
+	if opts.Root != "" {
+		cmd := rootChrootCmd(opts.Root, scriptShell(header), header+"\n"+block.Commands)
+		if opts.Confine {
+			cmd = rootBwrapCmd(opts.Root, scriptShell(header), header+"\n"+block.Commands)
+		}
+		if opts.Sudo {
+			cmd = sudoCommand(cmd, opts.Env)
+		}
+		return cmd, func() {}, nil
+	}
+
+	// Create a temporary script file for this block
+	dir := ""
+	if opts.Sandbox != nil {
+		dir = sandboxScriptDir
+	}
+	tmpfile, err := os.CreateTemp(dir, "imagecfg-block-*.sh")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating temporary script for '%s': %w", block.Name, err)
+	}
+	remove := func() {
+		if err := os.Remove(tmpfile.Name()); err != nil && !os.IsNotExist(err) {
+			log.Warn("failed to remove temporary script", "path", tmpfile.Name(), "error", err)
+		}
+	}
+
+	// Write the header and current command block to the temporary file
+	blockScript := header + "\n" + block.Commands
+	if _, err := tmpfile.WriteString(blockScript); err != nil {
+		_ = tmpfile.Close() // Attempt to close, ignore error as we are in an error path.
+		remove()
+		return nil, nil, fmt.Errorf("error writing script for '%s' to %s: %w", block.Name, tmpfile.Name(), err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		remove()
+		return nil, nil, fmt.Errorf("error closing temporary file for '%s' (%s): %w", block.Name, tmpfile.Name(), err)
+	}
+
+	// Make the script executable
+	if err := os.Chmod(tmpfile.Name(), 0755); err != nil {
+		remove()
+		return nil, nil, fmt.Errorf("error making script for '%s' (%s) executable: %w", block.Name, tmpfile.Name(), err)
+	}
+	cmd := exec.Command(tmpfile.Name())
+	if opts.Sandbox != nil {
+		cmd = opts.Sandbox.command(block, tmpfile.Name(), opts.blockTimeout(block.Name))
+	}
+	if opts.Sudo {
+		cmd = sudoCommand(cmd, opts.Env)
+	}
+	return cmd, remove, nil
+}
+
+// runBlock runs the commands of a block as a script with the header, or its native
+// operations if it has them. The output of the block is streamed with the name of
+// the block before every line. With the json log format, it is logged instead, so
+// that the log stays JSON, and with opts.Quiet, it is only shown if the block fails.
+// With opts.Journal, it is sent to the journal as well, and with opts.Report, the end
+// of its stdout and stderr is recorded.
+func runBlock(header string, block NamedCommandBlock, log *slog.Logger, opts applyOptions) error {
+	prefix := "[" + block.Name + "] "
+	stdout, stderr := &prefixWriter{w: os.Stdout, prefix: prefix}, &prefixWriter{w: os.Stderr, prefix: prefix}
+	var output bytes.Buffer
+	tail := &tailBuffer{max: failureTailSize}
+	var outWriter, errWriter io.Writer
+	if logFormat == "json" || opts.Quiet {
+		captured := io.MultiWriter(&output, tail)
+		outWriter, errWriter = captured, captured
+	} else {
+		outWriter, errWriter = io.MultiWriter(stdout, tail), io.MultiWriter(stderr, tail)
+	}
+	if opts.Report != nil {
+		stdoutTail, stderrTail := &tailBuffer{max: failureTailSize}, &tailBuffer{max: failureTailSize}
+		outWriter, errWriter = io.MultiWriter(outWriter, stdoutTail), io.MultiWriter(errWriter, stderrTail)
+		defer func() { opts.Report.output(block.Name, stdoutTail.Bytes(), stderrTail.Bytes()) }()
+	}
+	timeout := opts.blockTimeout(block.Name)
+	var timedOut bool
+	var err error
+	if block.Native != nil {
+		timedOut, err = runNative(block.Native, outWriter, errWriter, timeout, log)
+	} else {
+		execCmd, cleanup, cmdErr := blockCommand(header, block, opts, log)
+		if cmdErr != nil {
+			return cmdErr
+		}
+		defer cleanup()
+		execCmd.Stdout = outWriter
+		execCmd.Stderr = errWriter
+		timedOut, err = runWithTimeout(execCmd, timeout)
+	}
+	_ = stdout.Flush()
+	_ = stderr.Flush()
+	switch {
+	case output.Len() == 0:
+	case logFormat == "json":
+		level := slog.LevelDebug
+		if err != nil {
+			level = slog.LevelError
+		}
+		log.Log(context.Background(), level, "block output", "output", output.String())
+	case err != nil:
+		_, _ = stderr.Write(output.Bytes())
+		_ = stderr.Flush()
+	}
+	if opts.Journal != nil && logFormat != "json" {
+		// The output is only shown, the journal gets it as a message
+		if out := tail.Bytes(); len(out) > 0 {
+			slog.New(opts.Journal).Debug("block output", "block", block.Name, "output", string(out))
+		}
+	}
+	if timedOut {
+		return &blockFailure{err: fmt.Errorf("block '%s' timed out after %s", block.Name, timeout), output: tail.Bytes(), timedOut: true}
+	}
+	if err != nil {
+		return &blockFailure{err: fmt.Errorf("execution failed for block '%s': %w", block.Name, err), output: tail.Bytes()}
+	}
+	return nil
+}
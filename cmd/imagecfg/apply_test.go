@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// discardLogs makes the test log nothing.
+func discardLogs(t *testing.T) {
+	old := logger
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	t.Cleanup(func() { logger = old })
+}
+
+func TestApplyBlocks(t *testing.T) {
+	discardLogs(t)
+	dir := t.TempDir()
+	blocks := []NamedCommandBlock{
+		{Name: "First", Commands: "touch " + filepath.Join(dir, "first")},
+		{Name: "Empty", Commands: " "},
+		{Name: "Failing", Commands: "false"},
+		{Name: "Last", Commands: "touch " + filepath.Join(dir, "last")},
+	}
+
+	applied, failed, err := applyBlocks("#!/bin/sh\nset -eu\n", blocks, applyOptions{})
+	assert.EqualError(t, err, "execution failed for block 'Failing': exit status 1")
+	assert.Equal(t, []string{"First"}, applied)
+	assert.Equal(t, []string{"Failing"}, failed)
+	assert.FileExists(t, filepath.Join(dir, "first"))
+	assert.NoFileExists(t, filepath.Join(dir, "last"))
+
+	applied, failed, err = applyBlocks("#!/bin/sh\nset -eu\n", blocks, applyOptions{ContinueOnError: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"First", "Last"}, applied)
+	assert.Equal(t, []string{"Failing"}, failed)
+	assert.FileExists(t, filepath.Join(dir, "last"))
+}
+
+func TestApplyBlocksRollback(t *testing.T) {
+	discardLogs(t)
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc/hostname"), []byte("old\n"), 0644))
+	snapshot, err := newFileSnapshot(root)
+	require.NoError(t, err)
+	defer snapshot.Remove()
+
+	// The paths of the blocks are saved under the root of the snapshot
+	blocks := []NamedCommandBlock{
+		{Name: "Hostname", Commands: "echo new > " + root + "/etc/hostname # /etc/hostname"},
+		{Name: "Failing", Commands: "false"},
+	}
+	_, _, err = applyBlocks("#!/bin/sh\nset -eu\n", blocks, applyOptions{Snapshot: snapshot})
+	assert.EqualError(t, err, "execution failed for block 'Failing': exit status 1")
+	data, err := os.ReadFile(filepath.Join(root, "etc/hostname"))
+	require.NoError(t, err)
+	assert.Equal(t, "old\n", string(data))
+}
+
+func TestApplyBlocksJSONLog(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "json", "debug")
+	require.NoError(t, err)
+	oldLogger, oldFormat := logger, logFormat
+	logger, logFormat = l, "json"
+	defer func() { logger, logFormat = oldLogger, oldFormat }()
+
+	blocks := []NamedCommandBlock{{Name: "Hostname", Commands: "echo hello"}, {Name: "Failing", Commands: "echo oops >&2 && false"}}
+	_, _, err = applyBlocks("#!/bin/sh\nset -eu\n", blocks, applyOptions{ContinueOnError: true})
+	require.NoError(t, err)
+
+	var events []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var event map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &event), line)
+		events = append(events, event)
+	}
+	var messages []string
+	for _, event := range events {
+		messages = append(messages, event["level"].(string)+" "+event["msg"].(string)+" "+event["block"].(string))
+	}
+	assert.Equal(t, []string{
+		"INFO applying block Hostname",
+		"DEBUG block commands Hostname",
+		"DEBUG block output Hostname",
+		"INFO applied block Hostname",
+		"INFO applying block Failing",
+		"DEBUG block commands Failing",
+		"ERROR block output Failing",
+		"ERROR block failed Failing",
+	}, messages)
+	assert.Equal(t, "hello\n", events[2]["output"])
+	assert.Contains(t, events[3], "duration")
+	assert.Equal(t, "oops\n", events[6]["output"])
+	assert.Equal(t, "execution failed for block 'Failing': exit status 1", events[7]["error"])
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "text", "warn")
+	require.NoError(t, err)
+	l.Info("hidden")
+	l.Warn("shown", "block", "Users")
+	assert.Contains(t, buf.String(), "level=WARN msg=shown block=Users\n")
+	assert.NotContains(t, buf.String(), "hidden")
+
+	_, err = newLogger(&buf, "yaml", "info")
+	assert.EqualError(t, err, `unknown log format "yaml", must be text or json`)
+	_, err = newLogger(&buf, "text", "verbose")
+	assert.EqualError(t, err, `unknown log level "verbose", must be debug, info, warn or error`)
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &prefixWriter{w: &buf, prefix: "[Packages] "}
+	_, err := w.Write([]byte("Installing:\n  ngi"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("nx\nComplete"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Packages] Installing:\n[Packages]   nginx\n", buf.String())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "[Packages] Installing:\n[Packages]   nginx\n[Packages] Complete\n", buf.String())
+}
+
+func TestApplyBlocksQuiet(t *testing.T) {
+	discardLogs(t)
+	out, err := os.CreateTemp(t.TempDir(), "output")
+	require.NoError(t, err)
+	oldStdout, oldStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = out, out
+	defer func() { os.Stdout, os.Stderr = oldStdout, oldStderr }()
+
+	blocks := []NamedCommandBlock{{Name: "Hostname", Commands: "echo fine"}, {Name: "Failing", Commands: "echo broken && false"}}
+	_, _, err = applyBlocks("#!/bin/sh\nset -eu\n", blocks, applyOptions{ContinueOnError: true})
+	require.NoError(t, err)
+	_, _, err = applyBlocks("#!/bin/sh\nset -eu\n", blocks, applyOptions{ContinueOnError: true, Quiet: true})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(out.Name())
+	require.NoError(t, err)
+	// Without --quiet, all output is shown
+	assert.Equal(t, "[Hostname] fine\n[Failing] broken\n[Failing] broken\n", string(data))
+}
+
+func TestApplyBlocksParallel(t *testing.T) {
+	discardLogs(t)
+	dir := t.TempDir()
+	blocks := []NamedCommandBlock{
+		{Name: "Groups", Commands: "sleep 0.2 && touch " + filepath.Join(dir, "groups")},
+		// Users depend on groups
+		{Name: "Users", Commands: "test -e " + filepath.Join(dir, "groups")},
+		{Name: "Journald", Commands: "sleep 0.2"},
+		{Name: "Udev Rules", Commands: "sleep 0.2"},
+	}
+	start := time.Now()
+	applied, failed, err := applyBlocks("#!/bin/sh\nset -eu\n", blocks, applyOptions{Jobs: 4})
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+	assert.ElementsMatch(t, []string{"Groups", "Users", "Journald", "Udev Rules"}, applied)
+	assert.Less(t, slices.Index(applied, "Groups"), slices.Index(applied, "Users"))
+	assert.Empty(t, failed)
+
+	// Blocks depending on a failed block are not applied
+	blocks[0].Commands = "false"
+	applied, failed, err = applyBlocks("#!/bin/sh\nset -eu\n", blocks, applyOptions{Jobs: 4, ContinueOnError: true})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Journald", "Udev Rules"}, applied)
+	assert.Equal(t, []string{"Groups", "Users"}, failed)
+
+	// No more blocks start after a failure
+	applied, failed, err = applyBlocks("#!/bin/sh\nset -eu\n", blocks, applyOptions{Jobs: 2})
+	assert.EqualError(t, err, "execution failed for block 'Groups': exit status 1")
+	assert.Equal(t, []string{"Journald"}, applied)
+	assert.Equal(t, []string{"Groups"}, failed)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// cloudConfig is the subset of the cloud-init user-data format imagecfg emits
+type cloudConfig struct {
+	Hostname   string            `yaml:"hostname,omitempty"`
+	Timezone   string            `yaml:"timezone,omitempty"`
+	Bootcmd    [][]string        `yaml:"bootcmd,omitempty"`
+	Groups     []string          `yaml:"groups,omitempty"`
+	Users      []cloudConfigUser `yaml:"users,omitempty"`
+	Packages   []string          `yaml:"packages,omitempty"`
+	WriteFiles []cloudConfigFile `yaml:"write_files,omitempty"`
+	Runcmd     [][]string        `yaml:"runcmd,omitempty"`
+}
+
+type cloudConfigUser struct {
+	Name              string   `yaml:"name"`
+	Gecos             string   `yaml:"gecos,omitempty"`
+	Homedir           string   `yaml:"homedir,omitempty"`
+	Shell             string   `yaml:"shell,omitempty"`
+	UID               *int     `yaml:"uid,omitempty"`
+	PrimaryGroup      string   `yaml:"primary_group,omitempty"`
+	Groups            []string `yaml:"groups,omitempty"`
+	Passwd            string   `yaml:"passwd,omitempty"`
+	LockPasswd        *bool    `yaml:"lock_passwd,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+}
+
+type cloudConfigFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Owner       string `yaml:"owner,omitempty"`
+	Permissions string `yaml:"permissions,omitempty"`
+	Defer       bool   `yaml:"defer,omitempty"`
+}
+
+var cloudInitCmd = &cobra.Command{
+	Use:   "cloud-init [blueprint.toml...]",
+	Short: "Translate an OSBuild blueprint to cloud-init user-data",
+	Long: `Translates an OSBuild blueprint (TOML format) into cloud-init user-data,
+so that the same blueprint can configure cloud instances at first boot.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+The hostname, timezone, users, groups, packages and files are translated into
+their cloud-init modules. All other configurations are run as the same bash
+blocks the 'bash' command generates, using runcmd.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		userData, err := generateCloudConfig(bp)
+		if err != nil {
+			return fmt.Errorf("error generating cloud-init user-data: %w", err)
+		}
+		fmt.Print(userData)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cloudInitCmd)
+}
+
+// cloudConfigUsers translates the blueprint users into cloud-init users.
+func cloudConfigUsers(bp *Blueprint) []cloudConfigUser {
+	var users []cloudConfigUser
+	for _, user := range bp.Customizations.GetUsers() {
+		u := cloudConfigUser{
+			Name:   user.Name,
+			UID:    user.UID,
+			Groups: user.Groups,
+		}
+		if user.Description != nil {
+			u.Gecos = *user.Description
+		}
+		if user.Home != nil {
+			u.Homedir = *user.Home
+		}
+		if user.Shell != nil {
+			u.Shell = *user.Shell
+		}
+		if user.GID != nil {
+			// useradd accepts a numeric GID for the primary group
+			u.PrimaryGroup = fmt.Sprintf("%d", *user.GID)
+		}
+		if user.Password != nil && *user.Password != "" {
+			// cloud-init locks the password unless told otherwise
+			unlocked := false
+			u.Passwd = *user.Password
+			u.LockPasswd = &unlocked
+		}
+		if user.Key != nil && *user.Key != "" {
+			for _, key := range strings.Split(strings.TrimSpace(*user.Key), "\n") {
+				if key = strings.TrimSpace(key); key != "" {
+					u.SSHAuthorizedKeys = append(u.SSHAuthorizedKeys, key)
+				}
+			}
+		}
+		users = append(users, u)
+	}
+	return users
+}
+
+// cloudConfigFiles translates the blueprint files into cloud-init write_files.
+func cloudConfigFiles(bp *Blueprint) []cloudConfigFile {
+	var files []cloudConfigFile
+	for _, file := range bp.Customizations.GetFiles() {
+		f := cloudConfigFile{
+			Path:        file.Path,
+			Content:     file.Data,
+			Permissions: file.Mode,
+		}
+		if file.User != nil || file.Group != nil {
+			user, group := "root", "root"
+			if file.User != nil {
+				user = fmt.Sprint(file.User)
+			}
+			if file.Group != nil {
+				group = fmt.Sprint(file.Group)
+			}
+			f.Owner = user + ":" + group
+			// Wait for the users and groups to be created
+			f.Defer = true
+		}
+		if f.Permissions != "" && !strings.HasPrefix(f.Permissions, "0") {
+			f.Permissions = "0" + f.Permissions
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// generateCloudConfig generates cloud-init user-data from the blueprint.
+func generateCloudConfig(bp *Blueprint) (string, error) {
+	header, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return "", err
+	}
+
+	config := cloudConfig{
+		Users:      cloudConfigUsers(bp),
+		Packages:   bp.GetPackages(),
+		WriteFiles: cloudConfigFiles(bp),
+	}
+	if hostname := bp.Customizations.GetHostname(); hostname != nil {
+		config.Hostname = *hostname
+	}
+	if timezone, _ := bp.Customizations.GetTimezoneSettings(); timezone != nil {
+		config.Timezone = *timezone
+	}
+
+	// cloud-init cannot create groups with a fixed GID, those are created by
+	// bootcmd, which runs before the users and groups module
+	groupsWithGID := false
+	for _, group := range bp.Customizations.GetGroups() {
+		config.Groups = append(config.Groups, group.Name)
+		groupsWithGID = groupsWithGID || group.GID != nil
+	}
+
+	// Blocks that cloud-init handles natively
+	native := map[string]bool{
+		"Timezone": true,
+		"Packages": true,
+		"Users":    true,
+		"Groups":   !groupsWithGID,
+		// write_files cannot create directories
+		"Files and Directories": len(bp.Customizations.GetDirectories()) == 0,
+		// The imagecfg additions to the hostname have no cloud-init equivalent
+		"Hostname": bp.Extensions.GetPrettyHostname() == "" && bp.Extensions.GetChassis() == "" && bp.Extensions.GetHostsEntry() == nil,
+	}
+
+	shellHeader := strings.TrimPrefix(header, "#!/bin/bash\n")
+	for _, block := range namedBlocks {
+		if native[block.Name] {
+			continue
+		}
+		runCmd := []string{"bash", "-c", shellHeader + block.Commands}
+		if block.Name == "Groups" {
+			config.Bootcmd = append(config.Bootcmd, runCmd)
+			continue
+		}
+		config.Runcmd = append(config.Runcmd, runCmd)
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return "#cloud-config\n" + string(data), nil
+}
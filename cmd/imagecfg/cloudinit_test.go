@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestGenerateCloudConfig(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[packages]]
+name = "vim"
+
+[customizations]
+hostname = "cloud1"
+
+[customizations.timezone]
+timezone = "Europe/Prague"
+
+[[customizations.user]]
+name = "admin"
+password = "$6$hash"
+key = "ssh-ed25519 AAAA admin@example.com"
+groups = ["wheel"]
+
+[[customizations.files]]
+path = "/etc/motd"
+data = "hello\n"
+mode = "644"
+
+[customizations.services]
+enabled = ["cockpit.socket"]
+`)
+	userData, err := generateCloudConfig(bp)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(userData, "#cloud-config\n"))
+
+	var config cloudConfig
+	require.NoError(t, yaml.Unmarshal([]byte(userData), &config))
+	assert.Equal(t, "cloud1", config.Hostname)
+	assert.Equal(t, "Europe/Prague", config.Timezone)
+	assert.Contains(t, config.Packages, "vim")
+	require.Len(t, config.Users, 1)
+	assert.Equal(t, "$6$hash", config.Users[0].Passwd)
+	assert.False(t, *config.Users[0].LockPasswd)
+	assert.Equal(t, []string{"ssh-ed25519 AAAA admin@example.com"}, config.Users[0].SSHAuthorizedKeys)
+	assert.Equal(t, []cloudConfigFile{{Path: "/etc/motd", Content: "hello\n", Permissions: "0644"}}, config.WriteFiles)
+	assert.Empty(t, config.Bootcmd)
+
+	// Only the blocks cloud-init has no module for end up in runcmd
+	require.Len(t, config.Runcmd, 2)
+	assert.Equal(t, []string{"bash", "-c", "set -euf -o pipefail\n\nsystemctl enable cockpit.socket"}, config.Runcmd[0])
+	assert.Equal(t, "dnf clean all", strings.TrimPrefix(config.Runcmd[1][2], "set -euf -o pipefail\n\n"))
+}
+
+func TestGenerateCloudConfigGroupsWithGID(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.group]]
+name = "app"
+gid = 2000
+`)
+	userData, err := generateCloudConfig(bp)
+	require.NoError(t, err)
+
+	var config cloudConfig
+	require.NoError(t, yaml.Unmarshal([]byte(userData), &config))
+	assert.Equal(t, []string{"app"}, config.Groups)
+	require.Len(t, config.Bootcmd, 1)
+	assert.Contains(t, config.Bootcmd[0][2], "groupadd --gid 2000 app")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// minVersion is set by --min-version, the oldest imagecfg that may run the command
+var minVersion string
+
+// parseVersion parses a MAJOR.MINOR.PATCH version, with an optional v prefix, missing
+// parts and pre-release or build suffixes, which are ignored.
+func parseVersion(s string) ([3]int, error) {
+	var parsed [3]int
+	v := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if v == "" || len(parts) > 3 {
+		return parsed, fmt.Errorf("invalid version %q, must be MAJOR.MINOR.PATCH", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, fmt.Errorf("invalid version %q, must be MAJOR.MINOR.PATCH", s)
+		}
+		parsed[i] = n
+	}
+	return parsed, nil
+}
+
+// compareVersions returns -1, 0 or 1 if version a is older than, the same as or newer
+// than version b.
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// requireVersion fails if this imagecfg is older than required, for which is the
+// reason. Builds without a release version, e.g. from a git checkout, cannot be
+// checked and are assumed to support everything, with a warning, so that they can
+// still run the blueprints they are developed with.
+func requireVersion(required, which string) error {
+	want, err := parseVersion(required)
+	if err != nil {
+		return fmt.Errorf("%s: %w", which, err)
+	}
+	have, err := parseVersion(version)
+	if err != nil {
+		logger.Warn("not a release build, cannot check the required imagecfg version", "for", which, "required", required, "version", version)
+		return nil
+	}
+	if compareVersions(have, want) < 0 {
+		return fmt.Errorf("%s requires imagecfg %s or newer, this is imagecfg %s", which, required, version)
+	}
+	return nil
+}
+
+// checkBlueprintVersion checks the versions of the blueprint at path: its
+// imagecfg_min_version against this imagecfg, so that older builds fail instead of
+// mis-handling blueprints written for newer ones, and its own version, which
+// osbuild-composer requires to be a semantic version. The requirement has a key of
+// its own because version is the revision of the blueprint, which osbuild-composer
+// bumps on every change, and says nothing about the imagecfg it needs.
+func checkBlueprintVersion(bp *Blueprint, path string) error {
+	if bp.MinVersion != "" {
+		if err := requireVersion(bp.MinVersion, "blueprint "+path); err != nil {
+			return err
+		}
+	}
+	if bp.Blueprint != nil && bp.Version != "" {
+		if _, err := parseVersion(bp.Version); err != nil {
+			logger.Warn("blueprint version is not a semantic version, osbuild-composer will reject it", "blueprint", path, "version", bp.Version)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVersion(t *testing.T) {
+	for s, parsed := range map[string][3]int{
+		"1.4.2":       {1, 4, 2},
+		"v1.4":        {1, 4, 0},
+		"2":           {2, 0, 0},
+		"1.5.0-rc.1":  {1, 5, 0},
+		"1.5.0+g1234": {1, 5, 0},
+	} {
+		v, err := parseVersion(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, parsed, v, s)
+	}
+	for _, s := range []string{"", "dev", "1.x", "1.2.3.4", "-1"} {
+		_, err := parseVersion(s)
+		assert.Error(t, err, s)
+	}
+	assert.Equal(t, -1, compareVersions([3]int{1, 4, 2}, [3]int{1, 10, 0}))
+	assert.Equal(t, 0, compareVersions([3]int{1, 4, 0}, [3]int{1, 4, 0}))
+	assert.Equal(t, 1, compareVersions([3]int{2, 0, 0}, [3]int{1, 99, 99}))
+}
+
+func TestRequireVersion(t *testing.T) {
+	discardLogs(t)
+	oldVersion := version
+	t.Cleanup(func() { version = oldVersion })
+
+	version = "1.4.2"
+	assert.NoError(t, requireVersion("1.4", "--min-version"))
+	assert.EqualError(t, requireVersion("1.5.0", "--min-version"), "--min-version requires imagecfg 1.5.0 or newer, this is imagecfg 1.4.2")
+	assert.EqualError(t, requireVersion("latest", "--min-version"), `--min-version: invalid version "latest", must be MAJOR.MINOR.PATCH`)
+
+	// Development builds cannot be checked, which is warned about
+	var logs bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&logs, nil))
+	version = "dev"
+	assert.NoError(t, requireVersion("99.0.0", "--min-version"))
+	assert.Contains(t, logs.String(), "level=WARN")
+	assert.Contains(t, logs.String(), "cannot check the required imagecfg version")
+	assert.Contains(t, logs.String(), "required=99.0.0")
+}
+
+func TestLoadBlueprintMinVersion(t *testing.T) {
+	discardLogs(t)
+	oldVersion := version
+	t.Cleanup(func() { version = oldVersion })
+	version = "1.4.2"
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+name = "web"
+version = "0.0.1"
+imagecfg_min_version = "1.2.0"
+`), 0644))
+	bp, err := loadBlueprint([]string{path})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0", bp.MinVersion)
+
+	require.NoError(t, os.WriteFile(path, []byte(`imagecfg_min_version = "2.0.0"`), 0644))
+	_, err = loadBlueprint([]string{path})
+	assert.EqualError(t, err, "blueprint "+path+" requires imagecfg 2.0.0 or newer, this is imagecfg 1.4.2")
+}
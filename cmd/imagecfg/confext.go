@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var confextType = extensionType{
+	Kind:       "confext",
+	Dirs:       []string{"/etc"},
+	ReleaseDir: "/etc/extension-release.d",
+}
+
+var confextOptions extensionOptions
+
+var confextCmd = &cobra.Command{
+	Use:   "confext --name NAME --output FILE [blueprint.toml...]",
+	Short: "Build a systemd configuration extension from an OSBuild blueprint",
+	Long: `Applies the /etc customizations of an OSBuild blueprint (TOML format) and
+packages them as a systemd configuration extension image, which
+systemd-confext merges into /etc of the host.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+The blueprint is applied the same way as by the 'sysext' command. Only /etc
+can be extended, customizations changing /usr, /var or other paths, such as
+packages, are refused with a report of the fields they come from.
+
+This command requires root privileges, and mkfs.erofs or mksquashfs.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+		if err := buildExtensionImage(bp, confextType, confextOptions); err != nil {
+			return fmt.Errorf("error building configuration extension: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	addExtensionFlags(confextCmd, &confextOptions)
+	rootCmd.AddCommand(confextCmd)
+}
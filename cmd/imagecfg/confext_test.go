@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfextViolations(t *testing.T) {
+	changes := []string{
+		"/", "/etc", "/etc/hostname", "/etc/ld.so.cache",
+		"/var", "/var/lib", "/var/lib/dnf/history.sqlite",
+		"/usr", "/usr/bin/htop", "/var/lib/app",
+	}
+	assert.Equal(t, []string{"/usr/bin/htop", "/var/lib/app"}, extensionViolations(confextType, changes))
+}
+
+func TestBuildConfextFileViolations(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.directories]]
+path = "/etc/myapp"
+
+[[customizations.directories]]
+path = "/var/lib/myapp"
+
+[[customizations.files]]
+path = "/etc/myapp/config"
+data = "key=value\n"
+
+[[customizations.files]]
+path = "/usr/local/bin/myapp"
+data = "#!/bin/sh\n"
+`)
+	// Reported before anything is applied
+	err := buildExtensionImage(bp, confextType, extensionOptions{Name: "myapp", Output: "myapp.raw", Format: "erofs", OSID: "_any"})
+	assert.EqualError(t, err, "a confext can only contain /etc, these customizations change other paths:\n"+
+		"  customizations.directories: /var/lib/myapp\n"+
+		"  customizations.files: /usr/local/bin/myapp")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// applyConfine is set by --confine, the blocks applied to --root then run in a bwrap
+// sandbox instead of a chroot
+var applyConfine bool
+
+// confineCaps are the capabilities the blocks keep in the sandbox: enough to install
+// packages and to own files by any user, but not to mount, load modules or change the
+// clock and the other settings of the host kernel
+var confineCaps = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER", "CAP_FSETID",
+	"CAP_SETUID", "CAP_SETGID", "CAP_SETFCAP", "CAP_SETPCAP", "CAP_MKNOD",
+	"CAP_SYS_CHROOT", "CAP_KILL", "CAP_AUDIT_WRITE",
+}
+
+// checkConfine checks that --confine can be used.
+func checkConfine(root string) error {
+	if root == "" {
+		return fmt.Errorf("--confine needs --root, the tree to apply the blueprint to")
+	}
+	if _, err := exec.LookPath("bwrap"); err != nil {
+		return fmt.Errorf("--confine needs bubblewrap: %w", err)
+	}
+	return nil
+}
+
+// rootBwrapCmd returns a command running script with the shell in a bwrap sandbox with
+// root as its /, like rootChrootCmd, but none of the host: /dev, /proc and /tmp are
+// new, the sandbox has its own PID, IPC and UTS namespaces, and it keeps only
+// confineCaps. Only the network is shared, for installing packages.
+func rootBwrapCmd(root, shell, script string) *exec.Cmd {
+	args := []string{
+		"--bind", root, "/",
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--tmpfs", "/tmp",
+		"--tmpfs", "/run",
+		"--unshare-all", "--share-net",
+		"--die-with-parent", "--new-session",
+		"--cap-drop", "ALL",
+	}
+	for _, c := range confineCaps {
+		args = append(args, "--cap-add", c)
+	}
+	if info, err := os.Lstat(filepath.Join(root, "etc/resolv.conf")); err == nil && info.Mode().IsRegular() {
+		// Package installs need name resolution, trees that link it into /run get none
+		args = append(args, "--ro-bind", "/etc/resolv.conf", "/etc/resolv.conf")
+	}
+	args = append(args, "--", shell, "-c", script)
+	cmd := exec.Command("bwrap", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
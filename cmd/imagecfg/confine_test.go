@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootBwrapCmd(t *testing.T) {
+	root := t.TempDir()
+	cmd := rootBwrapCmd(root, "/bin/bash", "echo 'host' > /etc/hostname")
+	assert.Equal(t, []string{"bwrap", "--bind", root, "/", "--dev", "/dev", "--proc", "/proc"}, cmd.Args[:8])
+	assert.Subset(t, cmd.Args, []string{"--unshare-all", "--share-net", "--die-with-parent"})
+	assert.Contains(t, cmd.Args, "CAP_CHOWN")
+	assert.NotContains(t, cmd.Args, "CAP_SYS_ADMIN")
+	assert.NotContains(t, cmd.Args, "/etc/resolv.conf")
+	assert.Equal(t, []string{"--", "/bin/bash", "-c", "echo 'host' > /etc/hostname"}, cmd.Args[len(cmd.Args)-4:])
+
+	// The name servers of the host are used by trees with a resolv.conf of their own
+	require.NoError(t, os.Mkdir(filepath.Join(root, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc/resolv.conf"), nil, 0644))
+	cmd = rootBwrapCmd(root, "/bin/bash", "true")
+	assert.Subset(t, cmd.Args, []string{"--ro-bind", "/etc/resolv.conf"})
+}
+
+func TestCheckConfine(t *testing.T) {
+	assert.ErrorContains(t, checkConfine(""), "--confine needs --root")
+	t.Setenv("PATH", t.TempDir())
+	assert.ErrorContains(t, checkConfine("/mnt/image"), "--confine needs bubblewrap")
+}
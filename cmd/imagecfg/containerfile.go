@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	containerfileFrom        string
+	containerfileSingleLayer bool
+)
+
+var containerfileCmd = &cobra.Command{
+	Use:   "containerfile --from IMAGE [blueprint.toml...]",
+	Short: "Translate an OSBuild blueprint to a Containerfile",
+	Long: `Translates an OSBuild blueprint (TOML format) into a Containerfile that
+builds on top of the given base image, so that bootc container builds can
+consume blueprints without a separate apply step.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+Each block of the 'bash' command becomes a RUN instruction, except for the
+files of the blueprint, which become COPY instructions. Both use heredocs, which need podman
+or buildah 1.33 or newer, or Docker with BuildKit.
+
+With --single-layer, all blocks are chained in a single RUN instruction that
+also cleans up the DNF cache and temporary files, so that the configuration
+adds one layer only.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		containerfile, err := generateContainerfile(bp, containerfileFrom, containerfileSingleLayer)
+		if err != nil {
+			return fmt.Errorf("error generating Containerfile: %w", err)
+		}
+		fmt.Print(containerfile)
+		return nil
+	},
+}
+
+func init() {
+	containerfileCmd.Flags().StringVar(&containerfileFrom, "from", "", "base image of the Containerfile")
+	containerfileCmd.Flags().BoolVar(&containerfileSingleLayer, "single-layer", false, "run all blocks in a single RUN instruction")
+	_ = containerfileCmd.MarkFlagRequired("from")
+	rootCmd.AddCommand(containerfileCmd)
+}
+
+// heredocDelimiter returns a heredoc delimiter that does not occur as a line of content.
+func heredocDelimiter(content string) string {
+	delimiter := "IMAGECFG_EOF"
+	for i := 1; strings.Contains("\n"+content+"\n", "\n"+delimiter+"\n"); i++ {
+		delimiter = fmt.Sprintf("IMAGECFG_EOF_%d", i)
+	}
+	return delimiter
+}
+
+// heredoc returns the marker and the body of a quoted heredoc holding content, so that
+// the builder does not expand it. A missing final newline is added, as heredocs always
+// end with one.
+func heredoc(content string) (marker, body string) {
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	delimiter := heredocDelimiter(content)
+	return fmt.Sprintf("<<'%s'", delimiter), content + delimiter + "\n"
+}
+
+// tempCleanupCmd removes temporary files at the end of a single layer, globs are disabled
+const tempCleanupCmd = "find /tmp /var/tmp -mindepth 1 -delete"
+
+// generateContainerfile generates a Containerfile applying the blueprint on top of the base
+// image, with a RUN instruction per block or, with singleLayer, a single one.
+func generateContainerfile(bp *Blueprint, from string, singleLayer bool) (string, error) {
+	if from == "" || strings.ContainsAny(from, " \t\n") {
+		return "", fmt.Errorf("invalid base image %q", from)
+	}
+
+	header, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	out.WriteString("# syntax=docker/dockerfile:1\n")
+	fmt.Fprintf(&out, "FROM %s\n", from)
+
+	if singleLayer {
+		// Comments are allowed after &&, which keeps the block names readable
+		var script strings.Builder
+		script.WriteString(header)
+		for _, block := range namedBlocks {
+			fmt.Fprintf(&script, "# %s\n%s &&\n", block.Name, block.Commands)
+		}
+		script.WriteString("# Cleanup Temporary Files\n" + tempCleanupCmd)
+		marker, body := heredoc(script.String())
+		fmt.Fprintf(&out, "\nRUN %s\n%s", marker, body)
+		return out.String(), nil
+	}
+
+	for _, block := range namedBlocks {
+		if block.Name == "Files and Directories" {
+			// Files are copied in, only the directories need commands
+			if err := writeContainerfileFiles(&out, bp, header); err != nil {
+				return "", err
+			}
+			continue
+		}
+		marker, body := heredoc(header + block.Commands)
+		fmt.Fprintf(&out, "\n# %s\nRUN %s\n%s", block.Name, marker, body)
+	}
+
+	return out.String(), nil
+}
+
+// writeContainerfileFiles writes the instructions creating the directories and files of
+// the blueprint, a RUN instruction for the directories and a COPY instruction per file.
+func writeContainerfileFiles(out *strings.Builder, bp *Blueprint, header string) error {
+	dirCmds, err := directoryCmds(bp)
+	if err != nil {
+		return err
+	}
+	if len(dirCmds) > 0 {
+		marker, body := heredoc(header + strings.Join(dirCmds, " && "))
+		fmt.Fprintf(out, "\n# Directories\nRUN %s\n%s", marker, body)
+	}
+
+	for _, file := range bp.Customizations.GetFiles() {
+		if strings.ContainsAny(file.Path, " \t\n") {
+			return fmt.Errorf("file path %q cannot be used in a COPY instruction", file.Path)
+		}
+		var flags []string
+		if file.User != nil || file.Group != nil {
+			user, group := "root", "root"
+			if file.User != nil {
+				user = fmt.Sprint(file.User)
+			}
+			if file.Group != nil {
+				group = fmt.Sprint(file.Group)
+			}
+			flags = append(flags, fmt.Sprintf("--chown=%s:%s", user, group))
+		}
+		if file.Mode != "" {
+			flags = append(flags, "--chmod="+file.Mode)
+		}
+		marker, body := heredoc(file.Data)
+		flags = append(flags, marker, file.Path)
+		fmt.Fprintf(out, "\n# File %s\nCOPY %s\n%s", file.Path, strings.Join(flags, " "), body)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateContainerfile(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations]
+hostname = "box"
+
+[[customizations.files]]
+path = "/etc/motd"
+data = "IMAGECFG_EOF\n"
+mode = "0644"
+user = "root"
+`)
+	containerfile, err := generateContainerfile(bp, "quay.io/fedora/fedora-bootc:42", false)
+	require.NoError(t, err)
+	assert.Contains(t, containerfile, "# syntax=docker/dockerfile:1\nFROM quay.io/fedora/fedora-bootc:42\n")
+	assert.Contains(t, containerfile, "\n# Hostname\nRUN <<'IMAGECFG_EOF'\n#!/bin/bash\nset -euf -o pipefail\n\necho 'box' > /etc/hostname\nIMAGECFG_EOF\n")
+	assert.Contains(t, containerfile, "\n# Cleanup DNF Cache\nRUN <<'IMAGECFG_EOF'\n")
+	// The delimiter must not clash with the content
+	assert.Contains(t, containerfile, "\n# File /etc/motd\nCOPY --chown=root:root --chmod=0644 <<'IMAGECFG_EOF_1' /etc/motd\nIMAGECFG_EOF\nIMAGECFG_EOF_1\n")
+
+	_, err = generateContainerfile(bp, "", false)
+	assert.ErrorContains(t, err, "invalid base image")
+}
+
+func TestGenerateContainerfileSingleLayer(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[packages]]
+name = "vim"
+
+[customizations]
+hostname = "box"
+
+[[customizations.files]]
+path = "/etc/motd"
+data = "hello\n"
+`)
+	containerfile, err := generateContainerfile(bp, "quay.io/fedora/fedora-bootc:42", true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(containerfile, "\nRUN "))
+	assert.NotContains(t, containerfile, "COPY")
+	assert.Contains(t, containerfile, "\nRUN <<'IMAGECFG_EOF'\n#!/bin/bash\nset -euf -o pipefail\n\n# Packages\ndnf install -y vim kernel &&\n# Hostname\necho 'box' > /etc/hostname &&\n")
+	assert.Contains(t, containerfile, "# Cleanup DNF Cache\ndnf clean all &&\n# Cleanup Temporary Files\nfind /tmp /var/tmp -mindepth 1 -delete\nIMAGECFG_EOF\n")
+
+	// The chain is valid shell
+	if bash, err := exec.LookPath("bash"); err == nil {
+		script := strings.SplitN(containerfile, "\nRUN <<'IMAGECFG_EOF'\n", 2)[1]
+		check := exec.Command(bash, "-n")
+		check.Stdin = strings.NewReader(strings.TrimSuffix(script, "IMAGECFG_EOF\n"))
+		out, err := check.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	convertFrom string
+	convertTo   string
+)
+
+var convertCmd = &cobra.Command{
+	Use:   "convert --to toml|json|yaml [blueprint]",
+	Short: "Convert an OSBuild blueprint between TOML, JSON and YAML",
+	Long: `Converts an OSBuild blueprint between TOML, the JSON used by the
+osbuild-composer API and YAML, and prints it. The keys are the same in all
+formats, unknown keys are kept as they are.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+The input format is taken from the file extension (.toml, .json, .yaml or
+.yml) unless --from is given. Comments are not kept, none of the decoders
+preserve them.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		blueprintPath := defaultBlueprintPath
+		if len(args) > 0 {
+			blueprintPath = args[0]
+		}
+		from := convertFrom
+		if from == "" {
+			var err error
+			if from, err = blueprintFormat(blueprintPath); err != nil {
+				return err
+			}
+		}
+		data, err := readBlueprint(blueprintPath)
+		if err != nil {
+			return fmt.Errorf("error opening blueprint file %s: %w", blueprintPath, err)
+		}
+
+		out, err := convertBlueprint(data, from, convertTo)
+		if err != nil {
+			return fmt.Errorf("error converting %s: %w", blueprintPath, err)
+		}
+		fmt.Print(string(out))
+		return nil
+	},
+}
+
+func init() {
+	convertCmd.Flags().StringVar(&convertFrom, "from", "", "input format, toml, json or yaml (default: from the file extension)")
+	convertCmd.Flags().StringVar(&convertTo, "to", "", "output format, toml, json or yaml")
+	_ = convertCmd.MarkFlagRequired("to")
+	rootCmd.AddCommand(convertCmd)
+}
+
+// blueprintFormat returns the format of a blueprint file from its extension.
+func blueprintFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return "toml", nil
+	case ".json":
+		return "json", nil
+	case ".yaml", ".yml":
+		return "yaml", nil
+	}
+	return "", fmt.Errorf("cannot tell the format of %s from its extension, must be .toml, .json, .yaml or .yml", path)
+}
+
+// decodeDocument decodes a blueprint in the given format into maps and slices.
+func decodeDocument(data []byte, format string) (map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+	switch format {
+	case "toml":
+		if _, err := toml.Decode(string(data), &doc); err != nil {
+			return nil, err
+		}
+	case "json":
+		// Numbers are kept exact, UIDs must not turn into floats
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, err
+		}
+	case "yaml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown blueprint format %q, must be toml, json or yaml", format)
+	}
+	return normalizeDocument(doc).(map[string]interface{}), nil
+}
+
+// normalizeDocument converts the values of a decoded document to the types all the
+// encoders handle alike.
+func normalizeDocument(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = normalizeDocument(value)
+		}
+		return v
+	case []map[string]interface{}:
+		list := make([]interface{}, len(v))
+		for i, value := range v {
+			list[i] = normalizeDocument(value)
+		}
+		return list
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalizeDocument(value)
+		}
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case int:
+		return int64(v)
+	}
+	return v
+}
+
+// encodeDocument encodes a decoded blueprint in the given format.
+func encodeDocument(doc map[string]interface{}, format string) ([]byte, error) {
+	switch format {
+	case "toml":
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(doc); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "json":
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	case "yaml":
+		return yaml.Marshal(doc)
+	}
+	return nil, fmt.Errorf("unknown blueprint format %q, must be toml, json or yaml", format)
+}
+
+// convertBlueprint converts a blueprint from one format to another.
+func convertBlueprint(data []byte, from, to string) ([]byte, error) {
+	doc, err := decodeDocument(data, from)
+	if err != nil {
+		return nil, err
+	}
+	return encodeDocument(doc, to)
+}
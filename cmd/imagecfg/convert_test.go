@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertBlueprint(t *testing.T) {
+	data, err := os.ReadFile("../../test/config.toml")
+	require.NoError(t, err)
+	want, err := decodeDocument(data, "toml")
+	require.NoError(t, err)
+
+	for _, format := range []string{"json", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			converted, err := convertBlueprint(data, "toml", format)
+			require.NoError(t, err)
+			back, err := convertBlueprint(converted, format, "toml")
+			require.NoError(t, err)
+			got, err := decodeDocument(back, "toml")
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+
+			// The result is still the same blueprint
+			path := filepath.Join(t.TempDir(), "config.toml")
+			require.NoError(t, os.WriteFile(path, back, 0644))
+			_, err = parseBlueprint(path)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestConvertBlueprintJSON(t *testing.T) {
+	out, err := convertBlueprint([]byte(`{"name": "base", "customizations": {"user": [{"name": "admin", "uid": 1000}]}}`), "json", "toml")
+	require.NoError(t, err)
+	assert.Equal(t, "name = \"base\"\n\n[customizations]\n\n  [[customizations.user]]\n    name = \"admin\"\n    uid = 1000\n", string(out))
+
+	_, err = convertBlueprint(out, "toml", "xml")
+	assert.EqualError(t, err, `unknown blueprint format "xml", must be toml, json or yaml`)
+}
+
+func TestBlueprintFormat(t *testing.T) {
+	for path, want := range map[string]string{"a.toml": "toml", "b.JSON": "json", "c.yaml": "yaml", "d.yml": "yaml"} {
+		format, err := blueprintFormat(path)
+		require.NoError(t, err)
+		assert.Equal(t, want, format, path)
+	}
+	_, err := blueprintFormat("config")
+	assert.Error(t, err)
+}
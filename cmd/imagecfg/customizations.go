@@ -0,0 +1,550 @@
+package main
+
+import (
+	"github.com/osbuild/blueprint/pkg/blueprint"
+)
+
+// Blueprint is an OSBuild blueprint together with the customizations that
+// only imagecfg understands.
+type Blueprint struct {
+	*blueprint.Blueprint
+	Extensions *Customizations
+	// MinVersion is the oldest imagecfg the blueprint is written for
+	MinVersion string
+	// Keys are the dotted TOML keys defined in the blueprint file
+	Keys []string
+}
+
+// extensionBlueprint mirrors the blueprint layout for the keys that imagecfg
+// adds on top of the upstream schema.
+type extensionBlueprint struct {
+	Customizations *Customizations `json:"customizations,omitempty" toml:"customizations,omitempty"`
+	MinVersion     string          `json:"imagecfg_min_version,omitempty" toml:"imagecfg_min_version,omitempty"`
+}
+
+// Customizations holds the imagecfg-specific customizations. They live in the
+// same [customizations] table as the upstream ones.
+type Customizations struct {
+	Proxy          *ProxyCustomization          `json:"proxy,omitempty" toml:"proxy,omitempty"`
+	SSHD           *SSHDCustomization           `json:"sshd,omitempty" toml:"sshd,omitempty"`
+	Chrony         *ChronyCustomization         `json:"chrony,omitempty" toml:"chrony,omitempty"`
+	Journald       *JournaldCustomization       `json:"journald,omitempty" toml:"journald,omitempty"`
+	ScheduledTasks []ScheduledTaskCustomization `json:"scheduled_tasks,omitempty" toml:"scheduled_tasks,omitempty"`
+	// Environment holds system-wide environment variables
+	Environment         map[string]string                 `json:"environment,omitempty" toml:"environment,omitempty"`
+	PasswordPolicy      *PasswordPolicyCustomization      `json:"password_policy,omitempty" toml:"password_policy,omitempty"`
+	Sudoers             []SudoersCustomization            `json:"sudoers,omitempty" toml:"sudoers,omitempty"`
+	PolkitRules         []PolkitRuleCustomization         `json:"polkit_rules,omitempty" toml:"polkit_rules,omitempty"`
+	ContainerRegistries *ContainerRegistriesCustomization `json:"container_registries,omitempty" toml:"container_registries,omitempty"`
+	Flatpak             *FlatpakCustomization             `json:"flatpak,omitempty" toml:"flatpak,omitempty"`
+	Pip                 *PipCustomization                 `json:"pip,omitempty" toml:"pip,omitempty"`
+	DConf               []DConfCustomization              `json:"dconf,omitempty" toml:"dconf,omitempty"`
+	UdevRules           []UdevRuleCustomization           `json:"udev_rules,omitempty" toml:"udev_rules,omitempty"`
+	ModprobeOptions     []ModprobeOptionsCustomization    `json:"modprobe_options,omitempty" toml:"modprobe_options,omitempty"`
+	Tuned               *TunedCustomization               `json:"tuned,omitempty" toml:"tuned,omitempty"`
+	Swap                *SwapCustomization                `json:"swap,omitempty" toml:"swap,omitempty"`
+	Mounts              []MountCustomization              `json:"mounts,omitempty" toml:"mounts,omitempty"`
+	SELinux             *SELinuxCustomization             `json:"selinux,omitempty" toml:"selinux,omitempty"`
+	Fapolicyd           *FapolicydCustomization           `json:"fapolicyd,omitempty" toml:"fapolicyd,omitempty"`
+	DomainJoin          *DomainJoinCustomization          `json:"domain_join,omitempty" toml:"domain_join,omitempty"`
+	Zram                *ZramCustomization                `json:"zram,omitempty" toml:"zram,omitempty"`
+	GreenbootChecks     []GreenbootCheckCustomization     `json:"greenboot_checks,omitempty" toml:"greenboot_checks,omitempty"`
+	Syspurpose          *SyspurposeCustomization          `json:"syspurpose,omitempty" toml:"syspurpose,omitempty"`
+	// PrettyHostname, Chassis and HostsEntry complement the upstream hostname
+	PrettyHostname string                   `json:"pretty_hostname,omitempty" toml:"pretty_hostname,omitempty"`
+	Chassis        string                   `json:"chassis,omitempty" toml:"chassis,omitempty"`
+	HostsEntry     *HostsEntryCustomization `json:"hosts_entry,omitempty" toml:"hosts_entry,omitempty"`
+	// DefaultTarget is the systemd target booted into, e.g. "multi-user" or "graphical"
+	DefaultTarget string `json:"default_target,omitempty" toml:"default_target,omitempty"`
+	// ResetMachineID empties the machine ID at the end, for golden images
+	ResetMachineID bool `json:"reset_machine_id,omitempty" toml:"reset_machine_id,omitempty"`
+	// Locale extends the upstream [customizations.locale] table
+	Locale *LocaleCustomization `json:"locale,omitempty" toml:"locale,omitempty"`
+}
+
+// ProxyCustomization configures a system-wide HTTP(S) proxy.
+type ProxyCustomization struct {
+	HTTP    string   `json:"http,omitempty" toml:"http,omitempty"`
+	HTTPS   string   `json:"https,omitempty" toml:"https,omitempty"`
+	NoProxy []string `json:"no_proxy,omitempty" toml:"no_proxy,omitempty"`
+	// Units get a systemd drop-in with the proxy environment
+	Units []string `json:"units,omitempty" toml:"units,omitempty"`
+}
+
+// SSHDCustomization holds sshd options written to a drop-in configuration.
+type SSHDCustomization struct {
+	PermitRootLogin        *string `json:"permit_root_login,omitempty" toml:"permit_root_login,omitempty"`
+	PasswordAuthentication *bool   `json:"password_authentication,omitempty" toml:"password_authentication,omitempty"`
+	PubkeyAuthentication   *bool   `json:"pubkey_authentication,omitempty" toml:"pubkey_authentication,omitempty"`
+	Ports                  []int   `json:"ports,omitempty" toml:"ports,omitempty"`
+	// Options are written verbatim as "Key Value" lines
+	Options map[string]string `json:"options,omitempty" toml:"options,omitempty"`
+}
+
+// ChronyCustomization configures the time sources and clock discipline of chrony.
+type ChronyCustomization struct {
+	Servers []ChronySource `json:"servers,omitempty" toml:"servers,omitempty"`
+	Pools   []ChronySource `json:"pools,omitempty" toml:"pools,omitempty"`
+	// RemoveDefaultPools comments out the pools shipped in chrony.conf
+	RemoveDefaultPools bool            `json:"remove_default_pools,omitempty" toml:"remove_default_pools,omitempty"`
+	Makestep           *ChronyMakestep `json:"makestep,omitempty" toml:"makestep,omitempty"`
+	LeapSecMode        string          `json:"leapsecmode,omitempty" toml:"leapsecmode,omitempty"`
+}
+
+// ChronySource is an NTP server or pool. IBurst defaults to true.
+type ChronySource struct {
+	Hostname string `json:"hostname" toml:"hostname"`
+	IBurst   *bool  `json:"iburst,omitempty" toml:"iburst,omitempty"`
+	Prefer   bool   `json:"prefer,omitempty" toml:"prefer,omitempty"`
+}
+
+// ChronyMakestep allows stepping the clock by more than Threshold seconds
+// during the first Limit updates. A Limit of -1 means no limit.
+type ChronyMakestep struct {
+	Threshold float64 `json:"threshold" toml:"threshold"`
+	Limit     int     `json:"limit" toml:"limit"`
+}
+
+// JournaldCustomization holds systemd-journald settings.
+type JournaldCustomization struct {
+	Storage         string `json:"storage,omitempty" toml:"storage,omitempty"`
+	SystemMaxUse    string `json:"system_max_use,omitempty" toml:"system_max_use,omitempty"`
+	RuntimeMaxUse   string `json:"runtime_max_use,omitempty" toml:"runtime_max_use,omitempty"`
+	ForwardToSyslog *bool  `json:"forward_to_syslog,omitempty" toml:"forward_to_syslog,omitempty"`
+}
+
+// ScheduledTaskCustomization is a periodic command. Tasks with a Schedule
+// become cron.d entries, tasks with OnCalendar become systemd timers.
+type ScheduledTaskCustomization struct {
+	Name    string `json:"name" toml:"name"`
+	Command string `json:"command" toml:"command"`
+	// User runs the command, root by default
+	User string `json:"user,omitempty" toml:"user,omitempty"`
+	// Schedule is a cron expression such as "0 3 * * *" or "@daily"
+	Schedule string `json:"schedule,omitempty" toml:"schedule,omitempty"`
+	// OnCalendar is a systemd calendar event such as "daily" or "Mon *-*-* 03:00"
+	OnCalendar string `json:"on_calendar,omitempty" toml:"on_calendar,omitempty"`
+	// Persistent runs a missed timer on the next boot
+	Persistent bool `json:"persistent,omitempty" toml:"persistent,omitempty"`
+}
+
+// PasswordPolicyCustomization holds password quality (pwquality.conf) and
+// aging (login.defs) settings.
+type PasswordPolicyCustomization struct {
+	MinLen    *int `json:"minlen,omitempty" toml:"minlen,omitempty"`
+	MinClass  *int `json:"minclass,omitempty" toml:"minclass,omitempty"`
+	DCredit   *int `json:"dcredit,omitempty" toml:"dcredit,omitempty"`
+	UCredit   *int `json:"ucredit,omitempty" toml:"ucredit,omitempty"`
+	LCredit   *int `json:"lcredit,omitempty" toml:"lcredit,omitempty"`
+	OCredit   *int `json:"ocredit,omitempty" toml:"ocredit,omitempty"`
+	MaxRepeat *int `json:"maxrepeat,omitempty" toml:"maxrepeat,omitempty"`
+	MaxDays   *int `json:"max_days,omitempty" toml:"max_days,omitempty"`
+	MinDays   *int `json:"min_days,omitempty" toml:"min_days,omitempty"`
+	WarnAge   *int `json:"warn_age,omitempty" toml:"warn_age,omitempty"`
+}
+
+// SudoersCustomization is a drop-in in /etc/sudoers.d granting the users
+// and groups permission to run Commands as RunAs.
+type SudoersCustomization struct {
+	Name   string   `json:"name" toml:"name"`
+	Users  []string `json:"users,omitempty" toml:"users,omitempty"`
+	Groups []string `json:"groups,omitempty" toml:"groups,omitempty"`
+	// Commands defaults to ALL
+	Commands []string `json:"commands,omitempty" toml:"commands,omitempty"`
+	// RunAs defaults to ALL
+	RunAs    string `json:"run_as,omitempty" toml:"run_as,omitempty"`
+	NoPasswd bool   `json:"nopasswd,omitempty" toml:"nopasswd,omitempty"`
+}
+
+// PolkitRuleCustomization is a JavaScript rules file for polkit.
+type PolkitRuleCustomization struct {
+	// Name of the file in /etc/polkit-1/rules.d, without the .rules suffix
+	Name    string `json:"name" toml:"name"`
+	Content string `json:"content" toml:"content"`
+}
+
+// ContainerRegistriesCustomization configures registries.conf for podman and
+// the other containers/image tools.
+type ContainerRegistriesCustomization struct {
+	UnqualifiedSearch []string `json:"unqualified_search,omitempty" toml:"unqualified_search,omitempty"`
+	Blocked           []string `json:"blocked,omitempty" toml:"blocked,omitempty"`
+	Insecure          []string `json:"insecure,omitempty" toml:"insecure,omitempty"`
+}
+
+// FlatpakCustomization holds Flatpak remotes and the refs installed from them.
+type FlatpakCustomization struct {
+	Remotes []FlatpakRemote `json:"remotes,omitempty" toml:"remotes,omitempty"`
+	Refs    []FlatpakRef    `json:"refs,omitempty" toml:"refs,omitempty"`
+}
+
+type FlatpakRemote struct {
+	Name string `json:"name" toml:"name"`
+	// URL of the remote or of a .flatpakrepo file
+	URL string `json:"url" toml:"url"`
+}
+
+type FlatpakRef struct {
+	Remote string `json:"remote" toml:"remote"`
+	Ref    string `json:"ref" toml:"ref"`
+}
+
+// PipCustomization lists Python packages installed with pip, either
+// system-wide or into a virtual environment.
+type PipCustomization struct {
+	// Packages are pip requirement specifiers such as "requests==2.31.0"
+	Packages []string `json:"packages" toml:"packages"`
+	// Venv is the path of a virtual environment, created when missing
+	Venv string `json:"venv,omitempty" toml:"venv,omitempty"`
+}
+
+// DConfCustomization is a default value in the system dconf database,
+// optionally locked so that users cannot change it.
+type DConfCustomization struct {
+	// Path of the settings schema, e.g. "org/gnome/desktop/session"
+	Path string `json:"path" toml:"path"`
+	Key  string `json:"key" toml:"key"`
+	// Value in GVariant text format, e.g. "uint32 0" or "'Adwaita'"
+	Value string `json:"value" toml:"value"`
+	Lock  bool   `json:"lock,omitempty" toml:"lock,omitempty"`
+}
+
+// UdevRuleCustomization is a rules file for udev.
+type UdevRuleCustomization struct {
+	// Name of the file in /etc/udev/rules.d, without the .rules suffix
+	Name    string `json:"name" toml:"name"`
+	Content string `json:"content" toml:"content"`
+}
+
+// ModprobeOptionsCustomization holds the parameters passed to a kernel module
+// whenever it is loaded.
+type ModprobeOptionsCustomization struct {
+	Module string `json:"module" toml:"module"`
+	// Options are "parameter=value" pairs
+	Options []string `json:"options" toml:"options"`
+}
+
+// TunedCustomization selects the active tuned profile.
+type TunedCustomization struct {
+	// Profile may list several space-separated profiles to merge them
+	Profile string `json:"profile" toml:"profile"`
+}
+
+// SwapCustomization configures a swap file and zswap.
+type SwapCustomization struct {
+	// File is the path of the swap file, e.g. /var/swapfile
+	File string `json:"file,omitempty" toml:"file,omitempty"`
+	// Size of the swap file, e.g. 2G
+	Size  string         `json:"size,omitempty" toml:"size,omitempty"`
+	Zswap *ZswapSettings `json:"zswap,omitempty" toml:"zswap,omitempty"`
+}
+
+// ZswapSettings are the zswap module parameters set on every boot.
+type ZswapSettings struct {
+	Enabled        bool   `json:"enabled" toml:"enabled"`
+	Compressor     string `json:"compressor,omitempty" toml:"compressor,omitempty"`
+	MaxPoolPercent int    `json:"max_pool_percent,omitempty" toml:"max_pool_percent,omitempty"`
+}
+
+// MountCustomization is an additional mount, written to /etc/fstab or as
+// a systemd mount unit.
+type MountCustomization struct {
+	// What is the device, label (LABEL=...) or remote (host:/export, //host/share)
+	What  string `json:"what" toml:"what"`
+	Where string `json:"where" toml:"where"`
+	Type  string `json:"type" toml:"type"`
+	// Options are comma-separated mount options, "defaults" when empty
+	Options string `json:"options,omitempty" toml:"options,omitempty"`
+	// Unit creates a systemd .mount unit instead of an fstab entry
+	Unit bool `json:"unit,omitempty" toml:"unit,omitempty"`
+}
+
+// SELinuxCustomization sets the SELinux mode and booleans.
+type SELinuxCustomization struct {
+	// Mode is enforcing, permissive or disabled
+	Mode     string          `json:"mode,omitempty" toml:"mode,omitempty"`
+	Booleans map[string]bool `json:"booleans,omitempty" toml:"booleans,omitempty"`
+}
+
+// FapolicydCustomization holds fapolicyd trust entries and rules files.
+type FapolicydCustomization struct {
+	// Trust lists files or directories added to the trust database
+	Trust []string             `json:"trust,omitempty" toml:"trust,omitempty"`
+	Rules []FapolicydRulesFile `json:"rules,omitempty" toml:"rules,omitempty"`
+}
+
+type FapolicydRulesFile struct {
+	// Name of the file in /etc/fapolicyd/rules.d, without the .rules suffix
+	Name    string `json:"name" toml:"name"`
+	Content string `json:"content" toml:"content"`
+}
+
+// DomainJoinCustomization joins the system to an Active Directory or IPA
+// domain. The join password is never part of the blueprint, it is read from
+// a file or an environment variable when the commands run.
+type DomainJoinCustomization struct {
+	// Provider is "ad" (realm join) or "ipa" (ipa-client-install)
+	Provider string `json:"provider" toml:"provider"`
+	Domain   string `json:"domain" toml:"domain"`
+	// OU is the organizational unit for the computer account, AD only
+	OU string `json:"ou,omitempty" toml:"ou,omitempty"`
+	// Server is the IPA server, discovered via DNS when empty
+	Server       string `json:"server,omitempty" toml:"server,omitempty"`
+	User         string `json:"user" toml:"user"`
+	PasswordFile string `json:"password_file,omitempty" toml:"password_file,omitempty"`
+	PasswordEnv  string `json:"password_env,omitempty" toml:"password_env,omitempty"`
+}
+
+// ZramCustomization configures swap on zram through zram-generator.
+type ZramCustomization struct {
+	// SizeFraction of the RAM used for the zram device, e.g. 0.5
+	SizeFraction float64 `json:"size_fraction,omitempty" toml:"size_fraction,omitempty"`
+	// MaxSizeMB caps the size of the device
+	MaxSizeMB            int    `json:"max_size_mb,omitempty" toml:"max_size_mb,omitempty"`
+	CompressionAlgorithm string `json:"compression_algorithm,omitempty" toml:"compression_algorithm,omitempty"`
+	SwapPriority         *int   `json:"swap_priority,omitempty" toml:"swap_priority,omitempty"`
+}
+
+// GreenbootCheckCustomization is a greenboot health-check script. Failing
+// "required" checks mark the boot as failed, "wanted" ones only log.
+type GreenbootCheckCustomization struct {
+	Name    string `json:"name" toml:"name"`
+	Type    string `json:"type" toml:"type"`
+	Content string `json:"content" toml:"content"`
+}
+
+// SyspurposeCustomization sets the RHEL system purpose attributes used for
+// subscription matching.
+type SyspurposeCustomization struct {
+	Role   string   `json:"role,omitempty" toml:"role,omitempty"`
+	SLA    string   `json:"sla,omitempty" toml:"sla,omitempty"`
+	Usage  string   `json:"usage,omitempty" toml:"usage,omitempty"`
+	Addons []string `json:"addons,omitempty" toml:"addons,omitempty"`
+}
+
+// HostsEntryCustomization adds the hostname to /etc/hosts.
+type HostsEntryCustomization struct {
+	// IP defaults to 127.0.1.1
+	IP string `json:"ip,omitempty" toml:"ip,omitempty"`
+}
+
+// LocaleCustomization holds the imagecfg additions to the locale customization.
+type LocaleCustomization struct {
+	// Generate selects how the languages are made available: "langpack"
+	// (default) installs glibc-langpack packages, "localedef" compiles them.
+	Generate string `json:"generate,omitempty" toml:"generate,omitempty"`
+	// X11 keyboard settings, independent of the console keymap in "keyboard"
+	X11Layout  string `json:"x11_layout,omitempty" toml:"x11_layout,omitempty"`
+	X11Variant string `json:"x11_variant,omitempty" toml:"x11_variant,omitempty"`
+	X11Options string `json:"x11_options,omitempty" toml:"x11_options,omitempty"`
+	X11Model   string `json:"x11_model,omitempty" toml:"x11_model,omitempty"`
+}
+
+func (c *Customizations) GetProxy() *ProxyCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Proxy
+}
+
+func (c *Customizations) GetSSHD() *SSHDCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.SSHD
+}
+
+func (c *Customizations) GetChrony() *ChronyCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Chrony
+}
+
+func (c *Customizations) GetJournald() *JournaldCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Journald
+}
+
+func (c *Customizations) GetScheduledTasks() []ScheduledTaskCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.ScheduledTasks
+}
+
+func (c *Customizations) GetEnvironment() map[string]string {
+	if c == nil {
+		return nil
+	}
+	return c.Environment
+}
+
+func (c *Customizations) GetPasswordPolicy() *PasswordPolicyCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.PasswordPolicy
+}
+
+func (c *Customizations) GetSudoers() []SudoersCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Sudoers
+}
+
+func (c *Customizations) GetPolkitRules() []PolkitRuleCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.PolkitRules
+}
+
+func (c *Customizations) GetContainerRegistries() *ContainerRegistriesCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.ContainerRegistries
+}
+
+func (c *Customizations) GetFlatpak() *FlatpakCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Flatpak
+}
+
+func (c *Customizations) GetPip() *PipCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Pip
+}
+
+func (c *Customizations) GetDConf() []DConfCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.DConf
+}
+
+func (c *Customizations) GetUdevRules() []UdevRuleCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.UdevRules
+}
+
+func (c *Customizations) GetModprobeOptions() []ModprobeOptionsCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.ModprobeOptions
+}
+
+func (c *Customizations) GetTuned() *TunedCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Tuned
+}
+
+func (c *Customizations) GetSwap() *SwapCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Swap
+}
+
+func (c *Customizations) GetMounts() []MountCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Mounts
+}
+
+func (c *Customizations) GetSELinux() *SELinuxCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.SELinux
+}
+
+func (c *Customizations) GetFapolicyd() *FapolicydCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Fapolicyd
+}
+
+func (c *Customizations) GetDomainJoin() *DomainJoinCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.DomainJoin
+}
+
+func (c *Customizations) GetZram() *ZramCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Zram
+}
+
+func (c *Customizations) GetGreenbootChecks() []GreenbootCheckCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.GreenbootChecks
+}
+
+func (c *Customizations) GetSyspurpose() *SyspurposeCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Syspurpose
+}
+
+func (c *Customizations) GetPrettyHostname() string {
+	if c == nil {
+		return ""
+	}
+	return c.PrettyHostname
+}
+
+func (c *Customizations) GetChassis() string {
+	if c == nil {
+		return ""
+	}
+	return c.Chassis
+}
+
+func (c *Customizations) GetHostsEntry() *HostsEntryCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.HostsEntry
+}
+
+func (c *Customizations) GetDefaultTarget() string {
+	if c == nil {
+		return ""
+	}
+	return c.DefaultTarget
+}
+
+func (c *Customizations) GetResetMachineID() bool {
+	if c == nil {
+		return false
+	}
+	return c.ResetMachineID
+}
+
+func (c *Customizations) GetLocale() *LocaleCustomization {
+	if c == nil {
+		return nil
+	}
+	return c.Locale
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var describeFormat string
+
+// describeSection is a table of a blueprint summary
+type describeSection struct {
+	Title  string
+	Header []string
+	Rows   [][]string
+}
+
+// blueprintSummary is what describe prints about a blueprint: tables of the settings
+// it covers and the names of the blocks of the other configurations.
+type blueprintSummary struct {
+	Name        string
+	Description string
+	Sections    []describeSection
+	Other       []string
+}
+
+// add adds a table to the summary, unless it has no rows.
+func (s *blueprintSummary) add(title string, header []string, rows [][]string) {
+	if len(rows) > 0 {
+		s.Sections = append(s.Sections, describeSection{title, header, rows})
+	}
+}
+
+var describeCmd = &cobra.Command{
+	Use:   "describe [blueprint.toml...]",
+	Short: "Summarize what an OSBuild blueprint does",
+	Long: `Summarizes what applying an OSBuild blueprint (TOML format) does in a
+human readable form, e.g. for attaching to change reviews.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+Supported formats:
+- table: aligned tables of the system settings, users, groups, packages,
+  firewall and services, followed by the list of the other configurations,
+  for the terminal
+- md: the same as Markdown
+- json: the same as a JSON object, with a list of objects per table`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		var out string
+		switch describeFormat {
+		case "table":
+			out, err = describeTable(bp)
+		case "md":
+			out, err = describeMarkdown(bp)
+		case "json":
+			out, err = describeJSON(bp)
+		default:
+			return fmt.Errorf("unknown describe format %q, must be table, md or json", describeFormat)
+		}
+		if err != nil {
+			return fmt.Errorf("error describing blueprint: %w", err)
+		}
+		fmt.Print(out)
+		return nil
+	},
+}
+
+func init() {
+	describeCmd.Flags().StringVar(&describeFormat, "format", "table", "output format, table, md or json")
+	rootCmd.AddCommand(describeCmd)
+}
+
+// markdownCell escapes s for use in a Markdown table cell.
+func markdownCell(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// writeMarkdownTable writes a Markdown table, empty cells are shown as a dash.
+func writeMarkdownTable(out *strings.Builder, header []string, rows [][]string) {
+	out.WriteString("| " + strings.Join(header, " | ") + " |\n")
+	out.WriteString(strings.Repeat("| --- ", len(header)) + "|\n")
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			if cell == "" {
+				cell = "-"
+			}
+			cells[i] = markdownCell(cell)
+		}
+		out.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+	}
+}
+
+// title returns the title of the summary.
+func (s *blueprintSummary) title() string {
+	if s.Name != "" {
+		return "Blueprint " + s.Name
+	}
+	return "Blueprint"
+}
+
+// describeMarkdown generates a Markdown summary of the blueprint.
+func describeMarkdown(bp *Blueprint) (string, error) {
+	summary, err := summarizeBlueprint(bp)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	out.WriteString("# " + summary.title() + "\n")
+	if summary.Description != "" {
+		out.WriteString("\n" + summary.Description + "\n")
+	}
+	for _, section := range summary.Sections {
+		out.WriteString("\n## " + section.Title + "\n\n")
+		writeMarkdownTable(&out, section.Header, section.Rows)
+	}
+	if len(summary.Other) > 0 {
+		out.WriteString("\n## Other Configurations\n\n")
+		for _, name := range summary.Other {
+			out.WriteString("- " + name + "\n")
+		}
+	}
+	return out.String(), nil
+}
+
+// describeTable generates a summary of the blueprint as aligned tables, for the
+// terminal.
+func describeTable(bp *Blueprint) (string, error) {
+	summary, err := summarizeBlueprint(bp)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	out.WriteString(summary.title())
+	if summary.Description != "" {
+		out.WriteString(": " + summary.Description)
+	}
+	out.WriteString("\n")
+	for _, section := range summary.Sections {
+		out.WriteString("\n" + section.Title + "\n")
+		w := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  "+strings.ToUpper(strings.Join(section.Header, "\t")))
+		for _, row := range section.Rows {
+			cells := make([]string, len(row))
+			for i, cell := range row {
+				if cell == "" {
+					cell = "-"
+				}
+				cells[i] = strings.Join(strings.Fields(cell), " ")
+			}
+			fmt.Fprintln(w, "  "+strings.Join(cells, "\t"))
+		}
+		w.Flush()
+	}
+	if len(summary.Other) > 0 {
+		out.WriteString("\nOther Configurations\n  " + strings.Join(summary.Other, ", ") + "\n")
+	}
+	return out.String(), nil
+}
+
+// jsonName returns the JSON key of a table title or column, e.g. ssh_key.
+func jsonName(s string) string {
+	return strings.ReplaceAll(strings.ToLower(s), " ", "_")
+}
+
+// describeJSON generates a summary of the blueprint as JSON, an object with a list of
+// objects per table. Empty cells are left out.
+func describeJSON(bp *Blueprint) (string, error) {
+	summary, err := summarizeBlueprint(bp)
+	if err != nil {
+		return "", err
+	}
+	doc := map[string]interface{}{
+		"name":                 summary.Name,
+		"description":          summary.Description,
+		"other_configurations": append([]string{}, summary.Other...),
+	}
+	for _, section := range summary.Sections {
+		rows := make([]map[string]string, len(section.Rows))
+		for i, row := range section.Rows {
+			rows[i] = make(map[string]string)
+			for j, cell := range row {
+				if cell != "" {
+					rows[i][jsonName(section.Header[j])] = cell
+				}
+			}
+		}
+		doc[jsonName(section.Title)] = rows
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
+
+// summarizeBlueprint summarizes the blueprint in tables.
+func summarizeBlueprint(bp *Blueprint) (*blueprintSummary, error) {
+	_, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return nil, err
+	}
+
+	str := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	num := func(n *int) string {
+		if n == nil {
+			return ""
+		}
+		return strconv.Itoa(*n)
+	}
+
+	summary := &blueprintSummary{Name: bp.Name, Description: bp.Description}
+
+	var settings [][]string
+	if hostname := str(bp.Customizations.GetHostname()); hostname != "" {
+		settings = append(settings, []string{"Hostname", hostname})
+	}
+	if timezone, ntpServers := bp.Customizations.GetTimezoneSettings(); timezone != nil || len(ntpServers) > 0 {
+		settings = append(settings, []string{"Timezone", str(timezone)})
+		if len(ntpServers) > 0 {
+			settings = append(settings, []string{"NTP servers", strings.Join(ntpServers, ", ")})
+		}
+	}
+	if language, keyboard := bp.Customizations.GetPrimaryLocale(); language != nil || keyboard != nil {
+		settings = append(settings, []string{"Language", str(language)}, []string{"Keyboard", str(keyboard)})
+	}
+	if target := bp.Extensions.GetDefaultTarget(); target != "" {
+		settings = append(settings, []string{"Default target", target})
+	}
+	summary.add("System Settings", []string{"Setting", "Value"}, settings)
+
+	if users := bp.Customizations.GetUsers(); len(users) > 0 {
+		var rows [][]string
+		for _, user := range users {
+			sshKey := "no"
+			if str(user.Key) != "" {
+				sshKey = "yes"
+			}
+			password := "no"
+			if str(user.Password) != "" {
+				password = "yes"
+			}
+			rows = append(rows, []string{user.Name, num(user.UID), num(user.GID), strings.Join(user.Groups, ", "), str(user.Shell), password, sshKey})
+		}
+		summary.add("Users", []string{"Name", "UID", "GID", "Groups", "Shell", "Password", "SSH key"}, rows)
+	}
+
+	if groups := bp.Customizations.GetGroups(); len(groups) > 0 {
+		var rows [][]string
+		for _, group := range groups {
+			rows = append(rows, []string{group.Name, num(group.GID)})
+		}
+		summary.add("Groups", []string{"Name", "GID"}, rows)
+	}
+
+	if len(bp.Packages) > 0 || len(bp.Modules) > 0 || len(bp.Groups) > 0 {
+		var rows [][]string
+		for _, pkg := range slices.Concat(bp.Packages, bp.Modules) {
+			rows = append(rows, []string{pkg.Name, pkg.Version})
+		}
+		for _, group := range bp.Groups {
+			rows = append(rows, []string{"@" + group.Name, ""})
+		}
+		summary.add("Packages", []string{"Name", "Version"}, rows)
+	}
+
+	if fw := bp.Customizations.GetFirewall(); fw != nil {
+		var rows [][]string
+		for _, port := range fw.Ports {
+			rows = append(rows, []string{"Port", port, "allowed"})
+		}
+		if fw.Services != nil {
+			for _, service := range fw.Services.Enabled {
+				rows = append(rows, []string{"Service", service, "allowed"})
+			}
+			for _, service := range fw.Services.Disabled {
+				rows = append(rows, []string{"Service", service, "removed"})
+			}
+		}
+		summary.add("Firewall", []string{"Type", "Name", "State"}, rows)
+	}
+
+	if svc := bp.Customizations.GetServices(); svc != nil {
+		var rows [][]string
+		for _, name := range svc.Enabled {
+			rows = append(rows, []string{name, "enabled"})
+		}
+		for _, name := range svc.Disabled {
+			rows = append(rows, []string{name, "disabled"})
+		}
+		for _, name := range svc.Masked {
+			rows = append(rows, []string{name, "masked"})
+		}
+		summary.add("Services", []string{"Service", "State"}, rows)
+	}
+
+	// Everything that the tables above do not cover
+	described := map[string]bool{
+		"Hostname": true, "Timezone": true, "Locale": true, "Default Target": true,
+		"Users": true, "Groups": true, "Packages": true, "Firewall": true, "Services": true,
+		"Cleanup DNF Cache": true,
+	}
+	for _, block := range namedBlocks {
+		if !described[block.Name] {
+			summary.Other = append(summary.Other, block.Name)
+		}
+	}
+	return summary, nil
+}
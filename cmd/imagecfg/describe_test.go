@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribeMarkdown(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+name = "web"
+description = "Web server"
+
+[[packages]]
+name = "nginx"
+version = "1.24.*"
+
+[customizations]
+hostname = "web1"
+
+[[customizations.user]]
+name = "admin"
+groups = ["wheel"]
+key = "ssh-ed25519 AAAA"
+
+[customizations.firewall]
+ports = ["443:tcp"]
+
+[customizations.services]
+enabled = ["nginx"]
+masked = ["rpcbind"]
+
+[customizations.journald]
+storage = "persistent"
+`)
+	md, err := describeMarkdown(bp)
+	require.NoError(t, err)
+	assert.Contains(t, md, "# Blueprint web\n\nWeb server\n")
+	assert.Contains(t, md, "## System Settings\n\n| Setting | Value |\n| --- | --- |\n| Hostname | web1 |\n")
+	assert.Contains(t, md, "| Name | UID | GID | Groups | Shell | Password | SSH key |\n| --- | --- | --- | --- | --- | --- | --- |\n| admin | - | - | wheel | - | no | yes |\n")
+	assert.Contains(t, md, "| nginx | 1.24.* |\n")
+	assert.Contains(t, md, "| Port | 443:tcp | allowed |\n")
+	assert.Contains(t, md, "| nginx | enabled |\n| rpcbind | masked |\n")
+	assert.Contains(t, md, "## Other Configurations\n\n- Journald\n")
+}
+
+func TestMarkdownCell(t *testing.T) {
+	assert.Equal(t, `a \| b c`, markdownCell("a | b\nc"))
+}
+
+func TestDescribeTable(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+name = "web"
+
+[customizations]
+hostname = "web1"
+
+[[customizations.user]]
+name = "admin"
+uid = 1000
+
+[customizations.journald]
+storage = "persistent"
+`)
+	table, err := describeTable(bp)
+	require.NoError(t, err)
+	assert.Equal(t, `Blueprint web
+
+System Settings
+  SETTING   VALUE
+  Hostname  web1
+
+Users
+  NAME   UID   GID  GROUPS  SHELL  PASSWORD  SSH KEY
+  admin  1000  -    -       -      no        no
+
+Other Configurations
+  Journald
+`, table)
+}
+
+func TestDescribeJSON(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[packages]]
+name = "nginx"
+
+[customizations.firewall]
+ports = ["443:tcp"]
+`)
+	out, err := describeJSON(bp)
+	require.NoError(t, err)
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(out), &doc))
+	assert.Equal(t, []interface{}{map[string]interface{}{"name": "nginx"}}, doc["packages"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"type": "Port", "name": "443:tcp", "state": "allowed"}}, doc["firewall"])
+	assert.Equal(t, []interface{}{}, doc["other_configurations"])
+	assert.NotContains(t, doc, "users")
+}
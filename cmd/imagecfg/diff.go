@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// systemChange is a change applying the blueprint would make to the system
+type systemChange struct {
+	Block   string `json:"block"`
+	Message string `json:"message"`
+}
+
+// comparedBlocks are the blocks whose effect diffSystem can tell from the system state
+var comparedBlocks = []string{"Packages", "Hostname", "Timezone", "Groups", "Users", "Firewall", "Services"}
+
+// systemState is the part of the running system that the blueprint is compared to
+type systemState struct {
+	// Packages holds the installed packages as NAME, NAME-VERSION and NAME-VERSION-RELEASE
+	Packages map[string]bool
+	Hostname string
+	// Timezone is the zone /etc/localtime links to, empty if it is not a link
+	Timezone string
+	// Groups maps the existing groups to their members
+	Groups map[string][]string
+	Users  map[string]bool
+	// Services maps units to the state reported by systemctl is-enabled
+	Services      map[string]string
+	FirewallPorts []string
+	FirewallRules []string
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [blueprint.toml...]",
+	Short: "Print what applying an OSBuild blueprint would change on this system",
+	Long: `Compares an OSBuild blueprint (TOML format) to the running system and prints
+the changes that the 'apply' command would make, without modifying anything.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+Installed packages, existing users and groups, group memberships, the hostname,
+the timezone, the state of services and the firewall ports and services are
+compared. Package groups and the other blocks are listed as not compared.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		_, namedBlocks, err := generateBashScript(bp)
+		if err != nil {
+			return fmt.Errorf("error generating command blocks: %w", err)
+		}
+		state, err := readSystemState(bp)
+		if err != nil {
+			return fmt.Errorf("error reading system state: %w", err)
+		}
+
+		changes := diffSystem(bp, state)
+		for _, change := range changes {
+			fmt.Printf("%s: %s\n", change.Block, change.Message)
+		}
+		if len(changes) == 0 {
+			fmt.Println("No changes.")
+		}
+		var notCompared []string
+		for _, block := range namedBlocks {
+			if !slices.Contains(comparedBlocks, block.Name) && block.Name != "Cleanup DNF Cache" {
+				notCompared = append(notCompared, block.Name)
+			}
+		}
+		if len(notCompared) > 0 {
+			fmt.Printf("Not compared: %s\n", strings.Join(notCompared, ", "))
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+}
+
+// readLines returns the lines of a file, or nothing if it does not exist.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// readSystemState reads the state of the running system that the blueprint refers to.
+func readSystemState(bp *Blueprint) (*systemState, error) {
+	state := &systemState{
+		Packages: make(map[string]bool),
+		Groups:   make(map[string][]string),
+		Users:    make(map[string]bool),
+		Services: make(map[string]string),
+	}
+
+	out, err := exec.Command("rpm", "-qa", "--qf", "%{NAME}\\n%{NAME}-%{VERSION}\\n%{NAME}-%{VERSION}-%{RELEASE}\\n").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error querying installed packages: %w", err)
+	}
+	for _, pkg := range strings.Fields(string(out)) {
+		state.Packages[pkg] = true
+	}
+
+	hostname, err := os.ReadFile("/etc/hostname")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	state.Hostname = strings.TrimSpace(string(hostname))
+
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		if _, zone, found := strings.Cut(target, "zoneinfo/"); found {
+			state.Timezone = zone
+		}
+	}
+
+	groupLines, err := readLines("/etc/group")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range groupLines {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 || fields[0] == "" {
+			continue
+		}
+		var members []string
+		if fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		state.Groups[fields[0]] = members
+	}
+
+	passwdLines, err := readLines("/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range passwdLines {
+		if name, _, ok := strings.Cut(line, ":"); ok && name != "" {
+			state.Users[name] = true
+		}
+	}
+
+	if svc := bp.Customizations.GetServices(); svc != nil {
+		for _, name := range slices.Concat(svc.Enabled, svc.Disabled, svc.Masked) {
+			// is-enabled exits non-zero for everything but enabled units
+			out, _ := exec.Command("systemctl", "is-enabled", name).Output()
+			state.Services[name] = strings.TrimSpace(string(out))
+		}
+	}
+
+	// Without firewalld, the Firewall block installs it and starts from the defaults
+	if _, err := exec.LookPath("firewall-offline-cmd"); err == nil && bp.Customizations.GetFirewall() != nil {
+		ports, err := exec.Command("firewall-offline-cmd", "--list-ports").Output()
+		if err != nil {
+			return nil, fmt.Errorf("error listing firewall ports: %w", err)
+		}
+		services, err := exec.Command("firewall-offline-cmd", "--list-services").Output()
+		if err != nil {
+			return nil, fmt.Errorf("error listing firewall services: %w", err)
+		}
+		state.FirewallPorts = strings.Fields(string(ports))
+		state.FirewallRules = strings.Fields(string(services))
+	}
+
+	return state, nil
+}
+
+// diffSystem returns the changes applying the blueprint would make to a system in the
+// given state.
+func diffSystem(bp *Blueprint, state *systemState) []systemChange {
+	var changes []systemChange
+	change := func(block, format string, args ...interface{}) {
+		changes = append(changes, systemChange{Block: block, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for _, pkg := range bp.GetPackages() {
+		if !strings.HasPrefix(pkg, "@") && !state.Packages[pkg] {
+			change("Packages", "install %s", pkg)
+		}
+	}
+
+	if hostname := bp.Customizations.GetHostname(); hostname != nil && *hostname != "" && *hostname != state.Hostname {
+		change("Hostname", "set hostname to %s, currently %q", *hostname, state.Hostname)
+	}
+
+	if timezone, _ := bp.Customizations.GetTimezoneSettings(); timezone != nil && *timezone != "" && *timezone != state.Timezone {
+		change("Timezone", "set timezone to %s, currently %q", *timezone, state.Timezone)
+	}
+
+	for _, group := range bp.Customizations.GetGroups() {
+		if _, ok := state.Groups[group.Name]; !ok {
+			change("Groups", "create group %s", group.Name)
+		}
+	}
+
+	for _, user := range bp.Customizations.GetUsers() {
+		if !state.Users[user.Name] {
+			change("Users", "create user %s", user.Name)
+		}
+		for _, group := range user.Groups {
+			if !slices.Contains(state.Groups[group], user.Name) {
+				change("Users", "add user %s to group %s", user.Name, group)
+			}
+		}
+	}
+
+	if fw := bp.Customizations.GetFirewall(); fw != nil {
+		for _, port := range fw.Ports {
+			// firewalld lists ports as PORT/PROTOCOL only
+			if !slices.Contains(state.FirewallPorts, strings.Replace(port, ":", "/", 1)) {
+				change("Firewall", "open port %s", port)
+			}
+		}
+		if fw.Services != nil {
+			for _, service := range fw.Services.Enabled {
+				if !slices.Contains(state.FirewallRules, service) {
+					change("Firewall", "allow service %s", service)
+				}
+			}
+		}
+	}
+
+	if svc := bp.Customizations.GetServices(); svc != nil {
+		for _, action := range []struct {
+			verb  string
+			names []string
+		}{{"enable", svc.Enabled}, {"disable", svc.Disabled}, {"mask", svc.Masked}} {
+			for _, name := range action.names {
+				if s := state.Services[name]; !serviceInState(action.verb, s) {
+					change("Services", "%s %s, currently %s", action.verb, name, serviceState(s))
+				}
+			}
+		}
+	}
+
+	return changes
+}
+
+// serviceState describes the is-enabled state of a unit for the user.
+func serviceState(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// serviceInState returns whether a unit in the is-enabled state s needs no systemctl
+// enable, disable or mask.
+func serviceInState(verb, s string) bool {
+	switch verb {
+	case "enable":
+		return s == "enabled" || s == "alias" || s == "static"
+	case "disable":
+		return s != "enabled" && s != "enabled-runtime"
+	case "mask":
+		return s == "masked"
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffSystem(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[packages]]
+name = "vim-enhanced"
+
+[[packages]]
+name = "tmux"
+version = "3.4"
+
+[[groups]]
+name = "development-tools"
+
+[customizations]
+hostname = "box"
+
+[customizations.timezone]
+timezone = "Europe/Prague"
+
+[[customizations.group]]
+name = "app"
+
+[[customizations.group]]
+name = "web"
+
+[[customizations.user]]
+name = "admin"
+groups = ["wheel", "app"]
+
+[[customizations.user]]
+name = "deploy"
+groups = ["web"]
+
+[customizations.firewall]
+ports = ["22:tcp", "8080/tcp"]
+
+[customizations.firewall.services]
+enabled = ["http", "https"]
+
+[customizations.services]
+enabled = ["sshd", "cockpit.socket"]
+disabled = ["kdump", "bluetooth"]
+masked = ["packagekit"]
+`)
+	state := &systemState{
+		Packages: map[string]bool{"kernel": true, "tmux": true, "tmux-3.4": true, "tmux-3.4-1.fc40": true},
+		Hostname: "localhost",
+		Timezone: "Europe/Prague",
+		Groups:   map[string][]string{"wheel": {"admin"}, "app": nil},
+		Users:    map[string]bool{"root": true, "admin": true},
+		Services: map[string]string{
+			"sshd": "enabled", "cockpit.socket": "disabled",
+			"kdump": "enabled", "bluetooth": "masked", "packagekit": "static",
+		},
+		FirewallPorts: []string{"22/tcp"},
+		FirewallRules: []string{"ssh", "http"},
+	}
+	assert.Equal(t, []systemChange{
+		{Block: "Packages", Message: "install vim-enhanced"},
+		{Block: "Hostname", Message: `set hostname to box, currently "localhost"`},
+		{Block: "Groups", Message: "create group web"},
+		{Block: "Users", Message: "add user admin to group app"},
+		{Block: "Users", Message: "create user deploy"},
+		{Block: "Users", Message: "add user deploy to group web"},
+		{Block: "Firewall", Message: "open port 8080/tcp"},
+		{Block: "Firewall", Message: "allow service https"},
+		{Block: "Services", Message: "enable cockpit.socket, currently disabled"},
+		{Block: "Services", Message: "disable kdump, currently enabled"},
+		{Block: "Services", Message: "mask packagekit, currently static"},
+	}, diffSystem(bp, state))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// restrictedFormats are the commands that translate only some blocks, with the blocks
+// they translate. Every other command translates all of them.
+var restrictedFormats = []struct {
+	Command string
+	Blocks  map[string]bool
+}{
+	{"ignition", ignitionBlocks},
+	{"osbuild", osbuildBlocks},
+}
+
+var (
+	docsManDir   string
+	docsMarkdown string
+)
+
+var docsCmd = &cobra.Command{
+	Use:    "docs",
+	Short:  "Generate man pages and a Markdown reference",
+	Hidden: true,
+	Long: `Generates a man page for every command into --man-dir and a Markdown
+reference of the commands, including the supported blueprint fields, into
+--markdown, for packaging.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if docsManDir == "" && docsMarkdown == "" {
+			return fmt.Errorf("nothing to generate, --man-dir or --markdown is required")
+		}
+		if docsManDir != "" {
+			if err := os.MkdirAll(docsManDir, 0755); err != nil {
+				return fmt.Errorf("error creating man page directory: %w", err)
+			}
+			for _, c := range documentedCommands(rootCmd) {
+				path := filepath.Join(docsManDir, manPageName(c)+".1")
+				if err := os.WriteFile(path, []byte(manPage(c)), 0644); err != nil {
+					return fmt.Errorf("error writing man page: %w", err)
+				}
+			}
+		}
+		if docsMarkdown != "" {
+			if err := os.WriteFile(docsMarkdown, []byte(markdownReference(rootCmd)), 0644); err != nil {
+				return fmt.Errorf("error writing Markdown reference: %w", err)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	docsCmd.Flags().StringVar(&docsManDir, "man-dir", "", "directory to write the man pages to")
+	docsCmd.Flags().StringVar(&docsMarkdown, "markdown", "", "file to write the Markdown reference to")
+	rootCmd.AddCommand(docsCmd)
+}
+
+// documentedCommands returns the command and its visible subcommands, recursively.
+func documentedCommands(cmd *cobra.Command) []*cobra.Command {
+	// Like Execute, so that the usage lines show the inherited flags
+	cmd.InitDefaultHelpFlag()
+	commands := []*cobra.Command{cmd}
+	for _, c := range cmd.Commands() {
+		if c.IsAvailableCommand() {
+			commands = append(commands, documentedCommands(c)...)
+		}
+	}
+	return commands
+}
+
+// manPageName returns the name of the man page of the command, e.g. imagecfg-bash.
+func manPageName(cmd *cobra.Command) string {
+	return strings.ReplaceAll(cmd.CommandPath(), " ", "-")
+}
+
+// roffEscape escapes text for roff, so that no line starts a request.
+func roffEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\e`)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+			lines[i] = `\&` + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// manPage renders the man page of the command.
+func manPage(cmd *cobra.Command) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, ".TH \"%s\" \"1\" \"\" \"imagecfg %s\" \"imagecfg Manual\"\n", strings.ToUpper(manPageName(cmd)), roffEscape(version))
+	fmt.Fprintf(&out, ".SH NAME\n%s \\- %s\n", manPageName(cmd), roffEscape(cmd.Short))
+	fmt.Fprintf(&out, ".SH SYNOPSIS\n.B %s\n", roffEscape(cmd.UseLine()))
+	long := cmd.Long
+	if long == "" {
+		long = cmd.Short
+	}
+	fmt.Fprintf(&out, ".SH DESCRIPTION\n.nf\n%s\n.fi\n", roffEscape(long))
+
+	var flags []*pflag.Flag
+	cmd.NonInheritedFlags().VisitAll(func(flag *pflag.Flag) {
+		if !flag.Hidden {
+			flags = append(flags, flag)
+		}
+	})
+	if len(flags) > 0 {
+		out.WriteString(".SH OPTIONS\n")
+		for _, flag := range flags {
+			name := "\\-\\-" + flag.Name
+			if flag.Shorthand != "" {
+				name = "\\-" + flag.Shorthand + ", " + name
+			}
+			usage := flag.Usage
+			if flag.DefValue != "" && flag.DefValue != "false" && flag.DefValue != "[]" {
+				usage += fmt.Sprintf(" (default %s)", flag.DefValue)
+			}
+			fmt.Fprintf(&out, ".TP\n\\fB%s\\fR\n%s\n", name, roffEscape(usage))
+		}
+	}
+
+	var seeAlso []string
+	if cmd.HasParent() {
+		seeAlso = append(seeAlso, manPageName(cmd.Parent()))
+	}
+	for _, c := range cmd.Commands() {
+		if c.IsAvailableCommand() {
+			seeAlso = append(seeAlso, manPageName(c))
+		}
+	}
+	if len(seeAlso) > 0 {
+		out.WriteString(".SH SEE ALSO\n")
+		for i, name := range seeAlso {
+			sep := ","
+			if i == len(seeAlso)-1 {
+				sep = ""
+			}
+			fmt.Fprintf(&out, ".BR %s (1)%s\n", name, sep)
+		}
+	}
+	return out.String()
+}
+
+// fieldsTable renders the blocks, the blueprint fields they are generated from and the
+// commands with restricted support translating them.
+func fieldsTable() string {
+	header := []string{"Block", "Fields"}
+	for _, format := range restrictedFormats {
+		header = append(header, format.Command)
+	}
+	var rows [][]string
+	blocks := slices.Clone(blockGenerators)
+	for _, name := range slices.Sorted(maps.Keys(declarativeBlockGenerators)) {
+		blocks = append(blocks, declarativeBlockGenerators[name])
+	}
+	blocks = append(blocks, machineIDResetBlock)
+	for _, blk := range blocks {
+		row := []string{blk.name, strings.Join(blk.fields, ", ")}
+		for _, format := range restrictedFormats {
+			if format.Blocks[blk.name] {
+				row = append(row, "yes")
+			} else {
+				row = append(row, "no")
+			}
+		}
+		rows = append(rows, row)
+	}
+	var out strings.Builder
+	writeMarkdownTable(&out, header, rows)
+	return out.String()
+}
+
+// markdownReference renders the reference of all commands in Markdown.
+func markdownReference(root *cobra.Command) string {
+	var out strings.Builder
+	out.WriteString("# imagecfg command reference\n")
+	for _, cmd := range documentedCommands(root) {
+		fmt.Fprintf(&out, "\n## %s\n\n%s\n\n```\n%s\n```\n", cmd.CommandPath(), cmd.Short, cmd.UseLine())
+		if cmd.Long != "" {
+			fmt.Fprintf(&out, "\n%s\n", cmd.Long)
+		}
+		if flags := cmd.NonInheritedFlags().FlagUsages(); flags != "" {
+			fmt.Fprintf(&out, "\n### Options\n\n```\n%s```\n", flags)
+		}
+	}
+	out.WriteString("\n## Supported blueprint fields\n\n")
+	out.WriteString("Every command translating blueprints supports all fields, except for the blocks marked \"no\" for the commands below.\n\n")
+	out.WriteString(fieldsTable())
+	return out.String()
+}
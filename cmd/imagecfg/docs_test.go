@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManPage(t *testing.T) {
+	page := manPage(graphCmd)
+	assert.True(t, strings.HasPrefix(page, ".TH \"IMAGECFG-GRAPH\" \"1\" \"\" \"imagecfg "+version+"\" \"imagecfg Manual\"\n.SH NAME\nimagecfg-graph \\- Print the blocks"))
+	assert.Contains(t, page, ".SH SYNOPSIS\n.B imagecfg graph [blueprint.toml...] [flags]\n")
+	assert.Contains(t, page, ".TP\n\\fB\\-\\-format\\fR\noutput format, dot or mermaid (default dot)\n")
+	assert.True(t, strings.HasSuffix(page, ".SH SEE ALSO\n.BR imagecfg (1)\n"))
+	assert.Equal(t, "\\&.TH\nback\\eslash", roffEscape(".TH\nback\\slash"))
+
+	// The hidden docs command has no page
+	names := []string{}
+	for _, c := range documentedCommands(rootCmd) {
+		names = append(names, manPageName(c))
+	}
+	assert.Contains(t, names, "imagecfg-bash")
+	assert.NotContains(t, names, "imagecfg-docs")
+}
+
+func TestMarkdownReference(t *testing.T) {
+	ref := markdownReference(rootCmd)
+	assert.True(t, strings.HasPrefix(ref, "# imagecfg command reference\n\n## imagecfg\n"))
+	assert.Contains(t, ref, "\n## imagecfg bash\n\nTranslate an OSBuild blueprint to a bash script\n\n```\nimagecfg bash [blueprint.toml...] [flags]\n```\n")
+	assert.Contains(t, ref, "| Block | Fields | ignition | osbuild |\n")
+	assert.Contains(t, ref, "| Hostname | customizations.hostname, customizations.pretty_hostname, customizations.chassis, customizations.hosts_entry | yes | yes |\n")
+	assert.Contains(t, ref, "| Sysusers | customizations.group, customizations.user | no | no |\n")
+
+	dir := t.TempDir()
+	docsManDir, docsMarkdown = filepath.Join(dir, "man"), filepath.Join(dir, "reference.md")
+	defer func() { docsManDir, docsMarkdown = "", "" }()
+	require.NoError(t, docsCmd.RunE(docsCmd, nil))
+	_, err := os.Stat(filepath.Join(dir, "man", "imagecfg-bash.1"))
+	assert.NoError(t, err)
+	data, err := os.ReadFile(docsMarkdown)
+	require.NoError(t, err)
+	assert.Equal(t, ref, string(data))
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// doctorTools are the programs the generated blocks run that not every system has.
+// Blocks are checked for the ones they call.
+var doctorTools = []string{
+	"dnf", "rpm", "firewall-offline-cmd", "useradd", "usermod", "groupadd", "chpasswd",
+	"systemctl", "timedatectl", "hostnamectl", "localectl", "localedef", "semanage",
+	"setsebool", "flatpak", "python3", "visudo", "systemd-tmpfiles", "systemd-sysusers",
+	"realm", "ipa-client-install", "tuned-adm", "dconf", "mkswap", "swapon",
+	"fapolicyd-cli", "udevadm", "getent",
+}
+
+// toolPackages are the packages of the tools that blocks install by package when
+// they are missing, all others are installed by their name
+var toolPackages = map[string]string{
+	"firewall-offline-cmd": "firewalld",
+	"python3":              "python3-pip",
+	"realm":                "realmd",
+	"ipa-client-install":   "ipa-client",
+	"tuned-adm":            "tuned",
+	"fapolicyd-cli":        "fapolicyd",
+}
+
+// Block statuses of doctor
+const (
+	doctorOK      = "ok"
+	doctorFails   = "fails"
+	doctorMayFail = "may fail"
+)
+
+// doctorEnvironment is what doctor finds out about the host
+type doctorEnvironment struct {
+	Container    bool `json:"container"`
+	BootcImage   bool `json:"bootc_image"`
+	OstreeBooted bool `json:"ostree_booted"`
+	USRWritable  bool `json:"usr_writable"`
+	Root         bool `json:"root"`
+	// Tools maps the tools to their path, empty if they are missing
+	Tools map[string]string `json:"tools"`
+}
+
+// doctorBlock is whether a block can be applied on the host
+type doctorBlock struct {
+	Name     string   `json:"name"`
+	Status   string   `json:"status"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+type doctorReport struct {
+	Environment doctorEnvironment `json:"environment"`
+	Blocks      []doctorBlock     `json:"blocks"`
+}
+
+var doctorFormat string
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor [blueprint.toml...]",
+	Short: "Check whether the host can apply an OSBuild blueprint",
+	Long: `Checks whether the host has what the blocks of an OSBuild blueprint (TOML
+format) need to be applied, and reports the blocks that would fail.
+
+Checked are the tools every block runs, like dnf, firewall-offline-cmd,
+useradd or systemctl, whether /usr is writable for blocks installing packages
+and whether imagecfg runs as root. Tools that a block installs itself when
+they are missing only need dnf. Also reported is whether the host is a
+container, a bootc image being built or a booted image mode system.
+
+Fails if any block would fail.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if doctorFormat != "text" && doctorFormat != "json" {
+			return fmt.Errorf("unknown output format %q, must be text or json", doctorFormat)
+		}
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+		_, blocks, err := generateBashScript(bp)
+		if err != nil {
+			return fmt.Errorf("error generating command blocks: %w", err)
+		}
+
+		report := doctorReport{Environment: inspectEnvironment("/", exec.LookPath)}
+		report.Environment.Root = os.Geteuid() == 0
+		report.Blocks = checkBlocks(blocks, report.Environment)
+
+		if doctorFormat == "json" {
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return fmt.Errorf("error encoding report: %w", err)
+			}
+			fmt.Println(string(data))
+		} else {
+			fmt.Print(formatDoctorReport(report))
+		}
+
+		failed := 0
+		for _, block := range report.Blocks {
+			if block.Status == doctorFails {
+				failed++
+			}
+		}
+		if failed > 0 {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("%d of %d blocks would fail on this host", failed, len(report.Blocks))
+		}
+		return nil
+	},
+}
+
+func init() {
+	doctorCmd.Flags().StringVar(&doctorFormat, "format", "text", "output format, text or json")
+	rootCmd.AddCommand(doctorCmd)
+}
+
+// inspectEnvironment inspects the host with its files at root, finding the tools with
+// lookPath.
+func inspectEnvironment(root string, lookPath func(string) (string, error)) doctorEnvironment {
+	exists := func(path string) bool {
+		_, err := os.Stat(filepath.Join(root, path))
+		return err == nil
+	}
+	env := doctorEnvironment{
+		// podman and docker leave these behind in their containers
+		Container: exists("run/.containerenv") || exists(".dockerenv"),
+		// bootc images have it, also while they are being built
+		BootcImage:   exists("usr/lib/bootc"),
+		OstreeBooted: exists("run/ostree-booted"),
+		// W_OK, the syscall package has no constant for it
+		USRWritable: syscall.Access(filepath.Join(root, "usr"), 2) == nil,
+		Tools:       make(map[string]string),
+	}
+	for _, tool := range append(slices.Clone(doctorTools), "rpm-ostree") {
+		path, _ := lookPath(tool)
+		env.Tools[tool] = path
+	}
+	return env
+}
+
+// toolRegexp returns the regexp matching calls of the tool in shell commands.
+func toolRegexp(tool string) *regexp.Regexp {
+	return regexp.MustCompile(`(^|[\s;&|(])` + regexp.QuoteMeta(tool) + `(\s|$|\))`)
+}
+
+// blockTools returns the tools that the commands of a block call, and whether the
+// block installs each with dnf.
+func blockTools(commands string) map[string]bool {
+	tools := make(map[string]bool)
+	for _, tool := range doctorTools {
+		if !toolRegexp(tool).MatchString(commands) {
+			continue
+		}
+		pkg := tool
+		if p, ok := toolPackages[tool]; ok {
+			pkg = p
+		}
+		install := regexp.MustCompile(`dnf install -y( [^\s;&|)]+)* ` + regexp.QuoteMeta(pkg) + `(\s|$|\))`)
+		tools[tool] = install.MatchString(commands)
+	}
+	return tools
+}
+
+// checkBlocks returns whether each block can be applied in the environment.
+func checkBlocks(blocks []NamedCommandBlock, env doctorEnvironment) []doctorBlock {
+	var checked []doctorBlock
+	for _, block := range blocks {
+		if strings.TrimSpace(block.Commands) == "" {
+			continue
+		}
+		result := doctorBlock{Name: block.Name, Status: doctorOK}
+		tools := blockTools(block.Commands)
+		for _, tool := range doctorTools {
+			installed, used := tools[tool]
+			if !used || env.Tools[tool] != "" {
+				continue
+			}
+			if installed && env.Tools["dnf"] != "" {
+				continue
+			}
+			// Installing it needs dnf, which is then missing as well
+			result.Status = doctorFails
+			result.Problems = append(result.Problems, fmt.Sprintf("%s is missing", tool))
+		}
+		if !env.USRWritable && strings.Contains(block.Commands, "dnf install") {
+			if result.Status == doctorOK {
+				result.Status = doctorMayFail
+			}
+			problem := "installs packages if they are missing, but /usr is read-only"
+			if env.OstreeBooted {
+				problem += ", install them in the image build instead"
+			}
+			result.Problems = append(result.Problems, problem)
+		}
+		if !env.Root {
+			if result.Status == doctorOK {
+				result.Status = doctorMayFail
+			}
+			result.Problems = append(result.Problems, "not running as root")
+		}
+		checked = append(checked, result)
+	}
+	return checked
+}
+
+// yesNo formats a boolean for the text report.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// formatDoctorReport formats the report as text.
+func formatDoctorReport(report doctorReport) string {
+	var out strings.Builder
+	env := report.Environment
+	out.WriteString("Environment:\n")
+	fmt.Fprintf(&out, "  container: %s\n", yesNo(env.Container))
+	fmt.Fprintf(&out, "  bootc image: %s\n", yesNo(env.BootcImage))
+	fmt.Fprintf(&out, "  booted image mode system: %s\n", yesNo(env.OstreeBooted))
+	fmt.Fprintf(&out, "  /usr writable: %s\n", yesNo(env.USRWritable))
+	fmt.Fprintf(&out, "  root: %s\n", yesNo(env.Root))
+	if env.Tools["dnf"] == "" && env.Tools["rpm-ostree"] != "" {
+		out.WriteString("  dnf is missing, rpm-ostree is not supported, install packages in the image build\n")
+	}
+
+	out.WriteString("\nBlocks:\n")
+	for _, block := range report.Blocks {
+		fmt.Fprintf(&out, "  %s: %s\n", block.Name, block.Status)
+		for _, problem := range block.Problems {
+			fmt.Fprintf(&out, "    - %s\n", problem)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectEnvironment(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"run", "usr/lib/bootc"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(root, "run/.containerenv"), nil, 0644))
+
+	env := inspectEnvironment(root, func(tool string) (string, error) {
+		if tool == "dnf" {
+			return "/usr/bin/dnf", nil
+		}
+		return "", exec.ErrNotFound
+	})
+	assert.True(t, env.Container)
+	assert.True(t, env.BootcImage)
+	assert.False(t, env.OstreeBooted)
+	assert.Equal(t, "/usr/bin/dnf", env.Tools["dnf"])
+	assert.Equal(t, "", env.Tools["rpm-ostree"])
+	assert.Contains(t, env.Tools, "firewall-offline-cmd")
+}
+
+func TestBlockTools(t *testing.T) {
+	assert.Equal(t, map[string]bool{"dnf": false, "firewall-offline-cmd": true},
+		blockTools("(command -v firewall-offline-cmd >/dev/null || dnf install -y firewalld)\nfirewall-offline-cmd --add-port=22/tcp"))
+	assert.Equal(t, map[string]bool{"dnf": false, "rpm": false, "tuned-adm": true},
+		blockTools("(rpm -q tuned >/dev/null || dnf install -y tuned)\ntuned-adm profile virtual-guest"))
+	assert.Equal(t, map[string]bool{"useradd": false}, blockTools("useradd -m admin"))
+	// Paths and options are no calls
+	assert.Empty(t, blockTools("echo 'x' > /etc/dnf/dnf.conf"))
+}
+
+func TestCheckBlocks(t *testing.T) {
+	blocks := []NamedCommandBlock{
+		{Name: "Packages", Commands: "(rpm -q vim >/dev/null || dnf install -y vim)"},
+		{Name: "Firewall", Commands: "(command -v firewall-offline-cmd >/dev/null || dnf install -y firewalld)\nfirewall-offline-cmd --add-port=22/tcp"},
+		{Name: "Users", Commands: "useradd -m admin"},
+		{Name: "Empty", Commands: "\n"},
+	}
+	env := doctorEnvironment{
+		USRWritable: true,
+		Root:        true,
+		Tools:       map[string]string{"dnf": "/usr/bin/dnf", "rpm": "/usr/bin/rpm"},
+	}
+	assert.Equal(t, []doctorBlock{
+		{Name: "Packages", Status: doctorOK},
+		{Name: "Firewall", Status: doctorOK},
+		{Name: "Users", Status: doctorFails, Problems: []string{"useradd is missing"}},
+	}, checkBlocks(blocks, env))
+
+	env.Tools = map[string]string{"rpm": "/usr/bin/rpm", "useradd": "/usr/sbin/useradd"}
+	env.USRWritable = false
+	env.OstreeBooted = true
+	assert.Equal(t, []doctorBlock{
+		{Name: "Packages", Status: doctorFails, Problems: []string{
+			"dnf is missing",
+			"installs packages if they are missing, but /usr is read-only, install them in the image build instead",
+		}},
+		{Name: "Firewall", Status: doctorFails, Problems: []string{
+			"dnf is missing",
+			"firewall-offline-cmd is missing",
+			"installs packages if they are missing, but /usr is read-only, install them in the image build instead",
+		}},
+		{Name: "Users", Status: doctorOK},
+	}, checkBlocks(blocks, env))
+
+	env.Root = false
+	assert.Equal(t, doctorBlock{Name: "Users", Status: doctorMayFail, Problems: []string{"not running as root"}}, checkBlocks(blocks, env)[2])
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// blueprintExpandEnv, blueprintEnvFiles and blueprintAllowEnv are set by --expand-env,
+// --env-file and --allow-env: whether ${VAR} in the values of blueprints is expanded,
+// the files with the variables, and the variables of the environment that may be used
+var (
+	blueprintExpandEnv bool
+	blueprintEnvFiles  []string
+	blueprintAllowEnv  []string
+)
+
+// envRefRegexp matches ${VAR} and ${VAR:-default}, and $${ escaping a literal ${
+var envRefRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// envLookup returns the value of a variable and whether it is set
+type envLookup func(name string) (string, bool)
+
+// blueprintEnv returns the lookup of the variables: the ones of the env files, later
+// files overriding earlier ones, and the ones of the environment that --allow-env
+// allows. Secrets in the environment of apply are not in the blueprint unless allowed.
+func blueprintEnv(files, allow []string) (envLookup, error) {
+	vars := make(map[string]string)
+	for _, file := range files {
+		if err := readEnvFile(file, vars); err != nil {
+			return nil, err
+		}
+	}
+	return func(name string) (string, bool) {
+		if value, ok := vars[name]; ok {
+			return value, true
+		}
+		for _, pattern := range allow {
+			if matched, _ := path.Match(pattern, name); matched {
+				return os.LookupEnv(name)
+			}
+		}
+		return "", false
+	}, nil
+}
+
+// readEnvFile reads the KEY=VALUE lines of the env file into vars, like systemd
+// EnvironmentFile= does: with comments, blank lines, an optional export and quotes.
+func readEnvFile(file string, vars map[string]string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("error reading env file: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, value, found := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !found || !envNameRegexp.MatchString(name) {
+			return fmt.Errorf("%s:%d: invalid line, must be NAME=VALUE", file, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[name] = value
+	}
+	return scanner.Err()
+}
+
+// expandEnv expands the variables in s, failing on variables that are not set and
+// have no default.
+func expandEnv(s string, lookup envLookup) (string, error) {
+	var err error
+	expanded := envRefRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := envRefRegexp.FindStringSubmatch(ref)
+		if value, ok := lookup(m[1]); ok {
+			return value
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("variable %s is not set", m[1])
+		}
+		return ref
+	})
+	return expanded, err
+}
+
+// expandDocument expands the variables in the string values of the decoded blueprint,
+// not in its keys.
+func expandDocument(key string, v interface{}, lookup envLookup) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			childKey := k
+			if key != "" {
+				childKey = key + "." + k
+			}
+			expanded, err := expandDocument(childKey, value, lookup)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = expanded
+		}
+		return v, nil
+	case []interface{}:
+		for i, value := range v {
+			expanded, err := expandDocument(key, value, lookup)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+		return v, nil
+	case string:
+		expanded, err := expandEnv(v, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		return expanded, nil
+	}
+	return v, nil
+}
+
+// expandBlueprintVars expands the variables in the decoded blueprint read from path
+// with --expand-env.
+func expandBlueprintVars(path string, doc map[string]interface{}) (map[string]interface{}, error) {
+	lookup, err := blueprintEnv(blueprintEnvFiles, blueprintAllowEnv)
+	if err != nil {
+		return nil, err
+	}
+	expanded, err := expandDocument("", doc, lookup)
+	if err != nil {
+		return nil, fmt.Errorf("error expanding variables in %s: %w", path, err)
+	}
+	return expanded.(map[string]interface{}), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandEnv(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		value, ok := map[string]string{"SITE": "prg", "EMPTY": ""}[name]
+		return value, ok
+	}
+	for in, out := range map[string]string{
+		"web.${SITE}.example.com": "web.prg.example.com",
+		"${EMPTY}x":               "x",
+		"${REGION:-eu}":           "eu",
+		"${SITE:-eu}":             "prg",
+		"$${SITE} and $HOME":      "${SITE} and $HOME",
+		"echo $$":                 "echo $$",
+	} {
+		expanded, err := expandEnv(in, lookup)
+		require.NoError(t, err, in)
+		assert.Equal(t, out, expanded, in)
+	}
+	_, err := expandEnv("${MISSING}", lookup)
+	assert.EqualError(t, err, "variable MISSING is not set")
+}
+
+func TestBlueprintEnv(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "site.env")
+	require.NoError(t, os.WriteFile(file, []byte("# site\nexport SITE=prg\nPASSWORD='s3cr\"t'\n\nSITE_DOMAIN = \"example.com\"\n"), 0644))
+	t.Setenv("SITE_REGION", "eu")
+	t.Setenv("SECRET", "leaked")
+
+	lookup, err := blueprintEnv([]string{file}, []string{"SITE_*"})
+	require.NoError(t, err)
+	for name, value := range map[string]string{"SITE": "prg", "PASSWORD": `s3cr"t`, "SITE_DOMAIN": "example.com", "SITE_REGION": "eu"} {
+		got, ok := lookup(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, value, got, name)
+	}
+	// Only allowed variables are taken from the environment
+	_, ok := lookup("SECRET")
+	assert.False(t, ok)
+
+	require.NoError(t, os.WriteFile(file, []byte("not a variable\n"), 0644))
+	_, err = blueprintEnv([]string{file}, nil)
+	assert.ErrorContains(t, err, file+":1: invalid line, must be NAME=VALUE")
+}
+
+func TestLoadBlueprintExpandEnv(t *testing.T) {
+	dir := t.TempDir()
+	path, envFile := filepath.Join(dir, "config.toml"), filepath.Join(dir, "site.env")
+	require.NoError(t, os.WriteFile(path, []byte(`
+[customizations]
+hostname = "web.${SITE}.example.com"
+
+[[customizations.user]]
+name = "admin"
+password = "${ADMIN_PASSWORD}"
+`), 0644))
+	require.NoError(t, os.WriteFile(envFile, []byte("SITE=prg\n"), 0644))
+	t.Setenv("ADMIN_PASSWORD", `pa"ss`)
+
+	oldExpand, oldFiles, oldAllow := blueprintExpandEnv, blueprintEnvFiles, blueprintAllowEnv
+	t.Cleanup(func() { blueprintExpandEnv, blueprintEnvFiles, blueprintAllowEnv = oldExpand, oldFiles, oldAllow })
+
+	// Without --expand-env, nothing is expanded
+	bp, err := loadBlueprint([]string{path})
+	require.NoError(t, err)
+	assert.Equal(t, "web.${SITE}.example.com", *bp.Customizations.GetHostname())
+
+	blueprintExpandEnv, blueprintEnvFiles = true, []string{envFile}
+	_, err = loadBlueprint([]string{path})
+	assert.ErrorContains(t, err, "error expanding variables in "+path+": customizations.user.password: variable ADMIN_PASSWORD is not set")
+
+	blueprintAllowEnv = []string{"ADMIN_PASSWORD"}
+	bp, err = loadBlueprint([]string{path})
+	require.NoError(t, err)
+	assert.Equal(t, "web.prg.example.com", *bp.Customizations.GetHostname())
+	assert.Equal(t, `pa"ss`, *bp.Customizations.User[0].Password)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// explainedLine is a generated command and the blueprint keys producing it
+type explainedLine struct {
+	Line string
+	// Keys are the blueprint keys without which the command is not generated, none if
+	// no single key decides it
+	Keys []string
+}
+
+// explainedBlock is a block of commands explained line by line
+type explainedBlock struct {
+	Name  string
+	Lines []explainedLine
+}
+
+var explainSection string
+
+var explainCmd = &cobra.Command{
+	Use:   "explain [--section SECTION] [blueprint.toml]",
+	Short: "Explain the commands an OSBuild blueprint translates to",
+	Long: `Prints the commands generated from an OSBuild blueprint (TOML format), one
+per line and preceded by a comment with the blueprint keys that produce it,
+for reviewing the generated script. Commands chained with && are split.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+A command is attributed to a key if it is no longer generated once the key is
+removed from the blueprint. Commands attributed to no single key are needed by
+the block as a whole, like installing firewalld or cleaning the dnf cache.
+
+--section limits the output to a block, by name like "Users", or to the blocks
+generated from a key, like customizations.user.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		blueprintPath := defaultBlueprintPath
+		if len(args) > 0 {
+			blueprintPath = args[0]
+		}
+		data, err := readBlueprint(blueprintPath)
+		if err != nil {
+			return fmt.Errorf("error opening blueprint file %s: %w", blueprintPath, err)
+		}
+		if data, err = blueprintTOML(blueprintPath, data); err != nil {
+			return err
+		}
+
+		blocks, err := explainBlueprint(data, blueprintPath)
+		if err != nil {
+			return fmt.Errorf("error explaining blueprint: %w", err)
+		}
+		var selected []explainedBlock
+		for _, block := range blocks {
+			if explainSection == "" || explainSelects(explainSection, block) {
+				selected = append(selected, block)
+			}
+		}
+		if len(selected) == 0 {
+			return fmt.Errorf("no commands are generated for section %q", explainSection)
+		}
+		fmt.Print(formatExplanation(selected))
+		return nil
+	},
+}
+
+func init() {
+	explainCmd.Flags().StringVar(&explainSection, "section", "", "block name or blueprint key to explain")
+	rootCmd.AddCommand(explainCmd)
+}
+
+// explainSelects returns whether the section, a block name or blueprint key, selects
+// the block.
+func explainSelects(section string, block explainedBlock) bool {
+	if strings.EqualFold(section, block.Name) {
+		return true
+	}
+	for _, line := range block.Lines {
+		for _, key := range line.Keys {
+			if key == section || strings.HasPrefix(key, section+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// leafKeys returns the keys that no other key is nested in.
+func leafKeys(keys []string) []string {
+	var leaves []string
+	for _, key := range keys {
+		nested := slices.ContainsFunc(keys, func(other string) bool {
+			return strings.HasPrefix(other, key+".")
+		})
+		if !nested {
+			leaves = append(leaves, key)
+		}
+	}
+	return leaves
+}
+
+// removeKey removes the dotted key from a decoded blueprint, from every entry of the
+// lists of tables on the way.
+func removeKey(v interface{}, key []string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(key) == 1 {
+			delete(v, key[0])
+			return
+		}
+		removeKey(v[key[0]], key[1:])
+	case []interface{}:
+		for _, item := range v {
+			removeKey(item, key)
+		}
+	}
+}
+
+// splitCommands splits commands at the newlines and && outside of quotes.
+func splitCommands(commands string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(commands); i++ {
+		c := commands[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '\n':
+			parts = append(parts, commands[start:i])
+			start = i + 1
+		case strings.HasPrefix(commands[i:], " && "):
+			parts = append(parts, commands[start:i])
+			i += len(" && ") - 1
+			start = i + 1
+		}
+	}
+	parts = append(parts, commands[start:])
+	return slices.DeleteFunc(parts, func(part string) bool { return strings.TrimSpace(part) == "" })
+}
+
+// blockLines returns the generated commands of every block.
+func blockLines(bp *Blueprint) (map[string][]string, []NamedCommandBlock, error) {
+	_, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := make(map[string][]string)
+	for _, block := range namedBlocks {
+		lines[block.Name] = splitCommands(block.Commands)
+	}
+	return lines, namedBlocks, nil
+}
+
+// explainBlueprint generates the blocks of the blueprint in TOML format read from path
+// and attributes their commands to the keys producing them.
+func explainBlueprint(data []byte, path string) ([]explainedBlock, error) {
+	bp, _, err := decodeBlueprintTOML(data, path)
+	if err != nil {
+		return nil, err
+	}
+	lines, namedBlocks, err := blockLines(bp)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]explainedBlock, len(namedBlocks))
+	for i, block := range namedBlocks {
+		blocks[i].Name = block.Name
+		for _, line := range lines[block.Name] {
+			blocks[i].Lines = append(blocks[i].Lines, explainedLine{Line: line})
+		}
+	}
+
+	for _, key := range leafKeys(bp.Keys) {
+		doc, err := decodeDocument(data, "toml")
+		if err != nil {
+			return nil, err
+		}
+		removeKey(doc, strings.Split(key, "."))
+		without, err := encodeDocument(doc, "toml")
+		if err != nil {
+			return nil, err
+		}
+		reduced, _, err := decodeBlueprintTOML(without, path)
+		if err != nil {
+			continue // The key is required
+		}
+		reducedLines, _, err := blockLines(reduced)
+		if err != nil {
+			continue // The key is required
+		}
+
+		for i := range blocks {
+			remaining := slices.Clone(reducedLines[blocks[i].Name])
+			for j := range blocks[i].Lines {
+				line := &blocks[i].Lines[j]
+				if k := slices.Index(remaining, line.Line); k >= 0 {
+					remaining = slices.Delete(remaining, k, k+1)
+				} else {
+					line.Keys = append(line.Keys, key)
+				}
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// formatExplanation renders the explained blocks as commented commands. Consecutive
+// commands from the same keys share a comment.
+func formatExplanation(blocks []explainedBlock) string {
+	var out strings.Builder
+	for i, block := range blocks {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		fmt.Fprintf(&out, "# %s\n", block.Name)
+		var previous []string
+		for j, line := range block.Lines {
+			if j == 0 || !slices.Equal(line.Keys, previous) {
+				if len(line.Keys) == 0 {
+					out.WriteString("#   needed by the block\n")
+				} else {
+					fmt.Fprintf(&out, "#   from %s\n", strings.Join(line.Keys, ", "))
+				}
+			}
+			previous = line.Keys
+			out.WriteString(line.Line + "\n")
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitCommands(t *testing.T) {
+	assert.Equal(t, []string{
+		"a",
+		"printf '%s' 'x && y\nz' > f",
+		`echo "a && \"b\""`,
+		"(c || d)",
+	}, splitCommands("a && printf '%s' 'x && y\nz' > f\n"+`echo "a && \"b\""`+" && (c || d)\n"))
+}
+
+func TestExplainBlueprint(t *testing.T) {
+	blocks, err := explainBlueprint([]byte(`
+[customizations]
+hostname = "box"
+
+[customizations.firewall]
+ports = ["22/tcp"]
+
+[customizations.firewall.services]
+enabled = ["http"]
+`), "config.toml")
+	require.NoError(t, err)
+
+	var firewall explainedBlock
+	for _, block := range blocks {
+		if block.Name == "Firewall" {
+			firewall = block
+		}
+	}
+	assert.Equal(t, []explainedLine{
+		{Line: "(command -v firewall-offline-cmd >/dev/null || dnf install -y firewalld)"},
+		{Line: "firewall-offline-cmd --add-port=22/tcp", Keys: []string{"customizations.firewall.ports"}},
+		{Line: "firewall-offline-cmd --add-service=http", Keys: []string{"customizations.firewall.services.enabled"}},
+	}, firewall.Lines)
+	assert.True(t, explainSelects("customizations.firewall", firewall))
+	assert.True(t, explainSelects("firewall", firewall))
+	assert.False(t, explainSelects("customizations.hostname", firewall))
+
+	assert.Equal(t, `# Hostname
+#   from customizations.hostname
+echo 'box' > /etc/hostname
+
+# Firewall
+#   needed by the block
+(command -v firewall-offline-cmd >/dev/null || dnf install -y firewalld)
+#   from customizations.firewall.ports
+firewall-offline-cmd --add-port=22/tcp
+#   from customizations.firewall.services.enabled
+firewall-offline-cmd --add-service=http
+`, formatExplanation([]explainedBlock{blocks[1], firewall}))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Range of the IDs of regular users and groups, as in login.defs of Fedora
+const (
+	extractIDMin = 1000
+	extractIDMax = 60000
+)
+
+// commandRunner runs a command and returns its standard output
+type commandRunner func(name string, args ...string) ([]byte, error)
+
+func runCommand(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+// extractedUser is a regular user found on the system
+type extractedUser struct {
+	Name   string
+	UID    int
+	Home   string
+	Shell  string
+	Groups []string
+	Key    string
+}
+
+// extractedSystem are the settings of a system that map to blueprint fields
+type extractedSystem struct {
+	Packages      []string
+	Hostname      string
+	Timezone      string
+	Languages     []string
+	Keyboard      string
+	Groups        map[string]int
+	Users         []extractedUser
+	FirewallPorts []string
+	FirewallRules []string
+	Services      []string
+}
+
+var extractCmd = &cobra.Command{
+	Use:   "extract",
+	Short: "Generate an OSBuild blueprint from the running system",
+	Long: `Inspects the running system and prints a best-effort OSBuild blueprint (TOML
+format) of it, to start moving hand-configured machines to image mode.
+
+Extracted are the packages installed by the user, the hostname, timezone,
+locale and keymap, the regular users and groups with their group memberships
+and authorized SSH keys, the ports and services allowed by the firewall and
+the services enabled against their preset. Passwords are not extracted.
+
+Review the blueprint before using it, anything else configured on the system
+is missing from it.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sys, err := extractSystem("/", runCommand)
+		if err != nil {
+			return fmt.Errorf("error inspecting the system: %w", err)
+		}
+		fmt.Print(extractedBlueprint(sys))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(extractCmd)
+}
+
+// readKeyValueFile returns the value of key in a KEY=VALUE file like /etc/locale.conf.
+func readKeyValueFile(path, key string) (string, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range lines {
+		if name, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok && name == key {
+			return strings.Trim(value, `"'`), nil
+		}
+	}
+	return "", nil
+}
+
+// extractSystem inspects the system with its files at root, running the commands
+// querying it with run.
+func extractSystem(root string, run commandRunner) (*extractedSystem, error) {
+	sys := &extractedSystem{Groups: make(map[string]int)}
+
+	// dnf4 ends every line by itself, dnf5 needs the newline in the format
+	out, err := run("dnf", "repoquery", "--userinstalled", "--queryformat", "%{name}\\n")
+	if err != nil {
+		return nil, fmt.Errorf("error querying user installed packages: %w", err)
+	}
+	for _, pkg := range strings.Fields(string(out)) {
+		// The kernel is always installed
+		if pkg != "kernel" && !slices.Contains(sys.Packages, pkg) {
+			sys.Packages = append(sys.Packages, pkg)
+		}
+	}
+	slices.Sort(sys.Packages)
+
+	hostname, err := os.ReadFile(filepath.Join(root, "etc/hostname"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sys.Hostname = strings.TrimSpace(string(hostname))
+
+	if target, err := os.Readlink(filepath.Join(root, "etc/localtime")); err == nil {
+		if _, zone, found := strings.Cut(target, "zoneinfo/"); found {
+			sys.Timezone = zone
+		}
+	}
+
+	lang, err := readKeyValueFile(filepath.Join(root, "etc/locale.conf"), "LANG")
+	if err != nil {
+		return nil, err
+	}
+	if lang != "" {
+		sys.Languages = []string{lang}
+	}
+	if sys.Keyboard, err = readKeyValueFile(filepath.Join(root, "etc/vconsole.conf"), "KEYMAP"); err != nil {
+		return nil, err
+	}
+
+	groupLines, err := readLines(filepath.Join(root, "etc/group"))
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string][]string)
+	for _, line := range groupLines {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 {
+			continue
+		}
+		if fields[3] != "" {
+			for _, member := range strings.Split(fields[3], ",") {
+				members[member] = append(members[member], fields[0])
+			}
+		}
+		if gid, err := strconv.Atoi(fields[2]); err == nil && gid >= extractIDMin && gid <= extractIDMax {
+			sys.Groups[fields[0]] = gid
+		}
+	}
+
+	passwdLines, err := readLines(filepath.Join(root, "etc/passwd"))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range passwdLines {
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil || uid < extractIDMin || uid > extractIDMax {
+			continue
+		}
+		user := extractedUser{Name: fields[0], UID: uid, Home: fields[5], Shell: fields[6], Groups: members[fields[0]]}
+		// useradd creates the group of the user itself
+		delete(sys.Groups, user.Name)
+		key, err := os.ReadFile(filepath.Join(root, user.Home, ".ssh/authorized_keys"))
+		if err != nil && !os.IsNotExist(err) && !os.IsPermission(err) {
+			return nil, err
+		}
+		user.Key = strings.TrimSpace(string(key))
+		sys.Users = append(sys.Users, user)
+	}
+
+	// Without firewalld there is nothing to extract
+	if out, err := run("firewall-offline-cmd", "--list-ports"); err == nil {
+		sys.FirewallPorts = strings.Fields(string(out))
+		if out, err = run("firewall-offline-cmd", "--list-services"); err != nil {
+			return nil, fmt.Errorf("error listing firewall services: %w", err)
+		}
+		sys.FirewallRules = strings.Fields(string(out))
+	}
+
+	out, err = run("systemctl", "list-unit-files", "--type=service,socket,timer", "--state=enabled", "--no-legend", "--no-pager")
+	if err != nil {
+		return nil, fmt.Errorf("error listing enabled services: %w", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// UNIT STATE PRESET, units enabled by their preset need no customization
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == "enabled" && (len(fields) < 3 || fields[2] != "enabled") {
+			sys.Services = append(sys.Services, fields[0])
+		}
+	}
+
+	return sys, nil
+}
+
+// extractedBlueprint writes the extracted settings as a blueprint.
+func extractedBlueprint(sys *extractedSystem) string {
+	var out strings.Builder
+	out.WriteString("# Blueprint extracted by imagecfg extract, review before use\n")
+	for _, pkg := range sys.Packages {
+		fmt.Fprintf(&out, "\n[[packages]]\nname = %s\n", tomlValue(pkg))
+	}
+
+	if sys.Hostname != "" {
+		fmt.Fprintf(&out, "\n[customizations]\nhostname = %s\n", tomlValue(sys.Hostname))
+	}
+	if sys.Timezone != "" {
+		fmt.Fprintf(&out, "\n[customizations.timezone]\ntimezone = %s\n", tomlValue(sys.Timezone))
+	}
+	if len(sys.Languages) > 0 || sys.Keyboard != "" {
+		out.WriteString("\n[customizations.locale]\n")
+		if len(sys.Languages) > 0 {
+			fmt.Fprintf(&out, "languages = %s\n", tomlValue(sys.Languages))
+		}
+		if sys.Keyboard != "" {
+			fmt.Fprintf(&out, "keyboard = %s\n", tomlValue(sys.Keyboard))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(sys.Groups)) {
+		fmt.Fprintf(&out, "\n[[customizations.group]]\nname = %s\ngid = %d\n", tomlValue(name), sys.Groups[name])
+	}
+
+	for _, user := range sys.Users {
+		fmt.Fprintf(&out, "\n[[customizations.user]]\nname = %s\nuid = %d\n", tomlValue(user.Name), user.UID)
+		if user.Home != "/home/"+user.Name {
+			fmt.Fprintf(&out, "home = %s\n", tomlValue(user.Home))
+		}
+		if user.Shell != "/bin/bash" {
+			fmt.Fprintf(&out, "shell = %s\n", tomlValue(user.Shell))
+		}
+		if len(user.Groups) > 0 {
+			fmt.Fprintf(&out, "groups = %s\n", tomlValue(user.Groups))
+		}
+		if user.Key != "" {
+			fmt.Fprintf(&out, "key = %s\n", tomlValue(user.Key))
+		}
+	}
+
+	if len(sys.FirewallPorts) > 0 {
+		fmt.Fprintf(&out, "\n[customizations.firewall]\nports = %s\n", tomlValue(sys.FirewallPorts))
+	}
+	if len(sys.FirewallRules) > 0 {
+		fmt.Fprintf(&out, "\n[customizations.firewall.services]\nenabled = %s\n", tomlValue(sys.FirewallRules))
+	}
+	if len(sys.Services) > 0 {
+		fmt.Fprintf(&out, "\n[customizations.services]\nenabled = %s\n", tomlValue(sys.Services))
+	}
+	return out.String()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractSystem(t *testing.T) {
+	root := t.TempDir()
+	for path, content := range map[string]string{
+		"etc/hostname":                    "box\n",
+		"etc/locale.conf":                 "LANG=\"en_US.UTF-8\"\n",
+		"etc/vconsole.conf":               "KEYMAP=us\nFONT=eurlatgr\n",
+		"etc/group":                       "root:x:0:\nwheel:x:10:admin\napp:x:2000:admin,deploy\nadmin:x:1000:\ndeploy:x:1001:\n",
+		"etc/passwd":                      "root:x:0:0:root:/root:/bin/bash\nadmin:x:1000:1000::/home/admin:/bin/bash\ndeploy:x:1001:1001::/srv/deploy:/bin/sh\nnobody:x:65534:65534::/:/sbin/nologin\n",
+		"home/admin/.ssh/authorized_keys": "ssh-ed25519 AAAA admin\n",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, path), []byte(content), 0644))
+	}
+	require.NoError(t, os.Symlink("../usr/share/zoneinfo/Europe/Prague", filepath.Join(root, "etc/localtime")))
+
+	run := func(name string, args ...string) ([]byte, error) {
+		switch name + " " + strings.Join(args, " ") {
+		case `dnf repoquery --userinstalled --queryformat %{name}\n`:
+			return []byte("vim-enhanced\nkernel\n\ntmux\n"), nil
+		case "firewall-offline-cmd --list-ports":
+			return []byte("8080/tcp\n"), nil
+		case "firewall-offline-cmd --list-services":
+			return []byte("ssh cockpit\n"), nil
+		case "systemctl list-unit-files --type=service,socket,timer --state=enabled --no-legend --no-pager":
+			return []byte("sshd.service enabled enabled\nnginx.service enabled disabled\nold.service enabled\n"), nil
+		}
+		return nil, fmt.Errorf("unexpected command %s %v", name, args)
+	}
+
+	sys, err := extractSystem(root, run)
+	require.NoError(t, err)
+	out := extractedBlueprint(sys)
+	assert.Equal(t, `# Blueprint extracted by imagecfg extract, review before use
+
+[[packages]]
+name = "tmux"
+
+[[packages]]
+name = "vim-enhanced"
+
+[customizations]
+hostname = "box"
+
+[customizations.timezone]
+timezone = "Europe/Prague"
+
+[customizations.locale]
+languages = ["en_US.UTF-8"]
+keyboard = "us"
+
+[[customizations.group]]
+name = "app"
+gid = 2000
+
+[[customizations.user]]
+name = "admin"
+uid = 1000
+groups = ["wheel", "app"]
+key = "ssh-ed25519 AAAA admin"
+
+[[customizations.user]]
+name = "deploy"
+uid = 1001
+home = "/srv/deploy"
+shell = "/bin/sh"
+groups = ["app"]
+
+[customizations.firewall]
+ports = ["8080/tcp"]
+
+[customizations.firewall.services]
+enabled = ["ssh", "cockpit"]
+
+[customizations.services]
+enabled = ["nginx.service", "old.service"]
+`, out)
+
+	// The extracted blueprint is accepted
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(out), 0644))
+	_, err = parseBlueprint(path)
+	require.NoError(t, err)
+}
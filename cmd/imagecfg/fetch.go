@@ -0,0 +1,165 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blueprintSHA256, blueprintCACert, blueprintClientCert and blueprintClientKey are set
+// by --sha256, --ca-cert, --client-cert and --client-key: the SHA-256 the blueprint
+// must have, and the CA and client certificate blueprint URLs are fetched with
+var (
+	blueprintSHA256     string
+	blueprintCACert     string
+	blueprintClientCert string
+	blueprintClientKey  string
+)
+
+// fetchTimeout is how long fetching a blueprint may take
+const fetchTimeout = time.Minute
+
+// fetchMaxSize is the largest blueprint that is fetched
+const fetchMaxSize = 16 << 20
+
+// fetchedBlueprints are the blueprints fetched by URL or OCI reference, so that every command reading
+// one again, like apply hashing it for its state, gets the same data
+var (
+	fetchedBlueprints   = map[string][]byte{}
+	fetchedBlueprintsMu sync.Mutex
+)
+
+// isBlueprintURL returns whether the blueprint path is a URL to fetch it from.
+func isBlueprintURL(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// readBlueprint reads the blueprint file at path, or fetches it if path is an https://
+// URL or an OCI reference, see readBlueprintSource, and decrypts it if it is encrypted
+// by SOPS. With --sha256, the blueprint must have that hash and with --verify-signature
+// a valid signature before it is decrypted.
+func readBlueprint(path string) ([]byte, error) {
+	data, err := readBlueprintSource(path, blueprintSHA256 != "")
+	if err != nil {
+		return nil, err
+	}
+	if blueprintSHA256 != "" {
+		if sum := hashBytes(data); sum != strings.ToLower(blueprintSHA256) {
+			return nil, fmt.Errorf("SHA-256 of the blueprint is %s, not %s as --sha256 says", sum, blueprintSHA256)
+		}
+	}
+	// --signature is the signature of the blueprint given, not of the ones it includes
+	if err := verifyBlueprintSignature(path, cmp.Or(blueprintSignature, signaturePath(path)), data); err != nil {
+		return nil, err
+	}
+	return decryptBlueprint(path, data)
+}
+
+// readBlueprintSource reads the blueprint file at path, or fetches it if path is an
+// https:// URL or an OCI reference, see isOCIBlueprint. pinned tells whether the data
+// is checked against --sha256, only then may it be fetched over plain HTTP.
+func readBlueprintSource(path string, pinned bool) ([]byte, error) {
+	switch {
+	case isBlueprintURL(path):
+		return fetchOnce(path, func(url string) ([]byte, error) { return fetchBlueprint(url, pinned) })
+	case isOCIBlueprint(path):
+		return fetchOnce(path, fetchOCIBlueprint)
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory without *.toml blueprints", path)
+	}
+	return os.ReadFile(path)
+}
+
+// fetchOnce fetches the blueprint at path with fetch, unless it was fetched before.
+func fetchOnce(path string, fetch func(string) ([]byte, error)) ([]byte, error) {
+	fetchedBlueprintsMu.Lock()
+	defer fetchedBlueprintsMu.Unlock()
+	if data, ok := fetchedBlueprints[path]; ok {
+		return data, nil
+	}
+	data, err := fetch(path)
+	if err != nil {
+		return nil, err
+	}
+	fetchedBlueprints[path] = data
+	return data, nil
+}
+
+// fetchBlueprint fetches the blueprint at the URL. Plain http:// URLs, and redirects to
+// them, need the blueprint to be pinned by --sha256, nothing else tells that what was
+// fetched is the blueprint.
+func fetchBlueprint(url string, pinned bool) ([]byte, error) {
+	if strings.HasPrefix(url, "http://") && !pinned {
+		return nil, fmt.Errorf("fetching a blueprint over plain HTTP needs --sha256")
+	}
+	client, err := fetchClient(pinned)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, fetchMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > fetchMaxSize {
+		return nil, fmt.Errorf("blueprint is larger than %d MiB", fetchMaxSize>>20)
+	}
+	return data, nil
+}
+
+// fetchClient returns the HTTP client fetching blueprints, trusting the CA of --ca-cert
+// instead of the system ones if it is set, and with the client certificate of
+// --client-cert and --client-key. Redirects to plain HTTP are refused unless the
+// blueprint is pinned.
+func fetchClient(pinned bool) (*http.Client, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if blueprintCACert != "" {
+		pem, err := os.ReadFile(blueprintCACert)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificate: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA certificate file %s", blueprintCACert)
+		}
+	}
+	if blueprintClientKey != "" && blueprintClientCert == "" {
+		return nil, fmt.Errorf("--client-key needs --client-cert")
+	}
+	if blueprintClientCert != "" {
+		// The key may be in the file of the certificate
+		cert, err := tls.LoadX509KeyPair(blueprintClientCert, cmp.Or(blueprintClientKey, blueprintClientCert))
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	checkRedirect := func(req *http.Request, via []*http.Request) error {
+		// The limit of the default client
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		if req.URL.Scheme != "https" && !pinned {
+			return fmt.Errorf("redirected to %s, fetching a blueprint over plain HTTP needs --sha256", req.URL.Redacted())
+		}
+		return nil
+	}
+	return &http.Client{Transport: transport, Timeout: fetchTimeout, CheckRedirect: checkRedirect}, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fetchTestBlueprint = "[customizations]\nhostname = \"fetched\"\n"
+
+// setFetchFlags sets the flags fetching blueprints for the test.
+func setFetchFlags(t *testing.T, sha256, caCert string) {
+	oldSHA256, oldCACert := blueprintSHA256, blueprintCACert
+	blueprintSHA256, blueprintCACert = sha256, caCert
+	t.Cleanup(func() {
+		blueprintSHA256, blueprintCACert = oldSHA256, oldCACert
+		fetchedBlueprints = map[string][]byte{}
+	})
+}
+
+func TestLoadBlueprintURL(t *testing.T) {
+	requests := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/config.toml" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(fetchTestBlueprint))
+	}))
+	// The handshake failing without --ca-cert is expected
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644))
+
+	// The certificate of the server is not trusted without --ca-cert
+	setFetchFlags(t, "", "")
+	_, err := loadBlueprint([]string{server.URL + "/config.toml"})
+	assert.ErrorContains(t, err, "certificate")
+
+	setFetchFlags(t, hashBytes([]byte(fetchTestBlueprint)), caCert)
+	bp, err := loadBlueprint([]string{server.URL + "/config.toml"})
+	require.NoError(t, err)
+	assert.Equal(t, "fetched", *bp.Customizations.Hostname)
+
+	// Reading it again gets the same blueprint
+	_, err = readBlueprint(server.URL + "/config.toml")
+	require.NoError(t, err)
+	assert.Equal(t, 1, requests)
+
+	_, err = loadBlueprint([]string{server.URL + "/missing.toml"})
+	assert.ErrorContains(t, err, "server returned 404 Not Found")
+
+	setFetchFlags(t, hashBytes([]byte("other")), caCert)
+	_, err = loadBlueprint([]string{server.URL + "/config.toml"})
+	assert.ErrorContains(t, err, "SHA-256 of the blueprint is "+hashBytes([]byte(fetchTestBlueprint)))
+}
+
+func TestFetchBlueprintPlainHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(fetchTestBlueprint))
+	}))
+	defer server.Close()
+
+	setFetchFlags(t, "", "")
+	_, err := readBlueprint(server.URL)
+	assert.ErrorContains(t, err, "fetching a blueprint over plain HTTP needs --sha256")
+
+	setFetchFlags(t, hashBytes([]byte(fetchTestBlueprint)), "")
+	data, err := readBlueprint(server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, fetchTestBlueprint, string(data))
+}
+
+func TestFetchBlueprintRedirectToPlainHTTP(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(fetchTestBlueprint))
+	}))
+	defer plain.Close()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/config.toml" {
+			_, _ = w.Write([]byte("include = [\"redirect.toml\"]\n"))
+			return
+		}
+		http.Redirect(w, r, plain.URL+"/config.toml", http.StatusFound)
+	}))
+	defer server.Close()
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644))
+
+	setFetchFlags(t, "", caCert)
+	_, err := readBlueprint(server.URL + "/redirect.toml")
+	assert.ErrorContains(t, err, "redirected to "+plain.URL+"/config.toml, fetching a blueprint over plain HTTP needs --sha256")
+
+	// The hash checks what the redirect led to
+	setFetchFlags(t, hashBytes([]byte(fetchTestBlueprint)), caCert)
+	data, err := readBlueprint(server.URL + "/redirect.toml")
+	require.NoError(t, err)
+	assert.Equal(t, fetchTestBlueprint, string(data))
+
+	// Includes are not pinned by --sha256, so they are not fetched over plain HTTP
+	include := "include = [\"redirect.toml\"]\n"
+	setFetchFlags(t, hashBytes([]byte(include)), caCert)
+	fetchedBlueprints = map[string][]byte{}
+	_, err = loadBlueprint([]string{server.URL + "/config.toml"})
+	assert.ErrorContains(t, err, "fetching a blueprint over plain HTTP needs --sha256")
+}
+
+func TestReadBlueprintSHA256File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(fetchTestBlueprint), 0644))
+	setFetchFlags(t, "0000", "")
+	_, err := readBlueprint(path)
+	assert.ErrorContains(t, err, "not 0000 as --sha256 says")
+}
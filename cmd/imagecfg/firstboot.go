@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Paths of the first boot service
+const (
+	firstbootUnitName   = "imagecfg-firstboot.service"
+	firstbootScriptPath = "/usr/libexec/imagecfg-firstboot"
+	firstbootStampPath  = "/var/lib/imagecfg/firstboot-done"
+)
+
+var firstbootCmd = &cobra.Command{
+	Use:   "firstboot [blueprint.toml...]",
+	Short: "Generate a service applying an OSBuild blueprint on first boot",
+	Long: `Generates a bash script that installs a systemd service applying an OSBuild
+blueprint (TOML format) on the first boot of a deployed system, e.g. for
+customizations that cannot run at build time, like machine specific secrets.
+Run the script at image build time, e.g. in a RUN instruction.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+The service runs the same blocks the 'bash' command generates, embedded in
+` + firstbootScriptPath + `. It disables itself on success and leaves a stamp
+file so that it never runs again.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		script, err := generateFirstbootScript(bp)
+		if err != nil {
+			return fmt.Errorf("error generating first boot service: %w", err)
+		}
+		fmt.Print(script)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(firstbootCmd)
+}
+
+// firstbootUnit is the self-disabling service running the embedded script once
+var firstbootUnit = fmt.Sprintf(`# Managed by imagecfg
+[Unit]
+Description=Apply the imagecfg blueprint on first boot
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!%[1]s
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+StateDirectory=imagecfg
+ExecStart=%[2]s
+ExecStartPost=/usr/bin/touch %[1]s
+ExecStartPost=/usr/bin/systemctl disable %[3]s
+
+[Install]
+WantedBy=multi-user.target
+`, firstbootStampPath, firstbootScriptPath, firstbootUnitName)
+
+// generateFirstbootScript generates the bash script installing the first boot service.
+func generateFirstbootScript(bp *Blueprint) (string, error) {
+	header, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return "", err
+	}
+
+	var embedded strings.Builder
+	embedded.WriteString(header)
+	for _, block := range namedBlocks {
+		fmt.Fprintf(&embedded, "# %s\n%s\n\n", block.Name, block.Commands)
+	}
+
+	install := strings.Join([]string{
+		writeFileCmd(firstbootScriptPath, embedded.String(), 0755),
+		writeFileCmd("/etc/systemd/system/"+firstbootUnitName, firstbootUnit, 0644),
+		"systemctl enable " + firstbootUnitName,
+	}, " && ")
+	return header + "# First Boot Service\n" + install + "\n", nil
+}
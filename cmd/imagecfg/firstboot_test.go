@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateFirstbootScript(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations]
+hostname = "box"
+`)
+	script, err := generateFirstbootScript(bp)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(script, "#!/bin/bash\nset -euf -o pipefail\n\n# First Boot Service\n"))
+	assert.Contains(t, script, "> '/usr/libexec/imagecfg-firstboot' && chmod 0755 '/usr/libexec/imagecfg-firstboot'")
+	assert.Contains(t, script, "ConditionPathExists=!/var/lib/imagecfg/firstboot-done\n")
+	assert.Contains(t, script, "ExecStartPost=/usr/bin/systemctl disable imagecfg-firstboot.service\n")
+	assert.True(t, strings.HasSuffix(script, " && systemctl enable imagecfg-firstboot.service\n"))
+
+	// The installer writes the script with the blocks, quoted. The blocks have
+	// no && here, so the printf command can be picked out.
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	dir := t.TempDir()
+	embedded := strings.Split(script, " && ")[1]
+	embedded = strings.Replace(embedded, "'/usr/libexec/imagecfg-firstboot'", shellQuote(filepath.Join(dir, "firstboot")), 1)
+	out, err := exec.Command(sh, "-c", embedded).CombinedOutput()
+	require.NoError(t, err, string(out))
+	data, err := os.ReadFile(filepath.Join(dir, "firstboot"))
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/bash\nset -euf -o pipefail\n\n# Packages\ndnf install -y kernel\n\n# Hostname\necho 'box' > /etc/hostname\n\n# Cleanup DNF Cache\ndnf clean all\n\n", string(data))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/osbuild/blueprint/pkg/blueprint"
+	"github.com/spf13/cobra"
+)
+
+// bareKeyRegexp matches the TOML keys that need no quotes
+var bareKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var fmtCheck bool
+
+var fmtCmd = &cobra.Command{
+	Use:   "fmt [--check] [blueprint...]",
+	Short: "Rewrite OSBuild blueprints in canonical form",
+	Long: `Rewrites OSBuild blueprints in canonical form, so diffs between revisions of a
+blueprint show only what changed.
+
+TOML blueprints get their keys in the order of the blueprint reference (name,
+description, version, packages, ..., customizations), with unknown keys sorted
+after them, arrays on a single line, arrays of tables as [[sections]] and
+strings in double quotes. JSON and YAML blueprints get their keys sorted and
+consistent indentation. Comments are lost.
+
+With --check, nothing is written. The blueprints that are not in canonical
+form are printed and the command fails if there are any, for CI.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		paths := args
+		if len(paths) == 0 {
+			paths = []string{defaultBlueprintPath}
+		}
+		var unformatted []string
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				return fmt.Errorf("error opening blueprint file %s: %w", path, err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("error opening blueprint file %s: %w", path, err)
+			}
+			formatted, err := formatBlueprint(data, path)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(data, formatted) {
+				continue
+			}
+			if fmtCheck {
+				fmt.Println(path)
+				unformatted = append(unformatted, path)
+				continue
+			}
+			if err := writeBlueprintFile(path, formatted, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		if len(unformatted) > 0 {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("%d of %d blueprints are not in canonical form, run imagecfg fmt", len(unformatted), len(paths))
+		}
+		return nil
+	},
+}
+
+func init() {
+	fmtCmd.Flags().BoolVar(&fmtCheck, "check", false, "only list the blueprints that are not in canonical form")
+	rootCmd.AddCommand(fmtCmd)
+}
+
+// formatBlueprint returns the blueprint at path, in the format of its extension, in
+// canonical form.
+func formatBlueprint(data []byte, path string) ([]byte, error) {
+	format, err := blueprintFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeDocument(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing blueprint %s: %w", path, err)
+	}
+	return encodeCanonicalDocument(doc, format)
+}
+
+// encodeCanonicalDocument encodes the decoded blueprint in the format, in canonical
+// form.
+func encodeCanonicalDocument(doc map[string]interface{}, format string) ([]byte, error) {
+	if format != "toml" {
+		return encodeDocument(doc, format)
+	}
+	var out strings.Builder
+	writeCanonicalTable(&out, doc, nil, false, []reflect.Type{
+		reflect.TypeOf(blueprint.Blueprint{}),
+		reflect.TypeOf(extensionBlueprint{}),
+	})
+	return []byte(strings.TrimPrefix(out.String(), "\n")), nil
+}
+
+// tableType returns the struct or map type the values of type t are decoded into, nil
+// if they are no tables.
+func tableType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Struct || t.Kind() == reflect.Map {
+		return t
+	}
+	return nil
+}
+
+// canonicalKeys returns the keys of the table in the order of the fields of the types
+// it is decoded into, followed by the unknown keys sorted.
+func canonicalKeys(table map[string]interface{}, types []reflect.Type) []string {
+	var keys []string
+	for _, t := range types {
+		if t.Kind() != reflect.Struct {
+			continue
+		}
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("toml"), ",")
+			if _, ok := table[name]; ok && !slices.Contains(keys, name) {
+				keys = append(keys, name)
+			}
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(table)) {
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// fieldTypes returns the types the key of a table decoded into types is decoded into.
+func fieldTypes(types []reflect.Type, key string) []reflect.Type {
+	var fields []reflect.Type
+	for _, t := range types {
+		var field reflect.Type
+		switch t.Kind() {
+		case reflect.Map:
+			field = tableType(t.Elem())
+		case reflect.Struct:
+			for i := 0; i < t.NumField(); i++ {
+				if name, _, _ := strings.Cut(t.Field(i).Tag.Get("toml"), ","); name == key {
+					field = tableType(t.Field(i).Type)
+				}
+			}
+		}
+		if field != nil {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// tomlKey quotes the key if it is not bare.
+func tomlKey(key string) string {
+	if bareKeyRegexp.MatchString(key) {
+		return key
+	}
+	return tomlValue(key)
+}
+
+// isTableArray returns whether v is written as an array of tables.
+func isTableArray(v interface{}) bool {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return false
+	}
+	for _, entry := range list {
+		if _, ok := entry.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// writeCanonicalTable writes the table at path, decoded into types, in canonical form:
+// its values first, then its tables and arrays of tables.
+func writeCanonicalTable(out *strings.Builder, table map[string]interface{}, path []string, arrayEntry bool, types []reflect.Type) {
+	var values, tables []string
+	for _, key := range canonicalKeys(table, types) {
+		if _, ok := table[key].(map[string]interface{}); ok || isTableArray(table[key]) {
+			tables = append(tables, key)
+		} else {
+			values = append(values, key)
+		}
+	}
+
+	header := make([]string, len(path))
+	for i, part := range path {
+		header[i] = tomlKey(part)
+	}
+	// Tables holding only tables are implied by their headers
+	switch {
+	case arrayEntry:
+		fmt.Fprintf(out, "\n[[%s]]\n", strings.Join(header, "."))
+	case len(path) > 0 && (len(values) > 0 || len(tables) == 0):
+		fmt.Fprintf(out, "\n[%s]\n", strings.Join(header, "."))
+	}
+	for _, key := range values {
+		fmt.Fprintf(out, "%s = %s\n", tomlKey(key), tomlValue(table[key]))
+	}
+
+	for _, key := range tables {
+		child := append(slices.Clone(path), key)
+		switch v := table[key].(type) {
+		case map[string]interface{}:
+			writeCanonicalTable(out, v, child, false, fieldTypes(types, key))
+		case []interface{}:
+			for _, entry := range v {
+				writeCanonicalTable(out, entry.(map[string]interface{}), child, true, fieldTypes(types, key))
+			}
+		}
+	}
+}
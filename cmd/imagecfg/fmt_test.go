@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const unformattedBlueprint = `
+[customizations.timezone]
+timezone = 'UTC'
+
+[customizations]
+hostname = "edge-01"
+
+[[customizations.user]]
+key = "ssh-ed25519 AAAA"
+name = 'admin'
+groups = [
+  "wheel",
+]
+
+[[packages]]
+version = "*"
+name = "vim-enhanced"
+
+[customizations."x-notes"]
+"owner team" = "edge"
+
+[[customizations.files]]
+path = "/etc/motd"
+data = """
+Welcome
+"""
+`
+
+func TestFormatBlueprintTOML(t *testing.T) {
+	formatted, err := formatBlueprint([]byte("name = \"edge\"\n"+unformattedBlueprint), "blueprint.toml")
+	require.NoError(t, err)
+	assert.Equal(t, `name = "edge"
+
+[[packages]]
+name = "vim-enhanced"
+version = "*"
+
+[customizations]
+hostname = "edge-01"
+
+[[customizations.user]]
+name = "admin"
+key = "ssh-ed25519 AAAA"
+groups = ["wheel"]
+
+[customizations.timezone]
+timezone = "UTC"
+
+[[customizations.files]]
+path = "/etc/motd"
+data = "Welcome\n"
+
+[customizations.x-notes]
+"owner team" = "edge"
+`, string(formatted))
+
+	// Formatting is stable and keeps the content
+	again, err := formatBlueprint(formatted, "blueprint.toml")
+	require.NoError(t, err)
+	assert.Equal(t, string(formatted), string(again))
+	before, err := decodeDocument([]byte(unformattedBlueprint), "toml")
+	require.NoError(t, err)
+	after, err := decodeDocument(formatted, "toml")
+	require.NoError(t, err)
+	delete(after, "name")
+	assert.Equal(t, before, after)
+}
+
+func TestFormatBlueprintNestedTables(t *testing.T) {
+	formatted, err := formatBlueprint([]byte(`
+[customizations.firewall.services]
+enabled = ["ssh"]
+
+[customizations.firewall]
+ports = ["8443/tcp"]
+
+[customizations.installer]
+`), "blueprint.toml")
+	require.NoError(t, err)
+	assert.Equal(t, `[customizations.firewall]
+ports = ["8443/tcp"]
+
+[customizations.firewall.services]
+enabled = ["ssh"]
+
+[customizations.installer]
+`, string(formatted))
+}
+
+func TestFormatBlueprintJSON(t *testing.T) {
+	formatted, err := formatBlueprint([]byte(`{"packages": [{"version": "*", "name": "vim"}], "name": "edge"}`), "blueprint.json")
+	require.NoError(t, err)
+	assert.Equal(t, `{
+  "name": "edge",
+  "packages": [
+    {
+      "name": "vim",
+      "version": "*"
+    }
+  ]
+}
+`, string(formatted))
+}
+
+func TestTOMLKey(t *testing.T) {
+	assert.Equal(t, "enabled_modules", tomlKey("enabled_modules"))
+	assert.Equal(t, `"owner team"`, tomlKey("owner team"))
+	assert.Equal(t, `"a.b"`, tomlKey("a.b"))
+}
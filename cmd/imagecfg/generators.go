@@ -2,50 +2,220 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
 
+	"github.com/BurntSushi/toml"
 	"github.com/osbuild/blueprint/pkg/blueprint"
 )
 
-// generateHostnameCmd generates the bash command for setting the hostname.
-func generateHostnameCmd(bp *blueprint.Blueprint) (string, error) {
+// generateHostnameCmd generates the bash commands for setting the hostname, its /etc/hosts
+// entry and the pretty hostname and chassis.
+func generateHostnameCmd(bp *Blueprint) (string, error) {
+	var cmds []string
+
+	hostname := bp.Customizations.GetHostname()
+	if hostname != nil && *hostname != "" {
+		cmds = append(cmds, fmt.Sprintf("echo '%s' > /etc/hostname", *hostname))
+	}
+
+	if pattern, line, err := hostsEntryLine(bp); err != nil {
+		return "", err
+	} else if line != "" {
+		cmds = append(cmds, replaceMatchingLineCmd("/etc/hosts", pattern, line))
+	}
+
+	// hostnamectl stores these in /etc/machine-info, which is written directly
+	// when systemd is not running
+	var hostnamectl, machineInfo []string
+	if pretty := bp.Extensions.GetPrettyHostname(); pretty != "" {
+		if strings.ContainsAny(pretty, "\n\r") {
+			return "", fmt.Errorf("invalid pretty hostname %q", pretty)
+		}
+		hostnamectl = append(hostnamectl, "hostnamectl set-hostname --pretty "+shellQuote(pretty))
+		machineInfo = append(machineInfo, replaceLineCmd("/etc/machine-info", "PRETTY_HOSTNAME=", "PRETTY_HOSTNAME="+strconv.Quote(pretty)))
+	}
+	if chassis := bp.Extensions.GetChassis(); chassis != "" {
+		if !slices.Contains(chassisTypes, chassis) {
+			return "", fmt.Errorf("invalid chassis %q, must be one of %s", chassis, strings.Join(chassisTypes, ", "))
+		}
+		hostnamectl = append(hostnamectl, "hostnamectl set-chassis "+chassis)
+		machineInfo = append(machineInfo, replaceLineCmd("/etc/machine-info", "CHASSIS=", "CHASSIS="+chassis))
+	}
+	if len(hostnamectl) > 0 {
+		cmds = append(cmds, fmt.Sprintf("if %s; then %s; else %s; fi", liveSystemCheck, strings.Join(hostnamectl, " && "), strings.Join(machineInfo, " && ")))
+	}
+
+	return strings.Join(cmds, " && "), nil
+}
+
+// hostsEntryLine returns the extended regular expression matching the /etc/hosts lines
+// the hosts entry of the blueprint replaces, and its line, empty if it has none. Only
+// the lines naming just the hostname, at any address, are replaced, so that the
+// localhost lines of the same address are kept.
+func hostsEntryLine(bp *Blueprint) (string, string, error) {
+	entry := bp.Extensions.GetHostsEntry()
+	if entry == nil {
+		return "", "", nil
+	}
 	hostname := bp.Customizations.GetHostname()
 	if hostname == nil || *hostname == "" {
-		return "", nil // No hostname specified
+		return "", "", fmt.Errorf("hosts_entry requires a hostname")
+	}
+	ip := entry.IP
+	if ip == "" {
+		ip = "127.0.1.1"
+	}
+	if net.ParseIP(ip) == nil {
+		return "", "", fmt.Errorf("invalid hosts_entry IP address %q", ip)
+	}
+	names := *hostname
+	pattern := `^[^#[:space:]]+[[:space:]]+` + regexpEscape(*hostname)
+	if short, _, found := strings.Cut(*hostname, "."); found {
+		names += " " + short
+		pattern += `([[:space:]]+` + regexpEscape(short) + `)?`
 	}
-	cmd := fmt.Sprintf("echo '%s' > /etc/hostname", *hostname)
-	return cmd, nil
+	return pattern + `[[:space:]]*$`, ip + " " + names, nil
 }
 
+// chassisTypes are the chassis types accepted by hostnamectl.
+var chassisTypes = []string{"desktop", "laptop", "convertible", "server", "tablet", "handset", "watch", "embedded", "vm", "container"}
+
 // generateTimezoneCmd generates bash commands for setting the timezone.
-func generateTimezoneCmd(bp *blueprint.Blueprint) (string, error) {
-	timezone, ntpservers := bp.Customizations.GetTimezoneSettings()
+// The NTP servers from the timezone customization are handled by generateChronyCmd.
+func generateTimezoneCmd(bp *Blueprint) (string, error) {
+	timezone, _ := bp.Customizations.GetTimezoneSettings()
+	if timezone == nil || *timezone == "" {
+		return "", nil // No timezone specified
+	}
 
-	var cmds []string
+	// Format for symlink: e.g., /usr/share/zoneinfo/America/New_York
+	// We need to ensure the zoneinfo file exists, but that's better handled by the image build itself.
+	return fmt.Sprintf("ln -sf /usr/share/zoneinfo/%s /etc/localtime", *timezone), nil
+}
+
+// Paths of the chrony configuration managed by imagecfg
+const (
+	chronyConfPath    = "/etc/chrony.conf"
+	chronyDir         = "/etc/chrony.d"
+	chronySourcesPath = chronyDir + "/imagecfg.sources"
+	chronyConfDropIn  = chronyDir + "/imagecfg.conf"
+)
+
+// generateChronyCmd generates bash commands for the chrony configuration. Time sources
+// are written to a managed sources file instead of being edited into chrony.conf.
+func generateChronyCmd(bp *Blueprint) (string, error) {
+	_, ntpservers := bp.Customizations.GetTimezoneSettings()
+	chrony := bp.Extensions.GetChrony()
+	if len(ntpservers) == 0 && chrony == nil {
+		return "", nil // Nothing to configure
+	}
+	if chrony == nil {
+		chrony = &ChronyCustomization{}
+	}
+
+	var sources []string
+	for _, ntp := range ntpservers {
+		// A server also in the chrony servers is configured once, with their options
+		if slices.ContainsFunc(chrony.Servers, func(src ChronySource) bool { return src.Hostname == ntp }) {
+			continue
+		}
+		sources = append(sources, fmt.Sprintf("server %s iburst", ntp))
+	}
+	for _, src := range chrony.Servers {
+		line, err := chronySourceLine("server", src)
+		if err != nil {
+			return "", err
+		}
+		sources = append(sources, line)
+	}
+	for _, src := range chrony.Pools {
+		line, err := chronySourceLine("pool", src)
+		if err != nil {
+			return "", err
+		}
+		sources = append(sources, line)
+	}
 
-	if timezone != nil && *timezone != "" {
-		// Format for symlink: e.g., /usr/share/zoneinfo/America/New_York
-		// We need to ensure the zoneinfo file exists, but that's better handled by the image build itself.
-		cmds = append(cmds, fmt.Sprintf("ln -sf /usr/share/zoneinfo/%s /etc/localtime", *timezone))
+	var directives []string
+	if chrony.Makestep != nil {
+		if chrony.Makestep.Threshold <= 0 || chrony.Makestep.Limit == 0 || chrony.Makestep.Limit < -1 {
+			return "", fmt.Errorf("invalid makestep: threshold must be positive and limit positive or -1")
+		}
+		directives = append(directives, fmt.Sprintf("makestep %g %d", chrony.Makestep.Threshold, chrony.Makestep.Limit))
+	}
+	if chrony.LeapSecMode != "" {
+		switch chrony.LeapSecMode {
+		case "system", "step", "slew", "ignore":
+		default:
+			return "", fmt.Errorf("invalid leapsecmode %q: must be system, step, slew or ignore", chrony.LeapSecMode)
+		}
+		directives = append(directives, "leapsecmode "+chrony.LeapSecMode)
 	}
 
-	if len(ntpservers) > 0 {
-		for _, ntp := range ntpservers {
-			cmds = append(cmds,
-				fmt.Sprintf("sed -i '/^server %s /d' /etc/chrony.conf", ntp),
-				fmt.Sprintf("echo 'server %s iburst' >> /etc/chrony.conf", ntp),
-			)
+	var cmds []string
+	if chrony.RemoveDefaultPools {
+		cmds = append(cmds, fmt.Sprintf("sed -i 's/^pool /#pool /' %s", chronyConfPath))
+	}
+	if len(sources) > 0 {
+		cmds = append(cmds,
+			writeFileCmd(chronySourcesPath, "# Managed by imagecfg\n"+strings.Join(sources, "\n")+"\n", 0644),
+			fmt.Sprintf("(grep -qx 'sourcedir %[1]s' %[2]s || echo 'sourcedir %[1]s' >> %[2]s)", chronyDir, chronyConfPath),
+		)
+	}
+	if len(directives) > 0 {
+		// Drop the distribution defaults of the directives we manage so that ours are the only ones
+		for _, directive := range directives {
+			name, _, _ := strings.Cut(directive, " ")
+			cmds = append(cmds, fmt.Sprintf("sed -i '/^%s /d' %s", name, chronyConfPath))
 		}
+		cmds = append(cmds,
+			writeFileCmd(chronyConfDropIn, "# Managed by imagecfg\n"+strings.Join(directives, "\n")+"\n", 0644),
+			fmt.Sprintf("(grep -qx 'confdir %[1]s' %[2]s || echo 'confdir %[1]s' >> %[2]s)", chronyDir, chronyConfPath),
+		)
 	}
+
 	return strings.Join(cmds, " && "), nil
 }
 
+// chronySourceLine formats a server or pool directive for the chrony sources file.
+func chronySourceLine(kind string, src ChronySource) (string, error) {
+	if src.Hostname == "" || strings.ContainsAny(src.Hostname, " \t\n") {
+		return "", fmt.Errorf("invalid chrony %s hostname %q", kind, src.Hostname)
+	}
+	line := kind + " " + src.Hostname
+	if src.IBurst == nil || *src.IBurst {
+		line += " iburst"
+	}
+	if src.Prefer {
+		line += " prefer"
+	}
+	return line, nil
+}
+
 // generateLocaleCmd generates bash commands for locale and keyboard settings.
-func generateLocaleCmd(bp *blueprint.Blueprint) (string, error) {
+// All languages are made available, the first one becomes the system locale.
+func generateLocaleCmd(bp *Blueprint) (string, error) {
 	locale, keyboardLayout := bp.Customizations.GetPrimaryLocale()
 
 	var cmds []string
 
+	if bp.Customizations != nil && bp.Customizations.Locale != nil {
+		installCmds, err := localeInstallCmds(bp.Customizations.Locale.Languages, bp.Extensions.GetLocale())
+		if err != nil {
+			return "", err
+		}
+		cmds = append(cmds, installCmds...)
+	}
+
 	if locale != nil && *locale != "" {
 		cmds = append(cmds, fmt.Sprintf("echo 'LANG=%s' > /etc/locale.conf", *locale))
 	}
@@ -54,6 +224,14 @@ func generateLocaleCmd(bp *blueprint.Blueprint) (string, error) {
 		cmds = append(cmds, fmt.Sprintf("echo 'KEYMAP=%s' > /etc/vconsole.conf", *keyboardLayout))
 	}
 
+	x11Cmd, err := x11KeyboardCmd(bp.Extensions.GetLocale())
+	if err != nil {
+		return "", err
+	}
+	if x11Cmd != "" {
+		cmds = append(cmds, x11Cmd)
+	}
+
 	if len(cmds) == 0 {
 		return "", nil
 	}
@@ -61,8 +239,87 @@ func generateLocaleCmd(bp *blueprint.Blueprint) (string, error) {
 	return strings.Join(cmds, " && "), nil
 }
 
+// xkbValueRegexp matches XKB layout, variant, option and model lists.
+var xkbValueRegexp = regexp.MustCompile(`^[A-Za-z0-9_,:()+-]*$`)
+
+// x11KeyboardCmd returns the command writing the X11 keyboard configuration, the same
+// file "localectl set-x11-keymap" writes, which is not available in all build environments.
+func x11KeyboardCmd(ext *LocaleCustomization) (string, error) {
+	if ext == nil || (ext.X11Layout == "" && ext.X11Variant == "" && ext.X11Options == "" && ext.X11Model == "") {
+		return "", nil
+	}
+	if ext.X11Layout == "" {
+		return "", fmt.Errorf("x11_variant, x11_options and x11_model require x11_layout")
+	}
+
+	var conf strings.Builder
+	conf.WriteString("# Managed by imagecfg\nSection \"InputClass\"\n        Identifier \"system-keyboard\"\n        MatchIsKeyboard \"on\"\n")
+	for _, option := range []struct{ name, value string }{
+		{"XkbLayout", ext.X11Layout},
+		{"XkbModel", ext.X11Model},
+		{"XkbVariant", ext.X11Variant},
+		{"XkbOptions", ext.X11Options},
+	} {
+		if option.value == "" {
+			continue
+		}
+		if !xkbValueRegexp.MatchString(option.value) {
+			return "", fmt.Errorf("invalid X11 keyboard setting %s %q", option.name, option.value)
+		}
+		fmt.Fprintf(&conf, "        Option \"%s\" \"%s\"\n", option.name, option.value)
+	}
+	conf.WriteString("EndSection\n")
+
+	return writeFileCmd("/etc/X11/xorg.conf.d/00-keyboard.conf", conf.String(), 0644), nil
+}
+
+// localeRegexp matches locale names such as en_US.UTF-8 or sr_RS@latin.
+var localeRegexp = regexp.MustCompile(`^([a-z]{2,3})(_[A-Z]{2})?(\.[A-Za-z0-9-]+)?(@[a-z]+)?$`)
+
+// localeInstallCmds returns the commands that make the given locales available,
+// either by installing their glibc langpacks or by compiling them with localedef.
+func localeInstallCmds(languages []string, ext *LocaleCustomization) ([]string, error) {
+	method := "langpack"
+	if ext != nil && ext.Generate != "" {
+		method = ext.Generate
+	}
+	if method != "langpack" && method != "localedef" {
+		return nil, fmt.Errorf("invalid locale generate method %q: must be langpack or localedef", method)
+	}
+
+	var langpacks, cmds []string
+	seen := make(map[string]bool)
+	for _, language := range languages {
+		if language == "C" || language == "POSIX" || strings.HasPrefix(language, "C.") {
+			continue // Always available
+		}
+		m := localeRegexp.FindStringSubmatch(language)
+		if m == nil {
+			return nil, fmt.Errorf("invalid locale %q: expected something like en_US.UTF-8", language)
+		}
+		if method == "langpack" {
+			if pkg := "glibc-langpack-" + m[1]; !seen[pkg] {
+				seen[pkg] = true
+				langpacks = append(langpacks, pkg)
+			}
+			continue
+		}
+		charmap := "UTF-8"
+		if m[3] != "" {
+			charmap = m[3][1:]
+		}
+		input := m[1] + m[2] + m[4]
+		cmds = append(cmds, fmt.Sprintf("localedef -i %s -f %s %s", input, charmap, language))
+	}
+	if len(langpacks) > 0 {
+		pkgs := strings.Join(langpacks, " ")
+		cmds = append(cmds, fmt.Sprintf("(rpm -q %[1]s >/dev/null || dnf install -y %[1]s)", pkgs))
+	}
+	return cmds, nil
+}
+
 // generateGroupsBlockCmd generates a block of bash commands for creating groups.
-func generateGroupsBlockCmd(bp *blueprint.Blueprint) (string, error) {
+func generateGroupsBlockCmd(bp *Blueprint) (string, error) {
 	groups := bp.Customizations.GetGroups()
 	if len(groups) == 0 {
 		return "", nil
@@ -82,7 +339,7 @@ func generateGroupsBlockCmd(bp *blueprint.Blueprint) (string, error) {
 }
 
 // generateUsersBlockCmd generates a block of bash commands for creating/configuring users.
-func generateUsersBlockCmd(bp *blueprint.Blueprint) (string, error) {
+func generateUsersBlockCmd(bp *Blueprint) (string, error) {
 	users := bp.Customizations.GetUsers()
 	if len(users) == 0 {
 		return "", nil
@@ -113,26 +370,13 @@ func generateUsersBlockCmd(bp *blueprint.Blueprint) (string, error) {
 		singleUserCmds = append(singleUserCmds, fmt.Sprintf("(getent passwd %s > /dev/null || %s)", user.Name, useraddFullCmd))
 
 		// --- Secondary Groups ---
-		if len(user.Groups) > 0 {
-			singleUserCmds = append(singleUserCmds, fmt.Sprintf("usermod -aG %s %s", strings.Join(user.Groups, ","), user.Name))
-		}
-
-		// --- Password ---
-		if user.Password != nil && *user.Password != "" {
-			singleUserCmds = append(singleUserCmds, fmt.Sprintf("echo '%s:%s' | chpasswd -e", user.Name, *user.Password))
+		// usermod rewrites /etc/group even when nothing changes, so each group is only
+		// added once the user is not in it
+		for _, group := range user.Groups {
+			singleUserCmds = append(singleUserCmds, fmt.Sprintf("(%s || usermod -aG %s %s)", inGroupCheck(user.Name, group), group, user.Name))
 		}
 
-		// --- SSH Key ---
-		if user.Key != nil && *user.Key != "" {
-			homeDir := "/home/" + user.Name // Default home directory
-			if user.Home != nil && *user.Home != "" {
-				homeDir = *user.Home // Use specified home directory
-			}
-			// Ensure correct permissions and ownership for SSH key
-			sshCmd := fmt.Sprintf("mkdir -p %s/.ssh && echo '%s' | tee %s/.ssh/authorized_keys > /dev/null && chmod 700 %s/.ssh && chmod 600 %s/.ssh/authorized_keys && chown -R %s:%s %s/.ssh",
-				homeDir, *user.Key, homeDir, homeDir, homeDir, user.Name, user.Name, homeDir) // Assumes primary group name is same as user name for chown
-			singleUserCmds = append(singleUserCmds, sshCmd)
-		}
+		singleUserCmds = append(singleUserCmds, userCredentialCmds(user)...)
 
 		// Join all commands for this single user with '&&'
 		userBlockLines = append(userBlockLines, strings.Join(singleUserCmds, " && "))
@@ -141,8 +385,50 @@ func generateUsersBlockCmd(bp *blueprint.Blueprint) (string, error) {
 	return strings.Join(userBlockLines, "\n"), nil
 }
 
+// userCredentialCmds generates the commands setting the password and SSH key of an existing user.
+func userCredentialCmds(user blueprint.UserCustomization) []string {
+	var cmds []string
+
+	// --- Password ---
+	// chpasswd also resets the date of the last password change, so it only runs
+	// when the hash differs
+	if user.Password != nil && *user.Password != "" {
+		cmds = append(cmds, fmt.Sprintf("(%s || echo '%s:%s' | chpasswd -e)", passwordCheck(user.Name, "'"+*user.Password+"'"), user.Name, *user.Password))
+	}
+
+	// --- SSH Key ---
+	if user.Key != nil && len(authorizedKeys(*user.Key)) > 0 {
+		homeDir := "/home/" + user.Name // Default home directory
+		if user.Home != nil && *user.Home != "" {
+			homeDir = *user.Home // Use specified home directory
+		}
+		// Ensure correct permissions and ownership for SSH key
+		// Each key is added to authorized_keys unless it is there, keeping the other keys.
+		// "user:" is the login group of the user, whatever its name.
+		sshCmds := []string{fmt.Sprintf("mkdir -p %s/.ssh", homeDir)}
+		for _, key := range authorizedKeys(*user.Key) {
+			sshCmds = append(sshCmds, appendLineCmd(homeDir+"/.ssh/authorized_keys", key))
+		}
+		sshCmds = append(sshCmds, fmt.Sprintf("chmod 700 %s/.ssh && chmod 600 %s/.ssh/authorized_keys && chown -R %s: %s/.ssh",
+			homeDir, homeDir, user.Name, homeDir))
+		cmds = append(cmds, strings.Join(sshCmds, " && "))
+	}
+	return cmds
+}
+
+// authorizedKeys returns the SSH keys of the key of a user, which has one per line.
+func authorizedKeys(key string) []string {
+	var keys []string
+	for _, k := range strings.Split(key, "\n") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
 // generateFirewallCmd generates bash commands for firewall configuration.
-func generateFirewallCmd(bp *blueprint.Blueprint) (string, error) {
+func generateFirewallCmd(bp *Blueprint) (string, error) {
 	fwCustom := bp.Customizations.GetFirewall()
 	if fwCustom == nil {
 		return "", nil // No firewall customization
@@ -176,7 +462,7 @@ func generateFirewallCmd(bp *blueprint.Blueprint) (string, error) {
 }
 
 // generateServicesCmd generates bash commands for enabling/disabling/masking system services.
-func generateServicesCmd(bp *blueprint.Blueprint) (string, error) {
+func generateServicesCmd(bp *Blueprint) (string, error) {
 	svcCustom := bp.Customizations.GetServices()
 	if svcCustom == nil {
 		return "", nil // No service customization
@@ -206,11 +492,1549 @@ func generateServicesCmd(bp *blueprint.Blueprint) (string, error) {
 	return strings.Join(serviceManagementCmds, " && "), nil
 }
 
+// targetNameRegexp matches systemd target names, with or without the ".target" suffix.
+var targetNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9:_.\\@-]+$`)
+
+// generateDefaultTargetCmd generates the bash command for setting the default systemd target.
+func generateDefaultTargetCmd(bp *Blueprint) (string, error) {
+	target := bp.Extensions.GetDefaultTarget()
+	if target == "" {
+		return "", nil // No default target specified
+	}
+	if !targetNameRegexp.MatchString(target) {
+		return "", fmt.Errorf("invalid default target %q", target)
+	}
+	if !strings.HasSuffix(target, ".target") {
+		target += ".target"
+	}
+	return fmt.Sprintf("systemctl set-default %s", target), nil
+}
+
 // generatePackagesCmd generates the bash command for installing packages.
-func generatePackagesCmd(bp *blueprint.Blueprint) (string, error) {
+func generatePackagesCmd(bp *Blueprint) (string, error) {
 	packages := bp.GetPackages() // This method correctly gets all packages (from 'packages' and 'modules')
 	if len(packages) == 0 {
 		return "", nil // No packages to install
 	}
 	return fmt.Sprintf("dnf install -y %s", strings.Join(packages, " ")), nil
 }
+
+// generateProxyCmd generates bash commands for the system-wide proxy configuration.
+func generateProxyCmd(bp *Blueprint) (string, error) {
+	proxy := bp.Extensions.GetProxy()
+	if proxy == nil {
+		return "", nil // No proxy customization
+	}
+	if proxy.HTTP == "" && proxy.HTTPS == "" {
+		return "", fmt.Errorf("proxy customization requires an http or https proxy")
+	}
+	for _, proxyURL := range []string{proxy.HTTP, proxy.HTTPS} {
+		if err := validateProxyURL(proxyURL); err != nil {
+			return "", err
+		}
+	}
+	for _, host := range proxy.NoProxy {
+		if host == "" || strings.ContainsAny(host, " \t\n,") {
+			return "", fmt.Errorf("invalid no_proxy entry %q", host)
+		}
+	}
+
+	// Both spellings are set, tools disagree on which one they read
+	var env []string
+	if proxy.HTTP != "" {
+		env = append(env, "http_proxy="+proxy.HTTP, "HTTP_PROXY="+proxy.HTTP)
+	}
+	if proxy.HTTPS != "" {
+		env = append(env, "https_proxy="+proxy.HTTPS, "HTTPS_PROXY="+proxy.HTTPS)
+	}
+	if len(proxy.NoProxy) > 0 {
+		noProxy := strings.Join(proxy.NoProxy, ",")
+		env = append(env, "no_proxy="+noProxy, "NO_PROXY="+noProxy)
+	}
+
+	var cmds []string
+
+	// --- /etc/environment ---
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		cmds = append(cmds, replaceLineCmd("/etc/environment", key+"=", kv))
+	}
+
+	// --- dnf ---
+	// dnf has a single proxy option; repositories are usually served over https
+	dnfProxy := proxy.HTTPS
+	if dnfProxy == "" {
+		dnfProxy = proxy.HTTP
+	}
+	cmds = append(cmds,
+		"([ -f /etc/dnf/dnf.conf ] || printf '[main]\\n' > /etc/dnf/dnf.conf)",
+		"sed -i '/^proxy=/d' /etc/dnf/dnf.conf",
+		fmt.Sprintf("sed -i %s /etc/dnf/dnf.conf", shellQuote(`/^\[main\]/a proxy=`+dnfProxy)),
+	)
+
+	// --- systemd units ---
+	if len(proxy.Units) > 0 {
+		var dropIn strings.Builder
+		dropIn.WriteString("[Service]\n")
+		for _, kv := range env {
+			fmt.Fprintf(&dropIn, "Environment=\"%s\"\n", kv)
+		}
+		for _, unit := range proxy.Units {
+			if !strings.Contains(unit, ".") || strings.ContainsAny(unit, "/ \t\n") {
+				return "", fmt.Errorf("invalid unit name %q in proxy customization", unit)
+			}
+			path := fmt.Sprintf("/etc/systemd/system/%s.d/10-imagecfg-proxy.conf", unit)
+			cmds = append(cmds, writeFileCmd(path, dropIn.String(), 0644))
+		}
+	}
+
+	return strings.Join(cmds, " && "), nil
+}
+
+// validateProxyURL checks that proxyURL is empty or a usable proxy URL.
+func validateProxyURL(proxyURL string) error {
+	if proxyURL == "" {
+		return nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL %q: %w", proxyURL, err)
+	}
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+		return fmt.Errorf("invalid proxy URL %q: expected http://, https:// or socks5://host[:port]", proxyURL)
+	}
+	return nil
+}
+
+// sshdDropInPath is the sshd drop-in managed by imagecfg. sshd uses the first
+// value it reads for an option, so it sorts before the distribution drop-ins.
+const sshdDropInPath = "/etc/ssh/sshd_config.d/40-imagecfg.conf"
+
+// generateSSHDCmd generates bash commands for writing and validating an sshd drop-in.
+func generateSSHDCmd(bp *Blueprint) (string, error) {
+	sshd := bp.Extensions.GetSSHD()
+	if sshd == nil {
+		return "", nil // No sshd customization
+	}
+
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+
+	var lines []string
+	if sshd.PermitRootLogin != nil {
+		switch *sshd.PermitRootLogin {
+		case "yes", "no", "prohibit-password", "forced-commands-only":
+		default:
+			return "", fmt.Errorf("invalid permit_root_login %q: must be yes, no, prohibit-password or forced-commands-only", *sshd.PermitRootLogin)
+		}
+		lines = append(lines, "PermitRootLogin "+*sshd.PermitRootLogin)
+	}
+	if sshd.PasswordAuthentication != nil {
+		lines = append(lines, "PasswordAuthentication "+yesNo(*sshd.PasswordAuthentication))
+	}
+	if sshd.PubkeyAuthentication != nil {
+		lines = append(lines, "PubkeyAuthentication "+yesNo(*sshd.PubkeyAuthentication))
+	}
+	for _, port := range sshd.Ports {
+		if port < 1 || port > 65535 {
+			return "", fmt.Errorf("invalid sshd port %d", port)
+		}
+		lines = append(lines, fmt.Sprintf("Port %d", port))
+	}
+	var optionKeys []string
+	for key := range sshd.Options {
+		optionKeys = append(optionKeys, key)
+	}
+	sort.Strings(optionKeys)
+	for _, key := range optionKeys {
+		value := sshd.Options[key]
+		if !isAlnum(key) {
+			return "", fmt.Errorf("invalid sshd option name %q", key)
+		}
+		if value == "" || strings.ContainsAny(value, "\n\r") {
+			return "", fmt.Errorf("invalid value %q for sshd option %s", value, key)
+		}
+		lines = append(lines, key+" "+value)
+	}
+
+	if len(lines) == 0 {
+		return "", nil // Nothing to configure
+	}
+
+	// Put the drop-in in place, keeping the previous one under a name sshd doesn't include,
+	// and validate the main configuration, which includes it with the other drop-ins. If it
+	// is invalid, the previous drop-in is restored. "sshd -t" also checks the host keys,
+	// which are usually generated on first boot, so fall back to "sshd -G" which only parses
+	// the configuration.
+	staged := sshdDropInPath + ".new"
+	previous := sshdDropInPath + ".old"
+	content := "# Managed by imagecfg\n" + strings.Join(lines, "\n") + "\n"
+	validate := "if [ -e /etc/ssh/ssh_host_ed25519_key ] || [ -e /etc/ssh/ssh_host_rsa_key ]; then sshd -t; else sshd -G > /dev/null; fi"
+	restore := fmt.Sprintf("if [ -e %[1]s ]; then mv -f %[1]s %[2]s; else rm -f %[2]s; fi", previous, sshdDropInPath)
+	cmds := []string{
+		writeFileCmd(staged, content, 0600),
+		fmt.Sprintf("rm -f %s", previous),
+		fmt.Sprintf("if [ -e %[1]s ]; then mv -f %[1]s %[2]s; fi", sshdDropInPath, previous),
+		fmt.Sprintf("mv -f %s %s", staged, sshdDropInPath),
+		fmt.Sprintf("(%s || { %s; exit 1; })", validate, restore),
+		fmt.Sprintf("rm -f %s", previous),
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// isAlnum reports whether s is a non-empty string of ASCII letters and digits.
+func isAlnum(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// journaldSizeRegexp matches the size values accepted by journald.conf.
+var journaldSizeRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[KMGTPE]?$`)
+
+// generateJournaldCmd generates the bash command for writing a journald drop-in.
+func generateJournaldCmd(bp *Blueprint) (string, error) {
+	journald := bp.Extensions.GetJournald()
+	if journald == nil {
+		return "", nil // No journald customization
+	}
+
+	var lines []string
+	if journald.Storage != "" {
+		switch journald.Storage {
+		case "volatile", "persistent", "auto", "none":
+		default:
+			return "", fmt.Errorf("invalid journald storage %q: must be volatile, persistent, auto or none", journald.Storage)
+		}
+		lines = append(lines, "Storage="+journald.Storage)
+	}
+	for _, size := range []struct{ key, value string }{
+		{"SystemMaxUse", journald.SystemMaxUse},
+		{"RuntimeMaxUse", journald.RuntimeMaxUse},
+	} {
+		if size.value == "" {
+			continue
+		}
+		if !journaldSizeRegexp.MatchString(size.value) {
+			return "", fmt.Errorf("invalid journald %s %q: expected a size such as 100M", size.key, size.value)
+		}
+		lines = append(lines, size.key+"="+size.value)
+	}
+	if journald.ForwardToSyslog != nil {
+		lines = append(lines, fmt.Sprintf("ForwardToSyslog=%t", *journald.ForwardToSyslog))
+	}
+
+	if len(lines) == 0 {
+		return "", nil // Nothing to configure
+	}
+
+	content := "# Managed by imagecfg\n[Journal]\n" + strings.Join(lines, "\n") + "\n"
+	return writeFileCmd("/etc/systemd/journald.conf.d/50-imagecfg.conf", content, 0644), nil
+}
+
+// taskNameRegexp matches names usable both as cron.d file names and unit names.
+var taskNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// isValidUserName returns whether name can be written as a user into cron.d entries
+// and unit files: without whitespace, control characters or '=', which would change
+// the entry or add directives.
+func isValidUserName(name string) bool {
+	return name != "" && !strings.ContainsFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || r == '='
+	})
+}
+
+// generateScheduledTasksCmd generates bash commands for installing cron.d entries
+// and systemd service+timer pairs.
+func generateScheduledTasksCmd(bp *Blueprint) (string, error) {
+	tasks := bp.Extensions.GetScheduledTasks()
+	if len(tasks) == 0 {
+		return "", nil
+	}
+
+	var cmds []string
+	needsCron := false
+	for _, task := range tasks {
+		if !taskNameRegexp.MatchString(task.Name) {
+			return "", fmt.Errorf("invalid scheduled task name %q: only letters, digits, '-' and '_' are allowed", task.Name)
+		}
+		if task.Command == "" || strings.ContainsAny(task.Command, "\n\r") {
+			return "", fmt.Errorf("scheduled task %s needs a single-line command", task.Name)
+		}
+		if (task.Schedule == "") == (task.OnCalendar == "") {
+			return "", fmt.Errorf("scheduled task %s needs exactly one of schedule or on_calendar", task.Name)
+		}
+		user := task.User
+		if user == "" {
+			user = "root"
+		}
+		if !isValidUserName(user) {
+			return "", fmt.Errorf("invalid user %q in scheduled task %s", user, task.Name)
+		}
+
+		if task.Schedule != "" {
+			if err := validateCronSchedule(task.Schedule); err != nil {
+				return "", fmt.Errorf("scheduled task %s: %w", task.Name, err)
+			}
+			needsCron = true
+			// cron turns unescaped '%' into newlines
+			entry := fmt.Sprintf("# Managed by imagecfg\n%s %s %s\n", task.Schedule, user, strings.ReplaceAll(task.Command, "%", `\%`))
+			cmds = append(cmds, writeFileCmd("/etc/cron.d/"+task.Name, entry, 0644))
+			continue
+		}
+
+		if strings.ContainsAny(task.OnCalendar, "\n\r") {
+			return "", fmt.Errorf("scheduled task %s has an invalid on_calendar", task.Name)
+		}
+		service := fmt.Sprintf("# Managed by imagecfg\n[Unit]\nDescription=Scheduled task %[1]s\n\n[Service]\nType=oneshot\nUser=%[2]s\nExecStart=/bin/sh -c %[3]s\n",
+			task.Name, user, systemdQuote(task.Command))
+		timer := fmt.Sprintf("# Managed by imagecfg\n[Unit]\nDescription=Timer for scheduled task %[1]s\n\n[Timer]\nOnCalendar=%[2]s\nPersistent=%[3]t\n\n[Install]\nWantedBy=timers.target\n",
+			task.Name, task.OnCalendar, task.Persistent)
+		cmds = append(cmds,
+			writeFileCmd("/etc/systemd/system/"+task.Name+".service", service, 0644),
+			writeFileCmd("/etc/systemd/system/"+task.Name+".timer", timer, 0644),
+			fmt.Sprintf("systemctl enable %s.timer", task.Name),
+		)
+	}
+
+	if needsCron {
+		// Like firewalld, the cron daemon is installed on demand
+		cmds = append([]string{"(rpm -q cronie >/dev/null || dnf install -y cronie)"}, cmds...)
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// validateCronSchedule checks that schedule is a five-field cron expression or a
+// supported @ shortcut.
+func validateCronSchedule(schedule string) error {
+	if strings.HasPrefix(schedule, "@") {
+		switch schedule {
+		case "@reboot", "@yearly", "@annually", "@monthly", "@weekly", "@daily", "@hourly":
+			return nil
+		}
+		return fmt.Errorf("unknown cron shortcut %q", schedule)
+	}
+	fields := strings.Fields(schedule)
+	if len(fields) != 5 {
+		return fmt.Errorf("invalid cron schedule %q: expected 5 fields", schedule)
+	}
+	for _, field := range fields {
+		if strings.Trim(field, "0123456789*/,-abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return fmt.Errorf("invalid cron schedule %q: unexpected characters in %q", schedule, field)
+		}
+	}
+	return nil
+}
+
+// envNameRegexp matches valid environment variable names.
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// generateEnvironmentCmd generates bash commands for system-wide environment variables.
+// They are written to /etc/environment (read by pam_env) and to a profile.d script
+// for login shells.
+func generateEnvironmentCmd(bp *Blueprint) (string, error) {
+	names, lines, profile, err := environmentSettings(bp)
+	if err != nil || len(names) == 0 {
+		return "", err
+	}
+	var cmds []string
+	for i, name := range names {
+		cmds = append(cmds, replaceLineCmd("/etc/environment", name+"=", lines[i]))
+	}
+	cmds = append(cmds, writeFileCmd(environmentProfilePath, profile, 0644))
+
+	return strings.Join(cmds, " && "), nil
+}
+
+// environmentProfilePath is the profile.d script exporting the environment in shells
+const environmentProfilePath = "/etc/profile.d/imagecfg-environment.sh"
+
+// environmentSettings returns the sorted names of the environment variables of the
+// blueprint, their lines in /etc/environment and the profile.d script exporting them.
+func environmentSettings(bp *Blueprint) ([]string, []string, string, error) {
+	environment := bp.Extensions.GetEnvironment()
+	if len(environment) == 0 {
+		return nil, nil, "", nil
+	}
+
+	var names []string
+	for name := range environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	var profile strings.Builder
+	profile.WriteString("# Managed by imagecfg\n")
+	for _, name := range names {
+		value := environment[name]
+		if !envNameRegexp.MatchString(name) {
+			return nil, nil, "", fmt.Errorf("invalid environment variable name %q", name)
+		}
+		// pam_env has no escaping, so only plain double quoting is possible there
+		if strings.ContainsAny(value, "\"\n\r") {
+			return nil, nil, "", fmt.Errorf("value of environment variable %s must not contain double quotes or newlines", name)
+		}
+		envValue := value
+		if value == "" || strings.ContainsAny(value, " \t'\\#$") {
+			envValue = `"` + value + `"`
+		}
+		lines = append(lines, name+"="+envValue)
+		fmt.Fprintf(&profile, "export %s=%s\n", name, shellQuote(value))
+	}
+	return names, lines, profile.String(), nil
+}
+
+// generatePasswordPolicyCmd generates bash commands for the password quality and aging policy.
+func generatePasswordPolicyCmd(bp *Blueprint) (string, error) {
+	policy := bp.Extensions.GetPasswordPolicy()
+	if policy == nil {
+		return "", nil // No password policy customization
+	}
+
+	var cmds []string
+
+	// --- pwquality ---
+	var quality []string
+	for _, setting := range []struct {
+		key   string
+		value *int
+	}{
+		{"minlen", policy.MinLen},
+		{"minclass", policy.MinClass},
+		{"dcredit", policy.DCredit},
+		{"ucredit", policy.UCredit},
+		{"lcredit", policy.LCredit},
+		{"ocredit", policy.OCredit},
+		{"maxrepeat", policy.MaxRepeat},
+	} {
+		if setting.value != nil {
+			quality = append(quality, fmt.Sprintf("%s = %d", setting.key, *setting.value))
+		}
+	}
+	if policy.MinLen != nil && *policy.MinLen < 6 {
+		return "", fmt.Errorf("invalid password policy minlen %d: pwquality requires at least 6", *policy.MinLen)
+	}
+	if policy.MinClass != nil && (*policy.MinClass < 0 || *policy.MinClass > 4) {
+		return "", fmt.Errorf("invalid password policy minclass %d: must be between 0 and 4", *policy.MinClass)
+	}
+	if len(quality) > 0 {
+		content := "# Managed by imagecfg\n" + strings.Join(quality, "\n") + "\n"
+		cmds = append(cmds, writeFileCmd("/etc/security/pwquality.conf.d/50-imagecfg.conf", content, 0644))
+	}
+
+	// --- login.defs ---
+	for _, setting := range []struct {
+		key   string
+		value *int
+	}{
+		{"PASS_MAX_DAYS", policy.MaxDays},
+		{"PASS_MIN_DAYS", policy.MinDays},
+		{"PASS_WARN_AGE", policy.WarnAge},
+	} {
+		if setting.value == nil {
+			continue
+		}
+		if *setting.value < 0 {
+			return "", fmt.Errorf("invalid password policy %s %d: must not be negative", setting.key, *setting.value)
+		}
+		cmds = append(cmds, replaceLineCmd("/etc/login.defs", setting.key, fmt.Sprintf("%s\t%d", setting.key, *setting.value)))
+	}
+
+	return strings.Join(cmds, " && "), nil
+}
+
+// generateSudoersCmd generates bash commands for installing sudoers drop-ins.
+// Every drop-in is checked with visudo before it is put in place.
+func generateSudoersCmd(bp *Blueprint) (string, error) {
+	sudoers := bp.Extensions.GetSudoers()
+	if len(sudoers) == 0 {
+		return "", nil
+	}
+
+	var cmds []string
+	for _, sudo := range sudoers {
+		// sudo skips files in sudoers.d containing a '.', so the names are restricted
+		if !taskNameRegexp.MatchString(sudo.Name) {
+			return "", fmt.Errorf("invalid sudoers name %q: only letters, digits, '-' and '_' are allowed", sudo.Name)
+		}
+		principals := append([]string{}, sudo.Users...)
+		for _, group := range sudo.Groups {
+			principals = append(principals, "%"+group)
+		}
+		if len(principals) == 0 {
+			return "", fmt.Errorf("sudoers %s needs at least one user or group", sudo.Name)
+		}
+		for _, principal := range principals {
+			if strings.ContainsAny(principal, " \t\n,:=()") {
+				return "", fmt.Errorf("invalid user or group %q in sudoers %s", principal, sudo.Name)
+			}
+		}
+		runAs := sudo.RunAs
+		if runAs == "" {
+			runAs = "ALL"
+		}
+		commands := sudo.Commands
+		if len(commands) == 0 {
+			commands = []string{"ALL"}
+		}
+		for _, command := range append([]string{runAs}, commands...) {
+			if strings.ContainsAny(command, "\n\r,") {
+				return "", fmt.Errorf("invalid command or run_as %q in sudoers %s", command, sudo.Name)
+			}
+		}
+		tag := ""
+		if sudo.NoPasswd {
+			tag = "NOPASSWD: "
+		}
+
+		var content strings.Builder
+		content.WriteString("# Managed by imagecfg\n")
+		for _, principal := range principals {
+			fmt.Fprintf(&content, "%s ALL=(%s) %s%s\n", principal, runAs, tag, strings.Join(commands, ", "))
+		}
+
+		// The staged name contains a '.', so sudo ignores it even if the check fails
+		path := "/etc/sudoers.d/" + sudo.Name
+		staged := path + ".new"
+		cmds = append(cmds,
+			writeFileCmd(staged, content.String(), 0440),
+			fmt.Sprintf("(visudo -c -q -f %[1]s || { rm -f %[1]s; exit 1; })", staged),
+			fmt.Sprintf("mv -f %s %s", staged, path),
+		)
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// generatePolkitRulesCmd generates bash commands for installing polkit rules files.
+func generatePolkitRulesCmd(bp *Blueprint) (string, error) {
+	rules := bp.Extensions.GetPolkitRules()
+	if len(rules) == 0 {
+		return "", nil
+	}
+
+	var cmds []string
+	for _, rule := range rules {
+		if !taskNameRegexp.MatchString(rule.Name) {
+			return "", fmt.Errorf("invalid polkit rule name %q: only letters, digits, '-' and '_' are allowed", rule.Name)
+		}
+		if !strings.Contains(rule.Content, "polkit.addRule") && !strings.Contains(rule.Content, "polkit.addAdminRule") {
+			return "", fmt.Errorf("polkit rule %s neither calls polkit.addRule nor polkit.addAdminRule", rule.Name)
+		}
+		if err := checkJavaScriptSyntax(rule.Content); err != nil {
+			return "", fmt.Errorf("polkit rule %s: %w", rule.Name, err)
+		}
+		content := rule.Content
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		cmds = append(cmds, writeFileCmd("/etc/polkit-1/rules.d/"+rule.Name+".rules", content, 0644))
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// checkJavaScriptSyntax is a sanity check of JavaScript source: brackets must be
+// balanced and strings and comments terminated. It is not a parser, regular
+// expression literals containing brackets are not understood.
+func checkJavaScriptSyntax(src string) error {
+	closing := map[rune]rune{')': '(', ']': '[', '}': '{'}
+	var stack []rune
+	line := 1
+	runes := []rune(src)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\n':
+			line++
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '/':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			line++
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			start := line
+			for i += 2; i < len(runes) && !(runes[i] == '*' && i+1 < len(runes) && runes[i+1] == '/'); i++ {
+				if runes[i] == '\n' {
+					line++
+				}
+			}
+			if i >= len(runes) {
+				return fmt.Errorf("unterminated comment starting on line %d", start)
+			}
+			i++
+		case r == '"' || r == '\'' || r == '`':
+			start := line
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' {
+					i++
+				} else if runes[i] == '\n' {
+					if r != '`' {
+						return fmt.Errorf("unterminated string on line %d", start)
+					}
+					line++
+				}
+			}
+			if i >= len(runes) {
+				return fmt.Errorf("unterminated string starting on line %d", start)
+			}
+		case r == '(' || r == '[' || r == '{':
+			stack = append(stack, r)
+		case closing[r] != 0:
+			if len(stack) == 0 || stack[len(stack)-1] != closing[r] {
+				return fmt.Errorf("unbalanced %q on line %d", r, line)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("unclosed %q at end of input", stack[len(stack)-1])
+	}
+	return nil
+}
+
+// registriesConf is the subset of the containers-registries.conf(5) v2 format
+// written by imagecfg.
+type registriesConf struct {
+	UnqualifiedSearchRegistries []string                 `toml:"unqualified-search-registries,omitempty"`
+	Registries                  []registriesConfRegistry `toml:"registry,omitempty"`
+}
+
+type registriesConfRegistry struct {
+	Location string `toml:"location"`
+	Blocked  bool   `toml:"blocked,omitempty"`
+	Insecure bool   `toml:"insecure,omitempty"`
+}
+
+// generateContainerRegistriesCmd generates the bash command for writing a registries.conf drop-in.
+func generateContainerRegistriesCmd(bp *Blueprint) (string, error) {
+	registries := bp.Extensions.GetContainerRegistries()
+	if registries == nil {
+		return "", nil // No container registries customization
+	}
+
+	all := append(append(append([]string{}, registries.UnqualifiedSearch...), registries.Blocked...), registries.Insecure...)
+	for _, location := range all {
+		if location == "" || strings.Contains(location, "://") || strings.ContainsAny(location, " \t\n\"") {
+			return "", fmt.Errorf("invalid container registry %q: expected a host[:port][/namespace] without scheme", location)
+		}
+	}
+
+	conf := registriesConf{UnqualifiedSearchRegistries: registries.UnqualifiedSearch}
+	// A registry that is both blocked and insecure gets a single entry
+	index := make(map[string]int)
+	entry := func(location string) *registriesConfRegistry {
+		if i, ok := index[location]; ok {
+			return &conf.Registries[i]
+		}
+		index[location] = len(conf.Registries)
+		conf.Registries = append(conf.Registries, registriesConfRegistry{Location: location})
+		return &conf.Registries[len(conf.Registries)-1]
+	}
+	for _, location := range registries.Blocked {
+		entry(location).Blocked = true
+	}
+	for _, location := range registries.Insecure {
+		entry(location).Insecure = true
+	}
+
+	if len(conf.UnqualifiedSearchRegistries) == 0 && len(conf.Registries) == 0 {
+		return "", nil // Nothing to configure
+	}
+
+	var content strings.Builder
+	content.WriteString("# Managed by imagecfg\n")
+	if err := toml.NewEncoder(&content).Encode(conf); err != nil {
+		return "", fmt.Errorf("error encoding registries.conf: %w", err)
+	}
+	return writeFileCmd("/etc/containers/registries.conf.d/50-imagecfg.conf", content.String(), 0644), nil
+}
+
+// generateFlatpakCmd generates bash commands for adding Flatpak remotes and installing refs.
+func generateFlatpakCmd(bp *Blueprint) (string, error) {
+	flatpak := bp.Extensions.GetFlatpak()
+	if flatpak == nil || (len(flatpak.Remotes) == 0 && len(flatpak.Refs) == 0) {
+		return "", nil // No flatpak customization
+	}
+
+	cmds := []string{"(command -v flatpak >/dev/null || dnf install -y flatpak)"}
+	for _, remote := range flatpak.Remotes {
+		if remote.Name == "" || strings.ContainsAny(remote.Name, " \t\n/") {
+			return "", fmt.Errorf("invalid flatpak remote name %q", remote.Name)
+		}
+		if u, err := url.Parse(remote.URL); err != nil || u.Scheme == "" {
+			return "", fmt.Errorf("invalid URL %q for flatpak remote %s", remote.URL, remote.Name)
+		}
+		cmds = append(cmds, fmt.Sprintf("flatpak remote-add --system --if-not-exists %s %s", shellQuote(remote.Name), shellQuote(remote.URL)))
+	}
+
+	// One install per remote, in the order the remotes first appear
+	var remotes []string
+	refsByRemote := make(map[string][]string)
+	for _, ref := range flatpak.Refs {
+		if ref.Remote == "" || ref.Ref == "" || strings.ContainsAny(ref.Remote+ref.Ref, " \t\n") {
+			return "", fmt.Errorf("invalid flatpak ref %q from remote %q", ref.Ref, ref.Remote)
+		}
+		if _, ok := refsByRemote[ref.Remote]; !ok {
+			remotes = append(remotes, ref.Remote)
+		}
+		refsByRemote[ref.Remote] = append(refsByRemote[ref.Remote], shellQuote(ref.Ref))
+	}
+	for _, remote := range remotes {
+		cmds = append(cmds, fmt.Sprintf("flatpak install --system -y --noninteractive %s %s", shellQuote(remote), strings.Join(refsByRemote[remote], " ")))
+	}
+
+	return strings.Join(cmds, " && "), nil
+}
+
+// generatePipCmd generates bash commands for installing Python packages with pip.
+// It runs after the RPM packages, so python3 can come from the blueprint.
+func generatePipCmd(bp *Blueprint) (string, error) {
+	pip := bp.Extensions.GetPip()
+	if pip == nil || len(pip.Packages) == 0 {
+		return "", nil // No pip packages
+	}
+
+	var packages []string
+	for _, pkg := range pip.Packages {
+		if pkg == "" || strings.HasPrefix(pkg, "-") || strings.ContainsAny(pkg, " \t\n") {
+			return "", fmt.Errorf("invalid pip package %q", pkg)
+		}
+		packages = append(packages, shellQuote(pkg))
+	}
+
+	var cmds []string
+	python := "python3"
+	if pip.Venv != "" {
+		if !filepath.IsAbs(pip.Venv) {
+			return "", fmt.Errorf("pip venv path %q must be absolute", pip.Venv)
+		}
+		python = shellQuote(filepath.Join(pip.Venv, "bin", "python"))
+		cmds = append(cmds, fmt.Sprintf("([ -x %s ] || python3 -m venv %s)", python, shellQuote(pip.Venv)))
+	} else {
+		cmds = append(cmds, "(python3 -m pip --version >/dev/null 2>&1 || dnf install -y python3-pip)")
+	}
+	cmds = append(cmds, fmt.Sprintf("%s -m pip install --no-cache-dir %s", python, strings.Join(packages, " ")))
+
+	return strings.Join(cmds, " && "), nil
+}
+
+var (
+	dconfPathRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)*$`)
+	dconfKeyRegexp  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// generateDConfCmd generates bash commands for dconf defaults and locks in the
+// "local" system database.
+func generateDConfCmd(bp *Blueprint) (string, error) {
+	settings := bp.Extensions.GetDConf()
+	if len(settings) == 0 {
+		return "", nil
+	}
+
+	// Group keys by path, keeping the order in which the paths appear
+	var paths []string
+	keysByPath := make(map[string][]string)
+	var locks []string
+	for _, setting := range settings {
+		if !dconfPathRegexp.MatchString(setting.Path) {
+			return "", fmt.Errorf("invalid dconf path %q: expected something like org/gnome/desktop/session", setting.Path)
+		}
+		if !dconfKeyRegexp.MatchString(setting.Key) {
+			return "", fmt.Errorf("invalid dconf key %q in %s", setting.Key, setting.Path)
+		}
+		if setting.Value == "" || strings.ContainsAny(setting.Value, "\n\r") {
+			return "", fmt.Errorf("invalid value for dconf key %s/%s", setting.Path, setting.Key)
+		}
+		if _, ok := keysByPath[setting.Path]; !ok {
+			paths = append(paths, setting.Path)
+		}
+		keysByPath[setting.Path] = append(keysByPath[setting.Path], setting.Key+"="+setting.Value)
+		if setting.Lock {
+			locks = append(locks, "/"+setting.Path+"/"+setting.Key)
+		}
+	}
+
+	var keyfile strings.Builder
+	keyfile.WriteString("# Managed by imagecfg\n")
+	for i, path := range paths {
+		if i > 0 {
+			keyfile.WriteString("\n")
+		}
+		fmt.Fprintf(&keyfile, "[%s]\n%s\n", path, strings.Join(keysByPath[path], "\n"))
+	}
+
+	cmds := []string{
+		"(command -v dconf >/dev/null || dnf install -y dconf)",
+		// The user profile has to include the local database for the defaults to apply
+		"([ -f /etc/dconf/profile/user ] || (mkdir -p /etc/dconf/profile && printf 'user-db:user\\n' > /etc/dconf/profile/user))",
+		"(grep -qx 'system-db:local' /etc/dconf/profile/user || echo 'system-db:local' >> /etc/dconf/profile/user)",
+		writeFileCmd("/etc/dconf/db/local.d/00-imagecfg", keyfile.String(), 0644),
+	}
+	if len(locks) > 0 {
+		cmds = append(cmds, writeFileCmd("/etc/dconf/db/local.d/locks/00-imagecfg", "# Managed by imagecfg\n"+strings.Join(locks, "\n")+"\n", 0644))
+	}
+	cmds = append(cmds, "dconf update")
+
+	return strings.Join(cmds, " && "), nil
+}
+
+// generateUdevRulesCmd generates bash commands for installing udev rules. udev is
+// asked to reload them when it is running, which is not the case in a container build.
+func generateUdevRulesCmd(bp *Blueprint) (string, error) {
+	rules := bp.Extensions.GetUdevRules()
+	if len(rules) == 0 {
+		return "", nil
+	}
+
+	var cmds []string
+	for _, rule := range rules {
+		if !taskNameRegexp.MatchString(rule.Name) {
+			return "", fmt.Errorf("invalid udev rule name %q: only letters, digits, '-' and '_' are allowed", rule.Name)
+		}
+		for i, line := range strings.Split(rule.Content, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasSuffix(line, "\\") {
+				continue
+			}
+			if !strings.Contains(line, "=") {
+				return "", fmt.Errorf("udev rule %s line %d has no key: %q", rule.Name, i+1, line)
+			}
+		}
+		content := rule.Content
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		cmds = append(cmds, writeFileCmd("/etc/udev/rules.d/"+rule.Name+".rules", content, 0644))
+	}
+	cmds = append(cmds, "(if [ -S /run/udev/control ]; then udevadm control --reload; fi)")
+
+	return strings.Join(cmds, " && "), nil
+}
+
+var (
+	moduleNameRegexp   = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	moduleOptionRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+=[^\s]+$`)
+)
+
+// generateModprobeOptionsCmd generates bash commands for writing kernel module options
+// to /etc/modprobe.d, one file per module.
+func generateModprobeOptionsCmd(bp *Blueprint) (string, error) {
+	modules := bp.Extensions.GetModprobeOptions()
+	if len(modules) == 0 {
+		return "", nil
+	}
+
+	var cmds []string
+	for _, module := range modules {
+		if !moduleNameRegexp.MatchString(module.Module) {
+			return "", fmt.Errorf("invalid kernel module name %q", module.Module)
+		}
+		if len(module.Options) == 0 {
+			return "", fmt.Errorf("no options given for kernel module %s", module.Module)
+		}
+		for _, option := range module.Options {
+			if !moduleOptionRegexp.MatchString(option) {
+				return "", fmt.Errorf("invalid option %q for kernel module %s: expected parameter=value", option, module.Module)
+			}
+		}
+		content := fmt.Sprintf("# Managed by imagecfg\noptions %s %s\n", module.Module, strings.Join(module.Options, " "))
+		cmds = append(cmds, writeFileCmd("/etc/modprobe.d/imagecfg-"+module.Module+".conf", content, 0644))
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// tunedProfileRegexp matches one or more space-separated tuned profile names.
+var tunedProfileRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+( [A-Za-z0-9_.-]+)*$`)
+
+// generateTunedCmd generates bash commands for selecting a tuned profile.
+func generateTunedCmd(bp *Blueprint) (string, error) {
+	tuned := bp.Extensions.GetTuned()
+	if tuned == nil || tuned.Profile == "" {
+		return "", nil // No tuned profile
+	}
+	if !tunedProfileRegexp.MatchString(tuned.Profile) {
+		return "", fmt.Errorf("invalid tuned profile %q", tuned.Profile)
+	}
+
+	// tuned-adm needs the daemon. Without it (e.g. in a container build) the
+	// profile is written to the files tuned reads on startup.
+	cmds := []string{
+		"(rpm -q tuned >/dev/null || dnf install -y tuned)",
+		"systemctl enable tuned",
+		fmt.Sprintf("if systemctl is-active -q tuned 2>/dev/null; then tuned-adm profile %[1]s; else printf '%%s\\n' %[1]s > /etc/tuned/active_profile && printf 'manual\\n' > /etc/tuned/profile_mode; fi",
+			shellQuote(tuned.Profile)),
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// swapSizeRegexp matches the sizes accepted by fallocate that make sense for swap.
+var swapSizeRegexp = regexp.MustCompile(`^[1-9][0-9]*[KMGT]?$`)
+
+// generateSwapCmd generates bash commands for creating a swap file and configuring zswap.
+// Every step is guarded, so running it again is harmless.
+func generateSwapCmd(bp *Blueprint) (string, error) {
+	swap := bp.Extensions.GetSwap()
+	if swap == nil {
+		return "", nil // No swap customization
+	}
+
+	var cmds []string
+	if swap.File != "" || swap.Size != "" {
+		if !filepath.IsAbs(swap.File) || strings.ContainsAny(swap.File, " \t\n") {
+			return "", fmt.Errorf("swap file %q must be an absolute path without whitespace", swap.File)
+		}
+		if !swapSizeRegexp.MatchString(swap.Size) {
+			return "", fmt.Errorf("invalid swap size %q: expected something like 2G", swap.Size)
+		}
+		file := shellQuote(swap.File)
+		// Copy-on-write has to be disabled before the file gets data, or btrfs refuses to swap on it
+		cmds = append(cmds,
+			fmt.Sprintf("([ -f %[1]s ] || (touch %[1]s && (chattr +C %[1]s 2>/dev/null || true) && fallocate -l %[2]s %[1]s && chmod 600 %[1]s && mkswap %[1]s))", file, swap.Size),
+			fmt.Sprintf("(grep -q %[1]s /etc/fstab || printf '%%s\\n' %[2]s >> /etc/fstab)", shellQuote("^"+regexpEscape(swap.File)+"[[:space:]]"), shellQuote(swap.File+" none swap defaults 0 0")),
+			fmt.Sprintf("(if %[1]s; then swapon --show=NAME --noheadings | grep -qx %[2]s || swapon %[2]s; fi)", liveSystemCheck, file),
+		)
+	}
+
+	if swap.Zswap != nil {
+		// zswap is built into the kernel, so its parameters are set through sysfs on boot
+		var tmpfiles strings.Builder
+		tmpfiles.WriteString("# Managed by imagecfg\n")
+		fmt.Fprintf(&tmpfiles, "w /sys/module/zswap/parameters/enabled - - - - %s\n", map[bool]string{true: "Y", false: "N"}[swap.Zswap.Enabled])
+		if swap.Zswap.Compressor != "" {
+			if !moduleNameRegexp.MatchString(swap.Zswap.Compressor) {
+				return "", fmt.Errorf("invalid zswap compressor %q", swap.Zswap.Compressor)
+			}
+			fmt.Fprintf(&tmpfiles, "w /sys/module/zswap/parameters/compressor - - - - %s\n", swap.Zswap.Compressor)
+		}
+		if swap.Zswap.MaxPoolPercent != 0 {
+			if swap.Zswap.MaxPoolPercent < 1 || swap.Zswap.MaxPoolPercent > 100 {
+				return "", fmt.Errorf("invalid zswap max_pool_percent %d: must be between 1 and 100", swap.Zswap.MaxPoolPercent)
+			}
+			fmt.Fprintf(&tmpfiles, "w /sys/module/zswap/parameters/max_pool_percent - - - - %d\n", swap.Zswap.MaxPoolPercent)
+		}
+		cmds = append(cmds, writeFileCmd("/etc/tmpfiles.d/imagecfg-zswap.conf", tmpfiles.String(), 0644))
+	}
+
+	return strings.Join(cmds, " && "), nil
+}
+
+var (
+	mountOptionsRegexp = regexp.MustCompile(`^[A-Za-z0-9_.@:/=+-]+(,[A-Za-z0-9_.@:/=+-]+)*$`)
+	fsTypeRegexp       = regexp.MustCompile(`^[a-z0-9._]+$`)
+)
+
+// networkFsTypes get ordered after the network and their client tools installed.
+var networkFsTypes = map[string]string{
+	"nfs":  "nfs-utils",
+	"nfs4": "nfs-utils",
+	"cifs": "cifs-utils",
+	"smb3": "cifs-utils",
+}
+
+// generateMountsCmd generates bash commands for additional mounts: the mount point is
+// created and the mount is added to /etc/fstab or written as a systemd mount unit.
+func generateMountsCmd(bp *Blueprint) (string, error) {
+	mounts := bp.Extensions.GetMounts()
+	if len(mounts) == 0 {
+		return "", nil
+	}
+
+	var cmds []string
+	installed := make(map[string]bool)
+	for _, mount := range mounts {
+		if mount.What == "" || strings.ContainsAny(mount.What, " \t\n") {
+			return "", fmt.Errorf("invalid mount source %q: must not be empty or contain whitespace", mount.What)
+		}
+		if !filepath.IsAbs(mount.Where) || strings.ContainsAny(mount.Where, " \t\n") {
+			return "", fmt.Errorf("invalid mount point %q: must be an absolute path without whitespace", mount.Where)
+		}
+		if !fsTypeRegexp.MatchString(mount.Type) {
+			return "", fmt.Errorf("invalid filesystem type %q for %s", mount.Type, mount.Where)
+		}
+		options := mount.Options
+		if options == "" {
+			options = "defaults"
+		}
+		if !mountOptionsRegexp.MatchString(options) {
+			return "", fmt.Errorf("invalid mount options %q for %s: expected comma-separated options without spaces", options, mount.Where)
+		}
+		where := filepath.Clean(mount.Where)
+
+		network := strings.Contains(","+options+",", ",_netdev,")
+		if pkg, ok := networkFsTypes[mount.Type]; ok {
+			network = true
+			if !installed[pkg] {
+				installed[pkg] = true
+				cmds = append(cmds, fmt.Sprintf("(rpm -q %[1]s >/dev/null || dnf install -y %[1]s)", pkg))
+			}
+		}
+
+		cmds = append(cmds, fmt.Sprintf("mkdir -p %s", shellQuote(where)))
+		if !mount.Unit {
+			line := fmt.Sprintf("%s %s %s %s 0 0", mount.What, where, mount.Type, options)
+			cmds = append(cmds, fmt.Sprintf("(grep -qE %s /etc/fstab || printf '%%s\\n' %s >> /etc/fstab)",
+				shellQuote(`^[^#[:space:]]+[[:space:]]+`+regexpEscape(where)+`[[:space:]]`), shellQuote(line)))
+			continue
+		}
+
+		target := "local-fs.target"
+		after := ""
+		if network {
+			target = "remote-fs.target"
+			after = "After=network-online.target\nWants=network-online.target\n"
+		}
+		unitName := systemdEscapePath(where) + ".mount"
+		unit := fmt.Sprintf("# Managed by imagecfg\n[Unit]\nDescription=Mount %s\n%s\n[Mount]\nWhat=%s\nWhere=%s\nType=%s\nOptions=%s\n\n[Install]\nWantedBy=%s\n",
+			where, after, mount.What, where, mount.Type, options, target)
+		cmds = append(cmds,
+			writeFileCmd("/etc/systemd/system/"+unitName, unit, 0644),
+			fmt.Sprintf("systemctl enable %s", shellQuote(unitName)),
+		)
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// seboolRegexp matches SELinux boolean names.
+var seboolRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// generateSELinuxCmd generates bash commands for the SELinux mode and booleans.
+func generateSELinuxCmd(bp *Blueprint) (string, error) {
+	selinux := bp.Extensions.GetSELinux()
+	if selinux == nil {
+		return "", nil // No SELinux customization
+	}
+
+	var cmds []string
+	if selinux.Mode != "" {
+		switch selinux.Mode {
+		case "enforcing", "permissive", "disabled":
+		default:
+			return "", fmt.Errorf("invalid SELinux mode %q: must be enforcing, permissive or disabled", selinux.Mode)
+		}
+		// Minimal installs may not have the config yet, it is created then
+		cmds = append(cmds, "mkdir -p /etc/selinux", replaceLineCmd("/etc/selinux/config", "SELINUX=", "SELINUX="+selinux.Mode))
+	}
+
+	if len(selinux.Booleans) > 0 {
+		var names []string
+		for name := range selinux.Booleans {
+			if !seboolRegexp.MatchString(name) {
+				return "", fmt.Errorf("invalid SELinux boolean name %q", name)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		// On image mode systems the local policy store in /etc is merged with the one shipped
+		// in the image on updates, so changes there should rather be made in the image build.
+		cmds = append(cmds, "(if [ -e /run/ostree-booted ] && "+liveSystemCheck+"; then echo 'Warning: changing SELinux booleans on a booted image mode system, these changes are local and are better made in the image build' >&2; fi)")
+		for _, name := range names {
+			value := "off"
+			if selinux.Booleans[name] {
+				value = "on"
+			}
+			// Without a loaded policy (e.g. in a container build) the store is modified offline
+			cmds = append(cmds, fmt.Sprintf("if selinuxenabled; then setsebool -P %[1]s %[2]s; else semanage boolean -N -m --%[2]s %[1]s; fi", name, value))
+		}
+	}
+
+	return strings.Join(cmds, " && "), nil
+}
+
+// fapolicydDecisions are the decisions a fapolicyd rule can start with.
+var fapolicydDecisions = []string{"allow", "deny", "allow_audit", "deny_audit", "allow_syslog", "deny_syslog", "allow_log", "deny_log"}
+
+// generateFapolicydCmd generates bash commands for fapolicyd trust entries and rules.
+// The rules are compiled with fagenrules, and loaded when the daemon is running.
+func generateFapolicydCmd(bp *Blueprint) (string, error) {
+	fapolicyd := bp.Extensions.GetFapolicyd()
+	if fapolicyd == nil || (len(fapolicyd.Trust) == 0 && len(fapolicyd.Rules) == 0) {
+		return "", nil // No fapolicyd customization
+	}
+
+	cmds := []string{"(rpm -q fapolicyd >/dev/null || dnf install -y fapolicyd)"}
+	for _, path := range fapolicyd.Trust {
+		if !filepath.IsAbs(path) {
+			return "", fmt.Errorf("fapolicyd trust path %q must be absolute", path)
+		}
+		// "add" refuses files that are already trusted, "update" refreshes their hash
+		cmds = append(cmds, fmt.Sprintf("(fapolicyd-cli --file update %[1]s --trust-file imagecfg 2>/dev/null || fapolicyd-cli --file add %[1]s --trust-file imagecfg)", shellQuote(path)))
+	}
+
+	for _, rules := range fapolicyd.Rules {
+		if !taskNameRegexp.MatchString(rules.Name) {
+			return "", fmt.Errorf("invalid fapolicyd rules name %q: only letters, digits, '-' and '_' are allowed", rules.Name)
+		}
+		for i, line := range strings.Split(rules.Content, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "%") {
+				continue
+			}
+			decision, _, _ := strings.Cut(line, " ")
+			if !slices.Contains(fapolicydDecisions, decision) {
+				return "", fmt.Errorf("fapolicyd rules %s line %d: unknown decision %q", rules.Name, i+1, decision)
+			}
+		}
+		content := rules.Content
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		cmds = append(cmds, writeFileCmd("/etc/fapolicyd/rules.d/"+rules.Name+".rules", content, 0644))
+	}
+	if len(fapolicyd.Rules) > 0 {
+		cmds = append(cmds, "if systemctl is-active -q fapolicyd 2>/dev/null; then fagenrules --load; else fagenrules; fi")
+	}
+
+	return strings.Join(cmds, " && "), nil
+}
+
+// domainRegexp matches DNS domain names.
+var domainRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)+$`)
+
+// generateDomainJoinCmd generates bash commands for joining an AD or IPA domain.
+// Already joined systems are left alone.
+// blockEnvironment returns the environment variables the commands of the blueprint
+// read, the domain join password_env.
+func blockEnvironment(bp *Blueprint) []string {
+	if join := bp.Extensions.GetDomainJoin(); join != nil && join.PasswordEnv != "" {
+		return []string{join.PasswordEnv}
+	}
+	return nil
+}
+
+func generateDomainJoinCmd(bp *Blueprint) (string, error) {
+	join := bp.Extensions.GetDomainJoin()
+	if join == nil {
+		return "", nil // No domain join customization
+	}
+
+	if !domainRegexp.MatchString(join.Domain) {
+		return "", fmt.Errorf("invalid domain %q", join.Domain)
+	}
+	if join.User == "" || strings.ContainsAny(join.User, " \t\n") {
+		return "", fmt.Errorf("domain join needs a user without whitespace")
+	}
+	if (join.PasswordFile == "") == (join.PasswordEnv == "") {
+		return "", fmt.Errorf("domain join needs exactly one of password_file or password_env")
+	}
+
+	// password feeds the join password to the standard input of the join command
+	var password string
+	if join.PasswordFile != "" {
+		if !filepath.IsAbs(join.PasswordFile) {
+			return "", fmt.Errorf("domain join password_file %q must be absolute", join.PasswordFile)
+		}
+		password = fmt.Sprintf("cat %s", shellQuote(join.PasswordFile))
+	} else {
+		if !envNameRegexp.MatchString(join.PasswordEnv) {
+			return "", fmt.Errorf("invalid domain join password_env %q", join.PasswordEnv)
+		}
+		password = fmt.Sprintf(`printf '%%s' "${%[1]s:?%[1]s must contain the domain join password}"`, join.PasswordEnv)
+	}
+
+	var cmds []string
+	switch join.Provider {
+	case "ad":
+		if join.Server != "" {
+			return "", fmt.Errorf("server is only supported by the ipa domain join provider")
+		}
+		joinArgs := []string{"realm", "join", "--user=" + shellQuote(join.User)}
+		if join.OU != "" {
+			joinArgs = append(joinArgs, "--computer-ou="+shellQuote(join.OU))
+		}
+		joinArgs = append(joinArgs, shellQuote(join.Domain))
+		cmds = append(cmds,
+			"(rpm -q realmd sssd adcli >/dev/null || dnf install -y realmd sssd adcli oddjob oddjob-mkhomedir samba-common-tools)",
+			fmt.Sprintf("(realm list --name-only | grep -qix %s || %s | %s)", shellQuote(join.Domain), password, strings.Join(joinArgs, " ")),
+		)
+	case "ipa":
+		if join.OU != "" {
+			return "", fmt.Errorf("ou is only supported by the ad domain join provider")
+		}
+		installArgs := []string{"ipa-client-install", "--unattended", "--mkhomedir", "--domain=" + shellQuote(join.Domain), "--principal=" + shellQuote(join.User)}
+		if join.Server != "" {
+			installArgs = append(installArgs, "--server="+shellQuote(join.Server))
+		}
+		// Unattended, ipa-client-install reads the password of the principal from stdin
+		// when --password is not given, so it is not in its argv for every local user
+		// to read from /proc
+		cmds = append(cmds,
+			"(rpm -q ipa-client >/dev/null || dnf install -y ipa-client)",
+			fmt.Sprintf("([ -f /etc/ipa/default.conf ] || %s | %s)", password, strings.Join(installArgs, " ")),
+		)
+	default:
+		return "", fmt.Errorf("invalid domain join provider %q: must be ad or ipa", join.Provider)
+	}
+
+	return strings.Join(cmds, " && "), nil
+}
+
+// generateZramCmd generates bash commands for configuring swap on zram with zram-generator.
+func generateZramCmd(bp *Blueprint) (string, error) {
+	zram := bp.Extensions.GetZram()
+	if zram == nil {
+		return "", nil // No zram customization
+	}
+
+	fraction := zram.SizeFraction
+	if fraction == 0 {
+		fraction = 0.5 // zram-generator's default
+	}
+	if fraction < 0 || fraction > 4 {
+		return "", fmt.Errorf("invalid zram size_fraction %g: must be between 0 and 4", zram.SizeFraction)
+	}
+	size := fmt.Sprintf("ram * %g", fraction)
+	if zram.MaxSizeMB < 0 {
+		return "", fmt.Errorf("invalid zram max_size_mb %d", zram.MaxSizeMB)
+	}
+	if zram.MaxSizeMB > 0 {
+		size = fmt.Sprintf("min(%s, %d)", size, zram.MaxSizeMB)
+	}
+
+	lines := []string{"# Managed by imagecfg", "[zram0]", "zram-size = " + size}
+	if zram.CompressionAlgorithm != "" {
+		if !moduleNameRegexp.MatchString(zram.CompressionAlgorithm) {
+			return "", fmt.Errorf("invalid zram compression_algorithm %q", zram.CompressionAlgorithm)
+		}
+		lines = append(lines, "compression-algorithm = "+zram.CompressionAlgorithm)
+	}
+	if zram.SwapPriority != nil {
+		if *zram.SwapPriority < -1 || *zram.SwapPriority > 32767 {
+			return "", fmt.Errorf("invalid zram swap_priority %d: must be between -1 and 32767", *zram.SwapPriority)
+		}
+		lines = append(lines, fmt.Sprintf("swap-priority = %d", *zram.SwapPriority))
+	}
+
+	cmds := []string{
+		"(rpm -q zram-generator >/dev/null || dnf install -y zram-generator)",
+		writeFileCmd("/etc/systemd/zram-generator.conf", strings.Join(lines, "\n")+"\n", 0644),
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// generateGreenbootChecksCmd generates bash commands for installing greenboot health-check scripts.
+func generateGreenbootChecksCmd(bp *Blueprint) (string, error) {
+	checks := bp.Extensions.GetGreenbootChecks()
+	if len(checks) == 0 {
+		return "", nil
+	}
+
+	cmds := []string{"(rpm -q greenboot >/dev/null || dnf install -y greenboot)"}
+	for _, check := range checks {
+		if !taskNameRegexp.MatchString(check.Name) {
+			return "", fmt.Errorf("invalid greenboot check name %q: only letters, digits, '-' and '_' are allowed", check.Name)
+		}
+		if check.Type != "required" && check.Type != "wanted" {
+			return "", fmt.Errorf("invalid type %q of greenboot check %s: must be required or wanted", check.Type, check.Name)
+		}
+		// greenboot executes the checks directly
+		if !strings.HasPrefix(check.Content, "#!") {
+			return "", fmt.Errorf("greenboot check %s must start with a shebang line", check.Name)
+		}
+		content := check.Content
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		cmds = append(cmds, writeFileCmd(fmt.Sprintf("/etc/greenboot/check/%s.d/%s.sh", check.Type, check.Name), content, 0755))
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// generateSyspurposeCmd generates bash commands for setting the system purpose. Newer
+// releases manage it with subscription-manager, older ones with the syspurpose tool.
+func generateSyspurposeCmd(bp *Blueprint) (string, error) {
+	purpose := bp.Extensions.GetSyspurpose()
+	if purpose == nil {
+		return "", nil // No syspurpose customization
+	}
+
+	var cmds []string
+	attr := func(newCmd, oldCmd, value string) {
+		cmds = append(cmds, fmt.Sprintf("if command -v subscription-manager >/dev/null; then subscription-manager syspurpose %s %s; else syspurpose %s %[2]s; fi", newCmd, shellQuote(value), oldCmd))
+	}
+	for _, value := range append([]string{purpose.Role, purpose.SLA, purpose.Usage}, purpose.Addons...) {
+		if strings.ContainsAny(value, "\n\r") {
+			return "", fmt.Errorf("invalid syspurpose value %q", value)
+		}
+	}
+	if purpose.Role != "" {
+		attr("role --set", "set-role", purpose.Role)
+	}
+	if purpose.SLA != "" {
+		attr("service-level --set", "set-sla", purpose.SLA)
+	}
+	if purpose.Usage != "" {
+		attr("usage --set", "set-usage", purpose.Usage)
+	}
+	for _, addon := range purpose.Addons {
+		if addon == "" {
+			return "", fmt.Errorf("empty syspurpose addon")
+		}
+		attr("addons --add", "add-addons", addon)
+	}
+
+	return strings.Join(cmds, " && "), nil
+}
+
+// generateMachineIDResetCmd generates bash commands that empty the machine ID, so that
+// every instance of an image generates its own on first boot. systemd treats an empty
+// /etc/machine-id as uninitialized, D-Bus keeps its own copy which is removed.
+func generateMachineIDResetCmd(bp *Blueprint) (string, error) {
+	if !bp.Extensions.GetResetMachineID() {
+		return "", nil
+	}
+	return "(if " + liveSystemCheck + "; then echo 'Warning: resetting the machine ID of a running system, it will be regenerated on the next boot' >&2; fi) && " +
+		"(if [ -e /etc/machine-id ]; then truncate -s 0 /etc/machine-id; fi) && rm -f /var/lib/dbus/machine-id", nil
+}
+
+// fsNodeOwnerCmd generates the command setting the owner of a file or directory
+// customization, the user and group are names or IDs.
+func fsNodeOwnerCmd(path string, user, group interface{}) string {
+	if user == nil && group == nil {
+		return ""
+	}
+	var owner string
+	if user != nil {
+		owner = fmt.Sprint(user)
+	}
+	if group != nil {
+		owner += ":" + fmt.Sprint(group)
+	}
+	return fmt.Sprintf("chown %s %s", shellQuote(owner), shellQuote(path))
+}
+
+// fsNodeMode parses the octal mode of a file or directory customization.
+func fsNodeMode(mode string, defaultMode os.FileMode) (os.FileMode, error) {
+	if mode == "" {
+		return defaultMode, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q: %w", mode, err)
+	}
+	return os.FileMode(m), nil
+}
+
+// directoryCmds generates the commands creating the directories of the blueprint.
+func directoryCmds(bp *Blueprint) ([]string, error) {
+	var cmds []string
+	for _, dir := range bp.Customizations.GetDirectories() {
+		mode, err := fsNodeMode(dir.Mode, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("directory %s: %w", dir.Path, err)
+		}
+		if dir.EnsureParents {
+			cmds = append(cmds, "mkdir -p "+shellQuote(dir.Path))
+		} else {
+			cmds = append(cmds, fmt.Sprintf("([ -d %[1]s ] || mkdir %[1]s)", shellQuote(dir.Path)))
+		}
+		cmds = append(cmds, fmt.Sprintf("chmod %04o %s", mode, shellQuote(dir.Path)))
+		if owner := fsNodeOwnerCmd(dir.Path, dir.User, dir.Group); owner != "" {
+			cmds = append(cmds, owner)
+		}
+	}
+	return cmds, nil
+}
+
+// generateFilesAndDirectoriesCmd generates bash commands for creating the directories
+// and files of the blueprint. Directories come first, so that files can be placed in them.
+func generateFilesAndDirectoriesCmd(bp *Blueprint) (string, error) {
+	cmds, err := directoryCmds(bp)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range bp.Customizations.GetFiles() {
+		mode, err := fsNodeMode(file.Mode, 0644)
+		if err != nil {
+			return "", fmt.Errorf("file %s: %w", file.Path, err)
+		}
+		cmds = append(cmds, writeFileCmd(file.Path, file.Data, mode))
+		if owner := fsNodeOwnerCmd(file.Path, file.User, file.Group); owner != "" {
+			cmds = append(cmds, owner)
+		}
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// Paths of the fragments written in declarative mode
+const (
+	sysusersFragmentPath      = "/usr/lib/sysusers.d/imagecfg.conf"
+	tmpfilesHomesFragmentPath = "/usr/lib/tmpfiles.d/imagecfg-homes.conf"
+	tmpfilesFragmentPath      = "/usr/lib/tmpfiles.d/imagecfg.conf"
+)
+
+// sysusersQuote quotes s as a field of a sysusers.d line, escaping specifiers.
+func sysusersQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "%", "%%")
+	return `"` + s + `"`
+}
+
+// generateSysusersCmd generates bash commands that declare the groups and users of the
+// blueprint in a sysusers.d fragment, create their home directories with a tmpfiles.d
+// fragment and apply both. It replaces the groupadd and useradd commands in declarative mode.
+func generateSysusersCmd(bp *Blueprint) (string, error) {
+	groups := bp.Customizations.GetGroups()
+	users := bp.Customizations.GetUsers()
+	if len(groups) == 0 && len(users) == 0 {
+		return "", nil
+	}
+
+	var sysusers, homes strings.Builder
+	sysusers.WriteString("# Managed by imagecfg\n")
+	homes.WriteString("# Managed by imagecfg\n")
+	for _, group := range groups {
+		gid := "-"
+		if group.GID != nil {
+			gid = strconv.Itoa(*group.GID)
+		}
+		fmt.Fprintf(&sysusers, "g %s %s\n", group.Name, gid)
+	}
+	for _, user := range users {
+		id, group := "-", user.Name
+		if user.UID != nil {
+			id = strconv.Itoa(*user.UID)
+		}
+		if user.GID != nil {
+			if user.UID == nil {
+				return "", fmt.Errorf("user %s: a gid can only be declared together with a uid", user.Name)
+			}
+			group = strconv.Itoa(*user.GID)
+			id += ":" + group
+		}
+		// Same defaults as useradd, sysusers would use / and nologin
+		home, shell := "/home/"+user.Name, "/bin/bash"
+		if user.Home != nil && *user.Home != "" {
+			home = *user.Home
+		}
+		if user.Shell != nil && *user.Shell != "" {
+			shell = *user.Shell
+		}
+		if strings.ContainsAny(home, " \t\n\"'\\") {
+			return "", fmt.Errorf("home directory %q cannot be used in tmpfiles.d", home)
+		}
+		gecos := "-"
+		if user.Description != nil && *user.Description != "" {
+			gecos = sysusersQuote(*user.Description)
+		}
+		fmt.Fprintf(&sysusers, "u %s %s %s %s %s\n", user.Name, id, gecos, sysusersQuote(home), sysusersQuote(shell))
+		for _, member := range user.Groups {
+			fmt.Fprintf(&sysusers, "m %s %s\n", user.Name, member)
+		}
+		fmt.Fprintf(&homes, "d %s 0700 %s %s -\n", tmpfilesPath(home), user.Name, group)
+	}
+
+	cmds := []string{
+		writeFileCmd(sysusersFragmentPath, sysusers.String(), 0644),
+		"systemd-sysusers " + sysusersFragmentPath,
+	}
+	if len(users) > 0 {
+		cmds = append(cmds,
+			writeFileCmd(tmpfilesHomesFragmentPath, homes.String(), 0644),
+			"systemd-tmpfiles --create "+tmpfilesHomesFragmentPath)
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// generateUserCredentialsCmd generates bash commands for the passwords and SSH keys of
+// the users, which sysusers.d cannot declare. It replaces the users block in declarative mode.
+func generateUserCredentialsCmd(bp *Blueprint) (string, error) {
+	var lines []string
+	for _, user := range bp.Customizations.GetUsers() {
+		if cmds := userCredentialCmds(user); len(cmds) > 0 {
+			lines = append(lines, strings.Join(cmds, " && "))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// tmpfilesPath escapes the specifiers in a path of a tmpfiles.d line.
+func tmpfilesPath(path string) string {
+	return strings.ReplaceAll(path, "%", "%%")
+}
+
+// tmpfilesOwner formats a file or directory owner as a tmpfiles.d field.
+func tmpfilesOwner(owner interface{}) string {
+	if owner == nil {
+		return "-"
+	}
+	return fmt.Sprint(owner)
+}
+
+// tmpfilesArgument escapes file content as the argument of a tmpfiles.d line,
+// which is unescaped like a C string.
+func tmpfilesArgument(data string) string {
+	if data == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c == '%':
+			b.WriteString("%%")
+		case c < 0x20 || c == 0x7f || c == '"' || c == '\'',
+			i == 0 && (c == ' ' || c == '-'):
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// generateTmpfilesCmd generates bash commands that declare the directories and files of
+// the blueprint in a tmpfiles.d fragment and apply it. It replaces the files and
+// directories block in declarative mode. The file contents are restored on every boot.
+func generateTmpfilesCmd(bp *Blueprint) (string, error) {
+	dirs := bp.Customizations.GetDirectories()
+	files := bp.Customizations.GetFiles()
+	if len(dirs) == 0 && len(files) == 0 {
+		return "", nil
+	}
+
+	var conf strings.Builder
+	conf.WriteString("# Managed by imagecfg\n")
+	for _, dir := range dirs {
+		if strings.ContainsAny(dir.Path, " \t\n\"'\\") {
+			return "", fmt.Errorf("directory path %q cannot be used in tmpfiles.d", dir.Path)
+		}
+		mode, err := fsNodeMode(dir.Mode, 0755)
+		if err != nil {
+			return "", fmt.Errorf("directory %s: %w", dir.Path, err)
+		}
+		fmt.Fprintf(&conf, "d %s %04o %s %s -\n", tmpfilesPath(dir.Path), mode, tmpfilesOwner(dir.User), tmpfilesOwner(dir.Group))
+	}
+	for _, file := range files {
+		if strings.ContainsAny(file.Path, " \t\n\"'\\") {
+			return "", fmt.Errorf("file path %q cannot be used in tmpfiles.d", file.Path)
+		}
+		mode, err := fsNodeMode(file.Mode, 0644)
+		if err != nil {
+			return "", fmt.Errorf("file %s: %w", file.Path, err)
+		}
+		fmt.Fprintf(&conf, "f+ %s %04o %s %s %s\n", tmpfilesPath(file.Path), mode, tmpfilesOwner(file.User), tmpfilesOwner(file.Group), tmpfilesArgument(file.Data))
+	}
+
+	return strings.Join([]string{
+		writeFileCmd(tmpfilesFragmentPath, conf.String(), 0644),
+		"systemd-tmpfiles --create " + tmpfilesFragmentPath,
+	}, " && "), nil
+}
@@ -0,0 +1,1125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mustParseBlueprint parses the given TOML as a blueprint file.
+func mustParseBlueprint(t *testing.T, config string) *Blueprint {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(config), 0644))
+	bp, err := parseBlueprint(path)
+	require.NoError(t, err)
+	return bp
+}
+
+func TestGenerateProxyCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.proxy]
+http = "http://proxy.example.com:3128"
+https = "http://proxy.example.com:3129"
+no_proxy = ["localhost", ".example.com"]
+units = ["podman.service"]
+`)
+	cmd, err := generateProxyCmd(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, cmd, `sed -i '/^http_proxy=/d' '/etc/environment' && printf '%s\n' 'http_proxy=http://proxy.example.com:3128' >> '/etc/environment'`)
+	assert.Contains(t, cmd, `'NO_PROXY=localhost,.example.com'`)
+	assert.Contains(t, cmd, `sed -i '/^\[main\]/a proxy=http://proxy.example.com:3129' /etc/dnf/dnf.conf`)
+	assert.Contains(t, cmd, `'/etc/systemd/system/podman.service.d/10-imagecfg-proxy.conf'`)
+	assert.Contains(t, cmd, `Environment="HTTPS_PROXY=http://proxy.example.com:3129"`)
+
+	bp = mustParseBlueprint(t, `
+[customizations.proxy]
+http = "proxy.example.com:3128"
+`)
+	_, err = generateProxyCmd(bp)
+	assert.ErrorContains(t, err, "invalid proxy URL")
+
+	cmd, err = generateProxyCmd(mustParseBlueprint(t, ""))
+	require.NoError(t, err)
+	assert.Empty(t, cmd)
+}
+
+func TestGenerateSSHDCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.sshd]
+permit_root_login = "prohibit-password"
+password_authentication = false
+ports = [22, 2222]
+options = { MaxAuthTries = "3", ClientAliveInterval = "300" }
+`)
+	cmd, err := generateSSHDCmd(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, cmd, "'# Managed by imagecfg\nPermitRootLogin prohibit-password\nPasswordAuthentication no\nPort 22\nPort 2222\nClientAliveInterval 300\nMaxAuthTries 3\n' > '/etc/ssh/sshd_config.d/40-imagecfg.conf.new'")
+	assert.Contains(t, cmd, "mv -f /etc/ssh/sshd_config.d/40-imagecfg.conf.new /etc/ssh/sshd_config.d/40-imagecfg.conf && "+
+		"(if [ -e /etc/ssh/ssh_host_ed25519_key ] || [ -e /etc/ssh/ssh_host_rsa_key ]; then sshd -t; else sshd -G > /dev/null; fi || "+
+		"{ if [ -e /etc/ssh/sshd_config.d/40-imagecfg.conf.old ]; then mv -f /etc/ssh/sshd_config.d/40-imagecfg.conf.old /etc/ssh/sshd_config.d/40-imagecfg.conf; else rm -f /etc/ssh/sshd_config.d/40-imagecfg.conf; fi; exit 1; })")
+	assert.True(t, strings.HasSuffix(cmd, "rm -f /etc/ssh/sshd_config.d/40-imagecfg.conf.old"))
+
+	bp = mustParseBlueprint(t, `
+[customizations.sshd]
+permit_root_login = "maybe"
+`)
+	_, err = generateSSHDCmd(bp)
+	assert.ErrorContains(t, err, "invalid permit_root_login")
+
+	bp = mustParseBlueprint(t, `
+[customizations.sshd]
+ports = [70000]
+`)
+	_, err = generateSSHDCmd(bp)
+	assert.ErrorContains(t, err, "invalid sshd port 70000")
+}
+
+func TestSSHDDropInRollback(t *testing.T) {
+	// A fake sshd, rejecting the configuration if any drop-in it includes sets Bogus
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "sshd"), []byte("#!/bin/sh\n! cat \"$SSHD_CONFIG_D\"/*.conf | grep -q '^Bogus '\n"), 0755))
+	run := func(t *testing.T, dir, blueprint string) error {
+		cmd, err := generateSSHDCmd(mustParseBlueprint(t, blueprint))
+		require.NoError(t, err)
+		c := exec.Command("bash", "-c", strings.ReplaceAll(cmd, "/etc/ssh", dir))
+		c.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"), "SSHD_CONFIG_D="+filepath.Join(dir, "sshd_config.d"))
+		return c.Run()
+	}
+	const good = "[customizations.sshd]\nports = [2222]\n"
+	const bad = "[customizations.sshd]\noptions = { Bogus = \"yes\" }\n"
+
+	for _, previous := range []string{"", "# Managed by imagecfg\nPort 22\n"} {
+		dir := t.TempDir()
+		dropIn := filepath.Join(dir, "sshd_config.d", "40-imagecfg.conf")
+		require.NoError(t, os.Mkdir(filepath.Dir(dropIn), 0755))
+		if previous != "" {
+			require.NoError(t, os.WriteFile(dropIn, []byte(previous), 0600))
+		}
+
+		// The previous drop-in is restored
+		assert.Error(t, run(t, dir, bad))
+		data, err := os.ReadFile(dropIn)
+		if previous == "" {
+			assert.True(t, os.IsNotExist(err))
+		} else {
+			require.NoError(t, err)
+			assert.Equal(t, previous, string(data))
+		}
+
+		// Applied twice like every block
+		for range 2 {
+			require.NoError(t, run(t, dir, good))
+		}
+		data, err = os.ReadFile(dropIn)
+		require.NoError(t, err)
+		assert.Equal(t, "# Managed by imagecfg\nPort 2222\n", string(data))
+
+		entries, err := os.ReadDir(filepath.Dir(dropIn))
+		require.NoError(t, err)
+		assert.Len(t, entries, 1, "the staged and the previous drop-in are removed")
+	}
+}
+
+func TestGenerateChronyCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.timezone]
+timezone = "Europe/Prague"
+ntpservers = ["ntp.example.com"]
+
+[customizations.chrony]
+servers = [{ hostname = "10.0.0.1", iburst = false, prefer = true }]
+pools = [{ hostname = "pool.example.com" }]
+remove_default_pools = true
+makestep = { threshold = 1.5, limit = -1 }
+leapsecmode = "slew"
+`)
+	cmd, err := generateChronyCmd(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, cmd, "sed -i 's/^pool /#pool /' /etc/chrony.conf")
+	assert.Contains(t, cmd, "'# Managed by imagecfg\nserver ntp.example.com iburst\nserver 10.0.0.1 prefer\npool pool.example.com iburst\n' > '/etc/chrony.d/imagecfg.sources'")
+	assert.Contains(t, cmd, "echo 'sourcedir /etc/chrony.d' >> /etc/chrony.conf")
+	assert.Contains(t, cmd, "sed -i '/^makestep /d' /etc/chrony.conf")
+	assert.Contains(t, cmd, "'# Managed by imagecfg\nmakestep 1.5 -1\nleapsecmode slew\n' > '/etc/chrony.d/imagecfg.conf'")
+	assert.NotContains(t, cmd, "Europe/Prague")
+
+	// Servers in both lists are configured once
+	bp = mustParseBlueprint(t, `
+[customizations.timezone]
+ntpservers = ["10.0.0.1"]
+
+[customizations.chrony]
+servers = [{ hostname = "10.0.0.1", prefer = true }]
+`)
+	cmd, err = generateChronyCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, "'# Managed by imagecfg\nserver 10.0.0.1 iburst prefer\n'")
+
+	bp = mustParseBlueprint(t, `
+[customizations.chrony]
+leapsecmode = "smear"
+`)
+	_, err = generateChronyCmd(bp)
+	assert.ErrorContains(t, err, "invalid leapsecmode")
+}
+
+func TestGenerateJournaldCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.journald]
+storage = "volatile"
+system_max_use = "100M"
+forward_to_syslog = false
+`)
+	cmd, err := generateJournaldCmd(bp)
+	require.NoError(t, err)
+	assert.Equal(t, `mkdir -p '/etc/systemd/journald.conf.d' && printf '%s' '# Managed by imagecfg
+[Journal]
+Storage=volatile
+SystemMaxUse=100M
+ForwardToSyslog=false
+' > '/etc/systemd/journald.conf.d/50-imagecfg.conf' && chmod 0644 '/etc/systemd/journald.conf.d/50-imagecfg.conf'`, cmd)
+
+	bp = mustParseBlueprint(t, `
+[customizations.journald]
+runtime_max_use = "lots"
+`)
+	_, err = generateJournaldCmd(bp)
+	assert.ErrorContains(t, err, "invalid journald RuntimeMaxUse")
+}
+
+func TestGenerateScheduledTasksCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.scheduled_tasks]]
+name = "cleanup"
+command = "find /var/tmp -mtime +7 -delete; date +%F > /var/log/cleanup"
+schedule = "0 3 * * *"
+
+[[customizations.scheduled_tasks]]
+name = "backup"
+command = "/usr/local/bin/backup \"$HOME\""
+user = "backup"
+on_calendar = "daily"
+persistent = true
+`)
+	cmd, err := generateScheduledTasksCmd(bp)
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(cmd, "(rpm -q cronie >/dev/null || dnf install -y cronie)"))
+	assert.Contains(t, cmd, `0 3 * * * root find /var/tmp -mtime +7 -delete; date +\%F > /var/log/cleanup`)
+	assert.Contains(t, cmd, `ExecStart=/bin/sh -c "/usr/local/bin/backup \"$$HOME\""`)
+	assert.Contains(t, cmd, "User=backup")
+	assert.Contains(t, cmd, "OnCalendar=daily\nPersistent=true\n")
+	assert.True(t, strings.HasSuffix(cmd, "systemctl enable backup.timer"))
+
+	bp = mustParseBlueprint(t, `
+[[customizations.scheduled_tasks]]
+name = "both"
+command = "true"
+schedule = "@daily"
+on_calendar = "daily"
+`)
+	_, err = generateScheduledTasksCmd(bp)
+	assert.ErrorContains(t, err, "exactly one of schedule or on_calendar")
+
+	bp = mustParseBlueprint(t, `
+[[customizations.scheduled_tasks]]
+name = "short"
+command = "true"
+schedule = "0 3 * *"
+`)
+	_, err = generateScheduledTasksCmd(bp)
+	assert.ErrorContains(t, err, "expected 5 fields")
+
+	for _, user := range []string{"root\nExecStartPre=/bin/evil", "root true", "User=root", "root\t"} {
+		bp = mustParseBlueprint(t, fmt.Sprintf(`
+[[customizations.scheduled_tasks]]
+name = "injected"
+command = "true"
+user = %q
+on_calendar = "daily"
+`, user))
+		_, err = generateScheduledTasksCmd(bp)
+		assert.ErrorContains(t, err, "invalid user", user)
+	}
+}
+
+func TestGenerateEnvironmentCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.environment]
+EDITOR = "vim"
+GREETING = "it's a nice day"
+`)
+	cmd, err := generateEnvironmentCmd(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, cmd, `sed -i '/^EDITOR=/d' '/etc/environment' && printf '%s\n' 'EDITOR=vim' >> '/etc/environment'`)
+	assert.Contains(t, cmd, `printf '%s\n' 'GREETING="it'\''s a nice day"' >> '/etc/environment'`)
+	assert.Contains(t, cmd, `export EDITOR='\''vim'\''
+export GREETING='\''it'\''\'\'''\''s a nice day'\''
+' > '/etc/profile.d/imagecfg-environment.sh'`)
+
+	bp = mustParseBlueprint(t, `
+[customizations.environment]
+"NOT-VALID" = "x"
+`)
+	_, err = generateEnvironmentCmd(bp)
+	assert.ErrorContains(t, err, `invalid environment variable name "NOT-VALID"`)
+}
+
+func TestGeneratePasswordPolicyCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.password_policy]
+minlen = 14
+minclass = 4
+dcredit = -1
+max_days = 60
+warn_age = 7
+`)
+	cmd, err := generatePasswordPolicyCmd(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, cmd, "'# Managed by imagecfg\nminlen = 14\nminclass = 4\ndcredit = -1\n' > '/etc/security/pwquality.conf.d/50-imagecfg.conf'")
+	assert.Contains(t, cmd, "sed -i '/^PASS_MAX_DAYS/d' '/etc/login.defs' && printf '%s\\n' 'PASS_MAX_DAYS\t60' >> '/etc/login.defs'")
+	assert.Contains(t, cmd, "'PASS_WARN_AGE\t7'")
+	assert.NotContains(t, cmd, "PASS_MIN_DAYS")
+
+	bp = mustParseBlueprint(t, `
+[customizations.password_policy]
+minclass = 5
+`)
+	_, err = generatePasswordPolicyCmd(bp)
+	assert.ErrorContains(t, err, "invalid password policy minclass 5")
+}
+
+func TestGenerateSudoersCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.sudoers]]
+name = "wheel-nopasswd"
+groups = ["wheel"]
+nopasswd = true
+
+[[customizations.sudoers]]
+name = "operator"
+users = ["op"]
+run_as = "root"
+commands = ["/usr/bin/systemctl restart nginx", "/usr/bin/journalctl"]
+`)
+	cmd, err := generateSudoersCmd(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, cmd, "'# Managed by imagecfg\n%wheel ALL=(ALL) NOPASSWD: ALL\n' > '/etc/sudoers.d/wheel-nopasswd.new'")
+	assert.Contains(t, cmd, "(visudo -c -q -f /etc/sudoers.d/wheel-nopasswd.new || { rm -f /etc/sudoers.d/wheel-nopasswd.new; exit 1; }) && mv -f /etc/sudoers.d/wheel-nopasswd.new /etc/sudoers.d/wheel-nopasswd")
+	assert.Contains(t, cmd, "op ALL=(root) /usr/bin/systemctl restart nginx, /usr/bin/journalctl\n")
+
+	bp = mustParseBlueprint(t, `
+[[customizations.sudoers]]
+name = "90.wheel"
+groups = ["wheel"]
+`)
+	_, err = generateSudoersCmd(bp)
+	assert.ErrorContains(t, err, `invalid sudoers name "90.wheel"`)
+}
+
+func TestGeneratePolkitRulesCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.polkit_rules]]
+name = "49-wheel-reboot"
+content = """
+// Let wheel reboot without a password
+polkit.addRule(function(action, subject) {
+    if (action.id == "org.freedesktop.login1.reboot" && subject.isInGroup("wheel")) {
+        return polkit.Result.YES;
+    }
+});"""
+`)
+	cmd, err := generatePolkitRulesCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, "'/etc/polkit-1/rules.d/49-wheel-reboot.rules' && chmod 0644")
+
+	for _, tc := range []struct {
+		src string
+		err string
+	}{
+		{`polkit.addRule(function(action, subject) { return "}"; });`, ""},
+		{`polkit.addRule(function(action, subject) { /* ) */ });`, ""},
+		{`polkit.addRule(function(action, subject) {`, `unclosed '{'`},
+		{"polkit.addRule(function(action, subject) {\n});\n}", `unbalanced '}' on line 3`},
+		{`polkit.addRule(function(action, subject) { return "yes; });`, "unterminated string"},
+	} {
+		err := checkJavaScriptSyntax(tc.src)
+		if tc.err == "" {
+			assert.NoError(t, err, tc.src)
+		} else {
+			assert.ErrorContains(t, err, tc.err, tc.src)
+		}
+	}
+
+	bp = mustParseBlueprint(t, `
+[[customizations.polkit_rules]]
+name = "50-nothing"
+content = "var x = 1;"
+`)
+	_, err = generatePolkitRulesCmd(bp)
+	assert.ErrorContains(t, err, "neither calls polkit.addRule nor polkit.addAdminRule")
+}
+
+func TestGenerateContainerRegistriesCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.container_registries]
+unqualified_search = ["registry.example.com", "quay.io"]
+blocked = ["docker.io"]
+insecure = ["registry.local:5000", "docker.io"]
+`)
+	cmd, err := generateContainerRegistriesCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, `'# Managed by imagecfg
+unqualified-search-registries = ["registry.example.com", "quay.io"]
+
+[[registry]]
+  location = "docker.io"
+  blocked = true
+  insecure = true
+
+[[registry]]
+  location = "registry.local:5000"
+  insecure = true
+' > '/etc/containers/registries.conf.d/50-imagecfg.conf'`)
+
+	bp = mustParseBlueprint(t, `
+[customizations.container_registries]
+blocked = ["https://docker.io"]
+`)
+	_, err = generateContainerRegistriesCmd(bp)
+	assert.ErrorContains(t, err, "without scheme")
+}
+
+func TestGenerateFlatpakCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.flatpak]
+remotes = [{ name = "flathub", url = "https://dl.flathub.org/repo/flathub.flatpakrepo" }]
+refs = [
+  { remote = "flathub", ref = "org.mozilla.firefox" },
+  { remote = "fedora", ref = "org.gnome.Calculator" },
+  { remote = "flathub", ref = "org.gimp.GIMP" },
+]
+`)
+	cmd, err := generateFlatpakCmd(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "(command -v flatpak >/dev/null || dnf install -y flatpak) && "+
+		"flatpak remote-add --system --if-not-exists 'flathub' 'https://dl.flathub.org/repo/flathub.flatpakrepo' && "+
+		"flatpak install --system -y --noninteractive 'flathub' 'org.mozilla.firefox' 'org.gimp.GIMP' && "+
+		"flatpak install --system -y --noninteractive 'fedora' 'org.gnome.Calculator'", cmd)
+
+	bp = mustParseBlueprint(t, `
+[customizations.flatpak]
+remotes = [{ name = "flathub", url = "flathub.flatpakrepo" }]
+`)
+	_, err = generateFlatpakCmd(bp)
+	assert.ErrorContains(t, err, "invalid URL")
+}
+
+func TestGeneratePipCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.pip]
+packages = ["requests==2.31.0", "ansible-core"]
+`)
+	cmd, err := generatePipCmd(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "(python3 -m pip --version >/dev/null 2>&1 || dnf install -y python3-pip) && python3 -m pip install --no-cache-dir 'requests==2.31.0' 'ansible-core'", cmd)
+
+	bp = mustParseBlueprint(t, `
+[customizations.pip]
+packages = ["requests"]
+venv = "/opt/tools"
+`)
+	cmd, err = generatePipCmd(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "([ -x '/opt/tools/bin/python' ] || python3 -m venv '/opt/tools') && '/opt/tools/bin/python' -m pip install --no-cache-dir 'requests'", cmd)
+
+	bp = mustParseBlueprint(t, `
+[customizations.pip]
+packages = ["--index-url=http://evil"]
+`)
+	_, err = generatePipCmd(bp)
+	assert.ErrorContains(t, err, "invalid pip package")
+}
+
+func TestGenerateDConfCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.dconf]]
+path = "org/gnome/desktop/session"
+key = "idle-delay"
+value = "uint32 0"
+lock = true
+
+[[customizations.dconf]]
+path = "org/gnome/desktop/interface"
+key = "gtk-theme"
+value = "'Adwaita-dark'"
+
+[[customizations.dconf]]
+path = "org/gnome/desktop/session"
+key = "session-name"
+value = "'gnome'"
+`)
+	cmd, err := generateDConfCmd(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, cmd, `'# Managed by imagecfg
+[org/gnome/desktop/session]
+idle-delay=uint32 0
+session-name='\''gnome'\''
+
+[org/gnome/desktop/interface]
+gtk-theme='\''Adwaita-dark'\''
+' > '/etc/dconf/db/local.d/00-imagecfg'`)
+	assert.Contains(t, cmd, "'# Managed by imagecfg\n/org/gnome/desktop/session/idle-delay\n' > '/etc/dconf/db/local.d/locks/00-imagecfg'")
+	assert.True(t, strings.HasSuffix(cmd, "dconf update"))
+
+	bp = mustParseBlueprint(t, `
+[[customizations.dconf]]
+path = "/org/gnome/desktop/session/"
+key = "idle-delay"
+value = "uint32 0"
+`)
+	_, err = generateDConfCmd(bp)
+	assert.ErrorContains(t, err, "invalid dconf path")
+}
+
+func TestGenerateUdevRulesCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.udev_rules]]
+name = "70-serial"
+content = """
+# Let the dialout group use the modem
+SUBSYSTEM=="tty", ATTRS{idVendor}=="0403", GROUP="dialout", MODE="0660"
+"""
+`)
+	cmd, err := generateUdevRulesCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, "'/etc/udev/rules.d/70-serial.rules' && chmod 0644")
+	assert.True(t, strings.HasSuffix(cmd, "(if [ -S /run/udev/control ]; then udevadm control --reload; fi)"))
+
+	bp = mustParseBlueprint(t, `
+[[customizations.udev_rules]]
+name = "70-broken"
+content = "SUBSYSTEM"
+`)
+	_, err = generateUdevRulesCmd(bp)
+	assert.ErrorContains(t, err, "udev rule 70-broken line 1 has no key")
+}
+
+func TestGenerateModprobeOptionsCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.modprobe_options]]
+module = "kvm_intel"
+options = ["nested=1", "enable_apicv=0"]
+`)
+	cmd, err := generateModprobeOptionsCmd(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "mkdir -p '/etc/modprobe.d' && printf '%s' '# Managed by imagecfg\noptions kvm_intel nested=1 enable_apicv=0\n' > '/etc/modprobe.d/imagecfg-kvm_intel.conf' && chmod 0644 '/etc/modprobe.d/imagecfg-kvm_intel.conf'", cmd)
+
+	bp = mustParseBlueprint(t, `
+[[customizations.modprobe_options]]
+module = "kvm_intel"
+options = ["nested"]
+`)
+	_, err = generateModprobeOptionsCmd(bp)
+	assert.ErrorContains(t, err, "expected parameter=value")
+}
+
+func TestGenerateTunedCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.tuned]
+profile = "throughput-performance"
+`)
+	cmd, err := generateTunedCmd(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "(rpm -q tuned >/dev/null || dnf install -y tuned) && systemctl enable tuned && "+
+		"if systemctl is-active -q tuned 2>/dev/null; then tuned-adm profile 'throughput-performance'; "+
+		"else printf '%s\\n' 'throughput-performance' > /etc/tuned/active_profile && printf 'manual\\n' > /etc/tuned/profile_mode; fi", cmd)
+
+	bp = mustParseBlueprint(t, `
+[customizations.tuned]
+profile = "virtual-guest; reboot"
+`)
+	_, err = generateTunedCmd(bp)
+	assert.ErrorContains(t, err, "invalid tuned profile")
+}
+
+func TestGenerateSwapCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.swap]
+file = "/var/swapfile"
+size = "2G"
+zswap = { enabled = true, compressor = "zstd", max_pool_percent = 20 }
+`)
+	cmd, err := generateSwapCmd(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, cmd, "([ -f '/var/swapfile' ] || (touch '/var/swapfile' && (chattr +C '/var/swapfile' 2>/dev/null || true) && fallocate -l 2G '/var/swapfile' && chmod 600 '/var/swapfile' && mkswap '/var/swapfile'))")
+	assert.Contains(t, cmd, `(grep -q '^/var/swapfile[[:space:]]' /etc/fstab || printf '%s\n' '/var/swapfile none swap defaults 0 0' >> /etc/fstab)`)
+	assert.Contains(t, cmd, "(if [ -d /run/systemd/system ]; then swapon --show=NAME --noheadings | grep -qx '/var/swapfile' || swapon '/var/swapfile'; fi)")
+	assert.Contains(t, cmd, "w /sys/module/zswap/parameters/enabled - - - - Y\nw /sys/module/zswap/parameters/compressor - - - - zstd\nw /sys/module/zswap/parameters/max_pool_percent - - - - 20\n")
+
+	bp = mustParseBlueprint(t, `
+[customizations.swap]
+file = "/var/swapfile"
+size = "lots"
+`)
+	_, err = generateSwapCmd(bp)
+	assert.ErrorContains(t, err, "invalid swap size")
+}
+
+func TestGenerateMountsCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.mounts]]
+what = "LABEL=data"
+where = "/var/data"
+type = "xfs"
+
+[[customizations.mounts]]
+what = "nfs.example.com:/export/shared"
+where = "/var/mnt/shared-data"
+type = "nfs"
+options = "rw,vers=4.2"
+unit = true
+`)
+	cmd, err := generateMountsCmd(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, cmd, "mkdir -p '/var/data' && (grep -qE '^[^#[:space:]]+[[:space:]]+/var/data[[:space:]]' /etc/fstab || printf '%s\\n' 'LABEL=data /var/data xfs defaults 0 0' >> /etc/fstab)")
+	assert.Contains(t, cmd, "(rpm -q nfs-utils >/dev/null || dnf install -y nfs-utils)")
+	assert.Contains(t, cmd, "After=network-online.target\nWants=network-online.target\n\n[Mount]\nWhat=nfs.example.com:/export/shared\nWhere=/var/mnt/shared-data\nType=nfs\nOptions=rw,vers=4.2\n\n[Install]\nWantedBy=remote-fs.target\n' > '/etc/systemd/system/var-mnt-shared\\x2ddata.mount'")
+	assert.True(t, strings.HasSuffix(cmd, "systemctl enable 'var-mnt-shared\\x2ddata.mount'"))
+
+	bp = mustParseBlueprint(t, `
+[[customizations.mounts]]
+what = "/dev/sdb1"
+where = "/var/data"
+type = "ext4"
+options = "rw, noatime"
+`)
+	_, err = generateMountsCmd(bp)
+	assert.ErrorContains(t, err, "invalid mount options")
+}
+
+func TestGenerateSELinuxCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.selinux]
+mode = "permissive"
+booleans = { httpd_can_network_connect = true, container_manage_cgroup = false }
+`)
+	cmd, err := generateSELinuxCmd(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, cmd, "mkdir -p /etc/selinux && touch '/etc/selinux/config' && sed -i '/^SELINUX=/d' '/etc/selinux/config' && printf '%s\\n' 'SELINUX=permissive' >> '/etc/selinux/config'")
+	assert.Contains(t, cmd, "[ -e /run/ostree-booted ]")
+	assert.Contains(t, cmd, "if selinuxenabled; then setsebool -P container_manage_cgroup off; else semanage boolean -N -m --off container_manage_cgroup; fi && "+
+		"if selinuxenabled; then setsebool -P httpd_can_network_connect on; else semanage boolean -N -m --on httpd_can_network_connect; fi")
+
+	bp = mustParseBlueprint(t, `
+[customizations.selinux]
+mode = "strict"
+`)
+	_, err = generateSELinuxCmd(bp)
+	assert.ErrorContains(t, err, "invalid SELinux mode")
+}
+
+func TestSELinuxModeConfig(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.selinux]
+mode = "permissive"
+`)
+	cmd, err := generateSELinuxCmd(bp)
+	require.NoError(t, err)
+
+	for _, config := range []string{"", "SELINUX=enforcing\nSELINUXTYPE=targeted\n"} {
+		dir := filepath.Join(t.TempDir(), "selinux")
+		if config != "" {
+			require.NoError(t, os.Mkdir(dir, 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "config"), []byte(config), 0644))
+		}
+		// Applied twice like every block
+		for range 2 {
+			out, err := exec.Command("bash", "-c", strings.ReplaceAll(cmd, "/etc/selinux", dir)).CombinedOutput()
+			require.NoError(t, err, string(out))
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "config"))
+		require.NoError(t, err)
+		if config == "" {
+			assert.Equal(t, "SELINUX=permissive\n", string(data))
+		} else {
+			assert.Equal(t, "SELINUXTYPE=targeted\nSELINUX=permissive\n", string(data))
+		}
+	}
+}
+
+func TestGenerateFapolicydCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.fapolicyd]
+trust = ["/opt/app/bin/app"]
+rules = [{ name = "80-app", content = "%languages=application/x-executable\nallow perm=execute uid=app : dir=/opt/app/\n" }]
+`)
+	cmd, err := generateFapolicydCmd(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, cmd, "(fapolicyd-cli --file update '/opt/app/bin/app' --trust-file imagecfg 2>/dev/null || fapolicyd-cli --file add '/opt/app/bin/app' --trust-file imagecfg)")
+	assert.Contains(t, cmd, "> '/etc/fapolicyd/rules.d/80-app.rules'")
+	assert.True(t, strings.HasSuffix(cmd, "if systemctl is-active -q fapolicyd 2>/dev/null; then fagenrules --load; else fagenrules; fi"))
+
+	bp = mustParseBlueprint(t, `
+[customizations.fapolicyd]
+rules = [{ name = "80-app", content = "permit perm=any all : all" }]
+`)
+	_, err = generateFapolicydCmd(bp)
+	assert.ErrorContains(t, err, `fapolicyd rules 80-app line 1: unknown decision "permit"`)
+}
+
+func TestGenerateDomainJoinCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.domain_join]
+provider = "ad"
+domain = "corp.example.com"
+ou = "OU=Servers,DC=corp,DC=example,DC=com"
+user = "joiner"
+password_file = "/run/secrets/join"
+`)
+	cmd, err := generateDomainJoinCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, "(realm list --name-only | grep -qix 'corp.example.com' || cat '/run/secrets/join' | realm join --user='joiner' --computer-ou='OU=Servers,DC=corp,DC=example,DC=com' 'corp.example.com')")
+	assert.Empty(t, blockEnvironment(bp))
+
+	bp = mustParseBlueprint(t, `
+[customizations.domain_join]
+provider = "ipa"
+domain = "ipa.example.com"
+user = "admin"
+password_env = "IPA_PASSWORD"
+`)
+	cmd, err = generateDomainJoinCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, `([ -f /etc/ipa/default.conf ] || printf '%s' "${IPA_PASSWORD:?IPA_PASSWORD must contain the domain join password}" | ipa-client-install --unattended --mkhomedir --domain='ipa.example.com' --principal='admin')`)
+	// The password is never an argument
+	assert.NotContains(t, cmd, "--password")
+	// sudo keeps it in the environment of the blocks
+	assert.Equal(t, []string{"IPA_PASSWORD"}, blockEnvironment(bp))
+
+	bp = mustParseBlueprint(t, `
+[customizations.domain_join]
+provider = "ad"
+domain = "corp.example.com"
+user = "joiner"
+`)
+	_, err = generateDomainJoinCmd(bp)
+	assert.ErrorContains(t, err, "exactly one of password_file or password_env")
+}
+
+func TestGenerateZramCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.zram]
+size_fraction = 0.25
+max_size_mb = 4096
+compression_algorithm = "zstd"
+swap_priority = 100
+`)
+	cmd, err := generateZramCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, "'# Managed by imagecfg\n[zram0]\nzram-size = min(ram * 0.25, 4096)\ncompression-algorithm = zstd\nswap-priority = 100\n' > '/etc/systemd/zram-generator.conf'")
+
+	bp = mustParseBlueprint(t, `
+[customizations.zram]
+compression_algorithm = "lz4"
+`)
+	cmd, err = generateZramCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, "zram-size = ram * 0.5\ncompression-algorithm = lz4\n")
+
+	bp = mustParseBlueprint(t, `
+[customizations.zram]
+size_fraction = 8.0
+`)
+	_, err = generateZramCmd(bp)
+	assert.ErrorContains(t, err, "invalid zram size_fraction")
+}
+
+func TestGenerateGreenbootChecksCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.greenboot_checks]]
+name = "app-health"
+type = "required"
+content = """#!/bin/bash
+curl -sf http://localhost:8080/health
+"""
+
+[[customizations.greenboot_checks]]
+name = "disk-space"
+type = "wanted"
+content = "#!/bin/sh\ndf /var"
+`)
+	cmd, err := generateGreenbootChecksCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, "> '/etc/greenboot/check/required.d/app-health.sh' && chmod 0755 '/etc/greenboot/check/required.d/app-health.sh'")
+	assert.Contains(t, cmd, "'#!/bin/sh\ndf /var\n' > '/etc/greenboot/check/wanted.d/disk-space.sh'")
+
+	bp = mustParseBlueprint(t, `
+[[customizations.greenboot_checks]]
+name = "app-health"
+type = "optional"
+content = "#!/bin/sh\ntrue"
+`)
+	_, err = generateGreenbootChecksCmd(bp)
+	assert.ErrorContains(t, err, "must be required or wanted")
+}
+
+func TestGenerateSyspurposeCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.syspurpose]
+role = "Red Hat Enterprise Linux Server"
+sla = "Premium"
+usage = "Production"
+addons = ["ELS"]
+`)
+	cmd, err := generateSyspurposeCmd(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "if command -v subscription-manager >/dev/null; then subscription-manager syspurpose role --set 'Red Hat Enterprise Linux Server'; else syspurpose set-role 'Red Hat Enterprise Linux Server'; fi && "+
+		"if command -v subscription-manager >/dev/null; then subscription-manager syspurpose service-level --set 'Premium'; else syspurpose set-sla 'Premium'; fi && "+
+		"if command -v subscription-manager >/dev/null; then subscription-manager syspurpose usage --set 'Production'; else syspurpose set-usage 'Production'; fi && "+
+		"if command -v subscription-manager >/dev/null; then subscription-manager syspurpose addons --add 'ELS'; else syspurpose add-addons 'ELS'; fi", cmd)
+}
+
+func TestGenerateLocaleCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.locale]
+languages = ["en_US.UTF-8", "de_DE.UTF-8", "en_GB.UTF-8", "C.UTF-8"]
+keyboard = "us"
+`)
+	cmd, err := generateLocaleCmd(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "(rpm -q glibc-langpack-en glibc-langpack-de >/dev/null || dnf install -y glibc-langpack-en glibc-langpack-de) && "+
+		"echo 'LANG=en_US.UTF-8' > /etc/locale.conf && echo 'KEYMAP=us' > /etc/vconsole.conf", cmd)
+
+	bp = mustParseBlueprint(t, `
+[customizations.locale]
+languages = ["sr_RS.UTF-8@latin", "de_DE.ISO-8859-1"]
+generate = "localedef"
+`)
+	cmd, err = generateLocaleCmd(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "localedef -i sr_RS@latin -f UTF-8 sr_RS.UTF-8@latin && localedef -i de_DE -f ISO-8859-1 de_DE.ISO-8859-1 && "+
+		"echo 'LANG=sr_RS.UTF-8@latin' > /etc/locale.conf", cmd)
+
+	bp = mustParseBlueprint(t, `
+[customizations.locale]
+languages = ["english"]
+`)
+	_, err = generateLocaleCmd(bp)
+	assert.ErrorContains(t, err, `invalid locale "english"`)
+}
+
+func TestGenerateLocaleCmdX11Keyboard(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.locale]
+keyboard = "us"
+x11_layout = "us,cz"
+x11_variant = ",qwerty"
+x11_options = "grp:alt_shift_toggle"
+`)
+	cmd, err := generateLocaleCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, "echo 'KEYMAP=us' > /etc/vconsole.conf && ")
+	assert.Contains(t, cmd, `'# Managed by imagecfg
+Section "InputClass"
+        Identifier "system-keyboard"
+        MatchIsKeyboard "on"
+        Option "XkbLayout" "us,cz"
+        Option "XkbVariant" ",qwerty"
+        Option "XkbOptions" "grp:alt_shift_toggle"
+EndSection
+' > '/etc/X11/xorg.conf.d/00-keyboard.conf'`)
+
+	bp = mustParseBlueprint(t, `
+[customizations.locale]
+x11_variant = "dvorak"
+`)
+	_, err = generateLocaleCmd(bp)
+	assert.ErrorContains(t, err, "require x11_layout")
+}
+
+// defaultHosts is /etc/hosts as Fedora ships it
+const defaultHosts = `# Loopback entries; do not change.
+127.0.0.1   localhost localhost.localdomain localhost4 localhost4.localdomain4
+::1         localhost localhost.localdomain localhost6 localhost6.localdomain6
+`
+
+func TestHostsEntryKeepsLocalhost(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "::1", "127.0.1.1"} {
+		bp := mustParseBlueprint(t, fmt.Sprintf(`
+[customizations]
+hostname = "web1.example.com"
+
+[customizations.hosts_entry]
+ip = %q
+`, ip))
+		pattern, line, err := hostsEntryLine(bp)
+		require.NoError(t, err)
+		want := defaultHosts + ip + " web1.example.com web1\n"
+
+		// The commands, applied twice like every block
+		hosts := filepath.Join(t.TempDir(), "hosts")
+		require.NoError(t, os.WriteFile(hosts, []byte(defaultHosts), 0644))
+		cmd := replaceMatchingLineCmd(hosts, pattern, line)
+		for range 2 {
+			out, err := exec.Command("bash", "-c", cmd).CombinedOutput()
+			require.NoError(t, err, string(out))
+		}
+		data, err := os.ReadFile(hosts)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data), ip)
+
+		// The native operation
+		require.NoError(t, os.WriteFile(hosts, []byte(defaultHosts), 0644))
+		for range 2 {
+			require.NoError(t, replaceMatchingLineOp{hosts, pattern, line}.Apply(&nativeEnv{}))
+		}
+		data, err = os.ReadFile(hosts)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data), ip)
+	}
+
+	// An entry of another address is replaced
+	bp := mustParseBlueprint(t, `
+[customizations]
+hostname = "web1.example.com"
+
+[customizations.hosts_entry]
+`)
+	pattern, line, err := hostsEntryLine(bp)
+	require.NoError(t, err)
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(hosts, []byte(defaultHosts+"10.0.0.5 web1.example.com web1\n"), 0644))
+	require.NoError(t, replaceMatchingLineOp{hosts, pattern, line}.Apply(&nativeEnv{}))
+	data, err := os.ReadFile(hosts)
+	require.NoError(t, err)
+	assert.Equal(t, defaultHosts+"127.0.1.1 web1.example.com web1\n", string(data))
+}
+
+func TestGenerateHostnameCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations]
+hostname = "web1.example.com"
+pretty_hostname = "Web Server 1"
+chassis = "vm"
+
+[customizations.hosts_entry]
+`)
+	cmd, err := generateHostnameCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, "echo 'web1.example.com' > /etc/hostname && ")
+	assert.Contains(t, cmd, `sed -i -E '/^[^#[:space:]]+[[:space:]]+web1\.example\.com([[:space:]]+web1)?[[:space:]]*$/d' '/etc/hosts' && printf '%s\n' '127.0.1.1 web1.example.com web1' >> '/etc/hosts'`)
+	assert.Contains(t, cmd, "if [ -d /run/systemd/system ]; then hostnamectl set-hostname --pretty 'Web Server 1' && hostnamectl set-chassis vm; else ")
+	assert.Contains(t, cmd, `printf '%s\n' 'PRETTY_HOSTNAME="Web Server 1"' >> '/etc/machine-info'`)
+	assert.Contains(t, cmd, `printf '%s\n' 'CHASSIS=vm' >> '/etc/machine-info'; fi`)
+
+	bp = mustParseBlueprint(t, `
+[customizations]
+chassis = "mainframe"
+`)
+	_, err = generateHostnameCmd(bp)
+	assert.ErrorContains(t, err, `invalid chassis "mainframe"`)
+
+	bp = mustParseBlueprint(t, `
+[customizations.hosts_entry]
+ip = "10.0.0.5"
+`)
+	_, err = generateHostnameCmd(bp)
+	assert.ErrorContains(t, err, "hosts_entry requires a hostname")
+}
+
+func TestGenerateMachineIDResetCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations]
+reset_machine_id = true
+`)
+	_, blocks, err := generateBashScript(bp)
+	require.NoError(t, err)
+	last := blocks[len(blocks)-1]
+	assert.Equal(t, "Reset Machine ID", last.Name)
+	assert.Contains(t, last.Commands, "(if [ -e /etc/machine-id ]; then truncate -s 0 /etc/machine-id; fi) && rm -f /var/lib/dbus/machine-id")
+
+	cmd, err := generateMachineIDResetCmd(mustParseBlueprint(t, ""))
+	require.NoError(t, err)
+	assert.Empty(t, cmd)
+}
+
+func TestGenerateDefaultTargetCmd(t *testing.T) {
+	cmd, err := generateDefaultTargetCmd(mustParseBlueprint(t, `
+[customizations]
+default_target = "graphical"
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "systemctl set-default graphical.target", cmd)
+
+	cmd, err = generateDefaultTargetCmd(mustParseBlueprint(t, `
+[customizations]
+default_target = "multi-user.target"
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "systemctl set-default multi-user.target", cmd)
+
+	_, err = generateDefaultTargetCmd(mustParseBlueprint(t, `
+[customizations]
+default_target = "graphical; reboot"
+`))
+	assert.ErrorContains(t, err, "invalid default target")
+}
+
+func TestGenerateFilesAndDirectoriesCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.directories]]
+path = "/etc/myapp"
+mode = "0750"
+group = "wheel"
+
+[[customizations.files]]
+path = "/etc/myapp/config"
+data = "key=value\n"
+user = "root"
+group = 10
+`)
+	cmd, err := generateFilesAndDirectoriesCmd(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "([ -d '/etc/myapp' ] || mkdir '/etc/myapp') && chmod 0750 '/etc/myapp' && chown ':wheel' '/etc/myapp' && "+
+		"mkdir -p '/etc/myapp' && printf '%s' 'key=value\n' > '/etc/myapp/config' && chmod 0644 '/etc/myapp/config' && chown 'root:10' '/etc/myapp/config'", cmd)
+}
+
+func TestGenerateSysusersCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.group]]
+name = "app"
+gid = 2000
+
+[[customizations.user]]
+name = "svc"
+description = "App service"
+uid = 2001
+gid = 2000
+groups = ["wheel"]
+password = "$6$hash"
+
+[[customizations.user]]
+name = "ops"
+`)
+	cmd, err := generateSysusersCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, `'# Managed by imagecfg
+g app 2000
+u svc 2001:2000 "App service" "/home/svc" "/bin/bash"
+m svc wheel
+u ops - - "/home/ops" "/bin/bash"
+' > '/usr/lib/sysusers.d/imagecfg.conf'`)
+	assert.Contains(t, cmd, " && systemd-sysusers /usr/lib/sysusers.d/imagecfg.conf && ")
+	assert.Contains(t, cmd, `'# Managed by imagecfg
+d /home/svc 0700 svc 2000 -
+d /home/ops 0700 ops ops -
+' > '/usr/lib/tmpfiles.d/imagecfg-homes.conf'`)
+
+	cmd, err = generateUserCredentialsCmd(bp)
+	require.NoError(t, err)
+	assert.Equal(t, `([ "$(getent shadow svc | cut -d: -f2)" = '$6$hash' ] || echo 'svc:$6$hash' | chpasswd -e)`, cmd)
+}
+
+func TestGenerateTmpfilesCmd(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.directories]]
+path = "/var/lib/myapp"
+
+[[customizations.files]]
+path = "/etc/myapp.conf"
+data = " indented\t\"100%\"\n"
+mode = "0600"
+user = "root"
+`)
+	cmd, err := generateTmpfilesCmd(bp)
+	require.NoError(t, err)
+	assert.Contains(t, cmd, `'# Managed by imagecfg
+d /var/lib/myapp 0755 - - -
+f+ /etc/myapp.conf 0600 root - \x20indented\t\x22100%%\x22\n
+' > '/usr/lib/tmpfiles.d/imagecfg.conf'`)
+	assert.Contains(t, cmd, " && systemd-tmpfiles --create /usr/lib/tmpfiles.d/imagecfg.conf")
+}
+
+func TestGenerateBashScriptDeclarative(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.user]]
+name = "admin"
+
+[[customizations.files]]
+path = "/etc/motd"
+data = "hello"
+`)
+	declarativeMode = true
+	defer func() { declarativeMode = false }()
+
+	_, blocks, err := generateBashScript(bp)
+	require.NoError(t, err)
+	var names []string
+	for _, block := range blocks {
+		names = append(names, block.Name)
+	}
+	assert.Equal(t, []string{"Packages", "Sysusers", "Tmpfiles", "Cleanup DNF Cache"}, names)
+}
+
+func TestUserAuthorizedKeys(t *testing.T) {
+	// The current user, which exists and can own the files
+	current, err := user.Current()
+	require.NoError(t, err)
+	home := t.TempDir()
+	keys := filepath.Join(home, ".ssh/authorized_keys")
+	existing := "ssh-ed25519 AAAA first\nssh-rsa CCCC other\n"
+	want := existing + "ssh-ed25519 BBBB second\n"
+	bp := mustParseBlueprint(t, fmt.Sprintf(`
+[[customizations.user]]
+name = %q
+home = %q
+key = """
+ssh-ed25519 AAAA first
+ssh-ed25519 BBBB second
+"""
+`, current.Username, home))
+
+	cmds := userCredentialCmds(bp.Customizations.GetUsers()[0])
+	require.Len(t, cmds, 1)
+	assert.Equal(t, 2, strings.Count(cmds[0], "grep -qxF"))
+	require.NoError(t, os.MkdirAll(filepath.Dir(keys), 0700))
+	require.NoError(t, os.WriteFile(keys, []byte(existing), 0600))
+	for range 2 {
+		out, err := exec.Command("bash", "-c", cmds[0]).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	data, err := os.ReadFile(keys)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(data))
+
+	ops, err := nativeUsers(bp)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keys, []byte(existing), 0600))
+	for range 2 {
+		for _, op := range ops {
+			require.NoError(t, op.Apply(&nativeEnv{}), op.String())
+		}
+	}
+	data, err = os.ReadFile(keys)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(data))
+}
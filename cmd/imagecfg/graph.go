@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// installerBlocks are the blocks that install packages, either the blueprint ones or
+// the tools they need on demand
+var installerBlocks = []string{
+	"Packages", "Flatpak", "Pip", "Locale", "DConf", "Firewall", "Tuned", "Zram",
+	"Mounts", "Fapolicyd", "Domain Join", "Greenboot", "Scheduled Tasks",
+}
+
+// blockDependencies lists for each block the blocks that have to run before it. The
+// order of blockGenerators satisfies all of them.
+var blockDependencies = func() map[string][]string {
+	deps := map[string][]string{
+		// The packages may provide the tools, units and configuration these adjust
+		"Flatpak":     {"Packages"},
+		"Pip":         {"Packages"},
+		"Chrony":      {"Packages"},
+		"Firewall":    {"Packages"},
+		"SSHD":        {"Packages"},
+		"Tuned":       {"Packages"},
+		"Zram":        {"Packages"},
+		"Fapolicyd":   {"Packages"},
+		"Greenboot":   {"Packages"},
+		"Domain Join": {"Packages", "Hostname"},
+		// Aging settings apply to the users created afterwards
+		"Users": {"Groups", "Password Policy"},
+		// Owners have to exist, unit files may come from the blueprint files
+		"Files and Directories": {"Groups", "Users"},
+		"Sudoers":               {"Groups"},
+		"Services":              {"Packages", "Files and Directories"},
+		"Scheduled Tasks":       {"Users"},
+		// Declarative mode
+		"User Credentials": {"Sysusers"},
+		"Tmpfiles":         {"Sysusers"},
+		// The machine ID is reset as the very last step
+		"Reset Machine ID": {"Cleanup DNF Cache"},
+	}
+	// dnf has to go through the proxy, and its cache is cleaned once nothing installs anymore
+	for _, name := range installerBlocks {
+		deps[name] = append(deps[name], "Proxy")
+		deps["Cleanup DNF Cache"] = append(deps["Cleanup DNF Cache"], name)
+	}
+	return deps
+}()
+
+// exclusiveTools are the tools whose blocks run alone when blocks are applied in
+// parallel: package scriptlets may change any file and take the rpm database lock
+var exclusiveTools = []string{"dnf", "rpm", "rpm-ostree"}
+
+// toolLocks are the locks tools take, blocks running tools taking the same lock never
+// run at the same time
+var toolLocks = map[string]string{
+	"semanage":  "SELinux policy store",
+	"setsebool": "SELinux policy store",
+	"flatpak":   "flatpak installation",
+}
+
+// dependsOn returns whether the block has to run after the other one, directly or
+// through blocks between them.
+func dependsOn(block, other string) bool {
+	seen := make(map[string]bool)
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		for _, dep := range blockDependencies[name] {
+			if dep == other {
+				return true
+			}
+			if !seen[dep] {
+				seen[dep] = true
+				if visit(dep) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return visit(block)
+}
+
+// pathsOverlap returns whether any path of a is one of b, or a parent or child of one.
+func pathsOverlap(a, b []string) bool {
+	for _, p := range a {
+		for _, q := range b {
+			if p == q || strings.HasPrefix(q, p+"/") || strings.HasPrefix(p, q+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blockPrerequisites returns for each block the indexes of the earlier blocks that
+// have to finish before it can run: those it depends on, those changing the same files
+// or running tools taking the same lock, and all of them for blocks running the exclusive
+// tools and for resetting the machine ID, the very last step.
+func blockPrerequisites(namedBlocks []NamedCommandBlock) [][]int {
+	paths := make([][]string, len(namedBlocks))
+	locks := make([][]string, len(namedBlocks))
+	exclusive := make([]bool, len(namedBlocks))
+	for i, block := range namedBlocks {
+		paths[i] = blockPaths(block.Commands)
+		for tool, lock := range toolLocks {
+			if toolRegexp(tool).MatchString(block.Commands) {
+				locks[i] = append(locks[i], lock)
+			}
+		}
+		exclusive[i] = slices.ContainsFunc(exclusiveTools, func(tool string) bool { return toolRegexp(tool).MatchString(block.Commands) })
+	}
+
+	prerequisites := make([][]int, len(namedBlocks))
+	for j, block := range namedBlocks {
+		for i, earlier := range namedBlocks[:j] {
+			switch {
+			case block.Name == machineIDResetBlock.name, exclusive[i], exclusive[j]:
+			case dependsOn(block.Name, earlier.Name):
+			case pathsOverlap(paths[i], paths[j]):
+			case slices.ContainsFunc(locks[i], func(lock string) bool { return slices.Contains(locks[j], lock) }):
+			default:
+				continue
+			}
+			prerequisites[j] = append(prerequisites[j], i)
+		}
+	}
+	return prerequisites
+}
+
+var graphFormat string
+
+var graphCmd = &cobra.Command{
+	Use:   "graph [blueprint.toml...]",
+	Short: "Print the blocks of an OSBuild blueprint and their dependencies",
+	Long: `Prints the blocks an OSBuild blueprint (TOML format) translates to as a graph,
+with an edge for every ordering constraint between them, e.g. groups before
+users or the proxy before anything installing packages.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+Supported formats:
+- dot: Graphviz DOT
+- mermaid: Mermaid flowchart`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		_, namedBlocks, err := generateBashScript(bp)
+		if err != nil {
+			return fmt.Errorf("error generating block graph: %w", err)
+		}
+		var out string
+		switch graphFormat {
+		case "dot":
+			out = graphDOT(namedBlocks)
+		case "mermaid":
+			out = graphMermaid(namedBlocks)
+		default:
+			return fmt.Errorf("unknown graph format %q, must be dot or mermaid", graphFormat)
+		}
+		fmt.Print(out)
+		return nil
+	},
+}
+
+func init() {
+	graphCmd.Flags().StringVar(&graphFormat, "format", "dot", "output format, dot or mermaid")
+	rootCmd.AddCommand(graphCmd)
+}
+
+// graphEdge is an ordering constraint, From runs before To
+type graphEdge struct {
+	From, To int
+}
+
+// graphEdges returns the dependencies between the given blocks, as indexes into namedBlocks.
+func graphEdges(namedBlocks []NamedCommandBlock) []graphEdge {
+	index := make(map[string]int)
+	for i, block := range namedBlocks {
+		index[block.Name] = i
+	}
+	var edges []graphEdge
+	for i, block := range namedBlocks {
+		for _, dep := range blockDependencies[block.Name] {
+			if j, ok := index[dep]; ok {
+				edges = append(edges, graphEdge{From: j, To: i})
+			}
+		}
+	}
+	return edges
+}
+
+// graphDOT renders the block graph in the Graphviz DOT language.
+func graphDOT(namedBlocks []NamedCommandBlock) string {
+	var out strings.Builder
+	out.WriteString("digraph imagecfg {\n")
+	for _, block := range namedBlocks {
+		fmt.Fprintf(&out, "  %s;\n", strconv.Quote(block.Name))
+	}
+	for _, edge := range graphEdges(namedBlocks) {
+		fmt.Fprintf(&out, "  %s -> %s;\n", strconv.Quote(namedBlocks[edge.From].Name), strconv.Quote(namedBlocks[edge.To].Name))
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
+
+// graphMermaid renders the block graph as a Mermaid flowchart. The nodes are numbered
+// in the order the blocks run.
+func graphMermaid(namedBlocks []NamedCommandBlock) string {
+	var out strings.Builder
+	out.WriteString("flowchart TD\n")
+	for i, block := range namedBlocks {
+		fmt.Fprintf(&out, "  b%d[\"%s\"]\n", i+1, strings.ReplaceAll(block.Name, `"`, "#quot;"))
+	}
+	for _, edge := range graphEdges(namedBlocks) {
+		fmt.Fprintf(&out, "  b%d --> b%d\n", edge.From+1, edge.To+1)
+	}
+	return out.String()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockDependenciesMatchOrder(t *testing.T) {
+	// The position every block runs at, the declarative ones replace others
+	position := make(map[string]int)
+	for i, blk := range blockGenerators {
+		position[blk.name] = i
+		if replacement, ok := declarativeBlockGenerators[blk.name]; ok {
+			position[replacement.name] = i
+		}
+	}
+	position["Cleanup DNF Cache"] = len(blockGenerators)
+	position[machineIDResetBlock.name] = len(blockGenerators) + 1
+
+	for name, deps := range blockDependencies {
+		require.Contains(t, position, name)
+		for _, dep := range deps {
+			require.Contains(t, position, dep)
+			assert.Less(t, position[dep], position[name], "%s must run before %s", dep, name)
+		}
+	}
+}
+
+func TestGraph(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.group]]
+name = "app"
+
+[[customizations.user]]
+name = "admin"
+
+[customizations.journald]
+storage = "persistent"
+`)
+	_, blocks, err := generateBashScript(bp)
+	require.NoError(t, err)
+
+	assert.Equal(t, `digraph imagecfg {
+  "Packages";
+  "Groups";
+  "Users";
+  "Journald";
+  "Cleanup DNF Cache";
+  "Groups" -> "Users";
+  "Packages" -> "Cleanup DNF Cache";
+}
+`, graphDOT(blocks))
+
+	assert.Equal(t, `flowchart TD
+  b1["Packages"]
+  b2["Groups"]
+  b3["Users"]
+  b4["Journald"]
+  b5["Cleanup DNF Cache"]
+  b2 --> b3
+  b1 --> b5
+`, graphMermaid(blocks))
+}
+
+func TestBlockPrerequisites(t *testing.T) {
+	blocks := []NamedCommandBlock{
+		{Name: "Proxy", Commands: "sed -i '/^http_proxy=/d' /etc/environment"},
+		{Name: "Environment", Commands: "sed -i '/^EDITOR=/d' /etc/environment"},
+		{Name: "Packages", Commands: "dnf install -y nginx"},
+		{Name: "Hostname", Commands: "echo 'host' > /etc/hostname"},
+		{Name: "Groups", Commands: "getent group app >/dev/null || groupadd app"},
+		{Name: "Users", Commands: "getent passwd admin >/dev/null || useradd admin"},
+		{Name: "Journald", Commands: "mkdir -p '/etc/systemd/journald.conf.d'"},
+		{Name: "SELinux", Commands: "setsebool -P httpd_can_network_connect 1"},
+		{Name: "Fapolicyd", Commands: "semanage fcontext -m -t bin_t '/opt/app(/.*)?'"},
+		{Name: "Cleanup DNF Cache", Commands: "dnf clean all"},
+		{Name: "Reset Machine ID", Commands: "truncate -s 0 /etc/machine-id"},
+	}
+	assert.Equal(t, [][]int{
+		nil,
+		{0},                         // Both change /etc/environment
+		{0, 1},                      // dnf runs alone
+		{2},                         // Only after the packages
+		{2},                         // Only after the packages
+		{2, 4},                      // Users after groups, which use the same files
+		{2},                         // Only after the packages
+		{2},                         // Only after the packages
+		{0, 2, 7},                   // After the proxy, both lock the SELinux policy store
+		{0, 1, 2, 3, 4, 5, 6, 7, 8}, // dnf runs alone
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+	}, blockPrerequisites(blocks))
+
+	assert.True(t, dependsOn("Files and Directories", "Groups"))
+	assert.True(t, dependsOn("Services", "Groups"), "through Files and Directories and Users")
+	assert.False(t, dependsOn("Groups", "Users"))
+}
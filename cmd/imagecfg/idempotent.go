@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// idempotentCheck is set by --idempotent, bash and apply then refuse to generate
+// commands that are not safe to run twice
+var idempotentCheck bool
+
+// idempotencyRule is a command that fails or duplicates state when it runs twice,
+// unless the command it is part of guards it
+type idempotencyRule struct {
+	command *regexp.Regexp
+	// guard makes the command safe, nil if nothing does
+	guard   *regexp.Regexp
+	message string
+}
+
+var idempotencyRules = []idempotencyRule{
+	{regexp.MustCompile(`(^|[\s(;|])(useradd|groupadd)\s`), regexp.MustCompile(`getent (passwd|group) `), "creates a user or group without checking that it exists"},
+	{regexp.MustCompile(`(^|[\s(;|])usermod\s+-aG\s`), regexp.MustCompile(`grep -q`), "adds a user to groups without checking that it is a member"},
+	{regexp.MustCompile(`(^|[\s(;|])chpasswd\s`), regexp.MustCompile(`getent shadow `), "sets a password without checking that it is set, which resets its age"},
+	{regexp.MustCompile(`(^|[\s(;|])mkdir\s+[^-\s]`), regexp.MustCompile(`\[ -d `), "creates a directory without -p or checking that it exists"},
+	{regexp.MustCompile(`(^|[\s(;|])ln\s+-s\s`), nil, "creates a link that exists on the second run, use ln -sf"},
+	{regexp.MustCompile(`(^|[\s(;|])(mkswap|fallocate)\s`), regexp.MustCompile(`\[ -f `), "recreates a swap file that may be in use"},
+	{regexp.MustCompile(`(^|[\s(;|])(realm join|ipa-client-install)\s`), regexp.MustCompile(`\|\|`), "joins a domain without checking that it is joined"},
+	{regexp.MustCompile(`(^|[\s(;|])semanage \S+ (-a|--add)\s`), nil, "adds a SELinux record that exists on the second run, use -m"},
+}
+
+// quotedRegexp matches single quoted strings, which are arguments or file contents
+var quotedRegexp = regexp.MustCompile(`'[^']*'`)
+
+// appendRegexp matches appends to a file, with the file
+var appendRegexp = regexp.MustCompile(`(>>|tee -a)\s*('[^']*'|[^\s;)]+)`)
+
+// lineDeleteRegexp matches sed commands deleting lines by their start, with the file
+var lineDeleteRegexp = regexp.MustCompile(`sed -i (?:-E )?'/\^[^']*/d' ('[^']*'|[^\s;)]+)`)
+
+// idempotencyProblem is a generated command that is not safe to run twice
+type idempotencyProblem struct {
+	Block   string
+	Command string
+	Message string
+}
+
+// commandSegments splits commands at the newlines and && outside of quotes, subshells
+// and groups, so that guards stay with the commands they guard.
+func commandSegments(commands string) []string {
+	var segments []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(commands); i++ {
+		c := commands[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(' || c == '{':
+			depth++
+		case (c == ')' || c == '}') && depth > 0:
+			depth--
+		case depth > 0:
+		case c == '\n':
+			segments = append(segments, commands[start:i])
+			start = i + 1
+		case strings.HasPrefix(commands[i:], " && "):
+			segments = append(segments, commands[start:i])
+			i += len(" && ") - 1
+			start = i + 1
+		}
+	}
+	segments = append(segments, commands[start:])
+	var nonEmpty []string
+	for _, segment := range segments {
+		if s := strings.TrimSpace(segment); s != "" {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	return nonEmpty
+}
+
+// inQuotes returns whether the byte at i of the command is in single quotes.
+func inQuotes(command string, i int) bool {
+	return strings.Count(command[:i], "'")%2 == 1
+}
+
+// appendGuarded returns whether an append to file is safe to run twice: the segment
+// checks for the line with grep first, or an earlier segment deletes it.
+func appendGuarded(segment, file string, earlier []string) bool {
+	if strings.Contains(segment, "grep -q") {
+		return true
+	}
+	for _, prev := range earlier {
+		for _, m := range lineDeleteRegexp.FindAllStringSubmatch(prev, -1) {
+			if m[1] == file {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// idempotencyProblems returns the commands of the blocks that are not safe to run
+// twice.
+func idempotencyProblems(blocks []NamedCommandBlock) []idempotencyProblem {
+	var problems []idempotencyProblem
+	for _, block := range blocks {
+		segments := commandSegments(block.Commands)
+		for i, segment := range segments {
+			unquoted := quotedRegexp.ReplaceAllString(segment, "''")
+			for _, rule := range idempotencyRules {
+				if rule.command.MatchString(unquoted) && (rule.guard == nil || !rule.guard.MatchString(unquoted)) {
+					problems = append(problems, idempotencyProblem{block.Name, segment, rule.message})
+				}
+			}
+			for _, m := range appendRegexp.FindAllStringSubmatchIndex(segment, -1) {
+				file := segment[m[4]:m[5]]
+				if !inQuotes(segment, m[0]) && !appendGuarded(segment, file, segments[:i]) {
+					problems = append(problems, idempotencyProblem{block.Name, segment, "appends to " + file + " without removing or checking for the line first"})
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// checkIdempotent fails if any command of the blocks is not safe to run twice.
+func checkIdempotent(blocks []NamedCommandBlock) error {
+	problems := idempotencyProblems(blocks)
+	if len(problems) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, problem := range problems {
+		lines = append(lines, fmt.Sprintf("%s: %s: %s", problem.Block, problem.Message, problem.Command))
+	}
+	return fmt.Errorf("commands not safe to apply twice:\n%s", strings.Join(lines, "\n"))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandSegments(t *testing.T) {
+	assert.Equal(t, []string{
+		"mkdir -p '/etc/a && b'",
+		"(getent passwd admin >/dev/null || useradd admin)",
+		"x",
+		"{ echo a; echo b; } > /etc/c",
+		"echo \"&& \\\" &&\"",
+	}, commandSegments("mkdir -p '/etc/a && b' && (getent passwd admin >/dev/null || useradd admin) && x\n\n"+
+		"{ echo a; echo b; } > /etc/c\necho \"&& \\\" &&\""))
+}
+
+func TestIdempotencyProblems(t *testing.T) {
+	unsafe := map[string]string{
+		"useradd admin":                                "creates a user or group",
+		"mkdir '/etc/myapp'":                           "creates a directory",
+		"usermod -aG wheel admin":                      "adds a user to groups",
+		"echo 'admin:$6$x' | chpasswd -e":              "sets a password",
+		"ln -s /usr/share/zoneinfo/UTC /etc/localtime": "creates a link",
+		"mkswap /swapfile":                             "recreates a swap file",
+		"realm join corp.example.com":                  "joins a domain",
+		"semanage port -a -t ssh_port_t -p tcp 2222":   "adds a SELinux record",
+		"echo 'LANG=C' >> /etc/environment":            "appends to /etc/environment",
+		"printf '%s\\n' 'a' | tee -a '/etc/fstab'":     "appends to '/etc/fstab'",
+	}
+	for commands, message := range unsafe {
+		problems := idempotencyProblems([]NamedCommandBlock{{Name: "Test", Commands: commands}})
+		if assert.Len(t, problems, 1, commands) {
+			assert.Contains(t, problems[0].Message, message)
+			assert.Equal(t, "Test", problems[0].Block)
+		}
+	}
+
+	safe := []string{
+		"getent passwd admin >/dev/null || useradd admin",
+		"([ -d '/etc/myapp' ] || mkdir '/etc/myapp') && chmod 0750 '/etc/myapp'",
+		"(id -nG admin | tr ' ' '\\n' | grep -qxF wheel || usermod -aG wheel admin)",
+		`([ "$(getent shadow admin | cut -d: -f2)" = '$6$x' ] || echo 'admin:$6$x' | chpasswd -e)`,
+		"(grep -qxF 'ssh-ed25519 AAAA' '/home/admin/.ssh/authorized_keys' 2>/dev/null || printf '%s\\n' 'ssh-ed25519 AAAA' >> '/home/admin/.ssh/authorized_keys')",
+		"ln -sf /usr/share/zoneinfo/UTC /etc/localtime",
+		"[ -f /swapfile ] || { fallocate -l 2G /swapfile && mkswap /swapfile; }",
+		"realm list | grep -q corp.example.com || realm join corp.example.com",
+		"semanage port -m -t ssh_port_t -p tcp 2222",
+		"grep -qx 'sourcedir /etc/chrony.d' /etc/chrony.conf || echo 'sourcedir /etc/chrony.d' >> /etc/chrony.conf",
+		"sed -i '/^LANG=/d' /etc/environment\necho 'LANG=C' >> /etc/environment",
+		// Quoted file contents are no commands
+		"printf '%s' 'useradd admin >> /etc/passwd\n' > '/etc/notes'",
+	}
+	for _, commands := range safe {
+		assert.Empty(t, idempotencyProblems([]NamedCommandBlock{{Name: "Test", Commands: commands}}), commands)
+	}
+
+	err := checkIdempotent([]NamedCommandBlock{{Name: "Users", Commands: "useradd admin"}})
+	assert.EqualError(t, err, "commands not safe to apply twice:\nUsers: creates a user or group without checking that it exists: useradd admin")
+}
+
+// TestGeneratorsIdempotent checks the contract of --idempotent for every generator:
+// applying a blueprint twice is safe.
+func TestGeneratorsIdempotent(t *testing.T) {
+	bp, err := loadBlueprint([]string{"../../test/all-customizations.toml"})
+	require.NoError(t, err)
+
+	for _, declarative := range []bool{false, true} {
+		declarativeMode = declarative
+		_, blocks, err := generateBashScript(bp)
+		declarativeMode = false
+		require.NoError(t, err)
+		assert.NoError(t, checkIdempotent(blocks), "declarative: %v", declarative)
+	}
+}
+
+// reapplyBlueprint covers the blocks that change files and accounts, the ones
+// installing packages or talking to services only run stubs in TestApplyBlocksTwice
+const reapplyBlueprint = `
+[customizations]
+hostname = "web.example.com"
+
+[customizations.timezone]
+timezone = "Europe/Prague"
+ntpservers = ["ntp.example.com"]
+
+[customizations.chrony]
+remove_default_pools = true
+leapsecmode = "slew"
+
+[customizations.chrony.makestep]
+threshold = 1.0
+limit = 3
+
+[customizations.locale]
+languages = ["en_US.UTF-8"]
+keyboard = "us"
+
+[customizations.environment]
+EDITOR = "vim"
+
+[customizations.proxy]
+http = "http://proxy.example.com:3128"
+units = ["podman.service"]
+
+[[customizations.group]]
+name = "wheel"
+
+[[customizations.group]]
+name = "developers"
+
+[[customizations.user]]
+name = "admin"
+groups = ["wheel", "developers"]
+password = "$6$abcdefgh$0123456789"
+key = "ssh-ed25519 AAAA admin@example.com\nssh-ed25519 BBBB admin@laptop"
+
+[customizations.password_policy]
+minlen = 14
+max_days = 60
+
+[[customizations.directories]]
+path = "/etc/myapp"
+mode = "0750"
+group = "developers"
+
+[[customizations.files]]
+path = "/etc/myapp/config"
+data = "key=value\n"
+
+[[customizations.sudoers]]
+name = "wheel-nopasswd"
+groups = ["wheel"]
+nopasswd = true
+
+[[customizations.modprobe_options]]
+module = "kvm_intel"
+options = ["nested=1"]
+
+[customizations.sshd]
+password_authentication = false
+
+[customizations.journald]
+storage = "volatile"
+
+[[customizations.scheduled_tasks]]
+name = "cleanup"
+command = "find /var/tmp -mtime +7 -delete"
+schedule = "0 3 * * *"
+user = "root"
+
+[customizations.services]
+enabled = ["sshd"]
+`
+
+// TestApplyBlocksTwice applies every block twice to a copy of /etc and /home in a
+// mount namespace. The second run must succeed and change nothing.
+func TestApplyBlocksTwice(t *testing.T) {
+	if testing.Short() {
+		t.Skip("applies blocks to a copy of the system")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("needs root for the mount namespace and the user tools")
+	}
+	for _, tool := range []string{"unshare", "useradd", "groupadd", "usermod", "chpasswd"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+	if err := exec.Command("unshare", "--mount", "true").Run(); err != nil {
+		t.Skipf("cannot create a mount namespace: %v", err)
+	}
+
+	root := t.TempDir()
+	require.NoError(t, exec.Command("cp", "-a", "/etc", filepath.Join(root, "etc")).Run())
+	require.NoError(t, os.Mkdir(filepath.Join(root, "home"), 0755))
+	// The blocks edit these configuration files of the target
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc/chrony.conf"), []byte("pool 2.pool.ntp.org iburst\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc/dnf"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc/dnf/dnf.conf"), []byte("[main]\n"), 0644))
+
+	// The package and service tools of the target are not under test
+	stubs := t.TempDir()
+	for _, tool := range []string{"rpm", "dnf", "systemctl", "visudo", "sshd"} {
+		require.NoError(t, os.WriteFile(filepath.Join(stubs, tool), []byte("#!/bin/sh\nexit 0\n"), 0755))
+	}
+
+	bp := mustParseBlueprint(t, reapplyBlueprint)
+	_, blocks, err := generateBashScript(bp)
+	require.NoError(t, err)
+
+	apply := func(block NamedCommandBlock) {
+		script := filepath.Join(t.TempDir(), "block.sh")
+		require.NoError(t, os.WriteFile(script, []byte("#!/bin/bash\nset -euf -o pipefail\n"+block.Commands+"\n"), 0755))
+		cmd := exec.Command("unshare", "--mount", "/bin/sh", "-c",
+			`mount --bind "$1/etc" /etc && mount --bind "$1/home" /home && exec /bin/bash "$2"`, "sh", root, script)
+		cmd.Env = append(os.Environ(), "PATH="+stubs+":"+os.Getenv("PATH"))
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "%s: %s", block.Name, out)
+	}
+	for _, block := range blocks {
+		if strings.TrimSpace(block.Commands) == "" {
+			continue
+		}
+		apply(block)
+		first := snapshotTree(t, root)
+		apply(block)
+		assert.Equal(t, first, snapshotTree(t, root), "%s changed the system when applied again", block.Name)
+	}
+}
+
+// snapshotTree returns the type, mode, owner and content of every file under root.
+func snapshotTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := info.Mode().String()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry += fmt.Sprintf(" %d:%d", stat.Uid, stat.Gid)
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			entry += " -> " + target
+		case d.Type().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			entry += fmt.Sprintf(" %x", sha256.Sum256(data))
+		}
+		files[strings.TrimPrefix(path, root)] = entry
+		return nil
+	})
+	require.NoError(t, err)
+	return files
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// Versions of the emitted Ignition and Butane configs
+const (
+	ignitionVersion = "3.4.0"
+	butaneVariant   = "fcos"
+	butaneVersion   = "1.5.0"
+)
+
+// ignitionConfig is the subset of the Ignition config imagecfg emits. Butane
+// uses the same layout with a different header and inline file contents.
+type ignitionConfig struct {
+	Variant  string           `json:"-" yaml:"variant"`
+	Version  string           `json:"-" yaml:"version"`
+	Ignition *ignitionHeader  `json:"ignition,omitempty" yaml:"-"`
+	Passwd   *ignitionPasswd  `json:"passwd,omitempty" yaml:"passwd,omitempty"`
+	Storage  *ignitionStorage `json:"storage,omitempty" yaml:"storage,omitempty"`
+	Systemd  *ignitionUnits   `json:"systemd,omitempty" yaml:"systemd,omitempty"`
+}
+
+type ignitionHeader struct {
+	Version string `json:"version"`
+}
+
+type ignitionPasswd struct {
+	Users  []ignitionUser  `json:"users,omitempty" yaml:"users,omitempty"`
+	Groups []ignitionGroup `json:"groups,omitempty" yaml:"groups,omitempty"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name" yaml:"name"`
+	Gecos             string   `json:"gecos,omitempty" yaml:"gecos,omitempty"`
+	HomeDir           string   `json:"homeDir,omitempty" yaml:"home_dir,omitempty"`
+	Shell             string   `json:"shell,omitempty" yaml:"shell,omitempty"`
+	UID               *int     `json:"uid,omitempty" yaml:"uid,omitempty"`
+	PrimaryGroup      string   `json:"primaryGroup,omitempty" yaml:"primary_group,omitempty"`
+	Groups            []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+	PasswordHash      string   `json:"passwordHash,omitempty" yaml:"password_hash,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty" yaml:"ssh_authorized_keys,omitempty"`
+}
+
+type ignitionGroup struct {
+	Name string `json:"name" yaml:"name"`
+	GID  *int   `json:"gid,omitempty" yaml:"gid,omitempty"`
+}
+
+type ignitionStorage struct {
+	Directories []ignitionDirectory `json:"directories,omitempty" yaml:"directories,omitempty"`
+	Files       []ignitionFile      `json:"files,omitempty" yaml:"files,omitempty"`
+}
+
+type ignitionDirectory struct {
+	Path  string         `json:"path" yaml:"path"`
+	Mode  *int           `json:"mode,omitempty" yaml:"mode,omitempty"`
+	User  *ignitionOwner `json:"user,omitempty" yaml:"user,omitempty"`
+	Group *ignitionOwner `json:"group,omitempty" yaml:"group,omitempty"`
+}
+
+type ignitionFile struct {
+	Path      string           `json:"path" yaml:"path"`
+	Overwrite bool             `json:"overwrite" yaml:"overwrite"`
+	Mode      *int             `json:"mode,omitempty" yaml:"mode,omitempty"`
+	User      *ignitionOwner   `json:"user,omitempty" yaml:"user,omitempty"`
+	Group     *ignitionOwner   `json:"group,omitempty" yaml:"group,omitempty"`
+	Contents  ignitionContents `json:"contents" yaml:"contents"`
+}
+
+// ignitionOwner references a user or group by name or by ID.
+type ignitionOwner struct {
+	ID   *int64 `json:"id,omitempty" yaml:"id,omitempty"`
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+}
+
+type ignitionContents struct {
+	Source string `json:"source,omitempty" yaml:"-"`
+	Inline string `json:"-" yaml:"inline"`
+}
+
+type ignitionUnits struct {
+	Units []ignitionUnit `json:"units,omitempty" yaml:"units,omitempty"`
+}
+
+type ignitionUnit struct {
+	Name    string `json:"name" yaml:"name"`
+	Enabled *bool  `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Mask    bool   `json:"mask,omitempty" yaml:"mask,omitempty"`
+}
+
+var ignitionButane bool
+
+var ignitionCmd = &cobra.Command{
+	Use:   "ignition [blueprint.toml...]",
+	Short: "Translate an OSBuild blueprint to an Ignition or Butane config",
+	Long: `Translates an OSBuild blueprint (TOML format) into an Ignition config,
+or a Butane config with --butane, so that CoreOS and bootc systems provisioned
+with Ignition can reuse blueprints.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+The users, groups, SSH keys, hostname, files, directories and services are
+translated. Ignition has no equivalent for the other configurations, they
+are skipped with a warning.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		config, skipped, err := generateIgnitionConfig(bp, ignitionButane)
+		if err != nil {
+			return fmt.Errorf("error generating Ignition config: %w", err)
+		}
+		if len(skipped) > 0 {
+			logger.Warn("not supported by Ignition, skipped", "blocks", skipped)
+		}
+		fmt.Print(config)
+		return nil
+	},
+}
+
+func init() {
+	ignitionCmd.Flags().BoolVar(&ignitionButane, "butane", false, "emit a Butane config instead of Ignition JSON")
+	rootCmd.AddCommand(ignitionCmd)
+}
+
+// ignitionFileEntry creates a file entry with the given contents and mode.
+func ignitionFileEntry(path, contents string, mode int, butane bool) ignitionFile {
+	file := ignitionFile{Path: path, Overwrite: true, Mode: &mode}
+	if butane {
+		file.Contents.Inline = contents
+	} else {
+		file.Contents.Source = "data:;base64," + base64.StdEncoding.EncodeToString([]byte(contents))
+	}
+	return file
+}
+
+// ignitionFileOwner converts a blueprint file owner, a name or an ID, to an Ignition one.
+func ignitionFileOwner(owner interface{}) *ignitionOwner {
+	switch owner := owner.(type) {
+	case string:
+		return &ignitionOwner{Name: owner}
+	case int64:
+		return &ignitionOwner{ID: &owner}
+	}
+	return nil
+}
+
+// ignitionBlocks are the blocks that have an Ignition equivalent
+var ignitionBlocks = map[string]bool{
+	"Hostname":              true,
+	"Users":                 true,
+	"Groups":                true,
+	"Services":              true,
+	"Files and Directories": true,
+	// Nothing is installed, so there is no cache to clean
+	"Cleanup DNF Cache": true,
+}
+
+// generateIgnitionConfig generates an Ignition (or Butane) config from the blueprint. It
+// also returns the names of the blocks that have no Ignition equivalent.
+func generateIgnitionConfig(bp *Blueprint, butane bool) (string, []string, error) {
+	_, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return "", nil, err
+	}
+	var skipped []string
+	for _, block := range namedBlocks {
+		if !ignitionBlocks[block.Name] {
+			skipped = append(skipped, block.Name)
+		}
+	}
+	// Only the hostname itself can be expressed in Ignition
+	if bp.Extensions.GetPrettyHostname() != "" || bp.Extensions.GetChassis() != "" || bp.Extensions.GetHostsEntry() != nil {
+		skipped = append(skipped, "Hostname (pretty hostname, chassis and hosts entry)")
+	}
+
+	var passwd ignitionPasswd
+	for _, group := range bp.Customizations.GetGroups() {
+		passwd.Groups = append(passwd.Groups, ignitionGroup{Name: group.Name, GID: group.GID})
+	}
+	for _, user := range bp.Customizations.GetUsers() {
+		u := ignitionUser{Name: user.Name, UID: user.UID, Groups: user.Groups}
+		if user.Description != nil {
+			u.Gecos = *user.Description
+		}
+		if user.Home != nil {
+			u.HomeDir = *user.Home
+		}
+		if user.Shell != nil {
+			u.Shell = *user.Shell
+		}
+		if user.GID != nil {
+			// Ignition passes the primary group on to useradd, which accepts a GID
+			u.PrimaryGroup = strconv.Itoa(*user.GID)
+		}
+		if user.Password != nil {
+			u.PasswordHash = *user.Password
+		}
+		if user.Key != nil && *user.Key != "" {
+			for _, key := range strings.Split(strings.TrimSpace(*user.Key), "\n") {
+				if key = strings.TrimSpace(key); key != "" {
+					u.SSHAuthorizedKeys = append(u.SSHAuthorizedKeys, key)
+				}
+			}
+		}
+		passwd.Users = append(passwd.Users, u)
+	}
+
+	var storage ignitionStorage
+	for _, dir := range bp.Customizations.GetDirectories() {
+		mode, err := fsNodeMode(dir.Mode, 0755)
+		if err != nil {
+			return "", nil, fmt.Errorf("directory %s: %w", dir.Path, err)
+		}
+		m := int(mode)
+		storage.Directories = append(storage.Directories, ignitionDirectory{
+			Path:  dir.Path,
+			Mode:  &m,
+			User:  ignitionFileOwner(dir.User),
+			Group: ignitionFileOwner(dir.Group),
+		})
+	}
+	if hostname := bp.Customizations.GetHostname(); hostname != nil && *hostname != "" {
+		storage.Files = append(storage.Files, ignitionFileEntry("/etc/hostname", *hostname+"\n", 0644, butane))
+	}
+	for _, file := range bp.Customizations.GetFiles() {
+		mode, err := fsNodeMode(file.Mode, 0644)
+		if err != nil {
+			return "", nil, fmt.Errorf("file %s: %w", file.Path, err)
+		}
+		entry := ignitionFileEntry(file.Path, file.Data, int(mode), butane)
+		entry.User = ignitionFileOwner(file.User)
+		entry.Group = ignitionFileOwner(file.Group)
+		storage.Files = append(storage.Files, entry)
+	}
+
+	var systemd ignitionUnits
+	if svc := bp.Customizations.GetServices(); svc != nil {
+		enabled, disabled := true, false
+		for _, name := range svc.Enabled {
+			systemd.Units = append(systemd.Units, ignitionUnit{Name: name, Enabled: &enabled})
+		}
+		for _, name := range svc.Disabled {
+			systemd.Units = append(systemd.Units, ignitionUnit{Name: name, Enabled: &disabled})
+		}
+		for _, name := range svc.Masked {
+			systemd.Units = append(systemd.Units, ignitionUnit{Name: name, Mask: true})
+		}
+	}
+	// Ignition wants full unit names, the blueprint allows leaving out ".service"
+	for i, unit := range systemd.Units {
+		if !strings.Contains(unit.Name, ".") {
+			systemd.Units[i].Name += ".service"
+		}
+	}
+
+	var config ignitionConfig
+	if len(passwd.Users) > 0 || len(passwd.Groups) > 0 {
+		config.Passwd = &passwd
+	}
+	if len(storage.Directories) > 0 || len(storage.Files) > 0 {
+		config.Storage = &storage
+	}
+	if len(systemd.Units) > 0 {
+		config.Systemd = &systemd
+	}
+
+	if butane {
+		config.Variant = butaneVariant
+		config.Version = butaneVersion
+		data, err := yaml.Marshal(config)
+		if err != nil {
+			return "", nil, err
+		}
+		return string(data), skipped, nil
+	}
+
+	config.Ignition = &ignitionHeader{Version: ignitionVersion}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+	return string(data) + "\n", skipped, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const ignitionTestBlueprint = `
+[[packages]]
+name = "vim"
+
+[customizations]
+hostname = "core1"
+
+[[customizations.user]]
+name = "core"
+key = "ssh-ed25519 AAAA core@example.com"
+groups = ["wheel"]
+
+[[customizations.files]]
+path = "/etc/motd"
+data = "hello\n"
+mode = "0600"
+user = "core"
+
+[customizations.services]
+enabled = ["podman.socket"]
+masked = ["rpcbind"]
+`
+
+func TestGenerateIgnitionConfig(t *testing.T) {
+	bp := mustParseBlueprint(t, ignitionTestBlueprint)
+	data, skipped, err := generateIgnitionConfig(bp, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Packages"}, skipped)
+
+	var config map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(data), &config))
+	assert.Equal(t, map[string]interface{}{"version": "3.4.0"}, config["ignition"])
+	assert.NotContains(t, config, "variant")
+
+	users := config["passwd"].(map[string]interface{})["users"].([]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"name":              "core",
+		"groups":            []interface{}{"wheel"},
+		"sshAuthorizedKeys": []interface{}{"ssh-ed25519 AAAA core@example.com"},
+	}, users[0])
+
+	files := config["storage"].(map[string]interface{})["files"].([]interface{})
+	require.Len(t, files, 2)
+	assert.Equal(t, map[string]interface{}{
+		"path":      "/etc/hostname",
+		"overwrite": true,
+		"mode":      float64(0644),
+		"contents":  map[string]interface{}{"source": "data:;base64,Y29yZTEK"},
+	}, files[0])
+	assert.Equal(t, float64(0600), files[1].(map[string]interface{})["mode"])
+	assert.Equal(t, map[string]interface{}{"name": "core"}, files[1].(map[string]interface{})["user"])
+
+	units := config["systemd"].(map[string]interface{})["units"].([]interface{})
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "podman.socket", "enabled": true},
+		map[string]interface{}{"name": "rpcbind.service", "mask": true},
+	}, units)
+}
+
+func TestGenerateButaneConfig(t *testing.T) {
+	bp := mustParseBlueprint(t, ignitionTestBlueprint)
+	data, _, err := generateIgnitionConfig(bp, true)
+	require.NoError(t, err)
+
+	var config map[string]interface{}
+	require.NoError(t, yaml.Unmarshal([]byte(data), &config))
+	assert.Equal(t, "fcos", config["variant"])
+	assert.Equal(t, "1.5.0", config["version"])
+	assert.NotContains(t, config, "ignition")
+
+	files := config["storage"].(map[string]interface{})["files"].([]interface{})
+	assert.Equal(t, map[string]interface{}{"inline": "hello\n"}, files[1].(map[string]interface{})["contents"])
+	users := config["passwd"].(map[string]interface{})["users"].([]interface{})
+	assert.Equal(t, []interface{}{"ssh-ed25519 AAAA core@example.com"}, users[0].(map[string]interface{})["ssh_authorized_keys"])
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// applyImage and applyTag are set by --image and --tag, apply then builds an image
+// from applyImage with the blueprint applied, tagged applyTag
+var applyImage, applyTag string
+
+// imageApplyDir is where the build context with imagecfg and the blueprint is mounted
+// while the image is built
+const imageApplyDir = "/run/imagecfg"
+
+// imageApplyArgs returns the arguments for the apply in the image: the flags set on
+// the command line, except for those building the image and reading the blueprint.
+func imageApplyArgs(flags *pflag.FlagSet) []string {
+	var args []string
+	flags.Visit(func(flag *pflag.Flag) {
+		if flag.Name == "image" || flag.Name == "tag" || slices.Contains(blueprintInputFlags, flag.Name) {
+			return
+		}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			for _, v := range slice.GetSlice() {
+				args = append(args, "--"+flag.Name+"="+v)
+			}
+			return
+		}
+		args = append(args, "--"+flag.Name+"="+flag.Value.String())
+	})
+	return args
+}
+
+// imageContainerfile returns the Containerfile running apply with the arguments on the
+// image. The build context is only mounted for the apply, so that neither imagecfg nor
+// the blueprint end up in the image.
+func imageContainerfile(image string, args []string) (string, error) {
+	run, err := json.Marshal(append([]string{imageApplyDir + "/imagecfg", "apply"}, args...))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("FROM %s\nRUN --mount=type=bind,source=.,target=%s %s\n", image, imageApplyDir, run), nil
+}
+
+// streamCommand runs a command with its output passed through.
+func streamCommand(name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return nil, cmd.Run()
+}
+
+// applyToImage builds the image tag from image with the blueprints at blueprintPaths
+// applied by the imagecfg binary with the apply arguments, running podman with run.
+func applyToImage(image, tag, binary string, blueprintPaths []string, args []string, run commandRunner) error {
+	dir, err := os.MkdirTemp("", "imagecfg-image-")
+	if err != nil {
+		return fmt.Errorf("error creating build context: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := copyIntoContext(binary, filepath.Join(dir, "imagecfg"), 0755); err != nil {
+		return fmt.Errorf("error copying imagecfg: %w", err)
+	}
+	// The extension tells the format of the blueprint
+	data, format, _, err := readBlueprints(blueprintPaths)
+	if err != nil {
+		return fmt.Errorf("error copying blueprint: %w", err)
+	}
+	blueprintName := "blueprint." + format
+	if err := os.WriteFile(filepath.Join(dir, blueprintName), data, 0644); err != nil {
+		return fmt.Errorf("error copying blueprint: %w", err)
+	}
+	containerfile, err := imageContainerfile(image, append(args, imageApplyDir+"/"+blueprintName))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Containerfile"), []byte(containerfile), 0644); err != nil {
+		return fmt.Errorf("error writing Containerfile: %w", err)
+	}
+
+	// The context is not labeled for containers, it is only read
+	if _, err := run("podman", "build", "--security-opt", "label=disable", "-f", filepath.Join(dir, "Containerfile"), "-t", tag, dir); err != nil {
+		return fmt.Errorf("error applying %s to %s: %w", strings.Join(blueprintPaths, ", "), image, err)
+	}
+	return nil
+}
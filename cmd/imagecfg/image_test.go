@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageApplyArgs(t *testing.T) {
+	flags := pflag.NewFlagSet("apply", pflag.ContinueOnError)
+	flags.String("image", "", "")
+	flags.String("tag", "", "")
+	flags.StringSlice("only", nil, "")
+	flags.Bool("declarative", false, "")
+	flags.Int("jobs", 1, "")
+	flags.Bool("quiet", false, "")
+	// The blueprint copied into the image was read with these already
+	flags.StringArray("set", nil, "")
+	flags.StringSlice("profile", nil, "")
+	require.NoError(t, flags.Parse([]string{"--image", "quay.io/fedora/fedora-bootc:42", "--tag", "localhost/custom", "--only", "users,packages", "--declarative", "--jobs", "4", "--set", "packages[+].name=vim", "--profile", "debug"}))
+
+	assert.Equal(t, []string{"--declarative=true", "--jobs=4", "--only=users", "--only=packages"}, imageApplyArgs(flags))
+}
+
+func TestApplyToImage(t *testing.T) {
+	binary, blueprintPath := smokeTestFiles(t)
+	engine := &fakeEngine{results: map[string]func([]string) ([]byte, error){
+		"build": func(args []string) ([]byte, error) {
+			assert.Equal(t, []string{"build", "--security-opt", "label=disable", "-f"}, args[:4])
+			assert.Equal(t, []string{"-t", "localhost/custom"}, args[5:7])
+			context := args[len(args)-1]
+			containerfile, err := os.ReadFile(filepath.Join(context, "Containerfile"))
+			require.NoError(t, err)
+			assert.Equal(t, "FROM quay.io/fedora/fedora-bootc:42\n"+
+				`RUN --mount=type=bind,source=.,target=/run/imagecfg ["/run/imagecfg/imagecfg","apply","--declarative=true","/run/imagecfg/blueprint.toml"]`+"\n",
+				string(containerfile))
+			blueprint, err := os.ReadFile(filepath.Join(context, "blueprint.toml"))
+			require.NoError(t, err)
+			assert.Contains(t, string(blueprint), "hostname")
+			_, err = os.Stat(filepath.Join(context, "imagecfg"))
+			assert.NoError(t, err)
+			return nil, nil
+		},
+	}}
+	require.NoError(t, applyToImage("quay.io/fedora/fedora-bootc:42", "localhost/custom", binary, []string{blueprintPath}, []string{"--declarative=true"}, engine.run))
+	assert.Equal(t, []string{"podman build"}, engine.calls)
+
+	engine.results["build"] = func([]string) ([]byte, error) { return nil, errors.New("exit status 1") }
+	err := applyToImage("quay.io/fedora/fedora-bootc:42", "localhost/custom", binary, []string{blueprintPath}, nil, engine.run)
+	assert.EqualError(t, err, "error applying "+blueprintPath+" to quay.io/fedora/fedora-bootc:42: exit status 1")
+}
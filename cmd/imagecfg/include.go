@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// includeBlueprints returns the blueprint read from path with the blueprints of its
+// include key merged in, in order and before the blueprint itself, so it can extend
+// and override them like layered blueprints. Includes are resolved relative to the
+// blueprint and may include further blueprints, stack has the blueprints including
+// this one to detect cycles.
+func includeBlueprints(path string, doc map[string]interface{}, stack []string) (map[string]interface{}, error) {
+	raw, ok := doc["include"]
+	if !ok {
+		return doc, nil
+	}
+	delete(doc, "include")
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("include in %s must be a list of blueprints", path)
+	}
+	stack = append(stack, path)
+	var docs []map[string]interface{}
+	for _, v := range list {
+		include, ok := v.(string)
+		if !ok || include == "" {
+			return nil, fmt.Errorf("include in %s must be a list of blueprints", path)
+		}
+		includePath, err := resolveInclude(path, include)
+		if err != nil {
+			return nil, err
+		}
+		for i, including := range stack {
+			if sameBlueprint(including, includePath) {
+				return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack[i:], " -> "), includePath)
+			}
+		}
+		data, err := readBlueprintSource(includePath, false)
+		if err != nil {
+			return nil, fmt.Errorf("error opening blueprint %s included by %s: %w", includePath, path, err)
+		}
+		if err := verifyBlueprintSignature(includePath, signaturePath(includePath), data); err != nil {
+			return nil, err
+		}
+		if data, err = decryptBlueprint(includePath, data); err != nil {
+			return nil, err
+		}
+		if data, err = renderBlueprint(includePath, data); err != nil {
+			return nil, err
+		}
+		included, err := decodeRenderedDocument(includePath, data, stack)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, included)
+	}
+	return mergeBlueprints(append(docs, doc), nil), nil
+}
+
+// resolveInclude returns the path of the blueprint include of the blueprint at path:
+// relative to its directory, or to its URL, unless it is absolute itself.
+func resolveInclude(path, include string) (string, error) {
+	var resolved string
+	switch {
+	case isBlueprintURL(include) || isOCIBlueprint(include) || filepath.IsAbs(include):
+		resolved = include
+	case isBlueprintURL(path):
+		base, err := url.Parse(path)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(include)
+		if err != nil {
+			return "", fmt.Errorf("invalid include %s in %s: %w", include, path, err)
+		}
+		resolved = base.ResolveReference(ref).String()
+	case isOCIBlueprint(path):
+		return "", fmt.Errorf("include %s in %s must be absolute, a blueprint of an image has no directory", include, path)
+	default:
+		resolved = filepath.Join(filepath.Dir(path), include)
+	}
+	// Only the including blueprint is pinned by --sha256
+	if strings.HasPrefix(resolved, "http://") {
+		return "", fmt.Errorf("include %s in %s cannot be fetched over plain HTTP", resolved, path)
+	}
+	return resolved, nil
+}
+
+// sameBlueprint returns whether the paths are the same blueprint.
+func sameBlueprint(a, b string) bool {
+	if a == b {
+		return true
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
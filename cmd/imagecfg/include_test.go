@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadBlueprintInclude(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "common"), 0755))
+	for name, content := range map[string]string{
+		"config.toml": `
+include = ["common/users.toml", "common/hardening.toml"]
+
+[customizations]
+hostname = "web1"
+`,
+		"common/users.toml": `
+include = ["base.toml"]
+
+[[customizations.user]]
+name = "admin"
+groups = ["wheel"]
+`,
+		"common/base.toml": `
+[customizations]
+hostname = "base"
+timezone = { timezone = "UTC" }
+`,
+		"common/hardening.toml": `
+[customizations.services]
+disabled = ["telnet"]
+`,
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	bp, err := loadBlueprint([]string{filepath.Join(dir, "config.toml")})
+	require.NoError(t, err)
+	// The including blueprint overrides the included ones
+	assert.Equal(t, "web1", *bp.Customizations.GetHostname())
+	tz, _ := bp.Customizations.GetTimezoneSettings()
+	assert.Equal(t, "UTC", *tz)
+	require.Len(t, bp.Customizations.User, 1)
+	assert.Equal(t, "admin", bp.Customizations.User[0].Name)
+	assert.Equal(t, []string{"telnet"}, bp.Customizations.GetServices().Disabled)
+}
+
+func TestLoadBlueprintIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.toml"), filepath.Join(dir, "b.toml")
+	require.NoError(t, os.WriteFile(a, []byte(`include = ["b.toml"]`), 0644))
+	require.NoError(t, os.WriteFile(b, []byte(`include = ["./a.toml"]`), 0644))
+
+	_, err := loadBlueprint([]string{a})
+	assert.ErrorContains(t, err, "include cycle: "+a+" -> "+b+" -> "+a)
+
+	require.NoError(t, os.WriteFile(b, []byte(`include = "a.toml"`), 0644))
+	_, err = loadBlueprint([]string{a})
+	assert.ErrorContains(t, err, "include in "+b+" must be a list of blueprints")
+}
+
+func TestResolveInclude(t *testing.T) {
+	for _, tc := range []struct{ path, include, resolved string }{
+		{"site/config.toml", "common/users.toml", "site/common/users.toml"},
+		{"site/config.toml", "../users.toml", "users.toml"},
+		{"site/config.toml", "/etc/imagecfg/users.toml", "/etc/imagecfg/users.toml"},
+		{"https://example.com/bp/config.toml", "common/users.toml", "https://example.com/bp/common/users.toml"},
+		{"site/config.toml", "oras://registry.example.com/users:1", "oras://registry.example.com/users:1"},
+	} {
+		resolved, err := resolveInclude(tc.path, tc.include)
+		require.NoError(t, err, tc.include)
+		assert.Equal(t, tc.resolved, resolved, tc.include)
+	}
+	_, err := resolveInclude("docker://quay.io/example/web:1", "users.toml")
+	assert.ErrorContains(t, err, "must be absolute")
+	_, err = resolveInclude("site/config.toml", "http://example.com/users.toml")
+	assert.ErrorContains(t, err, "cannot be fetched over plain HTTP")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+)
+
+// initOptions are the settings a new blueprint is scaffolded with
+type initOptions struct {
+	Hostname string
+	Timezone string
+	User     string
+	Groups   []string
+	SSHKey   string
+	Packages []string
+	Services []string
+}
+
+var (
+	initOpts        initOptions
+	initSSHKeyFile  string
+	initOutput      string
+	initInteractive bool
+)
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Scaffold a new OSBuild blueprint",
+	Long: `Writes a new OSBuild blueprint (TOML format) with a hostname, a user that
+logs in with an SSH key, packages and enabled services, as a starting point
+instead of copying examples.
+
+The settings are taken from the flags. With --interactive, the command asks
+for each of them, suggesting the flag values. The blueprint is printed unless
+--output is given, an existing file is not overwritten.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := initOpts
+		if initSSHKeyFile != "" {
+			key, err := os.ReadFile(initSSHKeyFile)
+			if err != nil {
+				return fmt.Errorf("error reading SSH key: %w", err)
+			}
+			opts.SSHKey = strings.TrimSpace(string(key))
+		}
+		if initInteractive {
+			var err error
+			if opts, err = promptInitOptions(cmd.InOrStdin(), cmd.OutOrStdout(), opts); err != nil {
+				return err
+			}
+		}
+
+		out, err := scaffoldBlueprint(opts)
+		if err != nil {
+			return fmt.Errorf("error scaffolding blueprint: %w", err)
+		}
+		if initOutput == "" {
+			fmt.Print(out)
+			return nil
+		}
+		f, err := os.OpenFile(initOutput, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return fmt.Errorf("error creating blueprint: %w", err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(out); err != nil {
+			return fmt.Errorf("error writing blueprint: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	initCmd.Flags().StringVar(&initOpts.Hostname, "hostname", "", "hostname of the system")
+	initCmd.Flags().StringVar(&initOpts.Timezone, "timezone", "", "timezone of the system, e.g. Europe/Prague")
+	initCmd.Flags().StringVar(&initOpts.User, "user", "admin", "name of the user to create, empty for none")
+	initCmd.Flags().StringSliceVar(&initOpts.Groups, "user-groups", []string{"wheel"}, "groups of the user")
+	initCmd.Flags().StringVar(&initOpts.SSHKey, "ssh-key", "", "public SSH key of the user")
+	initCmd.Flags().StringVar(&initSSHKeyFile, "ssh-key-file", "", "file with the public SSH key of the user")
+	initCmd.Flags().StringSliceVar(&initOpts.Packages, "package", []string{"bash-completion", "vim-enhanced"}, "packages to install")
+	initCmd.Flags().StringSliceVar(&initOpts.Services, "service", []string{"sshd"}, "services to enable")
+	initCmd.Flags().StringVarP(&initOutput, "output", "o", "", "file to write the blueprint to")
+	initCmd.Flags().BoolVarP(&initInteractive, "interactive", "i", false, "ask for the settings")
+	rootCmd.AddCommand(initCmd)
+}
+
+// promptInitOptions asks for each setting on in, defaulting to the value in opts.
+func promptInitOptions(in io.Reader, out io.Writer, opts initOptions) (initOptions, error) {
+	scanner := bufio.NewScanner(in)
+	ask := func(question, value string) (string, error) {
+		fmt.Fprintf(out, "%s [%s]: ", question, value)
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("no answer to %q", question)
+		}
+		if answer := strings.TrimSpace(scanner.Text()); answer != "" {
+			return answer, nil
+		}
+		return value, nil
+	}
+	askList := func(question string, values []string) ([]string, error) {
+		answer, err := ask(question+", comma-separated", strings.Join(values, ","))
+		if err != nil {
+			return nil, err
+		}
+		var list []string
+		for _, value := range strings.Split(answer, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				list = append(list, value)
+			}
+		}
+		return list, nil
+	}
+
+	var err error
+	if opts.Hostname, err = ask("Hostname", opts.Hostname); err != nil {
+		return opts, err
+	}
+	if opts.Timezone, err = ask("Timezone", opts.Timezone); err != nil {
+		return opts, err
+	}
+	if opts.User, err = ask("User", opts.User); err != nil {
+		return opts, err
+	}
+	if opts.User != "" {
+		if opts.Groups, err = askList("Groups of the user", opts.Groups); err != nil {
+			return opts, err
+		}
+		if opts.SSHKey, err = ask("Public SSH key of the user", opts.SSHKey); err != nil {
+			return opts, err
+		}
+	}
+	if opts.Packages, err = askList("Packages", opts.Packages); err != nil {
+		return opts, err
+	}
+	if opts.Services, err = askList("Services to enable", opts.Services); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// tomlValue encodes v as a TOML value.
+func tomlValue(v interface{}) string {
+	data, err := toml.Marshal(map[string]interface{}{"v": v})
+	if err != nil {
+		panic(err) // Strings and lists of strings always encode
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(string(data), "v = "), "\n")
+}
+
+// scaffoldBlueprint writes a blueprint with the settings, and checks that imagecfg
+// accepts it.
+func scaffoldBlueprint(opts initOptions) (string, error) {
+	var out strings.Builder
+	out.WriteString("# Blueprint scaffolded by imagecfg init\n")
+	for _, pkg := range opts.Packages {
+		fmt.Fprintf(&out, "\n[[packages]]\nname = %s\n", tomlValue(pkg))
+	}
+
+	if opts.Hostname != "" {
+		fmt.Fprintf(&out, "\n[customizations]\nhostname = %s\n", tomlValue(opts.Hostname))
+	}
+	if opts.Timezone != "" {
+		fmt.Fprintf(&out, "\n[customizations.timezone]\ntimezone = %s\n", tomlValue(opts.Timezone))
+	}
+	if opts.User != "" {
+		fmt.Fprintf(&out, "\n[[customizations.user]]\nname = %s\n", tomlValue(opts.User))
+		if len(opts.Groups) > 0 {
+			fmt.Fprintf(&out, "groups = %s\n", tomlValue(opts.Groups))
+		}
+		if opts.SSHKey != "" {
+			fmt.Fprintf(&out, "key = %s\n", tomlValue(opts.SSHKey))
+		}
+	}
+	if len(opts.Services) > 0 {
+		fmt.Fprintf(&out, "\n[customizations.services]\nenabled = %s\n", tomlValue(opts.Services))
+	}
+
+	bp, _, err := decodeBlueprintTOML([]byte(out.String()), "scaffolded blueprint")
+	if err != nil {
+		return "", err
+	}
+	if issues := validateBlueprint(bp, systemGroups()); len(issues) > 0 {
+		return "", fmt.Errorf("%s: %s", issues[0].Field, issues[0].Message)
+	}
+	return out.String(), nil
+}
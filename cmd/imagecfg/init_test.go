@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScaffoldBlueprint(t *testing.T) {
+	out, err := scaffoldBlueprint(initOptions{
+		Hostname: "box",
+		Timezone: "Europe/Prague",
+		User:     "admin",
+		Groups:   []string{"wheel"},
+		SSHKey:   `ssh-ed25519 AAAA "me"`,
+		Packages: []string{"vim-enhanced"},
+		Services: []string{"sshd", "cockpit.socket"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `# Blueprint scaffolded by imagecfg init
+
+[[packages]]
+name = "vim-enhanced"
+
+[customizations]
+hostname = "box"
+
+[customizations.timezone]
+timezone = "Europe/Prague"
+
+[[customizations.user]]
+name = "admin"
+groups = ["wheel"]
+key = "ssh-ed25519 AAAA \"me\""
+
+[customizations.services]
+enabled = ["sshd", "cockpit.socket"]
+`, out)
+
+	_, err = scaffoldBlueprint(initOptions{Timezone: "Mars/Olympus_Mons"})
+	assert.EqualError(t, err, `customizations.timezone.timezone: unknown timezone "Mars/Olympus_Mons"`)
+}
+
+func TestPromptInitOptions(t *testing.T) {
+	var out bytes.Buffer
+	opts, err := promptInitOptions(strings.NewReader("box\n\ncore\nwheel, docker\nssh-ed25519 AAAA\n\n\n"), &out, initOptions{
+		User:     "admin",
+		Groups:   []string{"wheel"},
+		Packages: []string{"vim-enhanced"},
+		Services: []string{"sshd"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, initOptions{
+		Hostname: "box",
+		User:     "core",
+		Groups:   []string{"wheel", "docker"},
+		SSHKey:   "ssh-ed25519 AAAA",
+		Packages: []string{"vim-enhanced"},
+		Services: []string{"sshd"},
+	}, opts)
+	assert.True(t, strings.HasPrefix(out.String(), "Hostname []: Timezone []: User [admin]: Groups of the user, comma-separated [wheel]: "))
+
+	_, err = promptInitOptions(strings.NewReader("box\n"), &out, initOptions{})
+	assert.EqualError(t, err, `no answer to "Timezone"`)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// blueprintInputFormat is set by --input-format, the format of the blueprints read, or
+// auto to tell it from the extension or the content
+var blueprintInputFormat string
+
+// inputFormats are the values of --input-format
+var inputFormats = []string{"auto", "toml", "json", "yaml"}
+
+// detectBlueprintFormat returns the format of the blueprint read from path: the one of
+// --input-format or of the .toml, .json, .yaml and .yml extensions, and without them
+// json if the content is a JSON object and toml otherwise. YAML is only told by the
+// extension, any TOML file would parse as YAML.
+func detectBlueprintFormat(path string, data []byte) (string, error) {
+	if !slices.Contains(inputFormats, blueprintInputFormat) && blueprintInputFormat != "" {
+		return "", fmt.Errorf("unknown input format %q, must be one of: %s", blueprintInputFormat, strings.Join(inputFormats, ", "))
+	}
+	if blueprintInputFormat != "" && blueprintInputFormat != "auto" {
+		return blueprintInputFormat, nil
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return "toml", nil
+	case ".json":
+		return "json", nil
+	case ".yaml", ".yml":
+		return "yaml", nil
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return "json", nil
+	}
+	return "toml", nil
+}
+
+// decodeBlueprintDocument decodes the blueprint read from path into maps and slices,
+// see detectBlueprintFormat, rendered with --template and with the variables in it
+// expanded with --expand-env.
+func decodeBlueprintDocument(path string, data []byte) (map[string]interface{}, error) {
+	data, err := renderBlueprint(path, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRenderedDocument(path, data, nil)
+}
+
+// decodeRenderedDocument decodes the blueprint read from path like
+// decodeBlueprintDocument, after it was rendered, with the blueprints it includes
+// merged in, see includeBlueprints.
+func decodeRenderedDocument(path string, data []byte, stack []string) (map[string]interface{}, error) {
+	format, err := detectBlueprintFormat(path, data)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeDocument(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing blueprint %s from %s: %w", strings.ToUpper(format), path, err)
+	}
+	if format == "json" {
+		if doc, err = unwrapAPIBlueprint(doc); err != nil {
+			return nil, fmt.Errorf("error parsing blueprint JSON from %s: %w", path, err)
+		}
+	}
+	if blueprintExpandEnv {
+		if doc, err = expandBlueprintVars(path, doc); err != nil {
+			return nil, err
+		}
+	}
+	if doc, err = includeBlueprints(path, doc, stack); err != nil {
+		return nil, err
+	}
+	filtered, _, err := filterProfiles("", doc)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting profiles of %s: %w", path, err)
+	}
+	// A blueprint tagged with profiles that are not active is empty
+	if filtered == nil {
+		return map[string]interface{}{}, nil
+	}
+	return filtered.(map[string]interface{}), nil
+}
+
+// blueprintTOML returns the blueprint read from path as TOML, converted from the
+// format it is in, rendered with --template and with the variables in it expanded with
+// --expand-env.
+func blueprintTOML(path string, data []byte) ([]byte, error) {
+	data, err := renderBlueprint(path, data)
+	if err != nil {
+		return nil, err
+	}
+	format, err := detectBlueprintFormat(path, data)
+	if err != nil {
+		return nil, err
+	}
+	if format == "toml" && !needsDecoding(path, data) {
+		// Kept as it is, for the lines in the errors of the decoder
+		return data, nil
+	}
+	doc, err := decodeRenderedDocument(path, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	return encodeDocument(doc, "toml")
+}
+
+// needsDecoding returns whether the rendered blueprint read from path changes when it
+// is decoded: with --expand-env, if it includes blueprints or if it is tagged with
+// profiles. Blueprints that do not parse are reported by the decoder.
+func needsDecoding(path string, data []byte) bool {
+	if blueprintExpandEnv {
+		return true
+	}
+	format, err := detectBlueprintFormat(path, data)
+	if err != nil {
+		return true
+	}
+	doc, err := decodeDocument(data, format)
+	return err == nil && (doc["include"] != nil || hasProfiles(doc))
+}
+
+// blueprintInputFlags are the flags reading blueprints, which apply in an image is not
+// given as the blueprint copied into it was read with them already
+var blueprintInputFlags = []string{
+	"input-format", "expand-env", "env-file", "allow-env", "template", "values", "set", "profile",
+	"sha256", "ca-cert", "client-cert", "client-key", "age-key",
+	"verify-signature", "signature", "signature-key", "signature-identity", "signature-issuer",
+}
+
+// unwrapAPIBlueprint returns the blueprint in the JSON of the osbuild-composer and
+// image-builder APIs: a blueprint itself, a compose request with a "blueprint", or a
+// response of the blueprints/info route with one in "blueprints". Null values, which
+// TOML has none of, are left out.
+func unwrapAPIBlueprint(doc map[string]interface{}) (map[string]interface{}, error) {
+	if blueprints, ok := doc["blueprints"].([]interface{}); ok {
+		if len(blueprints) != 1 {
+			return nil, fmt.Errorf("response has %d blueprints, it must have one", len(blueprints))
+		}
+		bp, ok := blueprints[0].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("blueprint of the response is not an object")
+		}
+		doc = bp
+	} else if bp, ok := doc["blueprint"].(map[string]interface{}); ok {
+		doc = bp
+	}
+	return dropNulls(doc).(map[string]interface{}), nil
+}
+
+// dropNulls removes the null values of the decoded JSON document.
+func dropNulls(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if value == nil {
+				delete(v, key)
+			} else {
+				v[key] = dropNulls(value)
+			}
+		}
+	case []interface{}:
+		kept := v[:0]
+		for _, value := range v {
+			if value != nil {
+				kept = append(kept, dropNulls(value))
+			}
+		}
+		return kept
+	}
+	return v
+}
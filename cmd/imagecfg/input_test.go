@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectBlueprintFormat(t *testing.T) {
+	for _, tc := range []struct {
+		path, data, format string
+	}{
+		{"config.toml", "[customizations]", "toml"},
+		{"config.json", "", "json"},
+		{"config.JSON", "", "json"},
+		{"https://example.com/blueprint", "\n  {\"name\": \"web\"}", "json"},
+		{"/usr/lib/bootc-image-builder/config.toml", "{", "toml"},
+		{"-", "name = \"web\"", "toml"},
+		{"config.yaml", "name: web", "yaml"},
+		{"config.yml", "name: web", "yaml"},
+	} {
+		format, err := detectBlueprintFormat(tc.path, []byte(tc.data))
+		require.NoError(t, err)
+		assert.Equal(t, tc.format, format, tc.path)
+	}
+
+	old := blueprintInputFormat
+	t.Cleanup(func() { blueprintInputFormat = old })
+	blueprintInputFormat = "json"
+	format, err := detectBlueprintFormat("config.toml", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "json", format)
+	blueprintInputFormat = "xml"
+	_, err = detectBlueprintFormat("config.toml", nil)
+	assert.ErrorContains(t, err, `unknown input format "xml"`)
+}
+
+func TestLoadBlueprintJSON(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		// A blueprint as the weldr API takes it
+		"blueprint.json": `{"name": "web", "version": "0.0.1", "packages": [{"name": "nginx", "version": "*"}], "modules": null,
+			"customizations": {"hostname": "web1", "user": [{"name": "admin", "uid": 1001, "groups": ["wheel"]}]}}`,
+		// A compose request of the cloud API
+		"compose.json": `{"distribution": "fedora-42", "image_requests": [{"architecture": "x86_64", "image_type": "guest-image"}],
+			"blueprint": {"name": "web", "packages": [{"name": "nginx"}], "customizations": {"hostname": "web1", "user": [{"name": "admin", "uid": 1001}]}}}`,
+		// A response of the blueprints/info route
+		"info": `{"blueprints": [{"name": "web", "packages": [{"name": "nginx"}], "customizations": {"hostname": "web1", "user": [{"name": "admin", "uid": 1001}]}}], "changes": [], "errors": []}`,
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		bp, err := loadBlueprint([]string{path})
+		require.NoError(t, err, name)
+		assert.Equal(t, "web1", *bp.Customizations.GetHostname(), name)
+		assert.Equal(t, "nginx", bp.Packages[0].Name, name)
+		assert.Equal(t, 1001, *bp.Customizations.User[0].UID, name)
+	}
+
+	path := filepath.Join(dir, "unknown.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"customizations": {"hostnme": "web1"}}`), 0644))
+	_, err := loadBlueprint([]string{path})
+	assert.ErrorContains(t, err, "unknown configuration keys in "+path+": customizations.hostnme")
+
+	path = filepath.Join(dir, "ambiguous.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"blueprints": [{"name": "a"}, {"name": "b"}]}`), 0644))
+	_, err = loadBlueprint([]string{path})
+	assert.ErrorContains(t, err, "response has 2 blueprints, it must have one")
+}
+
+func TestLoadBlueprintYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`name: web
+packages:
+  - name: nginx
+customizations:
+  hostname: web1
+  user:
+    - name: admin
+      uid: 1001
+      groups: [wheel]
+  services:
+    enabled: [nginx]
+`), 0644))
+	bp, err := loadBlueprint([]string{path})
+	require.NoError(t, err)
+	assert.Equal(t, "web1", *bp.Customizations.GetHostname())
+	assert.Equal(t, "nginx", bp.Packages[0].Name)
+	assert.Equal(t, 1001, *bp.Customizations.User[0].UID)
+	assert.Equal(t, []string{"nginx"}, bp.Customizations.Services.Enabled)
+
+	require.NoError(t, os.WriteFile(path, []byte("customizations:\n  hostnme: web1\n"), 0644))
+	_, err = loadBlueprint([]string{path})
+	assert.ErrorContains(t, err, "unknown configuration keys in "+path+": customizations.hostnme")
+}
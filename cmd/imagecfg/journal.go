@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// applyJournal is set by --journal, apply then logs to the systemd journal as well
+var applyJournal bool
+
+// journalSocket is where journald receives messages in its native protocol
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalValueSize is the most of a field value sent to the journal, the end of it is
+// kept: messages are single datagrams, and the end of the output of a block says why
+// it failed
+const journalValueSize = 64 * 1024
+
+// journalHandler is a slog handler sending the records to journald, with the
+// attributes as IMAGECFG_ fields, e.g. IMAGECFG_BLOCK for "block"
+type journalHandler struct {
+	conn  net.Conn
+	level slog.Leveler
+	// attrs are the fields of the handler, encoded
+	attrs []byte
+	// prefix is the group of the attributes added next, as a field name prefix
+	prefix string
+}
+
+// newJournalHandler returns a handler logging the messages of the level and above to
+// the journald socket.
+func newJournalHandler(socket string, level slog.Leveler) (*journalHandler, error) {
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn, level: level}, nil
+}
+
+func (h *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", r.Message)
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(journalPriority(r.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", "imagecfg")
+	b.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		writeJournalAttr(&b, h.prefix, a)
+		return true
+	})
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b bytes.Buffer
+	b.Write(h.attrs)
+	for _, a := range attrs {
+		writeJournalAttr(&b, h.prefix, a)
+	}
+	return &journalHandler{conn: h.conn, level: h.level, attrs: b.Bytes(), prefix: h.prefix}
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	return &journalHandler{conn: h.conn, level: h.level, attrs: h.attrs, prefix: h.prefix + name + "_"}
+}
+
+// journalPriority returns the syslog priority of the level.
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// journalFieldName returns the journal field of the attribute key, e.g. IMAGECFG_BLOCK
+// for block: upper case letters, digits and underscores.
+func journalFieldName(key string) string {
+	var b strings.Builder
+	b.WriteString("IMAGECFG_")
+	for _, r := range strings.ToUpper(key) {
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// writeJournalAttr writes the attribute as a field, and the attributes of groups as a
+// field each.
+func writeJournalAttr(b *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			writeJournalAttr(b, prefix+a.Key+"_", ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	writeJournalField(b, journalFieldName(prefix+a.Key), a.Value.String())
+}
+
+// writeJournalField writes a field in the native journal protocol: KEY=VALUE lines, or
+// the length of the value before it if it has several lines.
+func writeJournalField(b *bytes.Buffer, key, value string) {
+	if len(value) > journalValueSize {
+		value = value[len(value)-journalValueSize:]
+	}
+	if !strings.Contains(value, "\n") {
+		b.WriteString(key + "=" + value + "\n")
+		return
+	}
+	b.WriteString(key + "\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// teeHandler is a slog handler passing the records to all its handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var handlers teeHandler
+	for _, h := range t {
+		handlers = append(handlers, h.WithAttrs(attrs))
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	var handlers teeHandler
+	for _, h := range t {
+		handlers = append(handlers, h.WithGroup(name))
+	}
+	return handlers
+}
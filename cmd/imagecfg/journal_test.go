@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenJournal returns a socket receiving journal messages like journald.
+func listenJournal(t *testing.T) (string, *net.UnixConn) {
+	socket := filepath.Join(t.TempDir(), "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return socket, conn
+}
+
+// readJournalMessage reads a message in the native journal protocol.
+func readJournalMessage(t *testing.T, conn *net.UnixConn) map[string]string {
+	buf := make([]byte, 1<<20)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	data := buf[:n]
+	fields := map[string]string{}
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		require.GreaterOrEqual(t, i, 0)
+		line := string(data[:i])
+		data = data[i+1:]
+		if key, value, ok := strings.Cut(line, "="); ok {
+			fields[key] = value
+			continue
+		}
+		size := binary.LittleEndian.Uint64(data[:8])
+		fields[line] = string(data[8 : 8+size])
+		data = data[8+size+1:]
+	}
+	return fields
+}
+
+func TestJournalHandler(t *testing.T) {
+	socket, conn := listenJournal(t)
+	h, err := newJournalHandler(socket, slog.LevelDebug)
+	require.NoError(t, err)
+	log := slog.New(h).With("block", "Packages")
+
+	log.Error("block failed", "result", "failed", "error", "exit status 1")
+	assert.Equal(t, map[string]string{
+		"MESSAGE":           "block failed",
+		"PRIORITY":          "3",
+		"SYSLOG_IDENTIFIER": "imagecfg",
+		"IMAGECFG_BLOCK":    "Packages",
+		"IMAGECFG_RESULT":   "failed",
+		"IMAGECFG_ERROR":    "exit status 1",
+	}, readJournalMessage(t, conn))
+
+	log.WithGroup("retry").Debug("block output", "output", "line 1\nline 2\n", "max-attempts", 3)
+	assert.Equal(t, map[string]string{
+		"MESSAGE":                     "block output",
+		"PRIORITY":                    "7",
+		"SYSLOG_IDENTIFIER":           "imagecfg",
+		"IMAGECFG_BLOCK":              "Packages",
+		"IMAGECFG_RETRY_OUTPUT":       "line 1\nline 2\n",
+		"IMAGECFG_RETRY_MAX_ATTEMPTS": "3",
+	}, readJournalMessage(t, conn))
+
+	// Only the end of long values is sent
+	log.Info("block output", "output", strings.Repeat("x", journalValueSize)+"end")
+	output := readJournalMessage(t, conn)["IMAGECFG_OUTPUT"]
+	assert.Len(t, output, journalValueSize)
+	assert.True(t, strings.HasSuffix(output, "xend"))
+}
+
+func TestNewJournalHandlerNoSocket(t *testing.T) {
+	_, err := newJournalHandler(filepath.Join(t.TempDir(), "socket"), slog.LevelDebug)
+	assert.Error(t, err)
+}
+
+func TestApplyBlocksJournal(t *testing.T) {
+	discardLogs(t)
+	socket, conn := listenJournal(t)
+	h, err := newJournalHandler(socket, slog.LevelDebug)
+	require.NoError(t, err)
+	logger = slog.New(teeHandler{logger.Handler(), h})
+
+	blocks := []NamedCommandBlock{{Name: "Hostname", Commands: "echo setting the hostname"}}
+	_, _, err = applyBlocks("#!/bin/bash", blocks, applyOptions{Quiet: true, Journal: h})
+	require.NoError(t, err)
+
+	var messages []map[string]string
+	for range 4 {
+		messages = append(messages, readJournalMessage(t, conn))
+	}
+	assert.Equal(t, "applying block", messages[0]["MESSAGE"])
+	assert.Equal(t, "Hostname", messages[0]["IMAGECFG_BLOCK"])
+	assert.Equal(t, "block commands", messages[1]["MESSAGE"])
+	assert.Equal(t, "echo setting the hostname", messages[1]["IMAGECFG_COMMANDS"])
+	assert.Equal(t, "block output", messages[2]["MESSAGE"])
+	assert.Equal(t, "setting the hostname\n", messages[2]["IMAGECFG_OUTPUT"])
+	assert.Equal(t, "applied block", messages[3]["MESSAGE"])
+	assert.Equal(t, "applied", messages[3]["IMAGECFG_RESULT"])
+}
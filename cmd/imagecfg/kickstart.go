@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var kickstartCmd = &cobra.Command{
+	Use:   "kickstart [blueprint.toml...]",
+	Short: "Translate an OSBuild blueprint to an Anaconda kickstart",
+	Long: `Translates an OSBuild blueprint (TOML format) into an Anaconda kickstart,
+for moving configurations between Anaconda and image mode workflows.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+The locale, keyboard, timezone, hostname, users, groups, firewall, services
+and packages are translated into kickstart commands. All other configurations
+are run as the same bash blocks the 'bash' command generates, in %post.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		kickstart, err := generateKickstart(bp)
+		if err != nil {
+			return fmt.Errorf("error generating kickstart: %w", err)
+		}
+		fmt.Print(kickstart)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(kickstartCmd)
+}
+
+// ksPlainArgRegexp matches kickstart arguments that need no quoting.
+var ksPlainArgRegexp = regexp.MustCompile(`^[A-Za-z0-9_.,:/@%+=-]+$`)
+
+// ksArg quotes s for a kickstart command line, which is split like a shell command.
+func ksArg(s string) string {
+	if ksPlainArgRegexp.MatchString(s) {
+		return s
+	}
+	return shellQuote(s)
+}
+
+// kickstartCommands returns the kickstart commands for the natively supported
+// customizations, together with the names of the blocks they replace.
+func kickstartCommands(bp *Blueprint) ([]string, map[string]bool) {
+	var lines []string
+	native := map[string]bool{
+		"Users":    true,
+		"Groups":   true,
+		"Packages": true,
+	}
+
+	// Languages and keymaps beyond the upstream locale customization are left to %post.
+	// The extension is decoded whenever the locale table exists, so compare its values.
+	ext := bp.Extensions.GetLocale()
+	if bp.Customizations != nil && bp.Customizations.Locale != nil && (ext == nil || *ext == LocaleCustomization{}) {
+		native["Locale"] = true
+		languages := bp.Customizations.Locale.Languages
+		if len(languages) > 0 {
+			line := "lang " + ksArg(languages[0])
+			if len(languages) > 1 {
+				line += " --addsupport=" + ksArg(strings.Join(languages[1:], ","))
+			}
+			lines = append(lines, line)
+		}
+		if keyboard := bp.Customizations.Locale.Keyboard; keyboard != nil && *keyboard != "" {
+			lines = append(lines, "keyboard --vckeymap="+ksArg(*keyboard))
+		}
+	}
+
+	if timezone, _ := bp.Customizations.GetTimezoneSettings(); timezone != nil && *timezone != "" {
+		native["Timezone"] = true
+		lines = append(lines, "timezone "+ksArg(*timezone))
+	}
+
+	if hostname := bp.Customizations.GetHostname(); hostname != nil && *hostname != "" {
+		// The imagecfg additions to the hostname have no kickstart equivalent
+		native["Hostname"] = bp.Extensions.GetPrettyHostname() == "" && bp.Extensions.GetChassis() == "" && bp.Extensions.GetHostsEntry() == nil
+		lines = append(lines, "network --hostname="+ksArg(*hostname))
+	}
+
+	for _, group := range bp.Customizations.GetGroups() {
+		line := "group --name=" + ksArg(group.Name)
+		if group.GID != nil {
+			line += fmt.Sprintf(" --gid=%d", *group.GID)
+		}
+		lines = append(lines, line)
+	}
+
+	for _, user := range bp.Customizations.GetUsers() {
+		line := "user --name=" + ksArg(user.Name)
+		if user.UID != nil {
+			line += fmt.Sprintf(" --uid=%d", *user.UID)
+		}
+		if user.GID != nil {
+			line += fmt.Sprintf(" --gid=%d", *user.GID)
+		}
+		if len(user.Groups) > 0 {
+			line += " --groups=" + ksArg(strings.Join(user.Groups, ","))
+		}
+		if user.Home != nil && *user.Home != "" {
+			line += " --homedir=" + ksArg(*user.Home)
+		}
+		if user.Shell != nil && *user.Shell != "" {
+			line += " --shell=" + ksArg(*user.Shell)
+		}
+		if user.Description != nil && *user.Description != "" {
+			line += " --gecos=" + ksArg(*user.Description)
+		}
+		if user.Password != nil && *user.Password != "" {
+			line += " --iscrypted --password=" + ksArg(*user.Password)
+		}
+		lines = append(lines, line)
+		if user.Key != nil && *user.Key != "" {
+			for _, key := range strings.Split(strings.TrimSpace(*user.Key), "\n") {
+				if key = strings.TrimSpace(key); key != "" {
+					lines = append(lines, fmt.Sprintf("sshkey --username=%s %s", ksArg(user.Name), shellQuote(key)))
+				}
+			}
+		}
+	}
+
+	if fw := bp.Customizations.GetFirewall(); fw != nil {
+		native["Firewall"] = true
+		line := "firewall --enabled"
+		if len(fw.Ports) > 0 {
+			line += " --port=" + ksArg(strings.Join(fw.Ports, ","))
+		}
+		if fw.Services != nil {
+			for _, service := range fw.Services.Enabled {
+				line += " --service=" + ksArg(service)
+			}
+			for _, service := range fw.Services.Disabled {
+				line += " --remove-service=" + ksArg(service)
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	// Masking has no kickstart equivalent
+	if svc := bp.Customizations.GetServices(); svc != nil && len(svc.Masked) == 0 && (len(svc.Enabled) > 0 || len(svc.Disabled) > 0) {
+		native["Services"] = true
+		line := "services"
+		if len(svc.Enabled) > 0 {
+			line += " --enabled=" + ksArg(strings.Join(svc.Enabled, ","))
+		}
+		if len(svc.Disabled) > 0 {
+			line += " --disabled=" + ksArg(strings.Join(svc.Disabled, ","))
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, native
+}
+
+// generateKickstart generates an Anaconda kickstart from the blueprint.
+func generateKickstart(bp *Blueprint) (string, error) {
+	header, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return "", err
+	}
+
+	lines, native := kickstartCommands(bp)
+
+	var out strings.Builder
+	out.WriteString("# Generated by imagecfg\n")
+	for _, line := range lines {
+		out.WriteString(line + "\n")
+	}
+
+	if packages := bp.GetPackages(); len(packages) > 0 {
+		out.WriteString("\n%packages\n")
+		for _, pkg := range packages {
+			out.WriteString(pkg + "\n")
+		}
+		out.WriteString("%end\n")
+	}
+
+	var post []string
+	for _, block := range namedBlocks {
+		if native[block.Name] {
+			continue
+		}
+		post = append(post, fmt.Sprintf("# %s\n%s", block.Name, block.Commands))
+	}
+	if len(post) > 0 {
+		script := strings.TrimPrefix(header, "#!/bin/bash\n") + strings.Join(post, "\n\n") + "\n"
+		if strings.Contains("\n"+script, "\n%end") {
+			return "", fmt.Errorf("the generated %%post section contains a line starting with %%end")
+		}
+		out.WriteString("\n%post --interpreter=/bin/bash --erroronfail\n")
+		out.WriteString(script)
+		out.WriteString("%end\n")
+	}
+
+	return out.String(), nil
+}
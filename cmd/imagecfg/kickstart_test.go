@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateKickstart(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[packages]]
+name = "vim"
+
+[customizations]
+hostname = "ks1"
+
+[customizations.locale]
+languages = ["en_US.UTF-8", "cs_CZ.UTF-8"]
+keyboard = "us"
+
+[customizations.timezone]
+timezone = "Europe/Prague"
+
+[[customizations.group]]
+name = "app"
+gid = 2000
+
+[[customizations.user]]
+name = "admin"
+description = "Site Admin"
+password = "$6$hash"
+key = "ssh-ed25519 AAAA admin@example.com"
+groups = ["wheel", "app"]
+
+[customizations.firewall]
+ports = ["8080:tcp"]
+
+[customizations.firewall.services]
+enabled = ["https"]
+
+[customizations.services]
+enabled = ["nginx"]
+masked = ["rpcbind"]
+
+[customizations.journald]
+storage = "persistent"
+`)
+	kickstart, err := generateKickstart(bp)
+	require.NoError(t, err)
+	assert.Contains(t, kickstart, "lang en_US.UTF-8 --addsupport=cs_CZ.UTF-8\nkeyboard --vckeymap=us\ntimezone Europe/Prague\nnetwork --hostname=ks1\n")
+	assert.Contains(t, kickstart, "group --name=app --gid=2000\n")
+	assert.Contains(t, kickstart, `user --name=admin --groups=wheel,app --gecos='Site Admin' --iscrypted --password='$6$hash'`+"\n")
+	assert.Contains(t, kickstart, "sshkey --username=admin 'ssh-ed25519 AAAA admin@example.com'\n")
+	assert.Contains(t, kickstart, "firewall --enabled --port=8080:tcp --service=https\n")
+	assert.Contains(t, kickstart, "\n%packages\nvim\n")
+
+	// Masked services are only possible in %post
+	assert.NotContains(t, kickstart, "\nservices ")
+	assert.Contains(t, kickstart, "\n%post --interpreter=/bin/bash --erroronfail\nset -euf -o pipefail\n\n# Services\nsystemctl enable nginx && systemctl mask rpcbind\n\n# Journald\n")
+	assert.NotContains(t, kickstart, "useradd")
+	assert.NotContains(t, kickstart, "/etc/hostname")
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+)
+
+// Severities of lint findings, only errors fail the lint
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+)
+
+// lintFinding is a problem a lint rule found in a blueprint
+type lintFinding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Field    string `json:"field"`
+	Message  string `json:"message"`
+}
+
+// lintRule is a check of the blueprint. The check returns findings without the rule
+// and severity, which are filled in by lintBlueprint.
+type lintRule struct {
+	ID       string
+	Name     string
+	Severity string
+	Check    func(bp *Blueprint) []lintFinding
+}
+
+// lintConfig is the configuration file of the linter
+type lintConfig struct {
+	// Disable lists the IDs or names of the rules to skip
+	Disable []string `toml:"disable"`
+	// Severity overrides the severity of rules, keyed by ID or name
+	Severity map[string]string `toml:"severity"`
+}
+
+// bootcConflictingPackages update or rebuild the system in place, which fights
+// with the image based updates of bootc
+var bootcConflictingPackages = []string{"dnf-automatic", "yum-cron", "PackageKit", "dracut-config-rescue"}
+
+var lintRules = []lintRule{
+	{"IC001", "plaintext-password", severityError, func(bp *Blueprint) []lintFinding {
+		var findings []lintFinding
+		for _, user := range bp.Customizations.GetUsers() {
+			// chpasswd -e expects a crypt(3) hash
+			if user.Password != nil && *user.Password != "" && !strings.HasPrefix(*user.Password, "$") {
+				findings = append(findings, lintFinding{Field: "customizations.user.password", Message: fmt.Sprintf("password of user %s is not hashed", user.Name)})
+			}
+		}
+		return findings
+	}},
+	{"IC002", "world-writable-mode", severityWarning, func(bp *Blueprint) []lintFinding {
+		var findings []lintFinding
+		for _, dir := range bp.Customizations.GetDirectories() {
+			if mode, err := fsNodeMode(dir.Mode, 0755); err == nil && mode&0002 != 0 {
+				findings = append(findings, lintFinding{Field: "customizations.directories.mode", Message: fmt.Sprintf("directory %s is world-writable (%04o)", dir.Path, mode)})
+			}
+		}
+		for _, file := range bp.Customizations.GetFiles() {
+			if mode, err := fsNodeMode(file.Mode, 0644); err == nil && mode&0002 != 0 {
+				findings = append(findings, lintFinding{Field: "customizations.files.mode", Message: fmt.Sprintf("file %s is world-writable (%04o)", file.Path, mode)})
+			}
+		}
+		return findings
+	}},
+	{"IC003", "root-login", severityWarning, func(bp *Blueprint) []lintFinding {
+		sshd := bp.Extensions.GetSSHD()
+		if sshd == nil {
+			return nil
+		}
+		permit := ""
+		if sshd.PermitRootLogin != nil {
+			permit = *sshd.PermitRootLogin
+		}
+		for key, value := range sshd.Options {
+			if strings.EqualFold(key, "PermitRootLogin") {
+				permit = value
+			}
+		}
+		if permit == "yes" {
+			return []lintFinding{{Field: "customizations.sshd.permit_root_login", Message: "root can log in over SSH with a password"}}
+		}
+		return nil
+	}},
+	{"IC004", "firewall-disabled", severityWarning, func(bp *Blueprint) []lintFinding {
+		fw := bp.Customizations.GetFirewall()
+		svc := bp.Customizations.GetServices()
+		if fw == nil || svc == nil || (len(fw.Ports) == 0 && (fw.Services == nil || len(fw.Services.Enabled) == 0)) {
+			return nil
+		}
+		for _, name := range slices.Concat(svc.Disabled, svc.Masked) {
+			if name == "firewalld" || name == "firewalld.service" {
+				return []lintFinding{{Field: "customizations.services", Message: "firewalld is disabled, the opened ports and services have no effect"}}
+			}
+		}
+		return nil
+	}},
+	{"IC005", "bootc-conflicting-package", severityWarning, func(bp *Blueprint) []lintFinding {
+		var findings []lintFinding
+		for _, pkg := range slices.Concat(bp.Packages, bp.Modules) {
+			if slices.Contains(bootcConflictingPackages, pkg.Name) {
+				findings = append(findings, lintFinding{Field: "packages", Message: fmt.Sprintf("package %s conflicts with image based updates of bootc", pkg.Name)})
+			}
+		}
+		return findings
+	}},
+}
+
+var (
+	lintFormat     string
+	lintConfigPath string
+	lintDisable    []string
+)
+
+var lintCmd = &cobra.Command{
+	Use:   "lint [blueprint.toml...]",
+	Short: "Check an OSBuild blueprint for bad practices",
+	Long: `Checks an OSBuild blueprint (TOML format) against rules for security and
+bootc best practices. Each finding has the ID of its rule and a severity,
+error, warning or info. The command fails if any error is found.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+Rules:
+- IC001 plaintext-password (error): user passwords that are not hashed
+- IC002 world-writable-mode (warning): world-writable files and directories
+- IC003 root-login (warning): sshd allows root to log in with a password
+- IC004 firewall-disabled (warning): firewalld is disabled, but ports are opened
+- IC005 bootc-conflicting-package (warning): packages updating the system in place
+
+Rules can be disabled with --disable, by ID or name. A TOML configuration file
+given with --config can disable rules and override their severities:
+
+  disable = ["IC005"]
+  [severity]
+  root-login = "error"`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if lintFormat != "text" && lintFormat != "json" {
+			return fmt.Errorf("unknown lint format %q, must be text or json", lintFormat)
+		}
+		var config lintConfig
+		if lintConfigPath != "" {
+			if _, err := toml.DecodeFile(lintConfigPath, &config); err != nil {
+				return fmt.Errorf("error reading lint configuration: %w", err)
+			}
+		}
+		config.Disable = append(config.Disable, lintDisable...)
+
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+		findings, err := lintBlueprint(bp, config)
+		if err != nil {
+			return err
+		}
+
+		if lintFormat == "json" {
+			data, err := json.MarshalIndent(append([]lintFinding{}, findings...), "", "  ")
+			if err != nil {
+				return fmt.Errorf("error encoding lint findings: %w", err)
+			}
+			fmt.Println(string(data))
+		} else {
+			for _, finding := range findings {
+				fmt.Printf("%s %s %s: %s\n", finding.Severity, finding.Rule, finding.Field, finding.Message)
+			}
+		}
+
+		errorCount := 0
+		for _, finding := range findings {
+			if finding.Severity == severityError {
+				errorCount++
+			}
+		}
+		if errorCount > 0 {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("%d lint error(s) found", errorCount)
+		}
+		return nil
+	},
+}
+
+func init() {
+	lintCmd.Flags().StringVar(&lintFormat, "format", "text", "output format, text or json")
+	lintCmd.Flags().StringVar(&lintConfigPath, "config", "", "TOML file disabling rules and overriding severities")
+	lintCmd.Flags().StringSliceVar(&lintDisable, "disable", nil, "IDs or names of rules to skip")
+	rootCmd.AddCommand(lintCmd)
+}
+
+// lintBlueprint runs the enabled lint rules on the blueprint.
+func lintBlueprint(bp *Blueprint, config lintConfig) ([]lintFinding, error) {
+	known := make(map[string]bool)
+	for _, rule := range lintRules {
+		known[rule.ID], known[rule.Name] = true, true
+	}
+	for _, name := range config.Disable {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown lint rule %q", name)
+		}
+	}
+	for name, severity := range config.Severity {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown lint rule %q", name)
+		}
+		if severity != severityError && severity != severityWarning && severity != severityInfo {
+			return nil, fmt.Errorf("invalid severity %q of rule %s, must be error, warning or info", severity, name)
+		}
+	}
+
+	var findings []lintFinding
+	for _, rule := range lintRules {
+		if slices.Contains(config.Disable, rule.ID) || slices.Contains(config.Disable, rule.Name) {
+			continue
+		}
+		severity := rule.Severity
+		for _, name := range []string{rule.Name, rule.ID} {
+			if s, ok := config.Severity[name]; ok {
+				severity = s
+			}
+		}
+		for _, finding := range rule.Check(bp) {
+			finding.Rule = rule.ID
+			finding.Severity = severity
+			findings = append(findings, finding)
+		}
+	}
+	return findings, nil
+}
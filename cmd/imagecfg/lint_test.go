@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const lintTestBlueprint = `
+[[packages]]
+name = "dnf-automatic"
+
+[[customizations.user]]
+name = "admin"
+password = "hunter2"
+
+[[customizations.user]]
+name = "deploy"
+password = "$6$hash"
+
+[[customizations.directories]]
+path = "/srv/shared"
+mode = "0777"
+
+[[customizations.files]]
+path = "/etc/myapp.conf"
+data = "x\n"
+mode = "0666"
+
+[customizations.sshd]
+permit_root_login = "yes"
+
+[customizations.firewall]
+ports = ["22/tcp"]
+
+[customizations.services]
+masked = ["firewalld"]
+`
+
+func TestLintBlueprint(t *testing.T) {
+	bp := mustParseBlueprint(t, lintTestBlueprint)
+	findings, err := lintBlueprint(bp, lintConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, []lintFinding{
+		{Rule: "IC001", Severity: "error", Field: "customizations.user.password", Message: "password of user admin is not hashed"},
+		{Rule: "IC002", Severity: "warning", Field: "customizations.directories.mode", Message: "directory /srv/shared is world-writable (0777)"},
+		{Rule: "IC002", Severity: "warning", Field: "customizations.files.mode", Message: "file /etc/myapp.conf is world-writable (0666)"},
+		{Rule: "IC003", Severity: "warning", Field: "customizations.sshd.permit_root_login", Message: "root can log in over SSH with a password"},
+		{Rule: "IC004", Severity: "warning", Field: "customizations.services", Message: "firewalld is disabled, the opened ports and services have no effect"},
+		{Rule: "IC005", Severity: "warning", Field: "packages", Message: "package dnf-automatic conflicts with image based updates of bootc"},
+	}, findings)
+}
+
+func TestLintBlueprintConfig(t *testing.T) {
+	bp := mustParseBlueprint(t, lintTestBlueprint)
+	findings, err := lintBlueprint(bp, lintConfig{
+		Disable:  []string{"IC002", "firewall-disabled", "IC005"},
+		Severity: map[string]string{"plaintext-password": "info", "IC003": "error"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []lintFinding{
+		{Rule: "IC001", Severity: "info", Field: "customizations.user.password", Message: "password of user admin is not hashed"},
+		{Rule: "IC003", Severity: "error", Field: "customizations.sshd.permit_root_login", Message: "root can log in over SSH with a password"},
+	}, findings)
+
+	_, err = lintBlueprint(bp, lintConfig{Disable: []string{"IC999"}})
+	assert.EqualError(t, err, `unknown lint rule "IC999"`)
+	_, err = lintBlueprint(bp, lintConfig{Severity: map[string]string{"IC001": "fatal"}})
+	assert.EqualError(t, err, `invalid severity "fatal" of rule IC001, must be error, warning or info`)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logFormat and logLevel are set by --log-format and --log-level
+var logFormat, logLevel string
+
+// logger logs the progress of commands to standard error
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// newLogger returns a logger writing to w in the format, text or json, that logs the
+// messages of the level, debug, info, warn or error, and above.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q, must be debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, must be text or json", format)
+	}
+}
@@ -2,10 +2,17 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/osbuild/blueprint/pkg/blueprint"
@@ -14,42 +21,235 @@ import (
 
 const defaultBlueprintPath = "/usr/lib/bootc-image-builder/config.toml"
 
+// resetMachineID is set by --reset-machine-id and overrides the blueprint setting
+var resetMachineID bool
+
+// shellDialect is set by --shell and selects the shell the script is generated for,
+// "bash" or "posix"
+var shellDialect = "bash"
+
+// splitOutputDir and splitArchive are set by --split-output and --archive of the bash
+// command, which write a script per block instead of printing the script
+var (
+	splitOutputDir string
+	splitArchive   string
+)
+
+// declarativeMode is set by --declarative, users, groups, files and directories are
+// then declared in sysusers.d and tmpfiles.d fragments
+var declarativeMode bool
+
 // --- Blueprint Parsing Helper ---
-func parseBlueprint(path string) (*blueprint.Blueprint, error) {
-	file, err := os.Open(path)
+func parseBlueprint(path string) (*Blueprint, error) {
+	bp, unknownKeys, err := decodeBlueprint(path)
 	if err != nil {
-		return nil, fmt.Errorf("error opening blueprint file %s: %w", path, err)
+		return nil, err
+	}
+	if len(unknownKeys) > 0 {
+		return nil, fmt.Errorf("unknown configuration keys in %s: %s", path, strings.Join(unknownKeys, ", "))
 	}
-	defer file.Close()
+	return bp, nil
+}
 
+// decodeBlueprint decodes the blueprint file at path, or fetched from the URL, see
+// readBlueprint, in TOML, JSON or YAML, see detectBlueprintFormat. Unlike parseBlueprint, it does not fail on unknown keys but returns
+// them along with the blueprint.
+func decodeBlueprint(path string) (*Blueprint, []string, error) {
+	data, err := readBlueprint(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening blueprint file %s: %w", path, err)
+	}
+	if data, err = blueprintTOML(path, data); err != nil {
+		return nil, nil, err
+	}
+	return decodeBlueprintTOML(data, path)
+}
+
+// decodeBlueprintTOML decodes a blueprint in TOML format read from path, like
+// decodeBlueprint.
+func decodeBlueprintTOML(data []byte, path string) (*Blueprint, []string, error) {
+	// The file is decoded twice: once into the upstream blueprint and once
+	// into the imagecfg extensions. A key is only unknown if neither knows it.
 	var bp blueprint.Blueprint
-	decoder := toml.NewDecoder(file)
-	meta, err := decoder.Decode(&bp)
+	meta, err := toml.NewDecoder(bytes.NewReader(data)).Decode(&bp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing blueprint TOML from %s: %w", path, err)
+	}
+
+	var ext extensionBlueprint
+	extMeta, err := toml.NewDecoder(bytes.NewReader(data)).Decode(&ext)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing blueprint TOML from %s: %w", path, err)
+		return nil, nil, fmt.Errorf("error parsing blueprint TOML from %s: %w", path, err)
 	}
 
 	// Check for undecoded keys
-	if len(meta.Undecoded()) > 0 {
-		var unknownKeys []string
-		for _, key := range meta.Undecoded() {
+	extUndecoded := make(map[string]bool)
+	for _, key := range extMeta.Undecoded() {
+		extUndecoded[key.String()] = true
+	}
+	var unknownKeys []string
+	for _, key := range meta.Undecoded() {
+		if extUndecoded[key.String()] {
 			unknownKeys = append(unknownKeys, key.String())
 		}
-		return nil, fmt.Errorf("unknown configuration keys in %s: %s", path, strings.Join(unknownKeys, ", "))
 	}
 
-	return &bp, nil
+	keys := make(map[string]bool)
+	for _, key := range append(meta.Keys(), extMeta.Keys()...) {
+		keys[key.String()] = true
+	}
+
+	return &Blueprint{Blueprint: &bp, Extensions: ext.Customizations, MinVersion: ext.MinVersion, Keys: slices.Sorted(maps.Keys(keys))}, unknownKeys, nil
 }
 
-// Helper function to load blueprint
-func loadBlueprint(args []string) (*blueprint.Blueprint, error) {
-	blueprintPath := defaultBlueprintPath
-	if len(args) > 0 {
-		blueprintPath = args[0]
+// blueprintPaths returns the blueprints given as arguments, the default one if there
+// are none. Directories stand for the *.toml files in them in lexical order, like
+// conf.d directories, so that packages and layers can each drop in a fragment.
+func blueprintPaths(args []string) []string {
+	if len(args) == 0 {
+		return []string{defaultBlueprintPath}
+	}
+	var paths []string
+	for _, arg := range args {
+		paths = append(paths, blueprintDirFiles(arg)...)
+	}
+	return paths
+}
+
+// blueprintDirFiles returns the *.toml files in the directory at path, except hidden
+// ones, or path itself if it is no directory or has none.
+func blueprintDirFiles(path string) []string {
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return []string{path}
+	}
+	matches, err := filepath.Glob(filepath.Join(path, "*.toml"))
+	if err != nil {
+		return []string{path}
+	}
+	var files []string
+	for _, match := range matches {
+		if !strings.HasPrefix(filepath.Base(match), ".") {
+			files = append(files, match)
+		}
+	}
+	if len(files) == 0 {
+		return []string{path}
+	}
+	return files
+}
+
+// blueprintName returns the name of the blueprints given as arguments for messages.
+func blueprintName(args []string) string {
+	if len(args) == 0 {
+		return defaultBlueprintPath
+	}
+	return strings.Join(args, ", ")
+}
+
+// readBlueprints reads the blueprints at paths, see readBlueprint, and returns the one
+// blueprint, rendered with --template, or all of them merged in order like by the
+// merge command as TOML, with the format of the returned data. A blueprint changed
+// when it is decoded, see needsDecoding, and one with the --set overrides applied are
+// returned as TOML as well. The unknown keys of the merged blueprints are returned by
+// path, so that they are reported with the file they are in.
+func readBlueprints(paths []string) ([]byte, string, map[string][]string, error) {
+	if len(paths) == 1 && len(blueprintSets) == 0 {
+		data, err := readBlueprint(paths[0])
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if data, err = renderBlueprint(paths[0], data); err != nil {
+			return nil, "", nil, err
+		}
+		if !needsDecoding(paths[0], data) {
+			format, err := detectBlueprintFormat(paths[0], data)
+			return data, format, nil, err
+		}
+	}
+	if blueprintSHA256 != "" && len(paths) > 1 {
+		return nil, "", nil, fmt.Errorf("--sha256 pins a single blueprint, not %d", len(paths))
+	}
+	if blueprintSignature != "" && len(paths) > 1 {
+		return nil, "", nil, fmt.Errorf("--signature is the signature of a single blueprint, not %d", len(paths))
+	}
+	var docs []map[string]interface{}
+	unknownKeys := make(map[string][]string)
+	for _, path := range paths {
+		data, err := readBlueprint(path)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("error opening blueprint file %s: %w", path, err)
+		}
+		doc, err := decodeBlueprintDocument(path, data)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if unknownKeys[path], err = documentUnknownKeys(doc, path); err != nil {
+			return nil, "", nil, err
+		}
+		docs = append(docs, doc)
+	}
+	doc := mergeBlueprints(docs, nil)
+	if err := applyOverrides(doc, blueprintSets); err != nil {
+		return nil, "", nil, err
+	}
+	data, err := encodeDocument(doc, "toml")
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error merging blueprints: %w", err)
 	}
-	bp, err := parseBlueprint(blueprintPath)
+	return data, "toml", unknownKeys, nil
+}
+
+// documentUnknownKeys returns the keys of the blueprint document read from path that
+// neither the upstream blueprint nor the imagecfg extensions know.
+func documentUnknownKeys(doc map[string]interface{}, path string) ([]string, error) {
+	data, err := encodeDocument(doc, "toml")
 	if err != nil {
-		return nil, err // Already includes path info
+		return nil, fmt.Errorf("error parsing blueprint %s: %w", path, err)
+	}
+	_, unknownKeys, err := decodeBlueprintTOML(data, path)
+	return unknownKeys, err
+}
+
+// Helper function to load blueprint. Several blueprints are merged in order, later
+// ones overriding and extending earlier ones, see mergeBlueprints, and the --set
+// overrides are applied on top.
+func loadBlueprint(args []string) (*Blueprint, error) {
+	paths := blueprintPaths(args)
+	var bp *Blueprint
+	if len(paths) == 1 && len(blueprintSets) == 0 {
+		parsed, err := parseBlueprint(paths[0])
+		if err != nil {
+			return nil, err // Already includes path info
+		}
+		bp = parsed
+	} else {
+		data, _, fileUnknownKeys, err := readBlueprints(paths)
+		if err != nil {
+			return nil, err
+		}
+		// Unknown keys are reported with the file they are in
+		for _, path := range paths {
+			if keys := fileUnknownKeys[path]; len(keys) > 0 {
+				return nil, fmt.Errorf("unknown configuration keys in %s: %s", path, strings.Join(keys, ", "))
+			}
+		}
+		var unknownKeys []string
+		if bp, unknownKeys, err = decodeBlueprintTOML(data, blueprintName(args)); err != nil {
+			return nil, err
+		}
+		// The keys of the files are known, these can only come from --set
+		if len(unknownKeys) > 0 {
+			return nil, fmt.Errorf("unknown configuration keys set by --set: %s", strings.Join(unknownKeys, ", "))
+		}
+	}
+	if err := checkBlueprintVersion(bp, blueprintName(args)); err != nil {
+		return nil, err
+	}
+	if resetMachineID {
+		if bp.Extensions == nil {
+			bp.Extensions = &Customizations{}
+		}
+		bp.Extensions.ResetMachineID = true
 	}
 	return bp, nil
 }
@@ -59,10 +259,24 @@ var rootCmd = &cobra.Command{
 	Use:   "imagecfg",
 	Short: "imagecfg is a tool for working with OSBuild blueprints",
 	Long:  `A command-line utility to process OSBuild blueprints, for example, to translate them into other formats like bash scripts.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		l, err := newLogger(os.Stderr, logFormat, logLevel)
+		if err != nil {
+			return err
+		}
+		logger = l
+		if minVersion != "" {
+			if err := requireVersion(minVersion, "--min-version"); err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+		}
+		return nil
+	},
 }
 
 var bashCmd = &cobra.Command{
-	Use:   "bash [blueprint.toml]",
+	Use:   "bash [blueprint.toml...]",
 	Short: "Translate an OSBuild blueprint to a bash script",
 	Long: `Translates an OSBuild blueprint (TOML format) into a bash script
 that attempts to apply the configurations.
@@ -71,18 +285,65 @@ If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder
 
 Supported configurations:
 - packages
+- flatpak (remotes and refs)
+- pip packages (system-wide or in a venv)
 - user
 - group
-- hostname
+- files and directories
+- hostname (including /etc/hosts entry, pretty hostname and chassis)
 - timezone
+- chrony (servers, pools, makestep, leap second handling)
 - firewall (ports, enabled services)
-- locale
+- locale (including glibc langpacks for all languages, console and X11 keyboard)
 - services (enabled/disabled)
+- default systemd target
+- journald (storage, size limits, syslog forwarding)
+- scheduled tasks (cron.d entries or systemd timers)
+- proxy (environment, dnf, systemd units)
+- environment variables (/etc/environment and /etc/profile.d)
+- sshd (validated sshd_config.d drop-in)
+- password policy (pwquality and login.defs aging)
+- sudoers (validated sudoers.d drop-ins)
+- polkit rules
+- container registries (search, blocked, insecure)
+- dconf defaults and locks
+- udev rules
+- kernel module options (modprobe.d)
+- tuned profile
+- swap (swap file, zswap)
+- zram swap (zram-generator)
+- mounts (fstab entries or systemd mount units)
+- selinux (mode and booleans)
+- fapolicyd (trust entries and rules)
+- domain join (Active Directory or IPA)
+- greenboot health checks
+- system purpose (role, SLA, usage, addons)
+- machine ID reset (also with --reset-machine-id)
 
 The generated script should be reviewed carefully before execution.
 Each customization type is translated into a block of bash commands.
-If multiple commands are needed for a single logical step, they are chained with '&&'.`,
-	Args: cobra.MaximumNArgs(1),
+If multiple commands are needed for a single logical step, they are chained with '&&'.
+
+With --shell=posix, the script is generated for a POSIX sh such as dash or
+busybox sh instead of bash.
+
+With --declarative, users and groups are written as a systemd-sysusers fragment
+and files and directories as a systemd-tmpfiles fragment instead.
+
+With --only or --skip and a comma separated list of blocks, e.g.
+--only users,packages or --skip firewall, only the listed blocks are generated
+or the listed blocks are left out. Blocks are named in lower case with
+dashes, e.g. files-and-directories, like the scripts of --split-output.
+
+With --idempotent, the script is only generated if every command is safe to
+run twice: users and groups are checked for before they are created, lines
+are removed or checked for before they are appended and so on. The commands
+that are not are reported instead.
+
+With --split-output or --archive, a numbered script per block and a run.sh
+script running them in order are written to a directory or a tar archive,
+so that blocks can be picked or reordered.`,
+	Args: cobra.ArbitraryArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		bp, err := loadBlueprint(args)
 		if err != nil {
@@ -93,6 +354,30 @@ If multiple commands are needed for a single logical step, they are chained with
 		if err != nil {
 			return fmt.Errorf("error generating bash script: %w", err)
 		}
+		namedBlocks, err = selectBlocks(namedBlocks, onlyBlocks, skipBlocks)
+		if err != nil {
+			return err
+		}
+		if idempotentCheck {
+			if err := checkIdempotent(namedBlocks); err != nil {
+				return err
+			}
+		}
+
+		if splitOutputDir != "" || splitArchive != "" {
+			scripts := splitScripts(header, namedBlocks)
+			if splitOutputDir != "" {
+				if err := writeSplitOutput(scripts, splitOutputDir); err != nil {
+					return fmt.Errorf("error writing block scripts: %w", err)
+				}
+			}
+			if splitArchive != "" {
+				if err := writeSplitArchive(scripts, splitArchive); err != nil {
+					return fmt.Errorf("error writing block script archive: %w", err)
+				}
+			}
+			return nil
+		}
 
 		var fullScript strings.Builder
 		fullScript.WriteString(header)
@@ -113,7 +398,7 @@ If multiple commands are needed for a single logical step, they are chained with
 }
 
 var applyCmd = &cobra.Command{
-	Use:   "apply [blueprint.toml]",
+	Use:   "apply [blueprint.toml...]",
 	Short: "Apply an OSBuild blueprint directly",
 	Long: `Applies an OSBuild blueprint (TOML format) by generating and executing
 a bash script that implements the configurations.
@@ -121,75 +406,360 @@ a bash script that implements the configurations.
 If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
 
 This command requires root privileges as it modifies system configuration.
-The same configurations are supported as in the 'bash' command.`,
-	Args: cobra.MaximumNArgs(1),
+When it does not run as root, it fails before applying anything, with what
+every block needs root privileges for. With --sudo, it runs every block with
+sudo instead, asking for the password once. --rollback and the native
+executor need apply itself to run as root.
+The same configurations are supported as in the 'bash' command.
+
+Applying a blueprint again is safe and changes nothing that is already
+configured. With --idempotent, nothing is applied if any command is not safe
+to run twice, see the 'bash' command.
+
+--only and --skip select the blocks to apply, e.g. to re-run the block that
+failed or to leave out blocks that are managed elsewhere, see the 'bash'
+command.
+
+With --rollback, the files and directories each block changes are saved
+before it runs, and restored when a block fails, so that a failed apply does
+not leave a half-applied system behind. Existing files are saved under /etc,
+elsewhere only the paths created by the blocks are removed. Installed
+packages, flatpaks, SELinux policy and domain joins are not rolled back.
+
+With --continue-on-error, a failing block does not stop apply: the remaining
+blocks are applied, and the blocks that were applied and the ones that failed
+are listed at the end. apply then fails if any block failed.
+
+Progress is logged with the number of the block and the elapsed time, and
+the output of the blocks, like that of long package installs, is shown as it
+is written, with the name of the block before every line. With --quiet, only
+failing blocks and their output are shown.
+
+With --jobs N, up to N blocks are applied at the same time, each as soon as
+the blocks it depends on are applied, e.g. users after groups and services
+after packages (see the 'graph' command). Blocks changing the same files run
+one after the other, and blocks installing packages run alone.
+
+With --root, the blueprint is applied to the tree mounted there, e.g. an image
+mounted at /mnt/image, instead of the running system, so that images can be
+configured from a build host. The blocks run in a chroot into the tree with
+/dev, /proc and /sys of the host, so dnf, useradd, systemctl and the other
+tools of the tree work on its packages and configuration. The tree needs a
+shell and the tools of the blocks, like every bootc image has.
+
+With --confine, the blocks applied to --root run in a bubblewrap sandbox
+instead of a chroot, for blueprints that are not trusted: the sandbox sees
+only the tree, with new /dev, /proc, /tmp and /run, its own PID, IPC and UTS
+namespaces and no capabilities but the ones for owning files and installing
+packages, so the blocks cannot change or look at the build host. Only the
+network is shared.
+
+With --image and --tag, the blueprint is applied to a container image instead:
+podman builds the image --tag from --image, running this imagecfg binary with
+the other flags given in a build step. imagecfg and the blueprint are only
+mounted into the build, so the new image does not contain them, and root
+privileges are not needed with rootless podman. imagecfg has to be a Linux
+binary that runs in the image, like the static release builds.
+
+apply records the hash of the blueprint and of every applied block with the
+time it was applied in a state file, /var/lib/imagecfg/state.json by
+default, or --state, in the --root tree with --root. Blocks whose commands
+did not change since they were applied successfully are not applied again,
+unless a block they depend on changed; failed blocks run again on the next
+apply. With --force, all blocks are applied, and with --state "", no state
+is recorded.
+
+With --verify, cheap probes check after every block that what it configures
+is in place: the users and groups exist with their IDs, shells and groups,
+/etc/hostname holds the hostname, the services are enabled, disabled or
+masked, the default target is set and the firewall ports and services are
+open. A block whose probes fail fails like a block whose commands failed,
+with the probes that failed. See the 'verify' command for checking a system
+later.
+
+With --timeout, a block running longer fails with a timeout error instead of
+a hung dnf or network call freezing the whole apply: the block and the
+commands it started are terminated, and killed if they do not exit within 10
+seconds. --block-timeout sets the timeout of single blocks, e.g.
+--block-timeout packages=1h --timeout 5m, and 0 runs a block without one.
+
+With --retries N, blocks failing transiently run again up to N times, first
+after --retry-delay and then twice as long every time. Failures are
+transient when a block installs packages or flatpaks, pulls containers or
+joins a domain or registers the system, and timed out or failed with a
+network error, like an unreachable mirror, or because the package database
+was locked. Other failures, like unknown packages, are fatal and not retried.
+
+With --executor native, the environment, packages, hostname, timezone,
+groups, users, files and directories, firewall, services, default target and
+DNF cache cleanup blocks are done in Go instead of by a shell script: files are written and
+links created directly, users and groups are looked up with os/user, and
+dnf, useradd, systemctl and the other tools run with their arguments as
+given, so no value of the blueprint is ever parsed by a shell. The other
+blocks and the probes of --verify still run as scripts. The native executor
+cannot be used with --root.
+
+With --journal, the log is sent to the systemd journal as well, with the
+commands and the output of every block whatever --log-level and --quiet are.
+The messages have the identifier imagecfg and their attributes as fields,
+IMAGECFG_BLOCK for the block and IMAGECFG_RESULT for whether it was applied,
+failed or skipped, so a first boot apply can be looked into later with
+journalctl -t imagecfg IMAGECFG_RESULT=failed.
+
+With --systemd-run, every block runs as a transient service with
+systemd-run --wait, shown by systemctl while it runs, with its own /tmp unless
+--private-tmp=false and the home directories read-only, or as --protect-home
+says. Blocks creating users or writing files in /tmp or the home directories
+run without the sandbox that would break them. --property sets further
+properties of the services, like resource limits:
+
+  imagecfg apply --systemd-run --property MemoryMax=2G --property CPUQuota=50%
+
+With --report and --report-junit, the results are written to a file as JSON
+and as JUnit XML, for CI systems to show: the status of every block, applied,
+failed, skipped, unchanged or not run, how long it ran, the end of its stdout
+and stderr and the blueprint fields it was generated from. The reports are
+written when blocks fail as well.`,
+	Args: cobra.ArbitraryArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if applyRollback && applyContinueOnError {
+			return fmt.Errorf("--rollback and --continue-on-error cannot be used together")
+		}
+		if applyImage != "" {
+			if applyTag == "" {
+				return fmt.Errorf("--image needs --tag, the name of the image to build")
+			}
+			if applyRoot != "" {
+				return fmt.Errorf("--image and --root cannot be used together")
+			}
+			// Problems with the blueprint itself are reported without building anything
+			if _, err := loadBlueprint(args); err != nil {
+				return err // Cobra will print this and exit
+			}
+			binary, err := os.Executable()
+			if err != nil {
+				return fmt.Errorf("error finding the imagecfg binary: %w", err)
+			}
+			if err := applyToImage(applyImage, applyTag, binary, blueprintPaths(args), imageApplyArgs(cmd.Flags()), streamCommand); err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+			logger.Info("built image", "image", applyTag, "from", applyImage)
+			return nil
+		}
+		if applyRoot != "" {
+			root, err := filepath.Abs(applyRoot)
+			if err != nil {
+				return err
+			}
+			if info, err := os.Stat(root); err != nil || !info.IsDir() {
+				return fmt.Errorf("--root %s is not a directory", applyRoot)
+			}
+			if root == "/" {
+				root = ""
+			}
+			applyRoot = root
+		}
+		if applyConfine {
+			if err := checkConfine(applyRoot); err != nil {
+				return err
+			}
+		}
+		if applyExecutor != "script" && applyExecutor != "native" {
+			return fmt.Errorf("unknown executor %q, must be script or native", applyExecutor)
+		}
+		if applyExecutor == "native" && applyRoot != "" {
+			return fmt.Errorf("--executor native cannot be used with --root")
+		}
+		sudo := applySudo && os.Geteuid() != 0
+		if sudo && applyExecutor == "native" {
+			return fmt.Errorf("--executor native needs apply to run as root, it cannot be used with --sudo")
+		}
+		if sudo && applyRollback {
+			return fmt.Errorf("--rollback needs apply to run as root, it cannot be used with --sudo")
+		}
+		var sandbox *systemdSandbox
+		if applySystemdRun {
+			switch {
+			case applyRoot != "":
+				return fmt.Errorf("--systemd-run cannot be used with --root")
+			case applyExecutor == "native":
+				return fmt.Errorf("--systemd-run cannot be used with --executor native")
+			case sudo:
+				return fmt.Errorf("--systemd-run needs apply to run as root, it cannot be used with --sudo")
+			}
+			var err error
+			if sandbox, err = newSystemdSandbox(applyPrivateTmp, applyProtectHome, applyProperties); err != nil {
+				return err
+			}
+		}
+		if applyJobs < 1 {
+			return fmt.Errorf("--jobs must be at least 1")
+		}
+		if applyRetries < 0 {
+			return fmt.Errorf("--retries must not be negative")
+		}
+		if applyTimeout < 0 {
+			return fmt.Errorf("--timeout must not be negative")
+		}
+		blockTimeouts, err := parseBlockTimeouts(applyBlockTimeouts)
+		if err != nil {
+			return err
+		}
+		if applyQuiet {
+			// Only failures are logged
+			l, err := newLogger(os.Stderr, logFormat, "error")
+			if err != nil {
+				return err
+			}
+			logger = l
+		}
+		var journal slog.Handler
+		if applyJournal {
+			h, err := newJournalHandler(journalSocket, slog.LevelDebug)
+			if err != nil {
+				return fmt.Errorf("error connecting to the journal: %w", err)
+			}
+			journal = h
+			logger = slog.New(teeHandler{logger.Handler(), journal})
+		}
 		bp, err := loadBlueprint(args)
 		if err != nil {
 			return err // Cobra will print this and exit
 		}
+		if env := blockEnvironment(bp); sandbox != nil && len(env) > 0 {
+			// systemd-run could only pass them in the environment of the unit,
+			// which every user can read with systemctl show
+			return fmt.Errorf("--systemd-run cannot pass %s to the blocks, use password_file for the domain join", strings.Join(env, ", "))
+		}
 
 		header, namedBlocks, err := generateBashScript(bp)
 		if err != nil {
 			return fmt.Errorf("error generating command blocks: %w", err)
 		}
+		namedBlocks, err = selectBlocks(namedBlocks, onlyBlocks, skipBlocks)
+		if err != nil {
+			return err
+		}
+		if idempotentCheck {
+			if err := checkIdempotent(namedBlocks); err != nil {
+				return err
+			}
+		}
 
 		if len(namedBlocks) == 0 {
-			fmt.Println("No configurations to apply.")
+			logger.Info("no configurations to apply")
 			return nil
 		}
-
-		for _, block := range namedBlocks {
-			if strings.TrimSpace(block.Commands) == "" {
-				continue // Skip empty command blocks
+		if applyExecutor == "native" {
+			scripts, err := addNativeOps(bp, namedBlocks)
+			if err != nil {
+				return err
+			}
+			if len(scripts) > 0 {
+				logger.Info("blocks without native operations run as scripts", "blocks", scripts)
 			}
+		}
 
-			fmt.Printf("Applying: %s...\n", block.Name)
+		var report *applyReport
+		if applyReportPath != "" || applyReportJUnit != "" {
+			report = newApplyReport(blueprintName(args), namedBlocks)
+		}
 
-			// Create a temporary script file for this block
-			tmpfile, err := os.CreateTemp("", "imagecfg-block-*.sh")
+		var state *applyState
+		var statePath string
+		if applyStatePath != "" {
+			statePath = filepath.Join(applyRoot, applyStatePath)
+			state, err = loadApplyState(statePath)
 			if err != nil {
-				return fmt.Errorf("error creating temporary script for '%s': %w", block.Name, err)
-			}
-			// Defer removal of the temp file. This runs when the RunE function returns.
-			// Using a func literal to capture the current tmpfile.Name().
-			defer func(name string) {
-				if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
-					// Log error during deferred removal, but don't override original error
-					fmt.Fprintf(os.Stderr, "Warning: failed to remove temporary script %s during deferred cleanup: %v\n", name, err)
+				return err
+			}
+			if !applyForce {
+				var unchanged []string
+				namedBlocks, unchanged = state.changedBlocks(header, namedBlocks)
+				if len(unchanged) > 0 {
+					logger.Info("skipping blocks unchanged since they were applied", "blocks", unchanged)
+				}
+				for _, name := range unchanged {
+					report.finish(name, reportUnchanged, 0, nil)
+				}
+				if len(namedBlocks) == 0 {
+					logger.Info("nothing changed since the last apply")
+					if report != nil {
+						return report.Write(applyReportPath, applyReportJUnit)
+					}
+					return nil
 				}
-			}(tmpfile.Name())
-
-			// Write the header and current command block to the temporary file
-			blockScript := header + "\n" + block.Commands
-			if _, err := tmpfile.WriteString(blockScript); err != nil {
-				_ = tmpfile.Close() // Attempt to close, ignore error as we are in an error path.
-				return fmt.Errorf("error writing script for '%s' to %s: %w", block.Name, tmpfile.Name(), err)
 			}
-			if err := tmpfile.Close(); err != nil {
-				return fmt.Errorf("error closing temporary file for '%s' (%s): %w", block.Name, tmpfile.Name(), err)
+		}
+
+		if sudo {
+			if err := sudoValidate(); err != nil {
+				cmd.SilenceUsage = true
+				return err
 			}
+		} else if err := checkPrivileges(namedBlocks); err != nil {
+			cmd.SilenceUsage = true
+			return err
+		}
 
-			// Make the script executable
-			if err := os.Chmod(tmpfile.Name(), 0755); err != nil {
-				return fmt.Errorf("error making script for '%s' (%s) executable: %w", block.Name, tmpfile.Name(), err)
+		var snapshot *fileSnapshot
+		if applyRollback {
+			snapshot, err = newFileSnapshot(cmp.Or(applyRoot, "/"))
+			if err != nil {
+				return err
 			}
+			defer snapshot.Remove()
+		}
 
-			// Execute the script
-			execCmd := exec.Command(tmpfile.Name())
-			execCmd.Stdout = os.Stdout
-			execCmd.Stderr = os.Stderr // Capture stderr for error reporting
-			if err := execCmd.Run(); err != nil {
-				fmt.Fprintf(os.Stderr, "\n--- ERROR: Failed to apply '%s' ---\n", block.Name)
-				fmt.Fprintf(os.Stderr, "Error details: %v\n", err)
-				fmt.Fprintf(os.Stderr, "Attempted commands for '%s':\n%s\n", block.Name, block.Commands)
-				fmt.Fprintf(os.Stderr, "--- END ERROR ---\n")
-				return fmt.Errorf("execution failed for block '%s'", block.Name) // Error returned, defer will clean up tmpfile
+		start := time.Now()
+		applied, failed, err := applyBlocks(header, namedBlocks, applyOptions{
+			Snapshot:        snapshot,
+			ContinueOnError: applyContinueOnError,
+			Quiet:           applyQuiet,
+			Jobs:            applyJobs,
+			Root:            applyRoot,
+			Confine:         applyConfine,
+			Verify:          applyVerify,
+			Timeout:         applyTimeout,
+			BlockTimeouts:   blockTimeouts,
+			Retries:         applyRetries,
+			RetryDelay:      applyRetryDelay,
+			Sudo:            sudo,
+			Env:             blockEnvironment(bp),
+			Journal:         journal,
+			Sandbox:         sandbox,
+			Report:          report,
+		})
+		if report != nil {
+			report.RolledBack = err != nil && snapshot != nil
+			if writeErr := report.Write(applyReportPath, applyReportJUnit); writeErr != nil {
+				return errors.Join(err, writeErr)
 			}
-			fmt.Printf("Successfully applied: %s\n", block.Name)
-			// Temp file for this successful block will be cleaned up by the deferred call when RunE exits.
 		}
-		fmt.Println("\nAll configurations applied successfully.")
+		if state != nil {
+			if err != nil && snapshot != nil {
+				// The applied blocks were rolled back
+				applied = nil
+			}
+			data, _, _, readErr := readBlueprints(blueprintPaths(args))
+			if readErr != nil {
+				return errors.Join(err, fmt.Errorf("error hashing blueprint: %w", readErr))
+			}
+			state.record(hashBytes(data), header, namedBlocks, applied, failed, time.Now())
+			if writeErr := state.Write(statePath, sudo); writeErr != nil {
+				return errors.Join(err, writeErr)
+			}
+		}
+		if err != nil {
+			cmd.SilenceUsage = true
+			return err
+		}
+		logger.Info("apply finished", "applied", applied, "failed", failed, "duration", time.Since(start))
+		if len(failed) > 0 {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("%d of %d blocks failed: %s", len(failed), len(applied)+len(failed), strings.Join(failed, ", "))
+		}
 		return nil
 	},
 }
@@ -199,13 +769,86 @@ func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		// Cobra automatically prints the error to os.Stderr if RunE returns an error.
 		// We just need to ensure the process exits with an error code.
+		var exitErr *exitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		os.Exit(1)
 	}
 }
 
+// exitCodeError makes the process exit with Code instead of 1
+type exitCodeError struct {
+	Code int
+	Err  error
+}
+
+func (e *exitCodeError) Error() string { return e.Err.Error() }
+
+func (e *exitCodeError) Unwrap() error { return e.Err }
+
 func init() {
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "format of the log on standard error, text or json")
+	rootCmd.PersistentFlags().StringVar(&minVersion, "min-version", "", "fail unless imagecfg is at least this version, e.g. 1.4.0")
+	rootCmd.PersistentFlags().StringVar(&blueprintInputFormat, "input-format", "auto", "format of the blueprints, toml, json or yaml, auto to tell it from the extension or the content")
+	rootCmd.PersistentFlags().BoolVar(&blueprintExpandEnv, "expand-env", false, "expand ${VAR} in the values of the blueprints")
+	rootCmd.PersistentFlags().StringArrayVar(&blueprintEnvFiles, "env-file", nil, "file with the NAME=VALUE variables of --expand-env")
+	rootCmd.PersistentFlags().StringSliceVar(&blueprintAllowEnv, "allow-env", nil, "variables of the environment --expand-env may use, e.g. SITE_*")
+	rootCmd.PersistentFlags().BoolVar(&blueprintTemplate, "template", false, "render the blueprints with Go text/template before parsing them")
+	rootCmd.PersistentFlags().StringArrayVar(&blueprintValues, "values", nil, "YAML file with the values of --template, later files overriding earlier ones")
+	rootCmd.PersistentFlags().BoolVar(&blueprintVerifySignature, "verify-signature", false, "refuse blueprints without a valid detached signature")
+	rootCmd.PersistentFlags().StringVar(&blueprintSignature, "signature", "", "detached signature of the blueprint (default: the blueprint with .sig, or .sigstore.json for keyless signatures)")
+	rootCmd.PersistentFlags().StringArrayVar(&blueprintSignatureKeys, "signature-key", nil, "GPG or cosign public key trusted to sign blueprints")
+	rootCmd.PersistentFlags().StringVar(&blueprintSignatureIdentity, "signature-identity", "", "certificate identity trusted to sign blueprints with keyless cosign")
+	rootCmd.PersistentFlags().StringVar(&blueprintSignatureIssuer, "signature-issuer", "", "OIDC issuer of --signature-identity")
+	rootCmd.PersistentFlags().StringVar(&blueprintAgeKey, "age-key", "", "age identity file to decrypt SOPS-encrypted blueprints with")
+	rootCmd.PersistentFlags().StringArrayVar(&blueprintSets, "set", nil, "override a blueprint field, e.g. customizations.hostname=edge-42 or 'packages[+].name=vim'")
+	rootCmd.PersistentFlags().StringSliceVar(&blueprintProfiles, "profile", nil, "active profile, selecting the blueprint entries tagged with it")
+	rootCmd.PersistentFlags().StringVar(&blueprintSHA256, "sha256", "", "SHA-256 the blueprint must have, e.g. when fetched from a URL")
+	rootCmd.PersistentFlags().StringVar(&blueprintCACert, "ca-cert", "", "CA certificate to trust when fetching the blueprint from an https:// URL")
+	rootCmd.PersistentFlags().StringVar(&blueprintClientCert, "client-cert", "", "client certificate to fetch the blueprint from an https:// URL with")
+	rootCmd.PersistentFlags().StringVar(&blueprintClientKey, "client-key", "", "key of --client-cert, if it is not in the certificate file")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "least severe messages logged, debug, info, warn or error")
+
 	rootCmd.AddCommand(bashCmd)
 	rootCmd.AddCommand(applyCmd)
+
+	applyCmd.Flags().BoolVar(&applyRollback, "rollback", false, "restore the changed files if a block fails")
+	applyCmd.Flags().StringVar(&applyImage, "image", "", "container image to apply the blueprint to, building --tag")
+	applyCmd.Flags().StringVar(&applyTag, "tag", "", "name of the image built with --image")
+	applyCmd.Flags().StringVar(&applyRoot, "root", "", "apply to the tree mounted at this directory")
+	applyCmd.Flags().BoolVar(&applyConfine, "confine", false, "run the blocks applied to --root in a bubblewrap sandbox instead of a chroot")
+	applyCmd.Flags().IntVarP(&applyJobs, "jobs", "j", 1, "number of blocks to apply at the same time")
+	applyCmd.Flags().BoolVarP(&applyQuiet, "quiet", "q", false, "only show failing blocks")
+	applyCmd.Flags().DurationVar(&applyTimeout, "timeout", 0, "longest a block may run for, e.g. 30m, no limit if 0")
+	applyCmd.Flags().StringSliceVar(&applyBlockTimeouts, "block-timeout", nil, "longest single blocks may run for, overriding --timeout, e.g. packages=1h")
+	applyCmd.Flags().BoolVar(&applySudo, "sudo", false, "run the blocks with sudo when not running as root")
+	applyCmd.Flags().StringVar(&applyExecutor, "executor", "script", "how to run the blocks, script or native")
+	applyCmd.Flags().IntVar(&applyRetries, "retries", 0, "how often to run blocks failing transiently again, e.g. on network errors")
+	applyCmd.Flags().DurationVar(&applyRetryDelay, "retry-delay", 10*time.Second, "wait before the first retry, doubled for every further one")
+	applyCmd.Flags().BoolVar(&applyVerify, "verify", false, "check after every block that what it configures is in place")
+	applyCmd.Flags().StringVar(&applyStatePath, "state", defaultStatePath, "file recording the applied blocks, empty to apply all blocks without one")
+	applyCmd.Flags().BoolVar(&applyForce, "force", false, "apply the blocks that did not change since they were applied as well")
+	applyCmd.Flags().BoolVar(&applyJournal, "journal", false, "log the blocks to the systemd journal as well")
+	applyCmd.Flags().BoolVar(&applySystemdRun, "systemd-run", false, "run every block as a transient service with systemd-run")
+	applyCmd.Flags().BoolVar(&applyPrivateTmp, "private-tmp", true, "give the blocks their own /tmp with --systemd-run")
+	applyCmd.Flags().StringVar(&applyProtectHome, "protect-home", "read-only", "protection of the home directories with --systemd-run, yes, no, read-only or tmpfs")
+	applyCmd.Flags().StringArrayVar(&applyProperties, "property", nil, "property of the services run with --systemd-run, e.g. MemoryMax=2G")
+	applyCmd.Flags().StringVar(&applyReportPath, "report", "", "write the results of the blocks to this file as JSON")
+	applyCmd.Flags().StringVar(&applyReportJUnit, "report-junit", "", "write the results of the blocks to this file as JUnit XML")
+	applyCmd.Flags().BoolVar(&applyContinueOnError, "continue-on-error", false, "apply the remaining blocks when a block fails")
+
+	bashCmd.Flags().StringVar(&splitOutputDir, "split-output", "", "write a script per block and a runner script to this directory")
+	bashCmd.Flags().StringVar(&splitArchive, "archive", "", "write a script per block and a runner script to this tar archive")
+
+	for _, cmd := range []*cobra.Command{bashCmd, applyCmd} {
+		cmd.Flags().BoolVar(&resetMachineID, "reset-machine-id", false, "empty the machine ID as the last step, for golden images")
+		cmd.Flags().StringVar(&shellDialect, "shell", "bash", "shell to generate the script for, bash or posix")
+		cmd.Flags().BoolVar(&declarativeMode, "declarative", false, "declare users, groups, files and directories in sysusers.d and tmpfiles.d")
+		cmd.Flags().StringSliceVar(&onlyBlocks, "only", nil, "generate only these blocks, e.g. users,packages")
+		cmd.Flags().StringSliceVar(&skipBlocks, "skip", nil, "leave out these blocks, e.g. firewall")
+		cmd.Flags().BoolVar(&idempotentCheck, "idempotent", false, "refuse commands that are not safe to apply twice")
+	}
 }
 
 // --- Main Application Logic ---
@@ -217,48 +860,140 @@ func main() {
 type NamedCommandBlock struct {
 	Name     string
 	Commands string
+	// Fields are the blueprint keys the block was generated from
+	Fields []string
+	// Probes are the commands checking that the block was applied, see blockProbes
+	Probes string
+	// Native are the operations the native executor does instead of running the
+	// commands, see nativeBlockGenerators
+	Native []nativeOp
+}
+
+// --- vibe-coding: Bash script generation so chill, even your TOML wants to dance.
+// --- Higher-order function inside a function, passing functions to functions, all to generate bash from TOML.
+type blockGen struct {
+	name      string
+	generator func(*Blueprint) (string, error)
+	// fields are the blueprint keys the generator reads, nested keys included
+	fields []string
+}
+
+var blockGenerators = []blockGen{
+	{"Proxy", generateProxyCmd, []string{"customizations.proxy"}}, // First, so that dnf can reach the repositories
+	{"Environment", generateEnvironmentCmd, []string{"customizations.environment"}},
+	{"Packages", generatePackagesCmd, []string{"packages", "modules", "groups", "customizations.kernel.name"}},
+	{"Flatpak", generateFlatpakCmd, []string{"customizations.flatpak"}},
+	{"Pip", generatePipCmd, []string{"customizations.pip"}},
+	{"Hostname", generateHostnameCmd, []string{"customizations.hostname", "customizations.pretty_hostname", "customizations.chassis", "customizations.hosts_entry"}},
+	{"Timezone", generateTimezoneCmd, []string{"customizations.timezone.timezone"}},
+	{"Chrony", generateChronyCmd, []string{"customizations.timezone.ntpservers", "customizations.chrony"}},
+	{"Locale", generateLocaleCmd, []string{"customizations.locale"}},
+	{"Groups", generateGroupsBlockCmd, []string{"customizations.group"}},
+	{"Password Policy", generatePasswordPolicyCmd, []string{"customizations.password_policy"}}, // Before users, so their aging settings apply
+	{"Users", generateUsersBlockCmd, []string{"customizations.user"}},
+	{"Files and Directories", generateFilesAndDirectoriesCmd, []string{"customizations.directories", "customizations.files"}},
+	{"Sudoers", generateSudoersCmd, []string{"customizations.sudoers"}},
+	{"Polkit", generatePolkitRulesCmd, []string{"customizations.polkit_rules"}},
+	{"Container Registries", generateContainerRegistriesCmd, []string{"customizations.container_registries"}},
+	{"DConf", generateDConfCmd, []string{"customizations.dconf"}},
+	{"Udev Rules", generateUdevRulesCmd, []string{"customizations.udev_rules"}},
+	{"Modprobe Options", generateModprobeOptionsCmd, []string{"customizations.modprobe_options"}},
+	{"Firewall", generateFirewallCmd, []string{"customizations.firewall"}},
+	{"SSHD", generateSSHDCmd, []string{"customizations.sshd"}},
+	{"Services", generateServicesCmd, []string{"customizations.services"}},
+	{"Default Target", generateDefaultTargetCmd, []string{"customizations.default_target"}},
+	{"Tuned", generateTunedCmd, []string{"customizations.tuned"}},
+	{"Swap", generateSwapCmd, []string{"customizations.swap"}},
+	{"Zram", generateZramCmd, []string{"customizations.zram"}},
+	{"Mounts", generateMountsCmd, []string{"customizations.mounts"}},
+	{"SELinux", generateSELinuxCmd, []string{"customizations.selinux"}},
+	{"Fapolicyd", generateFapolicydCmd, []string{"customizations.fapolicyd"}},
+	{"Domain Join", generateDomainJoinCmd, []string{"customizations.domain_join"}},
+	{"Greenboot", generateGreenbootChecksCmd, []string{"customizations.greenboot_checks"}},
+	{"Syspurpose", generateSyspurposeCmd, []string{"customizations.syspurpose"}},
+	{"Journald", generateJournaldCmd, []string{"customizations.journald"}},
+	{"Scheduled Tasks", generateScheduledTasksCmd, []string{"customizations.scheduled_tasks"}},
+}
+
+// declarativeBlockGenerators replace the blocks of the same name in declarative mode
+var declarativeBlockGenerators = map[string]blockGen{
+	"Groups":                {"Sysusers", generateSysusersCmd, []string{"customizations.group", "customizations.user"}},
+	"Users":                 {"User Credentials", generateUserCredentialsCmd, []string{"customizations.user.password", "customizations.user.key"}},
+	"Files and Directories": {"Tmpfiles", generateTmpfilesCmd, []string{"customizations.directories", "customizations.files"}},
+}
+
+// The machine ID is reset after everything else, so that nothing writes a new one
+var machineIDResetBlock = blockGen{"Reset Machine ID", generateMachineIDResetCmd, []string{"customizations.reset_machine_id"}}
+
+// blueprintFields returns the fields of the block that are set in the blueprint.
+func blueprintFields(bp *Blueprint, fields []string) []string {
+	var set []string
+	for _, field := range fields {
+		for _, key := range bp.Keys {
+			if key == field || strings.HasPrefix(key, field+".") {
+				set = append(set, field)
+				break
+			}
+		}
+	}
+	return set
 }
 
 // --- Bash Script Generation Orchestrator ---
-func generateBashScript(bp *blueprint.Blueprint) (string, []NamedCommandBlock, error) {
+func generateBashScript(bp *Blueprint) (string, []NamedCommandBlock, error) {
 	var scriptHeader strings.Builder
 	var namedCommandBlocks []NamedCommandBlock
 
 	// --- Script Header ---
-	scriptHeader.WriteString("#!/bin/bash\n")
-	scriptHeader.WriteString("set -euf -o pipefail\n\n") // Exit on error, unset var, fail on pipe error, no glob
-
-	// --- vibe-coding: Bash script generation so chill, even your TOML wants to dance.
-	// --- Higher-order function inside a function, passing functions to functions, all to generate bash from TOML.
-	type blockGen struct {
-		name      string
-		generator func(*blueprint.Blueprint) (string, error)
+	switch shellDialect {
+	case "bash":
+		scriptHeader.WriteString("#!/bin/bash\n")
+		scriptHeader.WriteString("set -euf -o pipefail\n\n") // Exit on error, unset var, fail on pipe error, no glob
+	case "posix":
+		// The blocks only use POSIX sh constructs, pipefail is the one option dash and busybox lack
+		scriptHeader.WriteString("#!/bin/sh\n")
+		scriptHeader.WriteString("set -euf\n\n")
+	default:
+		return "", nil, fmt.Errorf("unknown shell %q, must be bash or posix", shellDialect)
 	}
 
-	blockGenerators := []blockGen{
-		{"Packages", generatePackagesCmd},
-		{"Hostname", generateHostnameCmd},
-		{"Timezone", generateTimezoneCmd},
-		{"Locale", generateLocaleCmd},
-		{"Groups", generateGroupsBlockCmd},
-		{"Users", generateUsersBlockCmd},
-		{"Firewall", generateFirewallCmd},
-		{"Services", generateServicesCmd},
+	generators := slices.Clone(blockGenerators)
+	if declarativeMode {
+		for i, blk := range generators {
+			if replacement, ok := declarativeBlockGenerators[blk.name]; ok {
+				generators[i] = replacement
+			}
+		}
 	}
 
-	for _, blk := range blockGenerators {
+	generate := func(blk blockGen) error {
 		cmdStr, err := blk.generator(bp)
 		if err != nil {
-			return "", nil, fmt.Errorf("could not generate commands for %s: %w", blk.name, err)
+			return fmt.Errorf("could not generate commands for %s: %w", blk.name, err)
 		}
 		if cmdStr != "" {
-			namedCommandBlocks = append(namedCommandBlocks, NamedCommandBlock{Name: blk.name, Commands: cmdStr})
+			block := NamedCommandBlock{Name: blk.name, Commands: cmdStr, Fields: blueprintFields(bp, blk.fields)}
+			if probes, ok := blockProbes[blk.name]; ok {
+				block.Probes = probeScript(probes(bp))
+			}
+			namedCommandBlocks = append(namedCommandBlocks, block)
+		}
+		return nil
+	}
+
+	for _, blk := range generators {
+		if err := generate(blk); err != nil {
+			return "", nil, err
 		}
 	}
 
 	// Add dnf clean all as the very last operation
 	namedCommandBlocks = append(namedCommandBlocks, NamedCommandBlock{Name: "Cleanup DNF Cache", Commands: "dnf clean all"})
 
+	if err := generate(machineIDResetBlock); err != nil {
+		return "", nil, err
+	}
+
 	// Script generation no longer assembles the final script here.
 	// It returns the header and the blocks separately.
 	return scriptHeader.String(), namedCommandBlocks, nil
@@ -26,7 +26,8 @@ func TestBashCommand(t *testing.T) {
 	args := []string{"../../test/config.toml"}
 
 	// Run the bash command
-	bashCmd.Run(cmd, args)
+	err := bashCmd.RunE(cmd, args)
+	require.NoError(t, err)
 
 	// Restore stdout and get the output
 	w.Close()
@@ -72,6 +73,10 @@ func TestBashCommand(t *testing.T) {
 }
 
 func TestApplyCommand(t *testing.T) {
+	if _, err := exec.LookPath("podman"); err != nil {
+		t.Skip("podman is required to build the test container")
+	}
+
 	// Create a temporary directory for test artifacts
 	tmpDir, err := os.MkdirTemp("", "imagecfg-test-*")
 	require.NoError(t, err, "Failed to create temporary directory")
@@ -120,3 +125,117 @@ COPY config.toml /usr/lib/bootc-image-builder/config.toml`
 	out, err = runCmd.CombinedOutput()
 	require.NoError(t, err, "Failed to run apply command: %s", out)
 }
+
+func TestParseBlueprintExtensions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(path, []byte(`
+[customizations]
+hostname = "proxied"
+
+[customizations.proxy]
+http = "http://proxy.example.com:3128"
+`), 0644)
+	require.NoError(t, err)
+
+	bp, err := parseBlueprint(path)
+	require.NoError(t, err)
+	assert.Equal(t, "proxied", *bp.Customizations.GetHostname())
+	assert.Equal(t, "http://proxy.example.com:3128", bp.Extensions.GetProxy().HTTP)
+
+	err = os.WriteFile(path, []byte(`
+[customizations.proxy]
+http = "http://proxy.example.com:3128"
+htps = "http://proxy.example.com:3128"
+`), 0644)
+	require.NoError(t, err)
+
+	_, err = parseBlueprint(path)
+	assert.ErrorContains(t, err, "unknown configuration keys")
+	assert.ErrorContains(t, err, "customizations.proxy.htps")
+}
+
+func TestLoadBlueprintLayered(t *testing.T) {
+	dir := t.TempDir()
+	base, site, host := filepath.Join(dir, "base.toml"), filepath.Join(dir, "site.toml"), filepath.Join(dir, "host.toml")
+	require.NoError(t, os.WriteFile(base, []byte(`
+[[packages]]
+name = "vim"
+
+[customizations]
+hostname = "base"
+
+[customizations.timezone]
+timezone = "UTC"
+ntpservers = ["0.pool.ntp.org"]
+`), 0644))
+	require.NoError(t, os.WriteFile(site, []byte(`
+[[packages]]
+name = "nginx"
+
+[customizations.timezone]
+timezone = "Europe/Prague"
+`), 0644))
+	require.NoError(t, os.WriteFile(host, []byte(`
+[customizations]
+hostname = "web1"
+`), 0644))
+
+	bp, err := loadBlueprint([]string{base, site, host})
+	require.NoError(t, err)
+	assert.Equal(t, "web1", *bp.Customizations.GetHostname())
+	assert.Equal(t, "Europe/Prague", *bp.Customizations.Timezone.Timezone)
+	assert.Equal(t, []string{"0.pool.ntp.org"}, bp.Customizations.Timezone.NTPServers)
+	assert.Equal(t, []string{"vim", "nginx"}, []string{bp.Packages[0].Name, bp.Packages[1].Name})
+
+	// Unknown keys are reported with their file
+	require.NoError(t, os.WriteFile(host, []byte("[customizations]\nhostnme = \"web1\"\n"), 0644))
+	_, err = loadBlueprint([]string{base, site, host})
+	assert.ErrorContains(t, err, "unknown configuration keys in "+host)
+}
+
+func TestLoadBlueprintDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"10-base.toml":    "[customizations]\nhostname = \"base\"\n\n[[packages]]\nname = \"vim\"\n",
+		"50-nginx.toml":   "[[packages]]\nname = \"nginx\"\n",
+		"90-host.toml":    "[customizations]\nhostname = \"web1\"\n",
+		".hidden.toml":    "[customizations]\nhostname = \"hidden\"\n",
+		"README":          "not a blueprint",
+		"99-old.toml.bak": "[customizations]\nhostname = \"old\"\n",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	assert.Equal(t, []string{filepath.Join(dir, "10-base.toml"), filepath.Join(dir, "50-nginx.toml"), filepath.Join(dir, "90-host.toml")}, blueprintPaths([]string{dir}))
+
+	bp, err := loadBlueprint([]string{dir})
+	require.NoError(t, err)
+	assert.Equal(t, "web1", *bp.Customizations.GetHostname())
+	assert.Equal(t, []string{"vim", "nginx"}, []string{bp.Packages[0].Name, bp.Packages[1].Name})
+
+	_, err = loadBlueprint([]string{t.TempDir()})
+	assert.ErrorContains(t, err, "is a directory without *.toml blueprints")
+}
+
+func TestGenerateBashScriptPosix(t *testing.T) {
+	shellDialect = "posix"
+	defer func() { shellDialect = "bash" }()
+
+	bp, err := parseBlueprint("../../test/config.toml")
+	require.NoError(t, err)
+	header, blocks, err := generateBashScript(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\nset -euf\n\n", header)
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	script := header
+	for _, block := range blocks {
+		script += block.Commands + "\n"
+	}
+	check := exec.Command(sh, "-n")
+	check.Stdin = strings.NewReader(script)
+	out, err := check.CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
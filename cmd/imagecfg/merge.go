@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+
+	"github.com/spf13/cobra"
+)
+
+// mergeIdentityKeys identify the entries of table lists, e.g. [[packages]] by name
+// and [[customizations.files]] by path
+var mergeIdentityKeys = []string{"name", "path"}
+
+var (
+	mergeTo      string
+	mergeReplace []string
+)
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge BASE OVERLAY...",
+	Short: "Merge OSBuild blueprints into one",
+	Long: `Merges OSBuild blueprints (TOML, JSON or YAML, by file extension) into one and
+prints it, so a base blueprint can be maintained together with overlays per
+product. The blueprints are merged in the given order:
+
+- tables are merged key by key
+- scalars of later blueprints win
+- lists are appended, without duplicates
+- entries of lists of tables with the same name or path, such as users or
+  files, are merged like tables
+
+A section given with --replace, as a dotted key like customizations.firewall,
+is replaced by the later blueprints instead of merged.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var docs []map[string]interface{}
+		for _, path := range args {
+			format, err := blueprintFormat(path)
+			if err != nil {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("error opening blueprint file %s: %w", path, err)
+			}
+			doc, err := decodeDocument(data, format)
+			if err != nil {
+				return fmt.Errorf("error parsing blueprint %s: %w", path, err)
+			}
+			docs = append(docs, doc)
+		}
+
+		out, err := encodeDocument(mergeBlueprints(docs, mergeReplace), mergeTo)
+		if err != nil {
+			return fmt.Errorf("error encoding merged blueprint: %w", err)
+		}
+		fmt.Print(string(out))
+		return nil
+	},
+}
+
+func init() {
+	mergeCmd.Flags().StringVar(&mergeTo, "to", "toml", "output format, toml, json or yaml")
+	mergeCmd.Flags().StringSliceVar(&mergeReplace, "replace", nil, "dotted keys of sections to replace instead of merge")
+	rootCmd.AddCommand(mergeCmd)
+}
+
+// mergeBlueprints merges decoded blueprints in order. The sections at the dotted keys
+// in replace are taken from the last blueprint defining them.
+func mergeBlueprints(docs []map[string]interface{}, replace []string) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for _, doc := range docs {
+		merged = mergeValue("", merged, doc, replace).(map[string]interface{})
+	}
+	return merged
+}
+
+// mergeValue merges the overlay value at the dotted key into the base value.
+func mergeValue(key string, base, overlay interface{}, replace []string) interface{} {
+	if slices.Contains(replace, key) {
+		return overlay
+	}
+	switch overlay := overlay.(type) {
+	case map[string]interface{}:
+		baseMap, ok := base.(map[string]interface{})
+		if !ok {
+			return overlay
+		}
+		merged := make(map[string]interface{}, len(baseMap))
+		for k, v := range baseMap {
+			merged[k] = v
+		}
+		for k, v := range overlay {
+			childKey := k
+			if key != "" {
+				childKey = key + "." + k
+			}
+			if baseValue, ok := merged[k]; ok {
+				merged[k] = mergeValue(childKey, baseValue, v, replace)
+			} else {
+				merged[k] = v
+			}
+		}
+		return merged
+	case []interface{}:
+		baseList, ok := base.([]interface{})
+		if !ok {
+			return overlay
+		}
+		merged := slices.Clone(baseList)
+		for _, item := range overlay {
+			if i := mergeListIndex(merged, item); i >= 0 {
+				merged[i] = mergeValue(key, merged[i], item, replace)
+			} else {
+				merged = append(merged, item)
+			}
+		}
+		return merged
+	}
+	return overlay
+}
+
+// mergeListIndex returns the index of the entry in list that item is merged into, or -1
+// if item is appended.
+func mergeListIndex(list []interface{}, item interface{}) int {
+	table, isTable := item.(map[string]interface{})
+	for i, entry := range list {
+		if reflect.DeepEqual(entry, item) {
+			return i
+		}
+		entryTable, ok := entry.(map[string]interface{})
+		if !isTable || !ok {
+			continue
+		}
+		for _, id := range mergeIdentityKeys {
+			if value, ok := table[id]; ok {
+				if reflect.DeepEqual(value, entryTable[id]) {
+					return i
+				}
+				break
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeBlueprints(t *testing.T) {
+	var docs []map[string]interface{}
+	for _, data := range []string{`
+name = "base"
+version = "1.0.0"
+
+[[packages]]
+name = "vim-enhanced"
+
+[[packages]]
+name = "tmux"
+version = "3.3"
+
+[customizations]
+hostname = "base"
+
+[[customizations.user]]
+name = "admin"
+groups = ["wheel"]
+
+[customizations.firewall]
+ports = ["22/tcp"]
+
+[customizations.services]
+enabled = ["sshd"]
+`, `
+version = "1.1.0"
+
+[[packages]]
+name = "tmux"
+version = "3.4"
+
+[[packages]]
+name = "vim-enhanced"
+
+[[customizations.user]]
+name = "admin"
+groups = ["wheel", "app"]
+
+[[customizations.user]]
+name = "deploy"
+
+[customizations.firewall]
+ports = ["443/tcp"]
+
+[customizations.services]
+enabled = ["sshd", "cockpit.socket"]
+`} {
+		doc, err := decodeDocument([]byte(data), "toml")
+		require.NoError(t, err)
+		docs = append(docs, doc)
+	}
+
+	merged, err := encodeDocument(mergeBlueprints(docs, []string{"customizations.firewall"}), "toml")
+	require.NoError(t, err)
+	want, err := decodeDocument([]byte(`
+name = "base"
+version = "1.1.0"
+
+[[packages]]
+name = "vim-enhanced"
+
+[[packages]]
+name = "tmux"
+version = "3.4"
+
+[customizations]
+hostname = "base"
+
+[[customizations.user]]
+name = "admin"
+groups = ["wheel", "app"]
+
+[[customizations.user]]
+name = "deploy"
+
+[customizations.firewall]
+ports = ["443/tcp"]
+
+[customizations.services]
+enabled = ["sshd", "cockpit.socket"]
+`), "toml")
+	require.NoError(t, err)
+	got, err := decodeDocument(merged, "toml")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
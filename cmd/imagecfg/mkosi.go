@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Names of the mkosi configuration parts, relative to the output directory. They
+// do not use the mkosi.* names mkosi picks up by itself, so that the directory can
+// be included next to hand written configuration.
+const (
+	mkosiConfName     = "mkosi.conf"
+	mkosiExtraName    = "imagecfg.extra"
+	mkosiPostinstName = "imagecfg.postinst.chroot"
+)
+
+// mkosiTreeNode is a file or directory of the extra tree
+type mkosiTreeNode struct {
+	Path string
+	Dir  bool
+	Data string
+	Mode os.FileMode
+}
+
+// mkosiConfig holds the generated mkosi configuration
+type mkosiConfig struct {
+	Conf     string
+	Tree     []mkosiTreeNode
+	Postinst string
+}
+
+var mkosiOutputDir string
+
+var mkosiCmd = &cobra.Command{
+	Use:   "mkosi --output-dir DIR [blueprint.toml...]",
+	Short: "Translate an OSBuild blueprint to mkosi configuration",
+	Long: `Translates an OSBuild blueprint (TOML format) into mkosi configuration,
+so that blueprints can be reused in mkosi based pipelines. The output directory
+can be passed to mkosi with --include or Include=.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+The packages become Packages= and the files and directories an extra tree,
+unless some of them have an owner. All other configurations are run as the
+same bash blocks the 'bash' command generates, in a post-installation script.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		config, err := generateMkosiConfig(bp)
+		if err != nil {
+			return fmt.Errorf("error generating mkosi configuration: %w", err)
+		}
+		if err := writeMkosiConfig(config, mkosiOutputDir); err != nil {
+			return fmt.Errorf("error writing mkosi configuration: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	mkosiCmd.Flags().StringVar(&mkosiOutputDir, "output-dir", "", "directory to write the mkosi configuration to")
+	_ = mkosiCmd.MarkFlagRequired("output-dir")
+	rootCmd.AddCommand(mkosiCmd)
+}
+
+// mkosiTree returns the extra tree holding the files and directories of the blueprint.
+// It returns false if some of them have an owner, which an extra tree cannot express.
+func mkosiTree(bp *Blueprint) ([]mkosiTreeNode, bool, error) {
+	var tree []mkosiTreeNode
+	for _, dir := range bp.Customizations.GetDirectories() {
+		if dir.User != nil || dir.Group != nil {
+			return nil, false, nil
+		}
+		mode, err := fsNodeMode(dir.Mode, 0755)
+		if err != nil {
+			return nil, false, fmt.Errorf("directory %s: %w", dir.Path, err)
+		}
+		tree = append(tree, mkosiTreeNode{Path: dir.Path, Dir: true, Mode: mode})
+	}
+	for _, file := range bp.Customizations.GetFiles() {
+		if file.User != nil || file.Group != nil {
+			return nil, false, nil
+		}
+		mode, err := fsNodeMode(file.Mode, 0644)
+		if err != nil {
+			return nil, false, fmt.Errorf("file %s: %w", file.Path, err)
+		}
+		tree = append(tree, mkosiTreeNode{Path: file.Path, Data: file.Data, Mode: mode})
+	}
+	return tree, true, nil
+}
+
+// generateMkosiConfig generates the mkosi configuration of the blueprint.
+func generateMkosiConfig(bp *Blueprint) (*mkosiConfig, error) {
+	header, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return nil, err
+	}
+	tree, treeOK, err := mkosiTree(bp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks that the configuration handles natively, mkosi manages the package cache itself
+	native := map[string]bool{
+		"Packages":              true,
+		"Cleanup DNF Cache":     true,
+		"Files and Directories": treeOK,
+	}
+
+	config := &mkosiConfig{Tree: tree}
+	var postinst strings.Builder
+	for _, block := range namedBlocks {
+		if native[block.Name] {
+			continue
+		}
+		if postinst.Len() == 0 {
+			postinst.WriteString(header)
+		}
+		fmt.Fprintf(&postinst, "# %s\n%s\n\n", block.Name, block.Commands)
+	}
+	config.Postinst = postinst.String()
+
+	var conf strings.Builder
+	conf.WriteString("# Managed by imagecfg\n[Content]\n")
+	if packages := bp.GetPackages(); len(packages) > 0 {
+		conf.WriteString("Packages=\n")
+		for _, pkg := range packages {
+			conf.WriteString("        " + pkg + "\n")
+		}
+	}
+	if len(config.Tree) > 0 {
+		conf.WriteString("ExtraTrees=" + mkosiExtraName + "\n")
+	}
+	if config.Postinst != "" {
+		conf.WriteString("PostInstallationScripts=" + mkosiPostinstName + "\n")
+	}
+	config.Conf = conf.String()
+	return config, nil
+}
+
+// writeMkosiConfig writes the configuration to dir, which is created if missing.
+func writeMkosiConfig(config *mkosiConfig, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, mkosiConfName), []byte(config.Conf), 0644); err != nil {
+		return err
+	}
+	if config.Postinst != "" {
+		path := filepath.Join(dir, mkosiPostinstName)
+		if err := os.WriteFile(path, []byte(config.Postinst), 0755); err != nil {
+			return err
+		}
+		// WriteFile only applies the mode to new files
+		if err := os.Chmod(path, 0755); err != nil {
+			return err
+		}
+	}
+
+	extra := filepath.Join(dir, mkosiExtraName)
+	for _, node := range config.Tree {
+		path := filepath.Join(extra, node.Path)
+		if node.Dir {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		} else {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, []byte(node.Data), node.Mode); err != nil {
+				return err
+			}
+		}
+		// The umask applies on creation, mkosi copies the tree with its modes
+		if err := os.Chmod(path, node.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
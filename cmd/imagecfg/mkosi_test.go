@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateMkosiConfig(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[packages]]
+name = "vim"
+
+[[customizations.directories]]
+path = "/etc/myapp"
+mode = "0750"
+
+[[customizations.files]]
+path = "/etc/myapp/config"
+data = "key=value\n"
+mode = "0600"
+
+[customizations.journald]
+storage = "persistent"
+`)
+	config, err := generateMkosiConfig(bp)
+	require.NoError(t, err)
+	assert.Equal(t, "# Managed by imagecfg\n[Content]\nPackages=\n        vim\n        kernel\nExtraTrees=imagecfg.extra\nPostInstallationScripts=imagecfg.postinst.chroot\n", config.Conf)
+	assert.Equal(t, []mkosiTreeNode{
+		{Path: "/etc/myapp", Dir: true, Mode: 0750},
+		{Path: "/etc/myapp/config", Data: "key=value\n", Mode: 0600},
+	}, config.Tree)
+	assert.Contains(t, config.Postinst, "#!/bin/bash\nset -euf -o pipefail\n\n# Journald\n")
+	assert.NotContains(t, config.Postinst, "dnf")
+	assert.NotContains(t, config.Postinst, "/etc/myapp")
+
+	dir := t.TempDir()
+	require.NoError(t, writeMkosiConfig(config, dir))
+	info, err := os.Stat(filepath.Join(dir, "imagecfg.extra/etc/myapp"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	data, err := os.ReadFile(filepath.Join(dir, "imagecfg.extra/etc/myapp/config"))
+	require.NoError(t, err)
+	assert.Equal(t, "key=value\n", string(data))
+	info, err = os.Stat(filepath.Join(dir, "imagecfg.postinst.chroot"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+}
+
+func TestGenerateMkosiConfigOwnedFiles(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[customizations.files]]
+path = "/etc/myapp/config"
+data = "key=value\n"
+user = "root"
+group = 10
+`)
+	config, err := generateMkosiConfig(bp)
+	require.NoError(t, err)
+	// An extra tree cannot express owners, the files are written by the script
+	assert.Empty(t, config.Tree)
+	assert.NotContains(t, config.Conf, "ExtraTrees=")
+	assert.Contains(t, config.Postinst, "# Files and Directories\n")
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// applyExecutor is set by --executor, how apply runs the blocks: "script" runs the
+// commands of every block as a shell script, "native" does the work of the blocks in
+// nativeBlockGenerators in Go
+var applyExecutor string
+
+// nativeEnv is what the operations of a block run with
+type nativeEnv struct {
+	Stdout, Stderr io.Writer
+	// Deadline is when the block times out, zero if it has no timeout
+	Deadline time.Time
+	// TimedOut is set when a command is stopped at the deadline
+	TimedOut bool
+}
+
+// nativeOp is a step of a block done in Go. Like the commands of the blocks, an
+// operation changes nothing that is already in place when it runs again.
+type nativeOp interface {
+	Apply(env *nativeEnv) error
+	// String describes the operation as the shell command doing the same
+	String() string
+}
+
+// writeFileOp writes a file with the mode, creating its directory
+type writeFileOp struct {
+	Path string
+	Data string
+	Mode fs.FileMode
+}
+
+func (o writeFileOp) Apply(*nativeEnv) error {
+	if err := os.MkdirAll(filepath.Dir(o.Path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(o.Path, []byte(o.Data), o.Mode); err != nil {
+		return err
+	}
+	return os.Chmod(o.Path, o.Mode)
+}
+
+func (o writeFileOp) String() string {
+	return writeFileCmd(o.Path, o.Data, o.Mode)
+}
+
+// replaceLineOp removes the lines of a file starting with Prefix and appends Line,
+// creating the file if it is missing
+type replaceLineOp struct {
+	Path   string
+	Prefix string
+	Line   string
+}
+
+func (o replaceLineOp) Apply(*nativeEnv) error {
+	return replaceLines(o.Path, func(line string) bool { return strings.HasPrefix(line, o.Prefix) }, o.Line)
+}
+
+func (o replaceLineOp) String() string {
+	return replaceLineCmd(o.Path, o.Prefix, o.Line)
+}
+
+// replaceMatchingLineOp removes the lines of a file matching the extended regular
+// expression Pattern and appends Line, creating the file if it is missing
+type replaceMatchingLineOp struct {
+	Path    string
+	Pattern string
+	Line    string
+}
+
+func (o replaceMatchingLineOp) Apply(*nativeEnv) error {
+	re, err := regexp.Compile(o.Pattern)
+	if err != nil {
+		return err
+	}
+	return replaceLines(o.Path, func(line string) bool { return re.MatchString(strings.TrimSuffix(line, "\n")) }, o.Line)
+}
+
+func (o replaceMatchingLineOp) String() string {
+	return replaceMatchingLineCmd(o.Path, o.Pattern, o.Line)
+}
+
+// replaceLines removes the lines of the file at path that remove returns true for and
+// appends line, creating the file if it is missing.
+func replaceLines(path string, remove func(line string) bool, line string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	var b strings.Builder
+	for _, l := range strings.SplitAfter(string(data), "\n") {
+		if l != "" && !remove(l) {
+			b.WriteString(l)
+			if !strings.HasSuffix(l, "\n") {
+				b.WriteString("\n")
+			}
+		}
+	}
+	b.WriteString(line + "\n")
+	// Existing files keep their mode
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// appendLineOp appends Line to a file unless the file has it, creating the file with
+// the mode if it is missing
+type appendLineOp struct {
+	Path string
+	Line string
+	Mode fs.FileMode
+}
+
+func (o appendLineOp) Apply(*nativeEnv) error {
+	lines, err := readLines(o.Path)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(lines, o.Line) {
+		f, err := os.OpenFile(o.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, o.Mode)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteString(o.Line + "\n"); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(o.Path, o.Mode)
+}
+
+func (o appendLineOp) String() string {
+	return fmt.Sprintf("%s && chmod %04o %s", appendLineCmd(o.Path, o.Line), o.Mode, shellQuote(o.Path))
+}
+
+// mkdirOp creates a directory with the mode, and its parents with Parents
+type mkdirOp struct {
+	Path    string
+	Mode    fs.FileMode
+	Parents bool
+}
+
+func (o mkdirOp) Apply(*nativeEnv) error {
+	if o.Parents {
+		if err := os.MkdirAll(o.Path, 0755); err != nil {
+			return err
+		}
+	} else if info, err := os.Stat(o.Path); err != nil || !info.IsDir() {
+		if err := os.Mkdir(o.Path, 0755); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(o.Path, o.Mode)
+}
+
+func (o mkdirOp) String() string {
+	if o.Parents {
+		return fmt.Sprintf("mkdir -p %s && chmod %04o %[1]s", shellQuote(o.Path), o.Mode)
+	}
+	return fmt.Sprintf("([ -d %[1]s ] || mkdir %[1]s) && chmod %04o %[1]s", shellQuote(o.Path), o.Mode)
+}
+
+// chownOp changes the owner of a path, a name or ID, leaving empty ones as they are.
+// With LoginGroup, the group is the login group of User, like chown USER: does.
+type chownOp struct {
+	Path       string
+	User       string
+	Group      string
+	LoginGroup bool
+	Recursive  bool
+}
+
+func (o chownOp) Apply(*nativeEnv) error {
+	uid, gid := -1, -1
+	if o.User != "" {
+		u, err := lookupUser(o.User)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		if o.LoginGroup {
+			gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+	if o.Group != "" {
+		id, err := lookupGroupID(o.Group)
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+	if !o.Recursive {
+		return os.Chown(o.Path, uid, gid)
+	}
+	return filepath.WalkDir(o.Path, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+func (o chownOp) String() string {
+	owner := o.User
+	if o.Group != "" || o.LoginGroup {
+		owner += ":" + o.Group
+	}
+	if o.Recursive {
+		return fmt.Sprintf("chown -R %s %s", shellQuote(owner), shellQuote(o.Path))
+	}
+	return fmt.Sprintf("chown %s %s", shellQuote(owner), shellQuote(o.Path))
+}
+
+// lookupUser returns the user with the name or UID.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+// lookupGroupID returns the GID of the group with the name or GID.
+func lookupGroupID(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// symlinkOp points the link at Path to Target, replacing what is there
+type symlinkOp struct {
+	Target string
+	Path   string
+}
+
+func (o symlinkOp) Apply(*nativeEnv) error {
+	tmp := o.Path + ".imagecfg-new"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Symlink(o.Target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.Path)
+}
+
+func (o symlinkOp) String() string {
+	return fmt.Sprintf("ln -sf %s %s", o.Target, o.Path)
+}
+
+// commandOp runs a command with its arguments, without a shell
+type commandOp struct {
+	Argv []string
+	// Stdin is the input of the command, e.g. passwords, so that they are not in its
+	// arguments
+	Stdin string
+	// Skip returns whether there is nothing to do, the command then does not run
+	Skip func() bool
+	// SkipCheck is the shell check Skip does, for describing the operation
+	SkipCheck string
+}
+
+func (o commandOp) Apply(env *nativeEnv) error {
+	if o.Skip != nil && o.Skip() {
+		return nil
+	}
+	var timeout time.Duration
+	if !env.Deadline.IsZero() {
+		if timeout = time.Until(env.Deadline); timeout <= 0 {
+			env.TimedOut = true
+			return fmt.Errorf("%s: timed out", o.Argv[0])
+		}
+	}
+	cmd := exec.Command(o.Argv[0], o.Argv[1:]...)
+	cmd.Stdout = env.Stdout
+	cmd.Stderr = env.Stderr
+	if o.Stdin != "" {
+		cmd.Stdin = strings.NewReader(o.Stdin)
+	}
+	timedOut, err := runWithTimeout(cmd, timeout)
+	if timedOut {
+		env.TimedOut = true
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", o.Argv[0], err)
+	}
+	return nil
+}
+
+func (o commandOp) String() string {
+	var quoted []string
+	for _, arg := range o.Argv {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	cmd := strings.Join(quoted, " ")
+	if o.Stdin != "" {
+		// The input may be a password hash
+		cmd = "printf '%s' '...' | " + cmd
+	}
+	if o.SkipCheck != "" {
+		return fmt.Sprintf("(%s || %s)", o.SkipCheck, cmd)
+	}
+	return cmd
+}
+
+// liveSystemOp runs Live on a booted system, and Offline in a container or image build,
+// where the tools talking to systemd do not work
+type liveSystemOp struct {
+	Live, Offline []nativeOp
+}
+
+func (o liveSystemOp) Apply(env *nativeEnv) error {
+	ops := o.Offline
+	if info, err := os.Stat("/run/systemd/system"); err == nil && info.IsDir() {
+		ops = o.Live
+	}
+	for _, op := range ops {
+		if err := op.Apply(env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o liveSystemOp) String() string {
+	return fmt.Sprintf("if %s; then %s; else %s; fi", liveSystemCheck, nativeScript(o.Live), nativeScript(o.Offline))
+}
+
+// nativeScript describes the operations as shell commands.
+func nativeScript(ops []nativeOp) string {
+	var cmds []string
+	for _, op := range ops {
+		cmds = append(cmds, op.String())
+	}
+	return strings.Join(cmds, " && ")
+}
+
+// userExists returns a check whether the user exists, like getent passwd.
+func userExists(name string) func() bool {
+	return func() bool {
+		_, err := user.Lookup(name)
+		return err == nil
+	}
+}
+
+// inGroup returns a check whether the user is a member of the group, like id -nG.
+func inGroup(name, group string) func() bool {
+	return func() bool {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return false
+		}
+		gids, err := u.GroupIds()
+		if err != nil {
+			return false
+		}
+		for _, gid := range gids {
+			if g, err := user.LookupGroupId(gid); err == nil && g.Name == group {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// passwordIs returns a check whether the password hash of the user in /etc/shadow is
+// hash.
+func passwordIs(name, hash string) func() bool {
+	return func() bool {
+		lines, err := readLines("/etc/shadow")
+		if err != nil {
+			return false
+		}
+		for _, line := range lines {
+			if fields := strings.Split(line, ":"); len(fields) > 1 && fields[0] == name {
+				return fields[1] == hash
+			}
+		}
+		return false
+	}
+}
+
+// groupExists returns a check whether the group exists, like getent group.
+func groupExists(name string) func() bool {
+	return func() bool {
+		_, err := user.LookupGroup(name)
+		return err == nil
+	}
+}
+
+// commandFound returns a check whether the command is installed, like command -v.
+func commandFound(name string) func() bool {
+	return func() bool {
+		_, err := exec.LookPath(name)
+		return err == nil
+	}
+}
+
+// runNative runs the operations of a block, and returns whether a command timed out
+// after timeout, 0 for no timeout.
+func runNative(ops []nativeOp, stdout, stderr io.Writer, timeout time.Duration, log *slog.Logger) (bool, error) {
+	env := &nativeEnv{Stdout: stdout, Stderr: stderr}
+	if timeout > 0 {
+		env.Deadline = time.Now().Add(timeout)
+	}
+	for _, op := range ops {
+		log.Debug("applying operation", "operation", op.String())
+		if err := op.Apply(env); err != nil {
+			return env.TimedOut, err
+		}
+	}
+	return false, nil
+}
+
+// nativeBlockGenerators return the operations of the blocks the native executor does
+// in Go, by block name. They run after the commands of the blocks were generated, so
+// the blueprint is valid already. The other blocks run as scripts.
+var nativeBlockGenerators = map[string]func(*Blueprint) ([]nativeOp, error){
+	"Environment":           nativeEnvironment,
+	"Packages":              nativePackages,
+	"Hostname":              nativeHostname,
+	"Timezone":              nativeTimezone,
+	"Groups":                nativeGroups,
+	"Users":                 nativeUsers,
+	"Files and Directories": nativeFilesAndDirectories,
+	"Firewall":              nativeFirewall,
+	"Services":              nativeServices,
+	"Default Target":        nativeDefaultTarget,
+	"Cleanup DNF Cache":     nativeCleanup,
+}
+
+// addNativeOps sets the operations of the blocks that the native executor does in Go,
+// and returns the names of the blocks that still run as scripts.
+func addNativeOps(bp *Blueprint, blocks []NamedCommandBlock) ([]string, error) {
+	var scripts []string
+	for i, block := range blocks {
+		generate, ok := nativeBlockGenerators[block.Name]
+		if !ok {
+			scripts = append(scripts, block.Name)
+			continue
+		}
+		ops, err := generate(bp)
+		if err != nil {
+			return nil, fmt.Errorf("could not generate operations for %s: %w", block.Name, err)
+		}
+		blocks[i].Native = ops
+	}
+	return scripts, nil
+}
+
+func nativeEnvironment(bp *Blueprint) ([]nativeOp, error) {
+	names, lines, profile, err := environmentSettings(bp)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	var ops []nativeOp
+	for i, name := range names {
+		ops = append(ops, replaceLineOp{"/etc/environment", name + "=", lines[i]})
+	}
+	return append(ops, writeFileOp{environmentProfilePath, profile, 0644}), nil
+}
+
+func nativePackages(bp *Blueprint) ([]nativeOp, error) {
+	packages := bp.GetPackages()
+	if len(packages) == 0 {
+		return nil, nil
+	}
+	return []nativeOp{commandOp{Argv: append([]string{"dnf", "install", "-y"}, packages...)}}, nil
+}
+
+func nativeHostname(bp *Blueprint) ([]nativeOp, error) {
+	var ops []nativeOp
+	if hostname := bp.Customizations.GetHostname(); hostname != nil && *hostname != "" {
+		ops = append(ops, writeFileOp{"/etc/hostname", *hostname + "\n", 0644})
+	}
+	pattern, line, err := hostsEntryLine(bp)
+	if err != nil {
+		return nil, err
+	}
+	if line != "" {
+		ops = append(ops, replaceMatchingLineOp{"/etc/hosts", pattern, line})
+	}
+	var live, offline []nativeOp
+	if pretty := bp.Extensions.GetPrettyHostname(); pretty != "" {
+		live = append(live, commandOp{Argv: []string{"hostnamectl", "set-hostname", "--pretty", pretty}})
+		offline = append(offline, replaceLineOp{"/etc/machine-info", "PRETTY_HOSTNAME=", "PRETTY_HOSTNAME=" + strconv.Quote(pretty)})
+	}
+	if chassis := bp.Extensions.GetChassis(); chassis != "" {
+		live = append(live, commandOp{Argv: []string{"hostnamectl", "set-chassis", chassis}})
+		offline = append(offline, replaceLineOp{"/etc/machine-info", "CHASSIS=", "CHASSIS=" + chassis})
+	}
+	if len(live) > 0 {
+		ops = append(ops, liveSystemOp{live, offline})
+	}
+	return ops, nil
+}
+
+func nativeTimezone(bp *Blueprint) ([]nativeOp, error) {
+	timezone, _ := bp.Customizations.GetTimezoneSettings()
+	if timezone == nil || *timezone == "" {
+		return nil, nil
+	}
+	return []nativeOp{symlinkOp{"/usr/share/zoneinfo/" + *timezone, "/etc/localtime"}}, nil
+}
+
+func nativeGroups(bp *Blueprint) ([]nativeOp, error) {
+	var ops []nativeOp
+	for _, group := range bp.Customizations.GetGroups() {
+		argv := []string{"groupadd"}
+		if group.GID != nil {
+			argv = append(argv, "--gid", strconv.Itoa(*group.GID))
+		}
+		ops = append(ops, commandOp{
+			Argv:      append(argv, group.Name),
+			Skip:      groupExists(group.Name),
+			SkipCheck: "getent group " + group.Name + " > /dev/null",
+		})
+	}
+	return ops, nil
+}
+
+func nativeUsers(bp *Blueprint) ([]nativeOp, error) {
+	var ops []nativeOp
+	for _, u := range bp.Customizations.GetUsers() {
+		argv := []string{"useradd"}
+		home := "/home/" + u.Name
+		if u.Home != nil && *u.Home != "" {
+			home = *u.Home
+			argv = append(argv, "-d", home)
+		}
+		argv = append(argv, "-m")
+		if u.Shell != nil && *u.Shell != "" {
+			argv = append(argv, "-s", *u.Shell)
+		}
+		if u.UID != nil {
+			argv = append(argv, "-u", strconv.Itoa(*u.UID))
+		}
+		if u.GID != nil {
+			argv = append(argv, "-g", strconv.Itoa(*u.GID))
+		}
+		ops = append(ops, commandOp{
+			Argv:      append(argv, u.Name),
+			Skip:      userExists(u.Name),
+			SkipCheck: "getent passwd " + u.Name + " > /dev/null",
+		})
+		for _, group := range u.Groups {
+			ops = append(ops, commandOp{
+				Argv:      []string{"usermod", "-aG", group, u.Name},
+				Skip:      inGroup(u.Name, group),
+				SkipCheck: inGroupCheck(u.Name, group),
+			})
+		}
+		if u.Password != nil && *u.Password != "" {
+			ops = append(ops, commandOp{
+				Argv:      []string{"chpasswd", "-e"},
+				Stdin:     u.Name + ":" + *u.Password + "\n",
+				Skip:      passwordIs(u.Name, *u.Password),
+				SkipCheck: passwordCheck(u.Name, "'...'"),
+			})
+		}
+		if u.Key != nil && len(authorizedKeys(*u.Key)) > 0 {
+			ssh := home + "/.ssh"
+			ops = append(ops, mkdirOp{ssh, 0700, true})
+			for _, key := range authorizedKeys(*u.Key) {
+				ops = append(ops, appendLineOp{ssh + "/authorized_keys", key, 0600})
+			}
+			ops = append(ops, chownOp{Path: ssh, User: u.Name, LoginGroup: true, Recursive: true})
+		}
+	}
+	return ops, nil
+}
+
+func nativeFilesAndDirectories(bp *Blueprint) ([]nativeOp, error) {
+	var ops []nativeOp
+	owner := func(path string, u, g interface{}) {
+		if u == nil && g == nil {
+			return
+		}
+		op := chownOp{Path: path}
+		if u != nil {
+			op.User = fmt.Sprint(u)
+		}
+		if g != nil {
+			op.Group = fmt.Sprint(g)
+		}
+		ops = append(ops, op)
+	}
+	for _, dir := range bp.Customizations.GetDirectories() {
+		mode, err := fsNodeMode(dir.Mode, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("directory %s: %w", dir.Path, err)
+		}
+		ops = append(ops, mkdirOp{dir.Path, mode, dir.EnsureParents})
+		owner(dir.Path, dir.User, dir.Group)
+	}
+	for _, file := range bp.Customizations.GetFiles() {
+		mode, err := fsNodeMode(file.Mode, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %w", file.Path, err)
+		}
+		ops = append(ops, writeFileOp{file.Path, file.Data, mode})
+		owner(file.Path, file.User, file.Group)
+	}
+	return ops, nil
+}
+
+func nativeFirewall(bp *Blueprint) ([]nativeOp, error) {
+	fw := bp.Customizations.GetFirewall()
+	if fw == nil {
+		return nil, nil
+	}
+	var rules []nativeOp
+	for _, port := range fw.Ports {
+		rules = append(rules, commandOp{Argv: []string{"firewall-offline-cmd", "--add-port=" + port}})
+	}
+	if fw.Services != nil {
+		for _, service := range fw.Services.Enabled {
+			rules = append(rules, commandOp{Argv: []string{"firewall-offline-cmd", "--add-service=" + service}})
+		}
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	install := commandOp{
+		Argv:      []string{"dnf", "install", "-y", "firewalld"},
+		Skip:      commandFound("firewall-offline-cmd"),
+		SkipCheck: "command -v firewall-offline-cmd >/dev/null",
+	}
+	return append([]nativeOp{install}, rules...), nil
+}
+
+func nativeServices(bp *Blueprint) ([]nativeOp, error) {
+	svc := bp.Customizations.GetServices()
+	if svc == nil {
+		return nil, nil
+	}
+	var ops []nativeOp
+	for _, action := range []struct {
+		verb  string
+		units []string
+	}{{"enable", svc.Enabled}, {"disable", svc.Disabled}, {"mask", svc.Masked}} {
+		for _, unit := range action.units {
+			ops = append(ops, commandOp{Argv: []string{"systemctl", action.verb, unit}})
+		}
+	}
+	return ops, nil
+}
+
+func nativeDefaultTarget(bp *Blueprint) ([]nativeOp, error) {
+	target := bp.Extensions.GetDefaultTarget()
+	if target == "" {
+		return nil, nil
+	}
+	if !strings.HasSuffix(target, ".target") {
+		target += ".target"
+	}
+	return []nativeOp{commandOp{Argv: []string{"systemctl", "set-default", target}}}, nil
+}
+
+func nativeCleanup(*Blueprint) ([]nativeOp, error) {
+	return []nativeOp{commandOp{Argv: []string{"dnf", "clean", "all"}}}, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNativeFileOps(t *testing.T) {
+	dir := t.TempDir()
+	env := &nativeEnv{}
+
+	path := filepath.Join(dir, "etc/myapp/config")
+	require.NoError(t, writeFileOp{path, "key=value\n", 0640}.Apply(env))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "key=value\n", string(data))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	environment := filepath.Join(dir, "environment")
+	require.NoError(t, os.WriteFile(environment, []byte("EDITOR=nano\nPATH=/usr/bin\nEDITOR=vi"), 0600))
+	require.NoError(t, replaceLineOp{environment, "EDITOR=", "EDITOR=vim"}.Apply(env))
+	require.NoError(t, replaceLineOp{environment, "EDITOR=", "EDITOR=vim"}.Apply(env))
+	data, err = os.ReadFile(environment)
+	require.NoError(t, err)
+	assert.Equal(t, "PATH=/usr/bin\nEDITOR=vim\n", string(data))
+	info, err = os.Stat(environment)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Missing files are created
+	hosts := filepath.Join(dir, "hosts")
+	require.NoError(t, replaceLineOp{hosts, "127.0.1.1 ", "127.0.1.1 web"}.Apply(env))
+	data, err = os.ReadFile(hosts)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.1.1 web\n", string(data))
+
+	// Keys are added once, the other keys are kept
+	keys := filepath.Join(dir, "authorized_keys")
+	require.NoError(t, os.WriteFile(keys, []byte("ssh-ed25519 BBBB other\n"), 0644))
+	require.NoError(t, appendLineOp{keys, "ssh-ed25519 AAAA admin", 0600}.Apply(env))
+	require.NoError(t, appendLineOp{keys, "ssh-ed25519 AAAA admin", 0600}.Apply(env))
+	data, err = os.ReadFile(keys)
+	require.NoError(t, err)
+	assert.Equal(t, "ssh-ed25519 BBBB other\nssh-ed25519 AAAA admin\n", string(data))
+	info, err = os.Stat(keys)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	nested := filepath.Join(dir, "var/data/app")
+	assert.Error(t, mkdirOp{nested, 0750, false}.Apply(env))
+	require.NoError(t, mkdirOp{nested, 0750, true}.Apply(env))
+	require.NoError(t, mkdirOp{nested, 0700, false}.Apply(env))
+	info, err = os.Stat(nested)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	localtime := filepath.Join(dir, "localtime")
+	require.NoError(t, os.WriteFile(localtime, nil, 0644))
+	require.NoError(t, symlinkOp{"/usr/share/zoneinfo/UTC", localtime}.Apply(env))
+	require.NoError(t, symlinkOp{"/usr/share/zoneinfo/Europe/Prague", localtime}.Apply(env))
+	target, err := os.Readlink(localtime)
+	require.NoError(t, err)
+	assert.Equal(t, "/usr/share/zoneinfo/Europe/Prague", target)
+
+	if os.Getuid() == 0 {
+		require.NoError(t, chownOp{Path: filepath.Join(dir, "var"), User: "root", LoginGroup: true, Recursive: true}.Apply(env))
+		require.NoError(t, chownOp{Path: path, Group: "0"}.Apply(env))
+	}
+	assert.Error(t, chownOp{Path: path, User: "no-such-user"}.Apply(env))
+}
+
+func TestNativeCommandOp(t *testing.T) {
+	var stdout bytes.Buffer
+	env := &nativeEnv{Stdout: &stdout, Stderr: &stdout}
+
+	// Arguments are passed as they are, without a shell
+	require.NoError(t, commandOp{Argv: []string{"printf", "%s|", "a b", "$HOME", "'; reboot"}}.Apply(env))
+	assert.Equal(t, "a b|$HOME|'; reboot|", stdout.String())
+
+	stdout.Reset()
+	require.NoError(t, commandOp{Argv: []string{"cat"}, Stdin: "admin:$6$xyz\n"}.Apply(env))
+	assert.Equal(t, "admin:$6$xyz\n", stdout.String())
+
+	skipped := commandOp{Argv: []string{"false"}, Skip: func() bool { return true }, SkipCheck: "true"}
+	require.NoError(t, skipped.Apply(env))
+	assert.Equal(t, "(true || 'false')", skipped.String())
+
+	assert.EqualError(t, commandOp{Argv: []string{"false"}}.Apply(env), "false: exit status 1")
+
+	env.Deadline = time.Now().Add(100 * time.Millisecond)
+	assert.Error(t, commandOp{Argv: []string{"sleep", "60"}}.Apply(env))
+	assert.True(t, env.TimedOut)
+}
+
+func TestNativeBlocks(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+packages = [{ name = "nginx" }]
+
+[customizations]
+hostname = "web.example.com"
+
+[customizations.environment]
+EDITOR = "vim"
+GREETING = "hello world"
+
+[customizations.timezone]
+timezone = "Europe/Prague"
+
+[[customizations.group]]
+name = "developers"
+gid = 1000
+
+[[customizations.user]]
+name = "admin"
+password = "$6$xyz"
+key = "ssh-ed25519 AAAA"
+groups = ["wheel"]
+
+[[customizations.directories]]
+path = "/etc/myapp"
+mode = "0750"
+group = "developers"
+
+[[customizations.files]]
+path = "/etc/myapp/config"
+data = "key=value\n"
+
+[customizations.services]
+enabled = ["nginx"]
+masked = ["rpcbind"]
+`)
+	_, blocks, err := generateBashScript(bp)
+	require.NoError(t, err)
+	scripts, err := addNativeOps(bp, blocks)
+	require.NoError(t, err)
+	assert.Empty(t, scripts)
+
+	native := map[string]string{}
+	commands := map[string]string{}
+	for _, block := range blocks {
+		native[block.Name] = nativeScript(block.Native)
+		commands[block.Name] = block.Commands
+	}
+	// The operations do what the commands do
+	for _, name := range []string{"Environment", "Timezone"} {
+		assert.Equal(t, commands[name], native[name], name)
+	}
+	assert.Equal(t, "'dnf' 'install' '-y' 'nginx' 'kernel'", native["Packages"])
+	assert.Equal(t, "mkdir -p '/etc' && printf '%s' 'web.example.com\n' > '/etc/hostname' && chmod 0644 '/etc/hostname'", native["Hostname"])
+	assert.Equal(t, "(getent group developers > /dev/null || 'groupadd' '--gid' '1000' 'developers')", native["Groups"])
+	assert.Contains(t, native["Users"], "(getent passwd admin > /dev/null || 'useradd' '-m' 'admin')")
+	assert.Contains(t, native["Users"], "(id -nG admin | tr ' ' '\\n' | grep -qxF wheel || 'usermod' '-aG' 'wheel' 'admin')")
+	assert.Contains(t, native["Users"], "(getent shadow admin | cut -d: -f2)\" = '...' ] || printf '%s' '...' | 'chpasswd' '-e')")
+	assert.Contains(t, native["Users"], "chown -R 'admin:' '/home/admin/.ssh'")
+	assert.NotContains(t, native["Users"], "$6$xyz")
+	assert.Contains(t, native["Files and Directories"], "([ -d '/etc/myapp' ] || mkdir '/etc/myapp') && chmod 0750 '/etc/myapp' && chown ':developers' '/etc/myapp'")
+	assert.Contains(t, native["Files and Directories"], "printf '%s' 'key=value\n' > '/etc/myapp/config'")
+	assert.Equal(t, "'systemctl' 'enable' 'nginx' && 'systemctl' 'mask' 'rpcbind'", native["Services"])
+	assert.Equal(t, "'dnf' 'clean' 'all'", native["Cleanup DNF Cache"])
+}
+
+func TestApplyBlocksNative(t *testing.T) {
+	discardLogs(t)
+	path := filepath.Join(t.TempDir(), "hostname")
+	blocks := []NamedCommandBlock{
+		{Name: "Hostname", Commands: "exit 1", Native: []nativeOp{writeFileOp{path, "web\n", 0644}}},
+		{Name: "Timezone", Commands: "exit 1", Native: []nativeOp{commandOp{Argv: []string{"false"}}}},
+	}
+	applied, failed, err := applyBlocks("#!/bin/sh\nset -eu\n", blocks, applyOptions{ContinueOnError: true, Quiet: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Hostname"}, applied)
+	assert.Equal(t, []string{"Timezone"}, failed)
+	assert.FileExists(t, path)
+
+	_, _, err = applyBlocks("#!/bin/sh\nset -eu\n", blocks[1:], applyOptions{Quiet: true})
+	assert.EqualError(t, err, "execution failed for block 'Timezone': false: exit status 1")
+}
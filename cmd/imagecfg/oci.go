@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ociBlueprintLabel is the label, or manifest annotation, of images carrying the
+// blueprint configuring them
+const ociBlueprintLabel = "io.github.ondrejbudai.imagecfg.blueprint"
+
+// ociRunner runs oras and skopeo, a var so tests can replace it
+var ociRunner commandRunner = runCommand
+
+// isOCIBlueprint returns whether the blueprint path is a reference to an image or an
+// artifact in a registry or the local container storage.
+func isOCIBlueprint(path string) bool {
+	for _, prefix := range []string{"oras://", "docker://", "containers-storage:"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchOCIBlueprint fetches the blueprint of the reference: with oras:// the only file
+// of an ORAS artifact, pulled by oras, and with docker:// and containers-storage: the
+// ociBlueprintLabel of the image, inspected by skopeo, so that the blueprint travels
+// with the image it configures.
+func fetchOCIBlueprint(ref string) ([]byte, error) {
+	if artifact, ok := strings.CutPrefix(ref, "oras://"); ok {
+		return pullORASBlueprint(artifact)
+	}
+	return imageLabelBlueprint(ref)
+}
+
+// pullORASBlueprint pulls the artifact with oras and returns the file in it.
+func pullORASBlueprint(artifact string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "imagecfg-oras-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if _, err := ociRunner("oras", "pull", "--output", dir, artifact); err != nil {
+		return nil, fmt.Errorf("error pulling %s: %w", artifact, toolError(err))
+	}
+	var files []string
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 1 {
+		return nil, fmt.Errorf("artifact %s has %d files, it must have only the blueprint", artifact, len(files))
+	}
+	return os.ReadFile(files[0])
+}
+
+// imageLabelBlueprint returns the blueprint in the label of the image, or in the
+// annotation of its manifest if it has no such label.
+func imageLabelBlueprint(image string) ([]byte, error) {
+	out, err := ociRunner("skopeo", "inspect", image)
+	if err != nil {
+		return nil, fmt.Errorf("error inspecting %s: %w", image, toolError(err))
+	}
+	var config struct {
+		Labels map[string]string
+	}
+	if err := json.Unmarshal(out, &config); err != nil {
+		return nil, fmt.Errorf("error inspecting %s: %w", image, err)
+	}
+	if blueprint, ok := config.Labels[ociBlueprintLabel]; ok {
+		return []byte(blueprint), nil
+	}
+
+	out, err = ociRunner("skopeo", "inspect", "--raw", image)
+	if err != nil {
+		return nil, fmt.Errorf("error inspecting %s: %w", image, toolError(err))
+	}
+	var manifest struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(out, &manifest); err != nil {
+		return nil, fmt.Errorf("error inspecting %s: %w", image, err)
+	}
+	if blueprint, ok := manifest.Annotations[ociBlueprintLabel]; ok {
+		return []byte(blueprint), nil
+	}
+	return nil, fmt.Errorf("image %s has no %s label or annotation", image, ociBlueprintLabel)
+}
+
+// toolError adds what the tool printed to the error it failed with.
+func toolError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOCIRunner replaces oras and skopeo with run for the test.
+func fakeOCIRunner(t *testing.T, run commandRunner) {
+	old := ociRunner
+	ociRunner = run
+	fetchedBlueprints = map[string][]byte{}
+	t.Cleanup(func() {
+		ociRunner = old
+		fetchedBlueprints = map[string][]byte{}
+	})
+}
+
+func TestORASBlueprint(t *testing.T) {
+	var pulled []string
+	fakeOCIRunner(t, func(name string, args ...string) ([]byte, error) {
+		pulled = append(pulled, name+" "+strings.Join(args[:2], " ")+" "+args[3])
+		return nil, os.WriteFile(filepath.Join(args[2], "config.toml"), []byte(fetchTestBlueprint), 0644)
+	})
+	bp, err := loadBlueprint([]string{"oras://quay.io/example/config:v1"})
+	require.NoError(t, err)
+	assert.Equal(t, "fetched", *bp.Customizations.Hostname)
+	assert.Equal(t, []string{"oras pull --output quay.io/example/config:v1"}, pulled)
+
+	// Artifacts with several files are ambiguous
+	fakeOCIRunner(t, func(name string, args ...string) ([]byte, error) {
+		for _, f := range []string{"a.toml", "b.toml"} {
+			if err := os.WriteFile(filepath.Join(args[2], f), nil, 0644); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	_, err = readBlueprint("oras://quay.io/example/config:v1")
+	assert.ErrorContains(t, err, "artifact quay.io/example/config:v1 has 2 files, it must have only the blueprint")
+}
+
+func TestImageLabelBlueprint(t *testing.T) {
+	label := fmt.Sprintf(`{"Labels": {%q: %q}}`, ociBlueprintLabel, fetchTestBlueprint)
+	fakeOCIRunner(t, func(name string, args ...string) ([]byte, error) {
+		assert.Equal(t, []string{"inspect", "docker://quay.io/example/bootc:latest"}, args)
+		return []byte(label), nil
+	})
+	data, err := readBlueprint("docker://quay.io/example/bootc:latest")
+	require.NoError(t, err)
+	assert.Equal(t, fetchTestBlueprint, string(data))
+
+	// Without the label, the annotation of the manifest is used
+	fakeOCIRunner(t, func(name string, args ...string) ([]byte, error) {
+		if args[1] == "--raw" {
+			return []byte(fmt.Sprintf(`{"annotations": {%q: %q}}`, ociBlueprintLabel, fetchTestBlueprint)), nil
+		}
+		return []byte(`{"Labels": null}`), nil
+	})
+	data, err = readBlueprint("containers-storage:localhost/bootc")
+	require.NoError(t, err)
+	assert.Equal(t, fetchTestBlueprint, string(data))
+
+	fakeOCIRunner(t, func(name string, args ...string) ([]byte, error) {
+		return []byte(`{}`), nil
+	})
+	_, err = readBlueprint("docker://quay.io/example/bootc:latest")
+	assert.ErrorContains(t, err, "image docker://quay.io/example/bootc:latest has no "+ociBlueprintLabel+" label or annotation")
+}
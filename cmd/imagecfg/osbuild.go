@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// osbuildStage is a stage of an osbuild pipeline
+type osbuildStage struct {
+	Type    string      `json:"type"`
+	Options interface{} `json:"options"`
+}
+
+type osbuildUserOptions struct {
+	UID                *int     `json:"uid,omitempty"`
+	GID                *int     `json:"gid,omitempty"`
+	Groups             []string `json:"groups,omitempty"`
+	Description        *string  `json:"description,omitempty"`
+	Home               *string  `json:"home,omitempty"`
+	Shell              *string  `json:"shell,omitempty"`
+	Password           *string  `json:"password,omitempty"`
+	Key                *string  `json:"key,omitempty"`
+	ExpireDate         *int     `json:"expiredate,omitempty"`
+	ForcePasswordReset *bool    `json:"force_password_reset,omitempty"`
+}
+
+type osbuildGroupOptions struct {
+	GID *int `json:"gid,omitempty"`
+}
+
+type osbuildFirewallOptions struct {
+	Ports            []string `json:"ports,omitempty"`
+	EnabledServices  []string `json:"enabled_services,omitempty"`
+	DisabledServices []string `json:"disabled_services,omitempty"`
+}
+
+type osbuildSystemdOptions struct {
+	EnabledServices  []string `json:"enabled_services,omitempty"`
+	DisabledServices []string `json:"disabled_services,omitempty"`
+	MaskedServices   []string `json:"masked_services,omitempty"`
+	DefaultTarget    string   `json:"default_target,omitempty"`
+}
+
+var osbuildCmd = &cobra.Command{
+	Use:   "osbuild [blueprint.toml...]",
+	Short: "Translate an OSBuild blueprint to osbuild stages",
+	Long: `Translates an OSBuild blueprint (TOML format) into a JSON list of
+org.osbuild.* stages, which can be added to an osbuild pipeline.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+The locale, keymap, hostname, timezone, groups, users, firewall and systemd
+services and default target are translated. The other configurations have no
+stage equivalent, they are skipped with a warning.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		stages, skipped, err := generateOsbuildStages(bp)
+		if err != nil {
+			return fmt.Errorf("error generating osbuild stages: %w", err)
+		}
+		if len(skipped) > 0 {
+			logger.Warn("no osbuild stage, skipped", "blocks", skipped)
+		}
+		data, err := json.MarshalIndent(stages, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding osbuild stages: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(osbuildCmd)
+}
+
+// osbuildBlocks are the blocks that have osbuild stage equivalents
+var osbuildBlocks = map[string]bool{
+	"Hostname":       true,
+	"Timezone":       true,
+	"Groups":         true,
+	"Users":          true,
+	"Firewall":       true,
+	"Services":       true,
+	"Default Target": true,
+	// Packages are installed by the pipeline itself
+	"Packages":          true,
+	"Cleanup DNF Cache": true,
+}
+
+// generateOsbuildStages maps the blueprint customizations to osbuild stages. It also
+// returns the names of the blocks that have no stage equivalent.
+func generateOsbuildStages(bp *Blueprint) ([]osbuildStage, []string, error) {
+	_, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return nil, nil, err
+	}
+	supported := maps.Clone(osbuildBlocks)
+	// Only the upstream locale customization maps to the locale and keymap stages
+	if ext := bp.Extensions.GetLocale(); ext == nil || *ext == (LocaleCustomization{}) {
+		supported["Locale"] = true
+	}
+	var skipped []string
+	for _, block := range namedBlocks {
+		if !supported[block.Name] {
+			skipped = append(skipped, block.Name)
+		}
+	}
+	if bp.Extensions.GetPrettyHostname() != "" || bp.Extensions.GetChassis() != "" || bp.Extensions.GetHostsEntry() != nil {
+		skipped = append(skipped, "Hostname (pretty hostname, chassis and hosts entry)")
+	}
+
+	stages := []osbuildStage{}
+	add := func(stageType string, options interface{}) {
+		stages = append(stages, osbuildStage{Type: stageType, Options: options})
+	}
+
+	language, keyboard := bp.Customizations.GetPrimaryLocale()
+	if language != nil && *language != "" {
+		add("org.osbuild.locale", map[string]string{"language": *language})
+	}
+	if keyboard != nil && *keyboard != "" {
+		add("org.osbuild.keymap", map[string]string{"keymap": *keyboard})
+	}
+
+	if hostname := bp.Customizations.GetHostname(); hostname != nil && *hostname != "" {
+		add("org.osbuild.hostname", map[string]string{"hostname": *hostname})
+	}
+
+	if timezone, _ := bp.Customizations.GetTimezoneSettings(); timezone != nil && *timezone != "" {
+		add("org.osbuild.timezone", map[string]string{"zone": *timezone})
+	}
+
+	if groups := bp.Customizations.GetGroups(); len(groups) > 0 {
+		options := make(map[string]osbuildGroupOptions)
+		for _, group := range groups {
+			options[group.Name] = osbuildGroupOptions{GID: group.GID}
+		}
+		add("org.osbuild.groups", map[string]interface{}{"groups": options})
+	}
+
+	if users := bp.Customizations.GetUsers(); len(users) > 0 {
+		options := make(map[string]osbuildUserOptions)
+		for _, user := range users {
+			options[user.Name] = osbuildUserOptions{
+				UID:                user.UID,
+				GID:                user.GID,
+				Groups:             user.Groups,
+				Description:        user.Description,
+				Home:               user.Home,
+				Shell:              user.Shell,
+				Password:           user.Password,
+				Key:                user.Key,
+				ExpireDate:         user.ExpireDate,
+				ForcePasswordReset: user.ForcePasswordReset,
+			}
+		}
+		add("org.osbuild.users", map[string]interface{}{"users": options})
+	}
+
+	if fw := bp.Customizations.GetFirewall(); fw != nil {
+		options := osbuildFirewallOptions{Ports: fw.Ports}
+		if fw.Services != nil {
+			options.EnabledServices = fw.Services.Enabled
+			options.DisabledServices = fw.Services.Disabled
+		}
+		add("org.osbuild.firewall", options)
+	}
+
+	var systemd osbuildSystemdOptions
+	if svc := bp.Customizations.GetServices(); svc != nil {
+		systemd.EnabledServices = svc.Enabled
+		systemd.DisabledServices = svc.Disabled
+		systemd.MaskedServices = svc.Masked
+	}
+	// The target name was validated while generating the blocks
+	if target := bp.Extensions.GetDefaultTarget(); target != "" {
+		if !strings.HasSuffix(target, ".target") {
+			target += ".target"
+		}
+		systemd.DefaultTarget = target
+	}
+	if len(systemd.EnabledServices) > 0 || len(systemd.DisabledServices) > 0 || len(systemd.MaskedServices) > 0 || systemd.DefaultTarget != "" {
+		add("org.osbuild.systemd", systemd)
+	}
+
+	return stages, skipped, nil
+}
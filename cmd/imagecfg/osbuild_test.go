@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateOsbuildStages(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations]
+hostname = "build1"
+default_target = "multi-user"
+
+[customizations.locale]
+languages = ["en_US.UTF-8"]
+keyboard = "us"
+
+[[customizations.group]]
+name = "app"
+gid = 2000
+
+[[customizations.user]]
+name = "admin"
+groups = ["wheel"]
+
+[customizations.firewall]
+ports = ["8080:tcp"]
+
+[customizations.services]
+enabled = ["sshd"]
+
+[customizations.journald]
+storage = "persistent"
+`)
+	stages, skipped, err := generateOsbuildStages(bp)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Journald"}, skipped)
+
+	data, err := json.Marshal(stages)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"type": "org.osbuild.locale", "options": {"language": "en_US.UTF-8"}},
+		{"type": "org.osbuild.keymap", "options": {"keymap": "us"}},
+		{"type": "org.osbuild.hostname", "options": {"hostname": "build1"}},
+		{"type": "org.osbuild.groups", "options": {"groups": {"app": {"gid": 2000}}}},
+		{"type": "org.osbuild.users", "options": {"users": {"admin": {"groups": ["wheel"]}}}},
+		{"type": "org.osbuild.firewall", "options": {"ports": ["8080:tcp"]}},
+		{"type": "org.osbuild.systemd", "options": {"enabled_services": ["sshd"], "default_target": "multi-user.target"}}
+	]`, string(data))
+}
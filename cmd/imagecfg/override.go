@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blueprintSets is set by --set, the KEY=VALUE overrides of blueprint fields
+var blueprintSets []string
+
+// keySegmentRegexp matches a segment of a dotted key, a key with an optional list
+// index: [N], [-N] counting from the end, or [+] appending an entry
+var keySegmentRegexp = regexp.MustCompile(`^([A-Za-z0-9_-]+)(?:\[(\+|-?[0-9]+)\])?$`)
+
+// overrideValue returns the value of an override: a TOML boolean, integer, array or
+// inline table if the value is one, and a string otherwise. Floats and dates are kept
+// as strings, they are versions and the like in blueprints.
+func overrideValue(value string) interface{} {
+	doc, err := decodeDocument([]byte("v = "+value), "toml")
+	if err != nil {
+		return value
+	}
+	switch doc["v"].(type) {
+	case float64, time.Time:
+		return value
+	}
+	return doc["v"]
+}
+
+// applyOverrides sets the fields of the --set overrides in the decoded blueprint, in
+// order, so that per-machine tweaks do not need an edited blueprint. An override is
+// KEY=VALUE with a dotted key, see splitDocumentKey, e.g.
+// customizations.hostname=edge-42 or packages[+].name=vim.
+func applyOverrides(doc map[string]interface{}, sets []string) error {
+	for _, set := range sets {
+		key, value, found := strings.Cut(set, "=")
+		if !found || key == "" {
+			return fmt.Errorf("invalid --set %q, must be KEY=VALUE", set)
+		}
+		if err := setDocumentKey(doc, key, overrideValue(value)); err != nil {
+			return fmt.Errorf("invalid --set %q: %w", set, err)
+		}
+	}
+	return nil
+}
+
+// splitDocumentKey splits a dotted key of a blueprint field into the steps to the
+// field: the keys of tables and the list indexes, which are in brackets. A number
+// without brackets picks a list entry as well, customizations.user.0.uid and
+// customizations.user[0].uid are the same field.
+func splitDocumentKey(key string) ([]string, error) {
+	var steps []string
+	for _, segment := range strings.Split(key, ".") {
+		m := keySegmentRegexp.FindStringSubmatch(segment)
+		if m == nil {
+			return nil, fmt.Errorf("invalid key %q", segment)
+		}
+		steps = append(steps, m[1])
+		if m[2] != "" {
+			steps = append(steps, "["+m[2]+"]")
+		}
+	}
+	return steps, nil
+}
+
+// stepsKey joins steps of splitDocumentKey to a key for messages.
+func stepsKey(steps []string) string {
+	return strings.ReplaceAll(strings.Join(steps, "."), ".[", "[")
+}
+
+// documentEdit changes the field at the end of a key, given its value and whether it
+// exists. It returns the new value, or false to delete the field.
+type documentEdit func(value interface{}, exists bool) (interface{}, bool, error)
+
+// editDocument walks the steps from the table or list, creating the missing tables,
+// and lists for indexes, on the way, and changes the field they end at with edit. It
+// returns the table or list, which is a new list if the edit or an [+] step appended to
+// it or deleted from it. done are the steps walked so far, for messages.
+func editDocument(container interface{}, done, steps []string, edit documentEdit) (interface{}, error) {
+	step, index := steps[0], strings.HasPrefix(steps[0], "[")
+	var value interface{}
+	var exists bool
+	var i int
+	switch c := container.(type) {
+	case map[string]interface{}:
+		if index {
+			return nil, fmt.Errorf("%s is not a list", stepsKey(done))
+		}
+		value, exists = c[step]
+	case []interface{}:
+		n := strings.Trim(step, "[]")
+		if n == "+" {
+			i = len(c)
+		} else {
+			var err error
+			if i, err = strconv.Atoi(n); err != nil {
+				return nil, fmt.Errorf("%s is not a table", stepsKey(done))
+			}
+			if i < 0 {
+				i += len(c)
+			}
+			if i < 0 || i >= len(c) {
+				return nil, fmt.Errorf("%s has no entry %s", stepsKey(done), n)
+			}
+			value, exists = c[i], true
+		}
+	default:
+		return nil, fmt.Errorf("%s is not a table", stepsKey(done))
+	}
+
+	keep := true
+	if len(steps) == 1 {
+		var err error
+		if value, keep, err = edit(value, exists); err != nil {
+			return nil, err
+		}
+	} else {
+		if !exists {
+			// The key continues with a table, or a list if it is indexed next
+			if _, err := strconv.Atoi(strings.Trim(steps[1], "[]")); err == nil || steps[1] == "[+]" {
+				value = []interface{}{}
+			} else {
+				value = make(map[string]interface{})
+			}
+		}
+		var err error
+		if value, err = editDocument(value, append(done, step), steps[1:], edit); err != nil {
+			return nil, err
+		}
+	}
+
+	switch c := container.(type) {
+	case map[string]interface{}:
+		if keep {
+			c[step] = value
+		} else {
+			delete(c, step)
+		}
+		return c, nil
+	default:
+		list := container.([]interface{})
+		switch {
+		case !keep:
+			return append(list[:i:i], list[i+1:]...), nil
+		case i == len(list):
+			return append(list, value), nil
+		}
+		list[i] = value
+		return list, nil
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyOverrides(t *testing.T) {
+	doc := map[string]interface{}{
+		"packages": []interface{}{map[string]interface{}{"name": "nginx"}},
+	}
+	require.NoError(t, applyOverrides(doc, []string{
+		"customizations.hostname=edge-42",
+		"packages[+].name=vim",
+		"packages[-1].version=9.1",
+		"packages[0].version=*",
+		"customizations.user[+].name=admin",
+		"customizations.user.0.uid=1000",
+		"customizations.user[0].groups=[\"wheel\"]",
+		"customizations.firewall.ports[+]=22:tcp",
+		"customizations.kernel.append=",
+	}))
+	assert.Equal(t, map[string]interface{}{
+		"packages": []interface{}{
+			map[string]interface{}{"name": "nginx", "version": "*"},
+			map[string]interface{}{"name": "vim", "version": "9.1"},
+		},
+		"customizations": map[string]interface{}{
+			"hostname": "edge-42",
+			"user":     []interface{}{map[string]interface{}{"name": "admin", "uid": int64(1000), "groups": []interface{}{"wheel"}}},
+			"firewall": map[string]interface{}{"ports": []interface{}{"22:tcp"}},
+			"kernel":   map[string]interface{}{"append": ""},
+		},
+	}, doc)
+
+	for set, msg := range map[string]string{
+		"hostname":                    `invalid --set "hostname", must be KEY=VALUE`,
+		"packages[5].name=vim":        `invalid --set "packages[5].name=vim": packages has no entry 5`,
+		"packages.name=vim":           `invalid --set "packages.name=vim": packages is not a table`,
+		"customizations[0].x=1":       `invalid --set "customizations[0].x=1": customizations is not a list`,
+		"customizations.hostname.x=1": `invalid --set "customizations.hostname.x=1": customizations.hostname is not a table`,
+		"a..b=1":                      `invalid --set "a..b=1": invalid key ""`,
+	} {
+		assert.EqualError(t, applyOverrides(doc, []string{set}), msg, set)
+	}
+}
+
+func TestLoadBlueprintOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"packages": [{"name": "nginx"}], "customizations": {"hostname": "web1"}}`), 0644))
+	oldSets := blueprintSets
+	t.Cleanup(func() { blueprintSets = oldSets })
+
+	blueprintSets = []string{"customizations.hostname=edge-42", "packages[+].name=vim"}
+	bp, err := loadBlueprint([]string{path})
+	require.NoError(t, err)
+	assert.Equal(t, "edge-42", *bp.Customizations.GetHostname())
+	require.Len(t, bp.Packages, 2)
+	assert.Equal(t, "vim", bp.Packages[1].Name)
+
+	blueprintSets = []string{"customizations.hostnme=edge-42"}
+	_, err = loadBlueprint([]string{path})
+	assert.EqualError(t, err, "unknown configuration keys set by --set: customizations.hostnme")
+}
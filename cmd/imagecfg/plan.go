@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// metadataFields are the blueprint keys that describe the blueprint rather than the system
+var metadataFields = []string{"name", "description", "version", "distro", "architecture"}
+
+// planBlock describes a block of commands generated from the blueprint
+type planBlock struct {
+	Name     string   `json:"name" yaml:"name"`
+	Fields   []string `json:"fields" yaml:"fields"`
+	Commands string   `json:"commands" yaml:"commands"`
+	// Changes classifies each command against the running system, with --detect-changes
+	Changes []plannedCommand `json:"changes,omitempty" yaml:"changes,omitempty"`
+}
+
+// Statuses of planned commands
+const (
+	planWouldChange = "would change"
+	planSatisfied   = "already satisfied"
+	planUnknown     = "unknown"
+)
+
+// plannedCommand is a command of a block and whether it would change the system
+type plannedCommand struct {
+	Command string `json:"command" yaml:"command"`
+	Status  string `json:"status" yaml:"status"`
+}
+
+// plan is the machine-readable description of what applying a blueprint does
+type plan struct {
+	Blocks            []planBlock `json:"blocks" yaml:"blocks"`
+	UnsupportedFields []string    `json:"unsupported_fields" yaml:"unsupported_fields"`
+}
+
+var (
+	planFormat        string
+	planDetectChanges bool
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan [blueprint.toml...]",
+	Short: "Describe the blocks an OSBuild blueprint translates to",
+	Long: `Describes every block of commands that applying an OSBuild blueprint
+(TOML format) would run, the blueprint fields it comes from and the fields
+that imagecfg does not support, as JSON or YAML.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+With --detect-changes, each command is compared to the running system, like
+in the 'diff' command, and classified as "would change", "already satisfied"
+or "unknown" if imagecfg cannot tell.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		p, err := generatePlan(bp)
+		if err != nil {
+			return fmt.Errorf("error generating plan: %w", err)
+		}
+		if planDetectChanges {
+			state, err := readSystemState(bp)
+			if err != nil {
+				return fmt.Errorf("error reading system state: %w", err)
+			}
+			detectChanges(p, state)
+		}
+
+		var data []byte
+		switch planFormat {
+		case "json":
+			data, err = json.MarshalIndent(p, "", "  ")
+			data = append(data, '\n')
+		case "yaml":
+			data, err = yaml.Marshal(p)
+		default:
+			return fmt.Errorf("unknown plan format %q, must be json or yaml", planFormat)
+		}
+		if err != nil {
+			return fmt.Errorf("error encoding plan: %w", err)
+		}
+		fmt.Print(string(data))
+		return nil
+	},
+}
+
+func init() {
+	planCmd.Flags().StringVar(&planFormat, "format", "json", "output format, json or yaml")
+	planCmd.Flags().BoolVar(&planDetectChanges, "detect-changes", false, "classify the commands against the running system")
+	rootCmd.AddCommand(planCmd)
+}
+
+// supportedFields returns the blueprint keys that any block is generated from.
+func supportedFields() []string {
+	var fields []string
+	for _, blk := range blockGenerators {
+		fields = append(fields, blk.fields...)
+	}
+	for _, blk := range declarativeBlockGenerators {
+		fields = append(fields, blk.fields...)
+	}
+	return append(fields, machineIDResetBlock.fields...)
+}
+
+// unsupportedFields returns the keys set in the blueprint that no block is generated
+// from. Only the outermost key of an unsupported table is reported.
+func unsupportedFields(bp *Blueprint) []string {
+	supported := supportedFields()
+	isSupported := func(key string) bool {
+		for _, field := range supported {
+			// Tables containing a supported field, the field itself and its subkeys
+			if key == field || strings.HasPrefix(field, key+".") || strings.HasPrefix(key, field+".") {
+				return true
+			}
+		}
+		for _, field := range metadataFields {
+			if key == field {
+				return true
+			}
+		}
+		return false
+	}
+
+	unsupported := []string{}
+	for _, key := range bp.Keys {
+		if isSupported(key) {
+			continue
+		}
+		// The keys are sorted, so the parent table was reported before
+		if n := len(unsupported); n > 0 && strings.HasPrefix(key, unsupported[n-1]+".") {
+			continue
+		}
+		unsupported = append(unsupported, key)
+	}
+	return unsupported
+}
+
+// generatePlan generates the plan of the blueprint.
+func generatePlan(bp *Blueprint) (*plan, error) {
+	_, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plan{Blocks: []planBlock{}, UnsupportedFields: unsupportedFields(bp)}
+	for _, block := range namedBlocks {
+		fields := block.Fields
+		if fields == nil {
+			fields = []string{}
+		}
+		p.Blocks = append(p.Blocks, planBlock{Name: block.Name, Fields: fields, Commands: block.Commands})
+	}
+	return p, nil
+}
+
+// Commands of the compared blocks whose effect can be told from the system state
+var (
+	planPackagesRegexp = regexp.MustCompile(`^dnf install -y (.+)$`)
+	planHostnameRegexp = regexp.MustCompile(`^echo '([^']*)' > /etc/hostname$`)
+	planTimezoneRegexp = regexp.MustCompile(`^ln -sf /usr/share/zoneinfo/(\S+) /etc/localtime$`)
+	planGroupRegexp    = regexp.MustCompile(`^\(getent group (\S+) > /dev/null \|\| groupadd .*\)$`)
+	planUserRegexp     = regexp.MustCompile(`^\(getent passwd (\S+) > /dev/null \|\| useradd .*\)$`)
+	planUsermodRegexp  = regexp.MustCompile(`^(?:\(id -nG \S+ .* \|\| )?usermod -aG (\S+) ([^\s)]+)\)?$`)
+	planPortRegexp     = regexp.MustCompile(`^firewall-offline-cmd --add-port=(\S+)$`)
+	planServiceRegexp  = regexp.MustCompile(`^firewall-offline-cmd --add-service=(\S+)$`)
+	planSystemdRegexp  = regexp.MustCompile(`^systemctl (enable|disable|mask) (\S+)$`)
+)
+
+// commandStatus classifies a generated command against the system state.
+func commandStatus(command string, state *systemState) string {
+	status := func(satisfied bool) string {
+		if satisfied {
+			return planSatisfied
+		}
+		return planWouldChange
+	}
+	if m := planPackagesRegexp.FindStringSubmatch(command); m != nil {
+		for _, pkg := range strings.Fields(m[1]) {
+			if !state.Packages[pkg] {
+				return planWouldChange
+			}
+		}
+		return planSatisfied
+	}
+	if m := planHostnameRegexp.FindStringSubmatch(command); m != nil {
+		return status(state.Hostname == m[1])
+	}
+	if m := planTimezoneRegexp.FindStringSubmatch(command); m != nil {
+		return status(state.Timezone == m[1])
+	}
+	if m := planGroupRegexp.FindStringSubmatch(command); m != nil {
+		_, ok := state.Groups[m[1]]
+		return status(ok)
+	}
+	if m := planUserRegexp.FindStringSubmatch(command); m != nil {
+		return status(state.Users[m[1]])
+	}
+	if m := planUsermodRegexp.FindStringSubmatch(command); m != nil {
+		for _, group := range strings.Split(m[1], ",") {
+			if !slices.Contains(state.Groups[group], m[2]) {
+				return planWouldChange
+			}
+		}
+		return planSatisfied
+	}
+	if m := planPortRegexp.FindStringSubmatch(command); m != nil {
+		return status(slices.Contains(state.FirewallPorts, strings.Replace(m[1], ":", "/", 1)))
+	}
+	if m := planServiceRegexp.FindStringSubmatch(command); m != nil {
+		return status(slices.Contains(state.FirewallRules, m[1]))
+	}
+	if m := planSystemdRegexp.FindStringSubmatch(command); m != nil {
+		return status(serviceInState(m[1], state.Services[m[2]]))
+	}
+	return planUnknown
+}
+
+// detectChanges classifies every command of the plan against the system state.
+func detectChanges(p *plan, state *systemState) {
+	for i := range p.Blocks {
+		for _, command := range splitCommands(p.Blocks[i].Commands) {
+			p.Blocks[i].Changes = append(p.Blocks[i].Changes, plannedCommand{Command: command, Status: commandStatus(command, state)})
+		}
+	}
+}
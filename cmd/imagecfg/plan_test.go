@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratePlan(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+name = "web"
+
+[[packages]]
+name = "nginx"
+
+[customizations]
+hostname = "web1"
+
+[customizations.timezone]
+timezone = "UTC"
+ntpservers = ["pool.ntp.org"]
+
+[customizations.kernel]
+append = "nosmt"
+
+[[customizations.disk.partitions]]
+type = "plain"
+mountpoint = "/data"
+minsize = "1 GiB"
+fs_type = "xfs"
+`)
+	p, err := generatePlan(bp)
+	require.NoError(t, err)
+
+	var names []string
+	for _, block := range p.Blocks {
+		names = append(names, block.Name)
+	}
+	assert.Equal(t, []string{"Packages", "Hostname", "Timezone", "Chrony", "Cleanup DNF Cache"}, names)
+	assert.Equal(t, []string{"packages"}, p.Blocks[0].Fields)
+	assert.Equal(t, []string{"customizations.hostname"}, p.Blocks[1].Fields)
+	assert.Equal(t, []string{"customizations.timezone.ntpservers"}, p.Blocks[3].Fields)
+	assert.Equal(t, []string{}, p.Blocks[4].Fields)
+	assert.Equal(t, "echo 'web1' > /etc/hostname", p.Blocks[1].Commands)
+
+	assert.Equal(t, []string{"customizations.disk.partitions", "customizations.kernel.append"}, p.UnsupportedFields)
+}
+
+func TestDetectChanges(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[packages]]
+name = "tmux"
+
+[customizations]
+hostname = "box"
+
+[[customizations.group]]
+name = "app"
+
+[[customizations.user]]
+name = "admin"
+groups = ["wheel", "app"]
+
+[customizations.firewall]
+ports = ["22:tcp"]
+
+[customizations.services]
+enabled = ["sshd"]
+masked = ["packagekit"]
+`)
+	p, err := generatePlan(bp)
+	require.NoError(t, err)
+	detectChanges(p, &systemState{
+		Packages:      map[string]bool{"tmux": true, "kernel": true},
+		Hostname:      "localhost",
+		Groups:        map[string][]string{"wheel": {"admin"}, "app": nil},
+		Users:         map[string]bool{"admin": true},
+		Services:      map[string]string{"sshd": "enabled", "packagekit": "static"},
+		FirewallPorts: []string{"22/tcp"},
+	})
+
+	var changes []plannedCommand
+	for _, block := range p.Blocks {
+		changes = append(changes, block.Changes...)
+	}
+	assert.Equal(t, []plannedCommand{
+		{Command: "dnf install -y tmux kernel", Status: planSatisfied},
+		{Command: "echo 'box' > /etc/hostname", Status: planWouldChange},
+		{Command: "(getent group app > /dev/null || groupadd app)", Status: planSatisfied},
+		{Command: "(getent passwd admin > /dev/null || useradd -m admin)", Status: planSatisfied},
+		{Command: "(id -nG admin | tr ' ' '\\n' | grep -qxF wheel || usermod -aG wheel admin)", Status: planSatisfied},
+		{Command: "(id -nG admin | tr ' ' '\\n' | grep -qxF app || usermod -aG app admin)", Status: planWouldChange},
+		{Command: "(command -v firewall-offline-cmd >/dev/null || dnf install -y firewalld)", Status: planUnknown},
+		{Command: "firewall-offline-cmd --add-port=22:tcp", Status: planSatisfied},
+		{Command: "systemctl enable sshd", Status: planSatisfied},
+		{Command: "systemctl mask packagekit", Status: planWouldChange},
+		{Command: "dnf clean all", Status: planUnknown},
+	}, changes)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// applySudo is set by --sudo, apply then runs the blocks with sudo when it does not run
+// as root
+var applySudo bool
+
+// unprivilegedTools are the tools the blocks call that need no root privileges
+var unprivilegedTools = []string{"rpm", "getent", "python3"}
+
+// privilegeProblems returns a line per block saying what it needs root privileges for:
+// the tools it runs, or the files it changes if it runs none.
+func privilegeProblems(blocks []NamedCommandBlock) []string {
+	var problems []string
+	for _, block := range blocks {
+		if strings.TrimSpace(block.Commands) == "" {
+			continue
+		}
+		var tools []string
+		for tool := range blockTools(block.Commands) {
+			if !slices.Contains(unprivilegedTools, tool) {
+				tools = append(tools, tool)
+			}
+		}
+		slices.Sort(tools)
+		need := "changes the system configuration"
+		if len(tools) > 0 {
+			need = "runs " + strings.Join(tools, ", ")
+		} else if paths := blockPaths(block.Commands); len(paths) > 0 {
+			need = "writes " + strings.Join(paths, ", ")
+		}
+		problems = append(problems, fmt.Sprintf("  %s: %s", block.Name, need))
+	}
+	return problems
+}
+
+// checkPrivileges fails with what every block needs root privileges for, unless apply
+// runs as root.
+func checkPrivileges(blocks []NamedCommandBlock) error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	return fmt.Errorf("apply needs root privileges, run it as root or with --sudo:\n%s", strings.Join(privilegeProblems(blocks), "\n"))
+}
+
+// sudoValidate asks for the password of sudo once, if it needs one, so that the blocks
+// can run with sudo -n, also while other blocks run.
+func sudoValidate() error {
+	cmd := exec.Command("sudo", "-v")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running sudo: %w", err)
+	}
+	return nil
+}
+
+// sudoCommand returns the command running cmd with sudo, without asking for a
+// password. sudo resets the environment, the variables named in env are kept.
+func sudoCommand(cmd *exec.Cmd, env []string) *exec.Cmd {
+	args := []string{"-n"}
+	if len(env) > 0 {
+		args = append(args, "--preserve-env="+strings.Join(env, ","))
+	}
+	sudo := exec.Command("sudo", append(append(args, "--"), cmd.Args...)...)
+	sudo.Stdout = cmd.Stdout
+	sudo.Stderr = cmd.Stderr
+	return sudo
+}
+
+// sudoWriteFile writes data to the file at path with sudo, creating its directory.
+func sudoWriteFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp("", "imagecfg-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if out, err := exec.Command("sudo", "-n", "install", "-D", "-m", "0644", tmp.Name(), path).CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
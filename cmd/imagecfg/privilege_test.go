@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrivilegeProblems(t *testing.T) {
+	blocks := []NamedCommandBlock{
+		{Name: "Users", Commands: "(getent passwd admin > /dev/null || useradd -m admin) && usermod -aG wheel admin"},
+		{Name: "Journald", Commands: writeFileCmd("/etc/systemd/journald.conf.d/50-imagecfg.conf", "[Journal]\n", 0644)},
+		{Name: "Hostname", Commands: replaceLineCmd("/etc/machine-info", "CHASSIS=", "CHASSIS=vm")},
+		{Name: "Empty", Commands: " "},
+	}
+	assert.Equal(t, []string{
+		"  Users: runs useradd, usermod",
+		"  Journald: writes /etc/systemd/journald.conf.d, /etc/systemd/journald.conf.d/50-imagecfg.conf",
+		"  Hostname: writes /etc/machine-info",
+	}, privilegeProblems(blocks))
+
+	if os.Geteuid() == 0 {
+		assert.NoError(t, checkPrivileges(blocks))
+	} else {
+		assert.ErrorContains(t, checkPrivileges(blocks), "apply needs root privileges, run it as root or with --sudo:\n  Users: runs useradd, usermod")
+	}
+}
+
+func TestSudoCommand(t *testing.T) {
+	cmd := exec.Command("/tmp/imagecfg-block-1.sh")
+	cmd.Stdout = os.Stdout
+	sudo := sudoCommand(cmd, nil)
+	assert.Equal(t, []string{"sudo", "-n", "--", "/tmp/imagecfg-block-1.sh"}, sudo.Args)
+	assert.Equal(t, os.Stdout, sudo.Stdout)
+
+	sudo = sudoCommand(cmd, []string{"JOIN_PASSWORD"})
+	assert.Equal(t, []string{"sudo", "-n", "--preserve-env=JOIN_PASSWORD", "--", "/tmp/imagecfg-block-1.sh"}, sudo.Args)
+
+	sudo = sudoCommand(rootChrootCmd("/mnt/image", "/bin/bash", "true"), nil)
+	assert.Equal(t, []string{"sudo", "-n", "--", "unshare", "--mount"}, sudo.Args[:5])
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// applyVerify is set by --verify, apply then probes after every block that what it
+// configures is in place
+var applyVerify bool
+
+// blockProbes return the probes checking that a block was applied, by the name of
+// the block. A probe is a cheap command that fails if the state does not match.
+var blockProbes = map[string]func(*Blueprint) []string{
+	"Hostname":       probeHostname,
+	"Groups":         probeGroups,
+	"Users":          probeUsers,
+	"Firewall":       probeFirewall,
+	"Services":       probeServices,
+	"Default Target": probeDefaultTarget,
+}
+
+// probe returns a probe running check that reports message when it fails.
+func probe(check, message string) string {
+	return fmt.Sprintf("%s || { echo %s >&2; probe_failed=1; }", check, shellQuote(message))
+}
+
+// probeScript returns the commands running all probes and failing if any did.
+func probeScript(probes []string) string {
+	if len(probes) == 0 {
+		return ""
+	}
+	return "probe_failed=0\n" + strings.Join(probes, "\n") + "\n[ \"$probe_failed\" = 0 ]"
+}
+
+func probeHostname(bp *Blueprint) []string {
+	hostname := bp.Customizations.GetHostname()
+	if hostname == nil || *hostname == "" {
+		return nil
+	}
+	return []string{probe(fmt.Sprintf(`[ "$(cat /etc/hostname)" = %s ]`, shellQuote(*hostname)), "/etc/hostname is not "+*hostname)}
+}
+
+func probeGroups(bp *Blueprint) []string {
+	var probes []string
+	for _, group := range bp.Customizations.GetGroups() {
+		name := shellQuote(group.Name)
+		if group.GID != nil {
+			probes = append(probes, probe(fmt.Sprintf(`[ "$(getent group %s | cut -d: -f3)" = %d ]`, name, *group.GID), fmt.Sprintf("group %s does not exist with GID %d", group.Name, *group.GID)))
+		} else {
+			probes = append(probes, probe(fmt.Sprintf("getent group %s > /dev/null", name), "group "+group.Name+" does not exist"))
+		}
+	}
+	return probes
+}
+
+func probeUsers(bp *Blueprint) []string {
+	var probes []string
+	for _, user := range bp.Customizations.GetUsers() {
+		name := shellQuote(user.Name)
+		probes = append(probes, probe(fmt.Sprintf("getent passwd %s > /dev/null", name), "user "+user.Name+" does not exist"))
+		if user.UID != nil {
+			probes = append(probes, probe(fmt.Sprintf(`[ "$(getent passwd %s | cut -d: -f3)" = %d ]`, name, *user.UID), fmt.Sprintf("user %s does not have UID %d", user.Name, *user.UID)))
+		}
+		if user.Shell != nil && *user.Shell != "" {
+			probes = append(probes, probe(fmt.Sprintf(`[ "$(getent passwd %s | cut -d: -f7)" = %s ]`, name, shellQuote(*user.Shell)), fmt.Sprintf("user %s does not have the shell %s", user.Name, *user.Shell)))
+		}
+		for _, group := range user.Groups {
+			probes = append(probes, probe(fmt.Sprintf("id -nG %s | tr ' ' '\\n' | grep -qx %s", name, shellQuote(group)), fmt.Sprintf("user %s is not in group %s", user.Name, group)))
+		}
+	}
+	return probes
+}
+
+func probeFirewall(bp *Blueprint) []string {
+	fw := bp.Customizations.GetFirewall()
+	if fw == nil {
+		return nil
+	}
+	var probes []string
+	for _, port := range fw.Ports {
+		// firewalld takes ports as PORT/PROTOCOL only
+		query := strings.Replace(port, ":", "/", 1)
+		probes = append(probes, probe(fmt.Sprintf("firewall-offline-cmd --query-port=%s > /dev/null 2>&1", query), "port "+port+" is not open in the firewall"))
+	}
+	if fw.Services != nil {
+		for _, service := range fw.Services.Enabled {
+			probes = append(probes, probe(fmt.Sprintf("firewall-offline-cmd --query-service=%s > /dev/null 2>&1", service), "service "+service+" is not allowed by the firewall"))
+		}
+	}
+	return probes
+}
+
+func probeServices(bp *Blueprint) []string {
+	svc := bp.Customizations.GetServices()
+	if svc == nil {
+		return nil
+	}
+	var probes []string
+	for _, service := range svc.Enabled {
+		probes = append(probes, probe(fmt.Sprintf("systemctl is-enabled --quiet %s", service), service+" is not enabled"))
+	}
+	// Static units cannot be disabled and stay static
+	for _, service := range svc.Disabled {
+		probes = append(probes, probe(fmt.Sprintf(`[ "$(systemctl is-enabled %s 2>/dev/null || true)" != enabled ]`, service), service+" is enabled"))
+	}
+	for _, service := range svc.Masked {
+		probes = append(probes, probe(fmt.Sprintf(`[ "$(systemctl is-enabled %s 2>/dev/null || true)" = masked ]`, service), service+" is not masked"))
+	}
+	return probes
+}
+
+func probeDefaultTarget(bp *Blueprint) []string {
+	target := bp.Extensions.GetDefaultTarget()
+	if target == "" {
+		return nil
+	}
+	if !strings.HasSuffix(target, ".target") {
+		target += ".target"
+	}
+	return []string{probe(fmt.Sprintf(`[ "$(systemctl get-default)" = %s ]`, shellQuote(target)), "the default target is not "+target)}
+}
+
+// probeBlock runs the probes of a block after it was applied, like the block itself,
+// and fails with the messages of the failed probes if what the block configures is not
+// in place.
+func probeBlock(header string, block NamedCommandBlock, log *slog.Logger, opts applyOptions) error {
+	execCmd, cleanup, err := blockCommand(header, NamedCommandBlock{Name: block.Name, Commands: block.Probes}, opts, log)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	output, err := execCmd.CombinedOutput()
+	if err != nil {
+		failures := strings.TrimSpace(string(output))
+		if failures == "" {
+			failures = err.Error()
+		}
+		return fmt.Errorf("block '%s' succeeded, but verifying it failed:\n%s", block.Name, failures)
+	}
+	log.Debug("verified block")
+	return nil
+}
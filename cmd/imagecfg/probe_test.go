@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockProbes(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations]
+hostname = "web.example.com"
+default_target = "multi-user"
+
+[[customizations.group]]
+name = "developers"
+gid = 1000
+
+[[customizations.user]]
+name = "admin"
+uid = 1000
+shell = "/bin/zsh"
+groups = ["wheel"]
+
+[customizations.firewall]
+ports = ["8080:tcp"]
+[customizations.firewall.services]
+enabled = ["http"]
+
+[customizations.services]
+enabled = ["nginx"]
+disabled = ["telnet"]
+masked = ["rpcbind"]
+`)
+	_, blocks, err := generateBashScript(bp)
+	require.NoError(t, err)
+	probes := map[string]string{}
+	for _, block := range blocks {
+		probes[block.Name] = block.Probes
+	}
+
+	assert.Contains(t, probes["Hostname"], `[ "$(cat /etc/hostname)" = 'web.example.com' ] || { echo '/etc/hostname is not web.example.com' >&2; probe_failed=1; }`)
+	assert.Contains(t, probes["Groups"], `[ "$(getent group 'developers' | cut -d: -f3)" = 1000 ]`)
+	assert.Contains(t, probes["Users"], `getent passwd 'admin' > /dev/null`)
+	assert.Contains(t, probes["Users"], `[ "$(getent passwd 'admin' | cut -d: -f7)" = '/bin/zsh' ]`)
+	assert.Contains(t, probes["Users"], `id -nG 'admin' | tr ' ' '\n' | grep -qx 'wheel'`)
+	assert.Contains(t, probes["Firewall"], "firewall-offline-cmd --query-port=8080/tcp")
+	assert.Contains(t, probes["Firewall"], "firewall-offline-cmd --query-service=http")
+	assert.Contains(t, probes["Services"], "systemctl is-enabled --quiet nginx")
+	assert.Contains(t, probes["Services"], `[ "$(systemctl is-enabled telnet 2>/dev/null || true)" != enabled ]`)
+	assert.Contains(t, probes["Services"], `[ "$(systemctl is-enabled rpcbind 2>/dev/null || true)" = masked ]`)
+	assert.Contains(t, probes["Default Target"], `[ "$(systemctl get-default)" = 'multi-user.target' ]`)
+	assert.Empty(t, probes["Cleanup DNF Cache"])
+}
+
+func TestProbeBlock(t *testing.T) {
+	discardLogs(t)
+	header := "#!/bin/sh\nset -euf\n"
+
+	block := NamedCommandBlock{Name: "Hostname", Probes: probeScript([]string{probe("true", "not shown")})}
+	assert.NoError(t, probeBlock(header, block, logger, applyOptions{}))
+
+	// Every probe runs, and the failed ones are reported
+	block.Probes = probeScript([]string{
+		probe("false", "/etc/hostname is not web"),
+		probe("true", "not shown"),
+		probe("[ a = b ]", "a is not b"),
+	})
+	err := probeBlock(header, block, logger, applyOptions{})
+	assert.EqualError(t, err, "block 'Hostname' succeeded, but verifying it failed:\n/etc/hostname is not web\na is not b")
+}
+
+func TestApplyBlocksVerify(t *testing.T) {
+	discardLogs(t)
+	header := "#!/bin/sh\nset -euf\n"
+	blocks := []NamedCommandBlock{
+		{Name: "Hostname", Commands: "true", Probes: probeScript([]string{probe("false", "/etc/hostname is not web")})},
+		{Name: "Timezone", Commands: "true"},
+	}
+
+	applied, failed, err := applyBlocks(header, blocks, applyOptions{ContinueOnError: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Hostname", "Timezone"}, applied)
+	assert.Empty(t, failed)
+
+	applied, failed, err = applyBlocks(header, blocks, applyOptions{ContinueOnError: true, Verify: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Timezone"}, applied)
+	assert.Equal(t, []string{"Hostname"}, failed)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// blueprintProfiles is set by --profile, the active profiles of the blueprints
+var blueprintProfiles []string
+
+// profileActive returns whether an entry tagged with the profiles is kept: unless one
+// of the profiles it is excluded from with !NAME is active, if it has no other
+// profiles or one of them is active.
+func profileActive(profiles []string) bool {
+	tagged := false
+	for _, profile := range profiles {
+		if name, ok := strings.CutPrefix(profile, "!"); ok {
+			if slices.Contains(blueprintProfiles, name) {
+				return false
+			}
+			continue
+		}
+		tagged = true
+	}
+	if !tagged {
+		return true
+	}
+	for _, profile := range profiles {
+		if slices.Contains(blueprintProfiles, profile) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterProfiles removes the tables of the decoded blueprint tagged with profiles,
+// e.g. profiles = ["debug"] on a user or a package, that are not active with
+// --profile, and the profiles keys of the others, so that variants like dev and prod
+// can share one blueprint. It returns whether v itself is kept.
+func filterProfiles(key string, v interface{}) (interface{}, bool, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if raw, ok := v["profiles"]; ok {
+			list, ok := raw.([]interface{})
+			if !ok {
+				return nil, false, fmt.Errorf("%s: profiles must be a list of profile names", profileKey(key))
+			}
+			profiles := make([]string, len(list))
+			for i, profile := range list {
+				if profiles[i], ok = profile.(string); !ok || profiles[i] == "" {
+					return nil, false, fmt.Errorf("%s: profiles must be a list of profile names", profileKey(key))
+				}
+			}
+			if !profileActive(profiles) {
+				return nil, false, nil
+			}
+			delete(v, "profiles")
+		}
+		for k, value := range v {
+			childKey := k
+			if key != "" {
+				childKey = key + "." + k
+			}
+			filtered, keep, err := filterProfiles(childKey, value)
+			if err != nil {
+				return nil, false, err
+			}
+			if keep {
+				v[k] = filtered
+			} else {
+				delete(v, k)
+			}
+		}
+		return v, true, nil
+	case []interface{}:
+		kept := v[:0]
+		for _, value := range v {
+			filtered, keep, err := filterProfiles(key, value)
+			if err != nil {
+				return nil, false, err
+			}
+			if keep {
+				kept = append(kept, filtered)
+			}
+		}
+		return kept, true, nil
+	}
+	return v, true, nil
+}
+
+// profileKey returns the key of the profiles of the table at key.
+func profileKey(key string) string {
+	if key == "" {
+		return "profiles"
+	}
+	return key + ".profiles"
+}
+
+// hasProfiles returns whether a table of the decoded blueprint is tagged with profiles.
+func hasProfiles(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if _, ok := v["profiles"]; ok {
+			return true
+		}
+		for _, value := range v {
+			if hasProfiles(value) {
+				return true
+			}
+		}
+	case []interface{}:
+		return slices.ContainsFunc(v, hasProfiles)
+	}
+	return false
+}
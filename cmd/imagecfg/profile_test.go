@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfileActive(t *testing.T) {
+	oldProfiles := blueprintProfiles
+	t.Cleanup(func() { blueprintProfiles = oldProfiles })
+
+	blueprintProfiles = nil
+	assert.False(t, profileActive([]string{"debug"}))
+	assert.True(t, profileActive([]string{"!prod"}))
+
+	blueprintProfiles = []string{"debug"}
+	assert.True(t, profileActive([]string{"debug"}))
+	assert.True(t, profileActive([]string{"dev", "debug"}))
+	assert.False(t, profileActive([]string{"dev"}))
+	assert.False(t, profileActive([]string{"debug", "!debug"}))
+
+	blueprintProfiles = []string{"prod"}
+	assert.False(t, profileActive([]string{"!prod"}))
+}
+
+func TestLoadBlueprintProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+[[packages]]
+name = "nginx"
+
+[[packages]]
+name = "gdb"
+profiles = ["debug"]
+
+[customizations]
+hostname = "web1"
+
+[[customizations.user]]
+name = "admin"
+
+[[customizations.user]]
+name = "dev"
+profiles = ["debug", "dev"]
+
+[customizations.sshd]
+profiles = ["!prod"]
+password_authentication = true
+`), 0644))
+	oldProfiles := blueprintProfiles
+	t.Cleanup(func() { blueprintProfiles = oldProfiles })
+
+	blueprintProfiles = nil
+	bp, err := loadBlueprint([]string{path})
+	require.NoError(t, err)
+	require.Len(t, bp.Packages, 1)
+	assert.Equal(t, "nginx", bp.Packages[0].Name)
+	require.Len(t, bp.Customizations.User, 1)
+	assert.NotNil(t, bp.Extensions.SSHD)
+
+	blueprintProfiles = []string{"debug", "prod"}
+	bp, err = loadBlueprint([]string{path})
+	require.NoError(t, err)
+	require.Len(t, bp.Packages, 2)
+	require.Len(t, bp.Customizations.User, 2)
+	assert.Nil(t, bp.Extensions.SSHD)
+
+	data, format, _, err := readBlueprints([]string{path})
+	require.NoError(t, err)
+	assert.Equal(t, "toml", format)
+	assert.NotContains(t, string(data), "profiles")
+
+	require.NoError(t, os.WriteFile(path, []byte("[[packages]]\nname = \"gdb\"\nprofiles = \"debug\"\n"), 0644))
+	_, err = loadBlueprint([]string{path})
+	assert.EqualError(t, err, "error selecting profiles of "+path+": packages.profiles: profiles must be a list of profile names")
+}
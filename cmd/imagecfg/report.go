@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// applyReportPath and applyReportJUnit are set by --report and --report-junit, the
+// files apply writes its results to as JSON and as JUnit XML
+var (
+	applyReportPath  string
+	applyReportJUnit string
+)
+
+// Statuses of the blocks in the report
+const (
+	reportApplied   = "applied"
+	reportFailed    = "failed"
+	reportSkipped   = "skipped"
+	reportUnchanged = "unchanged"
+	reportNotRun    = "not run"
+)
+
+// applyReport is the result of an apply, for CI systems
+type applyReport struct {
+	mu sync.Mutex
+	// Blueprint is the path of the applied blueprint
+	Blueprint string `json:"blueprint"`
+	// StartedAt is when apply started applying the blocks
+	StartedAt time.Time `json:"started_at"`
+	// Duration is how long it took in seconds
+	Duration float64 `json:"duration_seconds"`
+	// RolledBack is whether the applied blocks were rolled back after a failure
+	RolledBack bool           `json:"rolled_back,omitempty"`
+	Blocks     []*blockReport `json:"blocks"`
+}
+
+// blockReport is the result of a block
+type blockReport struct {
+	Name string `json:"name"`
+	// Fields are the blueprint keys the block was generated from
+	Fields   []string `json:"fields"`
+	Status   string   `json:"status"`
+	Duration float64  `json:"duration_seconds"`
+	// Stdout and Stderr are the end of the output of the last run of the block
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	Error  string `json:"error,omitempty"`
+}
+
+// newApplyReport returns the report of applying the blocks of the blueprint at path,
+// none of them run yet.
+func newApplyReport(path string, blocks []NamedCommandBlock) *applyReport {
+	r := &applyReport{Blueprint: path, StartedAt: time.Now(), Blocks: []*blockReport{}}
+	for _, block := range blocks {
+		if strings.TrimSpace(block.Commands) == "" {
+			continue
+		}
+		fields := block.Fields
+		if fields == nil {
+			fields = []string{}
+		}
+		r.Blocks = append(r.Blocks, &blockReport{Name: block.Name, Fields: fields, Status: reportNotRun})
+	}
+	return r
+}
+
+// block returns the report of the block with the name, nil if there is none.
+func (r *applyReport) block(name string) *blockReport {
+	for _, b := range r.Blocks {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// finish records the status of a block, with how long it ran and why it failed. It
+// does nothing on a nil report, like the other methods recording results.
+func (r *applyReport) finish(name, status string, duration time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b := r.block(name); b != nil {
+		b.Status = status
+		b.Duration = duration.Seconds()
+		if err != nil {
+			b.Error = err.Error()
+		}
+	}
+}
+
+// output records the output of a run of a block.
+func (r *applyReport) output(name string, stdout, stderr []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b := r.block(name); b != nil {
+		b.Stdout, b.Stderr = string(stdout), string(stderr)
+	}
+}
+
+// Write writes the report as JSON to jsonPath and as JUnit XML to junitPath, if they
+// are set.
+func (r *applyReport) Write(jsonPath, junitPath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Duration = time.Since(r.StartedAt).Seconds()
+	if jsonPath != "" {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error writing report: %w", err)
+		}
+		if err := os.WriteFile(jsonPath, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("error writing report: %w", err)
+		}
+	}
+	if junitPath != "" {
+		data, err := xml.MarshalIndent(r.junit(), "", "  ")
+		if err != nil {
+			return fmt.Errorf("error writing JUnit report: %w", err)
+		}
+		if err := os.WriteFile(junitPath, append([]byte(xml.Header), append(data, '\n')...), 0644); err != nil {
+			return fmt.Errorf("error writing JUnit report: %w", err)
+		}
+	}
+	return nil
+}
+
+// JUnit XML, with a test suite for the apply and a test case for every block
+type (
+	junitTestSuites struct {
+		XMLName xml.Name         `xml:"testsuites"`
+		Suites  []junitTestSuite `xml:"testsuite"`
+	}
+	junitTestSuite struct {
+		Name      string          `xml:"name,attr"`
+		Tests     int             `xml:"tests,attr"`
+		Failures  int             `xml:"failures,attr"`
+		Skipped   int             `xml:"skipped,attr"`
+		Time      string          `xml:"time,attr"`
+		Timestamp string          `xml:"timestamp,attr"`
+		Cases     []junitTestCase `xml:"testcase"`
+	}
+	junitTestCase struct {
+		Name       string           `xml:"name,attr"`
+		Classname  string           `xml:"classname,attr"`
+		Time       string           `xml:"time,attr"`
+		Properties *junitProperties `xml:"properties,omitempty"`
+		Failure    *junitMessage    `xml:"failure,omitempty"`
+		Skipped    *junitMessage    `xml:"skipped,omitempty"`
+		SystemOut  string           `xml:"system-out,omitempty"`
+		SystemErr  string           `xml:"system-err,omitempty"`
+	}
+	junitProperties struct {
+		Properties []junitProperty `xml:"property"`
+	}
+	junitProperty struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	}
+	junitMessage struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	}
+)
+
+// junit returns the report as JUnit test suites. Blocks that were skipped, unchanged
+// or not run are skipped test cases, with the blueprint fields of every block as a
+// property.
+func (r *applyReport) junit() junitTestSuites {
+	suite := junitTestSuite{
+		Name:      "imagecfg apply " + r.Blueprint,
+		Tests:     len(r.Blocks),
+		Time:      fmt.Sprintf("%.3f", r.Duration),
+		Timestamp: r.StartedAt.UTC().Format(time.RFC3339),
+	}
+	for _, b := range r.Blocks {
+		tc := junitTestCase{
+			Name:      b.Name,
+			Classname: "imagecfg." + blockSlug(b.Name),
+			Time:      fmt.Sprintf("%.3f", b.Duration),
+			SystemOut: b.Stdout,
+			SystemErr: b.Stderr,
+		}
+		if len(b.Fields) > 0 {
+			tc.Properties = &junitProperties{[]junitProperty{{Name: "fields", Value: strings.Join(b.Fields, ", ")}}}
+		}
+		switch b.Status {
+		case reportFailed:
+			suite.Failures++
+			tc.Failure = &junitMessage{Message: b.Error, Text: b.Stderr}
+		case reportSkipped, reportUnchanged, reportNotRun:
+			suite.Skipped++
+			message := b.Status
+			if b.Error != "" {
+				message = b.Error
+			}
+			tc.Skipped = &junitMessage{Message: message}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	return junitTestSuites{Suites: []junitTestSuite{suite}}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyReport(t *testing.T) {
+	discardLogs(t)
+	blocks := []NamedCommandBlock{
+		{Name: "Hostname", Commands: "echo setting the hostname", Fields: []string{"customizations.hostname"}},
+		{Name: "Groups", Commands: "echo no such group >&2; exit 3", Fields: []string{"customizations.group"}},
+		{Name: "Users", Commands: "echo adding users", Fields: []string{"customizations.user"}},
+		{Name: "Timezone", Commands: "", Fields: []string{"customizations.timezone"}},
+		{Name: "Services", Commands: "echo enabling services"},
+	}
+	report := newApplyReport("config.toml", blocks)
+	report.finish("Services", reportUnchanged, 0, nil)
+	_, _, err := applyBlocks("#!/bin/bash", blocks[:3], applyOptions{Quiet: true, ContinueOnError: true, Report: report})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	jsonPath, junitPath := filepath.Join(dir, "report.json"), filepath.Join(dir, "report.xml")
+	require.NoError(t, report.Write(jsonPath, junitPath))
+
+	data, err := os.ReadFile(jsonPath)
+	require.NoError(t, err)
+	var written struct {
+		Blueprint string        `json:"blueprint"`
+		Blocks    []blockReport `json:"blocks"`
+	}
+	require.NoError(t, json.Unmarshal(data, &written))
+	assert.Equal(t, "config.toml", written.Blueprint)
+	require.Len(t, written.Blocks, 4)
+	assert.Equal(t, "Hostname", written.Blocks[0].Name)
+	assert.Equal(t, reportApplied, written.Blocks[0].Status)
+	assert.Equal(t, []string{"customizations.hostname"}, written.Blocks[0].Fields)
+	assert.Equal(t, "setting the hostname\n", written.Blocks[0].Stdout)
+	assert.Equal(t, reportFailed, written.Blocks[1].Status)
+	assert.Equal(t, "no such group\n", written.Blocks[1].Stderr)
+	assert.Contains(t, written.Blocks[1].Error, "execution failed for block 'Groups'")
+	assert.Equal(t, reportSkipped, written.Blocks[2].Status)
+	assert.Equal(t, "block 'Groups' it depends on failed", written.Blocks[2].Error)
+	assert.Equal(t, reportUnchanged, written.Blocks[3].Status)
+	assert.Equal(t, []string{}, written.Blocks[3].Fields)
+
+	data, err = os.ReadFile(junitPath)
+	require.NoError(t, err)
+	var suites junitTestSuites
+	require.NoError(t, xml.Unmarshal(data, &suites))
+	require.Len(t, suites.Suites, 1)
+	suite := suites.Suites[0]
+	assert.Equal(t, 4, suite.Tests)
+	assert.Equal(t, 1, suite.Failures)
+	assert.Equal(t, 2, suite.Skipped)
+	assert.Equal(t, "imagecfg.groups", suite.Cases[1].Classname)
+	require.NotNil(t, suite.Cases[1].Failure)
+	assert.Equal(t, "no such group\n", suite.Cases[1].Failure.Text)
+	assert.Nil(t, suite.Cases[0].Failure)
+	assert.Equal(t, "setting the hostname\n", suite.Cases[0].SystemOut)
+	assert.Equal(t, []junitProperty{{Name: "fields", Value: "customizations.hostname"}}, suite.Cases[0].Properties.Properties)
+	assert.Equal(t, "unchanged", suite.Cases[3].Skipped.Message)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// applyRetries and applyRetryDelay are set by --retries and --retry-delay, how often
+// blocks failing transiently are run again and how long apply waits before the first
+// retry
+var (
+	applyRetries    int
+	applyRetryDelay time.Duration
+)
+
+// retryTools are the tools whose failures may be transient: they download packages
+// and containers or talk to a server
+var retryTools = []string{"dnf", "flatpak", "pip", "podman", "realm", "ipa-client-install", "subscription-manager", "rhc"}
+
+// transientFailureRegexp matches the output of network and lock failures, which may
+// not happen again. Other failures, like unknown packages or dependency problems, are
+// fatal.
+var transientFailureRegexp = regexp.MustCompile(`(?i)curl error|cannot download|failed to download|` +
+	`failed to synchronize cache|could not resolve host|temporary failure in name resolution|` +
+	`connection (refused|reset|timed out)|timeout was reached|operation timed out|` +
+	`network is unreachable|no route to host|could not connect|unable to reach the server|` +
+	`max retries exceeded|read timed out|status code: (429|5\d\d)|too many requests|` +
+	`service unavailable|bad gateway|waiting for process with pid`)
+
+// failureTailSize is how much of the end of its output is kept of a block to tell
+// whether it failed transiently
+const failureTailSize = 64 * 1024
+
+// tailBuffer keeps the last max bytes written to it, from several writers at once
+type tailBuffer struct {
+	mu   sync.Mutex
+	max  int
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data = append(b.data, p...)
+	if len(b.data) > b.max {
+		b.data = b.data[len(b.data)-b.max:]
+	}
+	return len(p), nil
+}
+
+// Bytes returns the kept output.
+func (b *tailBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.data...)
+}
+
+// blockFailure is the error of a block whose commands failed
+type blockFailure struct {
+	err error
+	// output is the end of the output of the block
+	output []byte
+	// timedOut is set if the block was stopped for running too long
+	timedOut bool
+}
+
+func (f *blockFailure) Error() string { return f.err.Error() }
+
+func (f *blockFailure) Unwrap() error { return f.err }
+
+// transientFailure returns whether the block may succeed if it runs again: it calls
+// one of retryTools and either timed out or failed with the output of a network or lock
+// failure.
+func transientFailure(block NamedCommandBlock, err error) bool {
+	var failure *blockFailure
+	if !errors.As(err, &failure) {
+		return false
+	}
+	retryable := false
+	for _, tool := range retryTools {
+		retryable = retryable || toolRegexp(tool).MatchString(block.Commands)
+	}
+	return retryable && (failure.timedOut || transientFailureRegexp.Match(failure.output))
+}
+
+// runBlockWithRetries runs a block like runBlock, and runs it again up to opts.Retries
+// times while it fails transiently, waiting opts.RetryDelay before the first retry and
+// twice as long before every further one.
+func runBlockWithRetries(header string, block NamedCommandBlock, log *slog.Logger, opts applyOptions) error {
+	delay := opts.RetryDelay
+	for attempt := 1; ; attempt++ {
+		err := runBlock(header, block, log, opts)
+		if err == nil || attempt > opts.Retries {
+			return err
+		}
+		if !transientFailure(block, err) {
+			log.Debug("block failure is not transient, not retrying", "error", err)
+			return err
+		}
+		log.Warn("block failed transiently, retrying", "attempt", attempt, "retries", opts.Retries, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransientFailure(t *testing.T) {
+	packages := NamedCommandBlock{Name: "Packages", Commands: "dnf install -y nginx"}
+	users := NamedCommandBlock{Name: "Users", Commands: "useradd admin"}
+	failure := func(output string) error {
+		return &blockFailure{err: errors.New("execution failed"), output: []byte(output)}
+	}
+
+	assert.True(t, transientFailure(packages, failure("Curl error (6): Couldn't resolve host name for https://mirrors.fedoraproject.org [Could not resolve host: mirrors.fedoraproject.org]")))
+	assert.True(t, transientFailure(packages, failure("Error: Failed to download metadata for repo 'updates'")))
+	assert.True(t, transientFailure(packages, &blockFailure{err: errors.New("timed out"), timedOut: true}))
+	assert.True(t, transientFailure(NamedCommandBlock{Name: "Pip", Commands: "python3 -m pip install requests"}, failure("ReadTimeoutError: Read timed out.")))
+	// Unknown packages stay unknown
+	assert.False(t, transientFailure(packages, failure("No match for argument: ngnix\nError: Unable to find a match: ngnix")))
+	// Blocks talking to no server fail for good
+	assert.False(t, transientFailure(users, failure("Connection refused")))
+	assert.False(t, transientFailure(packages, errors.New("error creating temporary script")))
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := &tailBuffer{max: 8}
+	_, _ = b.Write([]byte("0123"))
+	_, _ = b.Write([]byte("456789"))
+	assert.Equal(t, "23456789", string(b.Bytes()))
+}
+
+func TestRunBlockWithRetries(t *testing.T) {
+	discardLogs(t)
+	// The output of the failed runs goes to the discarded log
+	oldFormat := logFormat
+	logFormat = "json"
+	t.Cleanup(func() { logFormat = oldFormat })
+	count := filepath.Join(t.TempDir(), "count")
+	// dnf fails with a network error the first two times
+	block := NamedCommandBlock{Name: "Packages", Commands: `dnf() {
+  n=$(cat '` + count + `' 2>/dev/null || echo 0)
+  echo $((n + 1)) > '` + count + `'
+  [ "$n" -ge 2 ] || { echo 'Curl error (7): Failed to connect: Connection refused' >&2; return 1; }
+}
+dnf install -y nginx`}
+	opts := applyOptions{Retries: 1, RetryDelay: time.Millisecond}
+
+	err := runBlockWithRetries("#!/bin/sh\nset -eu\n", block, logger, opts)
+	assert.EqualError(t, err, "execution failed for block 'Packages': exit status 1")
+	data, _ := os.ReadFile(count)
+	assert.Equal(t, "2\n", string(data))
+
+	require.NoError(t, os.Remove(count))
+	opts.Retries = 3
+	require.NoError(t, runBlockWithRetries("#!/bin/sh\nset -eu\n", block, logger, opts))
+	data, _ = os.ReadFile(count)
+	assert.Equal(t, "3\n", string(data))
+
+	// Fatal failures are not retried
+	require.NoError(t, os.Remove(count))
+	block.Commands = "dnf() { echo 1 >> '" + count + "'; echo 'No match for argument: ngnix' >&2; return 1; }\ndnf install -y ngnix"
+	assert.Error(t, runBlockWithRetries("#!/bin/sh\nset -eu\n", block, logger, opts))
+	data, _ = os.ReadFile(count)
+	assert.Equal(t, "1\n", string(data))
+}
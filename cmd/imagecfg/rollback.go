@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// applyRollback is set by --rollback, apply then restores the files changed by the
+// applied blocks when a block fails
+var applyRollback bool
+
+// toolStateFiles are the files the tools change that the commands of a block do not
+// name
+var toolStateFiles = map[string][]string{
+	"useradd":              {"/etc/passwd", "/etc/shadow", "/etc/group", "/etc/gshadow", "/etc/subuid", "/etc/subgid"},
+	"usermod":              {"/etc/passwd", "/etc/shadow", "/etc/group", "/etc/gshadow"},
+	"groupadd":             {"/etc/group", "/etc/gshadow"},
+	"chpasswd":             {"/etc/shadow"},
+	"firewall-offline-cmd": {"/etc/firewalld"},
+	"systemctl":            {"/etc/systemd/system"},
+	"timedatectl":          {"/etc/localtime"},
+	"hostnamectl":          {"/etc/hostname", "/etc/machine-info"},
+	"localectl":            {"/etc/locale.conf", "/etc/vconsole.conf", "/etc/X11/xorg.conf.d"},
+	"dconf":                {"/etc/dconf/db"},
+	"systemd-sysusers":     {"/etc/passwd", "/etc/shadow", "/etc/group", "/etc/gshadow"},
+}
+
+// rollbackSkipped are the trees whose paths are never saved: packages and pseudo
+// file systems are not rolled back, /usr/local is
+var rollbackSkipped = []string{"/dev", "/proc", "/sys", "/run", "/tmp", "/usr"}
+
+// rollbackKept are the trees under rollbackSkipped whose paths are saved
+var rollbackKept = []string{"/usr/local"}
+
+// rollbackCopied is the tree whose existing files are copied before blocks change
+// them. Elsewhere, home directories, swap files and mounts are too large to copy and
+// only the paths that blocks create are removed again.
+const rollbackCopied = "/etc"
+
+// quotedPathRegexp matches arguments that are a quoted absolute path, not a quoted sed
+// script like '/^KEY=/d'
+var quotedPathRegexp = regexp.MustCompile(`'(/[^'\s^]*)'`)
+
+// barePathRegexp matches unquoted absolute paths
+var barePathRegexp = regexp.MustCompile(`(^|[\s=>(])(/[\w.@+-][^\s;&|()'"<>]*)`)
+
+// doubleQuotedRegexp matches double quoted strings, sed scripts in the commands
+var doubleQuotedRegexp = regexp.MustCompile(`"(\\.|[^"\\])*"`)
+
+// blockPaths returns the files and directories the commands of a block may change:
+// the paths they name and the files of the tools they run.
+func blockPaths(commands string) []string {
+	var paths []string
+	add := func(path string) {
+		path = filepath.Clean(path)
+		for _, kept := range rollbackKept {
+			if path == kept || strings.HasPrefix(path, kept+"/") {
+				if !slices.Contains(paths, path) {
+					paths = append(paths, path)
+				}
+				return
+			}
+		}
+		for _, skipped := range rollbackSkipped {
+			if path == skipped || strings.HasPrefix(path, skipped+"/") {
+				return
+			}
+		}
+		if path != "/" && !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	for _, path := range commandPaths(commands) {
+		add(path)
+	}
+	for _, tool := range doctorTools {
+		if toolRegexp(tool).MatchString(commands) {
+			for _, path := range toolStateFiles[tool] {
+				add(path)
+			}
+		}
+	}
+	return paths
+}
+
+// commandPaths returns the absolute paths the commands name, quoted or not.
+func commandPaths(commands string) []string {
+	var paths []string
+	for _, m := range quotedPathRegexp.FindAllStringSubmatch(commands, -1) {
+		paths = append(paths, m[1])
+	}
+	// Paths in other quoted strings are file contents or sed scripts
+	unquoted := doubleQuotedRegexp.ReplaceAllString(quotedRegexp.ReplaceAllString(commands, "''"), `""`)
+	for _, m := range barePathRegexp.FindAllStringSubmatch(unquoted, -1) {
+		paths = append(paths, m[2])
+	}
+	return paths
+}
+
+// savedPath is a path as it was before the first block changing it
+type savedPath struct {
+	Path string
+	// Backup is the copy of the path, empty if it did not exist
+	Backup string
+}
+
+// fileSnapshot saves files and directories before blocks change them, so that they can
+// be restored if a later block fails
+type fileSnapshot struct {
+	root  string
+	dir   string
+	saved []savedPath
+}
+
+// newFileSnapshot returns an empty snapshot of the system with its files at root.
+func newFileSnapshot(root string) (*fileSnapshot, error) {
+	dir, err := os.MkdirTemp("", "imagecfg-rollback-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating rollback directory: %w", err)
+	}
+	return &fileSnapshot{root: root, dir: dir}, nil
+}
+
+// covered returns whether the path is saved already, itself or by a parent.
+func (s *fileSnapshot) covered(path string) bool {
+	for _, saved := range s.saved {
+		if path == saved.Path || strings.HasPrefix(path, strings.TrimSuffix(saved.Path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Save saves the paths that are not saved yet. Paths that do not exist are saved as
+// their topmost missing parent, so that restoring removes the directories created
+// for them as well. Existing paths are only saved under rollbackCopied.
+func (s *fileSnapshot) Save(paths []string) error {
+	for _, path := range paths {
+		if _, err := os.Lstat(filepath.Join(s.root, path)); errors.Is(err, fs.ErrNotExist) {
+			for parent := filepath.Dir(path); parent != "/"; parent = filepath.Dir(parent) {
+				if _, err := os.Lstat(filepath.Join(s.root, parent)); err == nil {
+					break
+				}
+				path = parent
+			}
+			if !s.covered(path) {
+				s.saved = append(s.saved, savedPath{Path: path})
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error saving %s: %w", path, err)
+		}
+		if s.covered(path) || !strings.HasPrefix(path, rollbackCopied+"/") {
+			continue
+		}
+		backup := filepath.Join(s.dir, strconv.Itoa(len(s.saved)))
+		if err := copyTree(filepath.Join(s.root, path), backup); err != nil {
+			return fmt.Errorf("error saving %s: %w", path, err)
+		}
+		s.saved = append(s.saved, savedPath{Path: path, Backup: backup})
+	}
+	return nil
+}
+
+// Restore restores the saved paths as they were, the last saved first, and returns the
+// restored paths.
+func (s *fileSnapshot) Restore() ([]string, error) {
+	var restored []string
+	var errs []error
+	for i := len(s.saved) - 1; i >= 0; i-- {
+		saved := s.saved[i]
+		target := filepath.Join(s.root, saved.Path)
+		if saved.Backup == "" && isMountPoint(target) {
+			// Blocks create mount points, what is mounted on them is no state of theirs
+			continue
+		}
+		if err := os.RemoveAll(target); err != nil {
+			errs = append(errs, fmt.Errorf("error restoring %s: %w", saved.Path, err))
+			continue
+		}
+		if saved.Backup != "" {
+			if err := copyTree(saved.Backup, target); err != nil {
+				errs = append(errs, fmt.Errorf("error restoring %s: %w", saved.Path, err))
+				continue
+			}
+		}
+		restored = append(restored, saved.Path)
+	}
+	return restored, errors.Join(errs...)
+}
+
+// isMountPoint returns whether a file system is mounted at path.
+func isMountPoint(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	parent, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	parentStat, parentOK := parent.Sys().(*syscall.Stat_t)
+	return ok && parentOK && stat.Dev != parentStat.Dev
+}
+
+// Remove removes the saved copies.
+func (s *fileSnapshot) Remove() error {
+	return os.RemoveAll(s.dir)
+}
+
+// copyTree copies the file, symlink or directory at src to dst, with its mode,
+// owner and modification time.
+func copyTree(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+	case info.IsDir():
+		if err := os.Mkdir(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyTree(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+	case info.Mode().IsRegular():
+		if err := copyFile(src, dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	default:
+		// Sockets and devices are recreated by whatever created them
+		return nil
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		// Only root can give files away, and only root can apply blueprints
+		if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		// Mkdir and OpenFile apply the umask, and chown clears setuid bits
+		if err := os.Chmod(dst, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+			return err
+		}
+		return os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// copyFile copies the regular file at src to a new file at dst.
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
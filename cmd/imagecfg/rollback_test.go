@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockPaths(t *testing.T) {
+	commands := "mkdir -p '/etc/myapp' && printf '%s' 'path=/var/lib/x\n' > '/etc/myapp/config'\n" +
+		"sed -i \"/^LANG=/d\" /etc/environment && echo 'LANG=C' >> /etc/environment\n" +
+		"getent passwd admin >/dev/null || useradd -m admin\n" +
+		"python3 -m venv /opt/tools && /opt/tools/bin/pip install requests 2>&1\n" +
+		"ln -sf /usr/share/zoneinfo/UTC /etc/localtime && touch /usr/local/etc/x"
+	assert.Equal(t, []string{
+		"/etc/myapp", "/etc/myapp/config", "/etc/environment", "/opt/tools", "/opt/tools/bin/pip",
+		"/etc/localtime", "/usr/local/etc/x",
+		"/etc/passwd", "/etc/shadow", "/etc/group", "/etc/gshadow", "/etc/subuid", "/etc/subgid",
+	}, blockPaths(commands))
+}
+
+func TestFileSnapshot(t *testing.T) {
+	root := t.TempDir()
+	write := func(path, content string, perm os.FileMode) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, path), []byte(content), perm))
+	}
+	read := func(path string) string {
+		data, err := os.ReadFile(filepath.Join(root, path))
+		require.NoError(t, err)
+		return string(data)
+	}
+	write("etc/environment", "EDITOR=vi\n", 0600)
+	write("etc/sudoers.d/old", "old\n", 0440)
+	write("var/lib/data", "data\n", 0644)
+	require.NoError(t, os.Symlink("../usr/share/zoneinfo/UTC", filepath.Join(root, "etc/localtime")))
+
+	snapshot, err := newFileSnapshot(root)
+	require.NoError(t, err)
+	defer snapshot.Remove()
+
+	// The first block
+	require.NoError(t, snapshot.Save([]string{"/etc/environment", "/etc/sudoers.d", "/etc/localtime", "/etc/myapp/conf.d/app.conf"}))
+	write("etc/environment", "EDITOR=vim\n", 0644)
+	write("etc/sudoers.d/new", "new\n", 0440)
+	require.NoError(t, os.Remove(filepath.Join(root, "etc/sudoers.d/old")))
+	require.NoError(t, os.Remove(filepath.Join(root, "etc/localtime")))
+	write("etc/myapp/conf.d/app.conf", "x\n", 0644)
+
+	// The second block, changed files keep the state from before the first
+	require.NoError(t, snapshot.Save([]string{"/etc/environment", "/etc/myapp/conf.d/app.conf", "/opt/tools", "/var/lib/data"}))
+	write("etc/environment", "EDITOR=nano\n", 0644)
+	write("opt/tools/bin/python", "", 0755)
+	write("var/lib/data", "changed\n", 0644)
+
+	restored, err := snapshot.Restore()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/opt", "/etc/myapp", "/etc/localtime", "/etc/sudoers.d", "/etc/environment"}, restored)
+
+	assert.Equal(t, "EDITOR=vi\n", read("etc/environment"))
+	info, err := os.Stat(filepath.Join(root, "etc/environment"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.Equal(t, "old\n", read("etc/sudoers.d/old"))
+	assert.NoFileExists(t, filepath.Join(root, "etc/sudoers.d/new"))
+	target, err := os.Readlink(filepath.Join(root, "etc/localtime"))
+	require.NoError(t, err)
+	assert.Equal(t, "../usr/share/zoneinfo/UTC", target)
+	assert.NoDirExists(t, filepath.Join(root, "etc/myapp"))
+	assert.NoDirExists(t, filepath.Join(root, "opt"))
+	// Existing files outside of /etc are not saved
+	assert.Equal(t, "changed\n", read("var/lib/data"))
+}
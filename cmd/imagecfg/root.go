@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// applyRoot is set by --root, apply then applies the blueprint to the tree mounted there
+var applyRoot string
+
+// scriptShell returns the shell of the script with the header, from its #! line.
+func scriptShell(header string) string {
+	line, _, _ := strings.Cut(header, "\n")
+	if shell, ok := strings.CutPrefix(line, "#!"); ok && shell != "" {
+		return strings.Fields(shell)[0]
+	}
+	return "/bin/sh"
+}
+
+// rootChrootCmd returns a command running script with the shell in a chroot into root,
+// with the pseudo file systems of the host mounted in a private mount namespace, so
+// that nothing stays mounted in the tree. Tools like dnf, useradd and systemctl are
+// the ones of the tree, so that they work with its rpm database and configuration.
+func rootChrootCmd(root, shell, script string) *exec.Cmd {
+	mountAndRun := `mount --rbind /dev "$1/dev" && mount -t proc proc "$1/proc" && mount --rbind /sys "$1/sys" && ` +
+		// Package installs need name resolution, trees that link it into /run get none
+		`{ [ ! -f "$1/etc/resolv.conf" ] || [ -L "$1/etc/resolv.conf" ] || mount --bind /etc/resolv.conf "$1/etc/resolv.conf"; } && ` +
+		`exec chroot "$1" "$2" -c "$3"`
+	cmd := exec.Command("unshare", "--mount", "--propagation", "private", "/bin/sh", "-c", mountAndRun, "sh", root, shell, script)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
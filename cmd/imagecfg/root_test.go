@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScriptShell(t *testing.T) {
+	assert.Equal(t, "/bin/bash", scriptShell("#!/bin/bash\nset -euf -o pipefail\n\n"))
+	assert.Equal(t, "/bin/sh", scriptShell("#!/bin/sh\nset -euf\n\n"))
+	assert.Equal(t, "/usr/bin/env", scriptShell("#!/usr/bin/env bash\n"))
+	assert.Equal(t, "/bin/sh", scriptShell("set -eu\n"))
+}
+
+func TestRootChrootCmd(t *testing.T) {
+	cmd := rootChrootCmd("/mnt/image", "/bin/bash", "echo 'host' > /etc/hostname")
+	assert.Equal(t, []string{"unshare", "--mount", "--propagation", "private", "/bin/sh", "-c"}, cmd.Args[:6])
+	assert.Contains(t, cmd.Args[6], `mount --rbind /dev "$1/dev"`)
+	assert.Contains(t, cmd.Args[6], `exec chroot "$1" "$2" -c "$3"`)
+	assert.Equal(t, []string{"sh", "/mnt/image", "/bin/bash", "echo 'host' > /etc/hostname"}, cmd.Args[7:])
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// saltState is a single state declaration of a Salt SLS file
+type saltState struct {
+	ID       string
+	Function string
+	Args     []map[string]interface{}
+}
+
+var saltCmd = &cobra.Command{
+	Use:   "salt [blueprint.toml...]",
+	Short: "Translate an OSBuild blueprint to Salt states",
+	Long: `Translates an OSBuild blueprint (TOML format) into a SaltStack SLS file,
+so that the blueprint can stay the single source of truth in Salt managed
+environments.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+The packages, groups, users, SSH keys, timezone, firewall and services are
+translated into pkg, group, user, ssh_auth, timezone, firewalld and service
+states. All other configurations are run as the same bash blocks the 'bash'
+command generates, using cmd.run.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		sls, err := generateSaltStates(bp)
+		if err != nil {
+			return fmt.Errorf("error generating Salt states: %w", err)
+		}
+		fmt.Print(sls)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(saltCmd)
+}
+
+// saltStateID turns a block name into a state ID, e.g. "imagecfg-cleanup-dnf-cache".
+func saltStateID(name string) string {
+	return "imagecfg-" + blockSlug(name)
+}
+
+// saltPackageStates returns the states installing the blueprint packages.
+func saltPackageStates(bp *Blueprint) []saltState {
+	var pkgs []interface{}
+	for _, pkg := range slices.Concat(bp.Packages, bp.Modules) {
+		if pkg.Version == "" || pkg.Version == "*" {
+			pkgs = append(pkgs, pkg.Name)
+		} else {
+			pkgs = append(pkgs, map[string]string{pkg.Name: pkg.Version})
+		}
+	}
+	if kernel := bp.Customizations.GetKernel(); kernel.Name != "" {
+		pkgs = append(pkgs, kernel.Name)
+	}
+
+	var states []saltState
+	if len(pkgs) > 0 {
+		states = append(states, saltState{ID: "imagecfg-packages", Function: "pkg.installed", Args: []map[string]interface{}{{"pkgs": pkgs}}})
+	}
+	for _, group := range bp.Groups {
+		states = append(states, saltState{ID: "imagecfg-package-group-" + group.Name, Function: "pkg.group_installed", Args: []map[string]interface{}{{"name": group.Name}}})
+	}
+	return states
+}
+
+// saltUserStates returns the states creating the blueprint users and their SSH keys.
+func saltUserStates(bp *Blueprint) []saltState {
+	var states []saltState
+	for _, user := range bp.Customizations.GetUsers() {
+		args := []map[string]interface{}{{"name": user.Name}}
+		if user.UID != nil {
+			args = append(args, map[string]interface{}{"uid": *user.UID})
+		}
+		if user.GID != nil {
+			args = append(args, map[string]interface{}{"gid": *user.GID})
+		}
+		if len(user.Groups) > 0 {
+			// Keep the groups the user is in already
+			args = append(args, map[string]interface{}{"optional_groups": user.Groups})
+		}
+		if user.Description != nil {
+			args = append(args, map[string]interface{}{"fullname": *user.Description})
+		}
+		if user.Home != nil {
+			args = append(args, map[string]interface{}{"home": *user.Home})
+		}
+		if user.Shell != nil {
+			args = append(args, map[string]interface{}{"shell": *user.Shell})
+		}
+		if user.Password != nil && *user.Password != "" {
+			// The blueprint password is a crypt hash already
+			args = append(args, map[string]interface{}{"password": *user.Password}, map[string]interface{}{"hash_password": false})
+		}
+		states = append(states, saltState{ID: "imagecfg-user-" + user.Name, Function: "user.present", Args: args})
+
+		if user.Key != nil && *user.Key != "" {
+			var keys []string
+			for _, key := range strings.Split(strings.TrimSpace(*user.Key), "\n") {
+				if key = strings.TrimSpace(key); key != "" {
+					keys = append(keys, key)
+				}
+			}
+			states = append(states, saltState{
+				ID:       "imagecfg-ssh-keys-" + user.Name,
+				Function: "ssh_auth.present",
+				Args: []map[string]interface{}{
+					{"user": user.Name},
+					{"names": keys},
+					{"require": []map[string]string{{"user": "imagecfg-user-" + user.Name}}},
+				},
+			})
+		}
+	}
+	return states
+}
+
+// saltServiceStates returns the states enabling, disabling and masking the blueprint services.
+func saltServiceStates(bp *Blueprint) []saltState {
+	svc := bp.Customizations.GetServices()
+	if svc == nil {
+		return nil
+	}
+	var states []saltState
+	for _, name := range svc.Enabled {
+		states = append(states, saltState{ID: "imagecfg-service-" + name, Function: "service.running", Args: []map[string]interface{}{{"name": name}, {"enable": true}}})
+	}
+	for _, name := range svc.Disabled {
+		states = append(states, saltState{ID: "imagecfg-service-" + name, Function: "service.disabled", Args: []map[string]interface{}{{"name": name}}})
+	}
+	for _, name := range svc.Masked {
+		states = append(states, saltState{ID: "imagecfg-service-" + name, Function: "service.masked", Args: []map[string]interface{}{{"name": name}}})
+	}
+	return states
+}
+
+// generateSaltStates generates a Salt SLS file from the blueprint. The states are
+// in the order of the blocks they replace, which Salt keeps when applying them.
+func generateSaltStates(bp *Blueprint) (string, error) {
+	header, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return "", err
+	}
+
+	native := map[string]func() []saltState{
+		"Packages": func() []saltState { return saltPackageStates(bp) },
+		"Users":    func() []saltState { return saltUserStates(bp) },
+		"Services": func() []saltState { return saltServiceStates(bp) },
+		"Groups": func() []saltState {
+			var states []saltState
+			for _, group := range bp.Customizations.GetGroups() {
+				args := []map[string]interface{}{{"name": group.Name}}
+				if group.GID != nil {
+					args = append(args, map[string]interface{}{"gid": *group.GID})
+				}
+				states = append(states, saltState{ID: "imagecfg-group-" + group.Name, Function: "group.present", Args: args})
+			}
+			return states
+		},
+		"Timezone": func() []saltState {
+			timezone, _ := bp.Customizations.GetTimezoneSettings()
+			return []saltState{{ID: "imagecfg-timezone", Function: "timezone.system", Args: []map[string]interface{}{{"name": *timezone}}}}
+		},
+		"Firewall": func() []saltState {
+			fw := bp.Customizations.GetFirewall()
+			args := []map[string]interface{}{{"name": "public"}}
+			if len(fw.Ports) > 0 {
+				args = append(args, map[string]interface{}{"ports": fw.Ports}, map[string]interface{}{"prune_ports": false})
+			}
+			if fw.Services != nil && len(fw.Services.Enabled) > 0 {
+				args = append(args, map[string]interface{}{"services": fw.Services.Enabled}, map[string]interface{}{"prune_services": false})
+			}
+			return []saltState{{ID: "imagecfg-firewall", Function: "firewalld.present", Args: args}}
+		},
+	}
+
+	shellHeader := strings.TrimPrefix(header, "#!/bin/bash\n")
+	var states []saltState
+	for _, block := range namedBlocks {
+		if gen, ok := native[block.Name]; ok {
+			states = append(states, gen()...)
+			continue
+		}
+		states = append(states, saltState{
+			ID:       saltStateID(block.Name),
+			Function: "cmd.run",
+			Args: []map[string]interface{}{
+				{"name": shellHeader + block.Commands},
+				{"shell": "/bin/bash"},
+			},
+		})
+	}
+
+	var out strings.Builder
+	for i, state := range states {
+		data, err := yaml.Marshal(map[string]map[string][]map[string]interface{}{
+			state.ID: {state.Function: state.Args},
+		})
+		if err != nil {
+			return "", err
+		}
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		out.Write(data)
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestGenerateSaltStates(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[[packages]]
+name = "vim"
+
+[[packages]]
+name = "nginx"
+version = "1.24"
+
+[[customizations.group]]
+name = "app"
+gid = 2000
+
+[[customizations.user]]
+name = "admin"
+password = "$6$hash"
+key = "ssh-ed25519 AAAA admin@example.com"
+groups = ["wheel", "app"]
+
+[customizations.timezone]
+timezone = "Europe/Prague"
+
+[customizations.firewall]
+ports = ["8080/tcp"]
+
+[customizations.services]
+enabled = ["nginx"]
+masked = ["rpcbind"]
+
+[customizations.journald]
+storage = "persistent"
+`)
+	sls, err := generateSaltStates(bp)
+	require.NoError(t, err)
+
+	assert.Contains(t, sls, "imagecfg-packages:\n    pkg.installed:\n        - pkgs:\n            - vim\n            - nginx: \"1.24\"\n            - kernel\n")
+	assert.Contains(t, sls, "imagecfg-group-app:\n    group.present:\n        - name: app\n        - gid: 2000\n")
+	assert.Contains(t, sls, "imagecfg-user-admin:\n    user.present:\n        - name: admin\n        - optional_groups:\n            - wheel\n            - app\n        - password: $6$hash\n        - hash_password: false\n")
+	assert.Contains(t, sls, "        - require:\n            - user: imagecfg-user-admin\n")
+	assert.Contains(t, sls, "imagecfg-timezone:\n    timezone.system:\n        - name: Europe/Prague\n")
+	assert.Contains(t, sls, "imagecfg-firewall:\n    firewalld.present:\n        - name: public\n        - ports:\n            - 8080/tcp\n")
+	assert.Contains(t, sls, "imagecfg-service-nginx:\n    service.running:\n        - name: nginx\n        - enable: true\n")
+	assert.Contains(t, sls, "imagecfg-service-rpcbind:\n    service.masked:\n")
+
+	// Every state ID is unique and the SLS is valid YAML
+	var states map[string]map[string][]map[string]interface{}
+	require.NoError(t, yaml.Unmarshal([]byte(sls), &states))
+	journald := states["imagecfg-journald"]["cmd.run"]
+	require.Len(t, journald, 2)
+	assert.Contains(t, journald[0]["name"], "set -euf -o pipefail\n\n")
+	assert.Contains(t, journald[0]["name"], "journald.conf")
+	assert.Contains(t, states, "imagecfg-cleanup-dnf-cache")
+	assert.NotContains(t, sls, "dnf install")
+}
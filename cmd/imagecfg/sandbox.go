@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// applySystemdRun, applyPrivateTmp, applyProtectHome and applyProperties are set by
+// --systemd-run, --private-tmp, --protect-home and --property, apply then runs every
+// block as a transient service with these sandbox and resource control properties
+var (
+	applySystemdRun  bool
+	applyPrivateTmp  bool
+	applyProtectHome string
+	applyProperties  []string
+)
+
+// protectHomeValues are the values of --protect-home, as ProtectHome= takes them
+var protectHomeValues = []string{"yes", "no", "read-only", "tmpfs"}
+
+// sandboxScriptDir is where the scripts of the blocks are kept while they run as
+// services, outside of /tmp so that PrivateTmp does not hide them, a var so tests can
+// change it
+var sandboxScriptDir = "/run/imagecfg"
+
+// systemdSandbox runs the blocks with systemd-run
+type systemdSandbox struct {
+	// PrivateTmp gives the blocks their own /tmp and /var/tmp
+	PrivateTmp bool
+	// ProtectHome is the ProtectHome= of the blocks, no if it is empty
+	ProtectHome string
+	// Properties are further properties of the services, like MemoryMax=2G
+	Properties []string
+}
+
+// newSystemdSandbox checks the sandbox options and that systemd-run is there.
+func newSystemdSandbox(privateTmp bool, protectHome string, properties []string) (*systemdSandbox, error) {
+	if !slices.Contains(protectHomeValues, protectHome) {
+		return nil, fmt.Errorf("invalid --protect-home %q, must be one of: %s", protectHome, strings.Join(protectHomeValues, ", "))
+	}
+	for _, property := range properties {
+		if name, _, found := strings.Cut(property, "="); !found || name == "" {
+			return nil, fmt.Errorf("invalid property %q, must be NAME=VALUE, e.g. MemoryMax=2G", property)
+		}
+	}
+	if _, err := exec.LookPath("systemd-run"); err != nil {
+		return nil, fmt.Errorf("--systemd-run needs systemd-run: %w", err)
+	}
+	if err := os.MkdirAll(sandboxScriptDir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", sandboxScriptDir, err)
+	}
+	return &systemdSandbox{PrivateTmp: privateTmp, ProtectHome: protectHome, Properties: properties}, nil
+}
+
+// writesUnder returns whether the commands name a path under one of the dirs.
+func writesUnder(commands string, dirs ...string) bool {
+	for _, path := range commandPaths(commands) {
+		path = filepath.Clean(path)
+		for _, dir := range dirs {
+			if path == dir || strings.HasPrefix(path, dir+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// properties returns the properties of the service running the block. The sandbox is
+// relaxed for the blocks it would break: /tmp is not private for blocks writing files
+// there, and the home directories are not protected for blocks creating users or
+// writing files in them.
+func (s *systemdSandbox) properties(block NamedCommandBlock, timeout time.Duration) []string {
+	properties := []string{"Description=imagecfg: " + block.Name}
+	if s.PrivateTmp && !writesUnder(block.Commands, "/tmp", "/var/tmp") {
+		properties = append(properties, "PrivateTmp=yes")
+	}
+	_, useradd := blockTools(block.Commands)["useradd"]
+	_, usermod := blockTools(block.Commands)["usermod"]
+	homes := useradd || usermod || writesUnder(block.Commands, "/home", "/root")
+	if s.ProtectHome != "" && s.ProtectHome != "no" && !homes {
+		properties = append(properties, "ProtectHome="+s.ProtectHome)
+	}
+	if timeout > 0 {
+		// The service is stopped as well when systemd-run is killed for the timeout
+		properties = append(properties, fmt.Sprintf("RuntimeMaxSec=%d", int((timeout+timeoutKillDelay).Seconds())))
+	}
+	return append(properties, s.Properties...)
+}
+
+// command returns the command running the script of the block at path with
+// systemd-run, waiting for it and passing its output through.
+func (s *systemdSandbox) command(block NamedCommandBlock, path string, timeout time.Duration) *exec.Cmd {
+	args := []string{
+		"--wait", "--pipe", "--quiet", "--collect", "--service-type=exec",
+		fmt.Sprintf("--unit=imagecfg-%d-%s", os.Getpid(), blockSlug(block.Name)),
+	}
+	for _, property := range s.properties(block, timeout) {
+		args = append(args, "--property="+property)
+	}
+	return exec.Command("systemd-run", append(append(args, "--"), path)...)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemdSandboxProperties(t *testing.T) {
+	sandbox := &systemdSandbox{PrivateTmp: true, ProtectHome: "read-only", Properties: []string{"MemoryMax=2G"}}
+
+	block := NamedCommandBlock{Name: "Hostname", Commands: "hostnamectl set-hostname web"}
+	assert.Equal(t, []string{
+		"Description=imagecfg: Hostname",
+		"PrivateTmp=yes",
+		"ProtectHome=read-only",
+		"RuntimeMaxSec=70",
+		"MemoryMax=2G",
+	}, sandbox.properties(block, time.Minute))
+
+	// Users get their home directories
+	block = NamedCommandBlock{Name: "Users", Commands: "useradd -m alice"}
+	assert.Equal(t, []string{"Description=imagecfg: Users", "PrivateTmp=yes", "MemoryMax=2G"}, sandbox.properties(block, 0))
+
+	// Files in /tmp and the home directories stay
+	block = NamedCommandBlock{Name: "Files and Directories", Commands: writeFileCmd("/tmp/motd", "hello", 0644) + "\n" + writeFileCmd("/root/.bashrc", "", 0644)}
+	assert.Equal(t, []string{"Description=imagecfg: Files and Directories", "MemoryMax=2G"}, sandbox.properties(block, 0))
+
+	sandbox = &systemdSandbox{ProtectHome: "no"}
+	assert.Equal(t, []string{"Description=imagecfg: Hostname"}, sandbox.properties(NamedCommandBlock{Name: "Hostname"}, 0))
+}
+
+func TestNewSystemdSandboxInvalid(t *testing.T) {
+	_, err := newSystemdSandbox(true, "sometimes", nil)
+	assert.ErrorContains(t, err, `invalid --protect-home "sometimes"`)
+	_, err = newSystemdSandbox(true, "yes", []string{"MemoryMax"})
+	assert.ErrorContains(t, err, `invalid property "MemoryMax", must be NAME=VALUE`)
+}
+
+func TestApplyBlocksSystemdRun(t *testing.T) {
+	discardLogs(t)
+	dir := t.TempDir()
+	// systemd-run recording its arguments and running the command after --
+	bin := filepath.Join(dir, "bin")
+	require.NoError(t, os.Mkdir(bin, 0755))
+	fake := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\nwhile [ \"$1\" != -- ]; do shift; done\nshift\nexec \"$@\"\n"
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "systemd-run"), []byte(fake), 0755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	oldDir := sandboxScriptDir
+	sandboxScriptDir = filepath.Join(dir, "run")
+	t.Cleanup(func() { sandboxScriptDir = oldDir })
+	require.NoError(t, os.Mkdir(sandboxScriptDir, 0700))
+
+	sandbox := &systemdSandbox{PrivateTmp: true, ProtectHome: "yes"}
+	blocks := []NamedCommandBlock{{Name: "Timezone", Commands: "touch " + filepath.Join(dir, "applied")}}
+	_, _, err := applyBlocks("#!/bin/bash", blocks, applyOptions{Quiet: true, Sandbox: sandbox})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "applied"))
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	assert.Contains(t, string(args), "--wait --pipe --quiet --collect --service-type=exec --unit=imagecfg-")
+	// The block touches a file in /tmp, so it has no private one
+	assert.Contains(t, string(args), "-timezone --property=Description=imagecfg: Timezone --property=ProtectHome=yes -- "+sandboxScriptDir+"/imagecfg-block-")
+}
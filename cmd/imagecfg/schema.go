@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/osbuild/blueprint/pkg/blueprint"
+	"github.com/spf13/cobra"
+)
+
+// jsonSchemaDialect is the JSON Schema version of the exported schema
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON Schema of the supported blueprint fields",
+	Long: `Prints a JSON Schema describing the blueprint fields that imagecfg supports,
+for editors to autocomplete blueprints and for CI to catch typos before
+running imagecfg. The schema applies to the JSON and YAML forms of a
+blueprint, and to TOML with editors that validate TOML against JSON Schema.
+
+Fields that imagecfg ignores and unknown keys are rejected by the schema.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := json.MarshalIndent(blueprintSchema(), "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding schema: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+}
+
+// schemaIncludes returns whether the dotted key is a supported field, in or around one.
+func schemaIncludes(key string) bool {
+	for _, field := range slices.Concat(metadataFields, supportedFields()) {
+		if key == field || strings.HasPrefix(key, field+".") || strings.HasPrefix(field, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// typeSchema returns the schema of values of type t at the dotted key. Only the
+// supported fields of structs are included.
+func typeSchema(t reflect.Type, key string) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), key)
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, opts, _ := strings.Cut(field.Tag.Get("toml"), ",")
+			if !field.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			fieldKey := name
+			if key != "" {
+				fieldKey = key + "." + name
+			}
+			if !schemaIncludes(fieldKey) {
+				continue
+			}
+			properties[name] = typeSchema(field.Type, fieldKey)
+			// bootc-image-builder configurations have no name, so nothing at the top is required
+			if key != "" && opts != "omitempty" && field.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), key)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), key)}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	// interface{}, e.g. owners given as a name or an ID
+	return map[string]interface{}{}
+}
+
+// mergeSchemas adds the properties of the extension object schema to the base one.
+func mergeSchemas(base, extension map[string]interface{}) map[string]interface{} {
+	baseProperties, ok := base["properties"].(map[string]interface{})
+	extProperties, extOK := extension["properties"].(map[string]interface{})
+	if !ok || !extOK {
+		return extension
+	}
+	for name, ext := range extProperties {
+		if b, ok := baseProperties[name].(map[string]interface{}); ok {
+			baseProperties[name] = mergeSchemas(b, ext.(map[string]interface{}))
+		} else {
+			baseProperties[name] = ext
+		}
+	}
+	return base
+}
+
+// blueprintSchema returns the JSON Schema of the supported blueprint fields, the
+// upstream ones together with the imagecfg extensions.
+func blueprintSchema() map[string]interface{} {
+	schema := mergeSchemas(
+		typeSchema(reflect.TypeOf(blueprint.Blueprint{}), ""),
+		typeSchema(reflect.TypeOf(extensionBlueprint{}), ""),
+	)
+	// The blueprints included by the blueprint, see includeBlueprints
+	schema["properties"].(map[string]interface{})["include"] = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}
+	schema["$schema"] = jsonSchemaDialect
+	schema["title"] = "imagecfg blueprint"
+	return schema
+}
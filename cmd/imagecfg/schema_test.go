@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// schemaProperty returns the schema of the dotted key, looking through arrays.
+func schemaProperty(schema map[string]interface{}, key string) map[string]interface{} {
+	for _, name := range strings.Split(key, ".") {
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			schema = items
+		}
+		properties, ok := schema["properties"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if schema, ok = properties[name].(map[string]interface{}); !ok {
+			return nil
+		}
+	}
+	return schema
+}
+
+func TestBlueprintSchema(t *testing.T) {
+	schema := blueprintSchema()
+	assert.Equal(t, jsonSchemaDialect, schema["$schema"])
+	assert.Equal(t, false, schema["additionalProperties"])
+
+	bp, err := parseBlueprint("../../test/config.toml")
+	require.NoError(t, err)
+	for _, key := range bp.Keys {
+		assert.NotNil(t, schemaProperty(schema, key), key)
+	}
+
+	assert.Equal(t, map[string]interface{}{"type": "string"}, schemaProperty(schema, "customizations.hostname"))
+	assert.Equal(t, "array", schemaProperty(schema, "customizations.user")["type"])
+	assert.Equal(t, []string{"name"}, schemaProperty(schema, "customizations.user")["items"].(map[string]interface{})["required"])
+	assert.Equal(t, "integer", schemaProperty(schema, "customizations.user.uid")["type"])
+	// Extensions are merged into the upstream tables
+	assert.NotNil(t, schemaProperty(schema, "customizations.locale.languages"))
+	assert.NotNil(t, schemaProperty(schema, "customizations.locale.x11_layout"))
+	assert.NotNil(t, schemaProperty(schema, "customizations.sshd"))
+	assert.Equal(t, "array", schemaProperty(schema, "include")["type"])
+	// Unsupported fields are left out
+	assert.NotNil(t, schemaProperty(schema, "customizations.kernel.name"))
+	assert.Nil(t, schemaProperty(schema, "customizations.kernel.append"))
+	assert.Nil(t, schemaProperty(schema, "customizations.openscap"))
+	assert.Nil(t, schemaProperty(schema, "containers"))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// onlyBlocks and skipBlocks are set by --only and --skip, the blocks bash and apply
+// generate are then limited to them or exclude them
+var onlyBlocks, skipBlocks []string
+
+// blockNames returns the slugs of all blocks that can be generated, in their order.
+func blockNames() []string {
+	var names []string
+	for _, blk := range blockGenerators {
+		names = append(names, blockSlug(blk.name))
+		if replacement, ok := declarativeBlockGenerators[blk.name]; ok {
+			names = append(names, blockSlug(replacement.name))
+		}
+	}
+	return append(names, blockSlug("Cleanup DNF Cache"), blockSlug(machineIDResetBlock.name))
+}
+
+// selectBlocks returns the blocks selected by only, or all blocks if it is empty,
+// without the blocks in skip. Blocks are named by their slugs, e.g. users or
+// files-and-directories, or by their names.
+func selectBlocks(blocks []NamedCommandBlock, only, skip []string) ([]NamedCommandBlock, error) {
+	if len(only) > 0 && len(skip) > 0 {
+		return nil, fmt.Errorf("--only and --skip cannot be used together")
+	}
+	known := blockNames()
+	slugs := func(names []string) ([]string, error) {
+		var s []string
+		for _, name := range names {
+			slug := blockSlug(name)
+			if !slices.Contains(known, slug) {
+				return nil, fmt.Errorf("unknown block %q, must be one of: %s", name, strings.Join(known, ", "))
+			}
+			s = append(s, slug)
+		}
+		return s, nil
+	}
+	onlySlugs, err := slugs(only)
+	if err != nil {
+		return nil, err
+	}
+	skipSlugs, err := slugs(skip)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []NamedCommandBlock
+	for _, block := range blocks {
+		slug := blockSlug(block.Name)
+		if len(onlySlugs) > 0 && !slices.Contains(onlySlugs, slug) || slices.Contains(skipSlugs, slug) {
+			continue
+		}
+		selected = append(selected, block)
+	}
+	return selected, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectBlocks(t *testing.T) {
+	blocks := []NamedCommandBlock{
+		{Name: "Packages", Commands: "dnf install -y nginx"},
+		{Name: "Users", Commands: "useradd admin"},
+		{Name: "Files and Directories", Commands: "mkdir -p /etc/myapp"},
+		{Name: "Firewall", Commands: "firewall-offline-cmd --add-port=80/tcp"},
+		{Name: "Cleanup DNF Cache", Commands: "dnf clean all"},
+	}
+	names := func(blocks []NamedCommandBlock) []string {
+		var names []string
+		for _, block := range blocks {
+			names = append(names, block.Name)
+		}
+		return names
+	}
+
+	selected, err := selectBlocks(blocks, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, blocks, selected)
+
+	selected, err = selectBlocks(blocks, []string{"users", "Packages"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Packages", "Users"}, names(selected))
+
+	selected, err = selectBlocks(blocks, nil, []string{"firewall", "files-and-directories"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Packages", "Users", "Cleanup DNF Cache"}, names(selected))
+
+	// Blocks the blueprint does not generate can be named
+	selected, err = selectBlocks(blocks, []string{"sysusers"}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, selected)
+
+	_, err = selectBlocks(blocks, []string{"user"}, nil)
+	assert.ErrorContains(t, err, `unknown block "user", must be one of: proxy, environment, packages,`)
+	_, err = selectBlocks(blocks, []string{"users"}, []string{"firewall"})
+	assert.EqualError(t, err, "--only and --skip cannot be used together")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+)
+
+// setDelete and setInPlace are set by --delete and --in-place of the set command
+var (
+	setDelete  []string
+	setInPlace bool
+)
+
+var setCmd = &cobra.Command{
+	Use:   "set [--in-place] [KEY=VALUE | KEY+=VALUE]... blueprint",
+	Short: "Change fields of an OSBuild blueprint",
+	Long: `Sets, appends to and deletes fields of an OSBuild blueprint (TOML, JSON or
+YAML, by file extension) by their dotted keys and prints the result, e.g.
+
+  imagecfg set customizations.hostname=edge-01 blueprint.toml
+  imagecfg set -i customizations.firewall.ports+=8443/tcp blueprint.toml
+  imagecfg set customizations.user.0.uid=1001 --delete customizations.timezone blueprint.toml
+
+KEY=VALUE sets the field, KEY+=VALUE appends to a list and --delete removes
+the field. Keys are the ones of --set: a number in a key, like
+customizations.user.0 or customizations.user[0], selects an entry of a list,
+[-1] the last one, and packages[+].name=vim appends an entry.
+
+VALUE is read as a TOML value if it is one, like 1000, true or ["a", "b"], and
+as a string otherwise. Quote it ('"1000"') to get a string anyway. The result
+has to be a valid blueprint.
+
+The blueprint is re-encoded, which loses its comments and formatting, so the
+file is only replaced with --in-place.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, exprs := args[len(args)-1], args[:len(args)-1]
+		if len(exprs) == 0 && len(setDelete) == 0 {
+			return fmt.Errorf("nothing to change, give KEY=VALUE, KEY+=VALUE or --delete KEY")
+		}
+		var out io.Writer
+		if !setInPlace {
+			out = cmd.OutOrStdout()
+		}
+		return editBlueprintFile(path, out, func(doc map[string]interface{}) error {
+			for _, expr := range exprs {
+				if err := applySetExpression(doc, expr); err != nil {
+					return err
+				}
+			}
+			for _, key := range setDelete {
+				if err := deleteDocumentKey(doc, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	},
+}
+
+func init() {
+	setCmd.Flags().StringSliceVar(&setDelete, "delete", nil, "dotted keys of fields to delete")
+	setCmd.Flags().BoolVarP(&setInPlace, "in-place", "i", false, "replace the blueprint file instead of printing the result, losing its comments and formatting")
+	rootCmd.AddCommand(setCmd)
+}
+
+// editBlueprintFile decodes the blueprint at path, changes it with edit and writes it
+// in its format to out, or back to the file if out is nil, if it is still a valid
+// blueprint.
+func editBlueprintFile(path string, out io.Writer, edit func(doc map[string]interface{}) error) error {
+	format, err := blueprintFormat(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error opening blueprint file %s: %w", path, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error opening blueprint file %s: %w", path, err)
+	}
+	doc, err := decodeDocument(data, format)
+	if err != nil {
+		return fmt.Errorf("error parsing blueprint %s: %w", path, err)
+	}
+	if err := edit(doc); err != nil {
+		return err
+	}
+
+	// The blueprint is checked in TOML, whatever its format
+	tomlData, err := encodeDocument(doc, "toml")
+	if err != nil {
+		return fmt.Errorf("error encoding blueprint: %w", err)
+	}
+	_, unknownKeys, err := decodeBlueprintTOML(tomlData, path)
+	if err != nil {
+		return err
+	}
+	if len(unknownKeys) > 0 {
+		return fmt.Errorf("unknown keys in blueprint: %s", strings.Join(unknownKeys, ", "))
+	}
+
+	data, err = encodeDocument(doc, format)
+	if err != nil {
+		return fmt.Errorf("error encoding blueprint: %w", err)
+	}
+	if out != nil {
+		_, err := out.Write(data)
+		return err
+	}
+	return writeBlueprintFile(path, data, info.Mode().Perm())
+}
+
+// writeBlueprintFile replaces the blueprint at path with data. It is written next to it
+// and renamed, so an error leaves the blueprint intact.
+func writeBlueprintFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".imagecfg-*")
+	if err != nil {
+		return fmt.Errorf("error writing blueprint: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing blueprint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing blueprint: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("error writing blueprint: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing blueprint: %w", err)
+	}
+	return nil
+}
+
+// parseSetValue reads a value given on the command line as TOML, or as a string if it
+// is not TOML.
+func parseSetValue(s string) interface{} {
+	var v struct{ V interface{} }
+	if _, err := toml.Decode("V = "+s, &v); err == nil {
+		return normalizeDocument(v.V)
+	}
+	return s
+}
+
+// applySetExpression applies KEY=VALUE or KEY+=VALUE to the decoded blueprint.
+func applySetExpression(doc map[string]interface{}, expr string) error {
+	key, value, found := strings.Cut(expr, "=")
+	if !found || key == "" {
+		return fmt.Errorf("invalid expression %q, must be KEY=VALUE or KEY+=VALUE", expr)
+	}
+	if appendKey, ok := strings.CutSuffix(key, "+"); ok {
+		return appendDocumentKey(doc, appendKey, parseSetValue(value))
+	}
+	return setDocumentKey(doc, key, parseSetValue(value))
+}
+
+// setDocumentKey sets the dotted key of the decoded blueprint to value, see
+// splitDocumentKey.
+func setDocumentKey(doc map[string]interface{}, key string, value interface{}) error {
+	return editDocumentKey(doc, key, func(interface{}, bool) (interface{}, bool, error) {
+		return value, true, nil
+	})
+}
+
+// appendDocumentKey appends value to the list at the dotted key of the decoded
+// blueprint, creating the list if needed.
+func appendDocumentKey(doc map[string]interface{}, key string, value interface{}) error {
+	return editDocumentKey(doc, key, func(current interface{}, exists bool) (interface{}, bool, error) {
+		list, ok := current.([]interface{})
+		if exists && !ok {
+			return nil, false, fmt.Errorf("%s: cannot append to a field that is not a list", key)
+		}
+		return append(list, value), true, nil
+	})
+}
+
+// deleteDocumentKey deletes the dotted key from the decoded blueprint.
+func deleteDocumentKey(doc map[string]interface{}, key string) error {
+	return editDocumentKey(doc, key, func(_ interface{}, exists bool) (interface{}, bool, error) {
+		if !exists {
+			return nil, false, fmt.Errorf("%s: no such field", key)
+		}
+		return nil, false, nil
+	})
+}
+
+// editDocumentKey changes the field at the dotted key of the decoded blueprint with
+// edit, see editDocument.
+func editDocumentKey(doc map[string]interface{}, key string, edit documentEdit) error {
+	steps, err := splitDocumentKey(key)
+	if err != nil {
+		return err
+	}
+	_, err = editDocument(doc, nil, steps, edit)
+	return err
+}
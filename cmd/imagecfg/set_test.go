@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSetValue(t *testing.T) {
+	assert.Equal(t, "edge-01", parseSetValue("edge-01"))
+	assert.Equal(t, int64(1000), parseSetValue("1000"))
+	assert.Equal(t, "1000", parseSetValue(`"1000"`))
+	assert.Equal(t, true, parseSetValue("true"))
+	assert.Equal(t, []interface{}{"a", "b"}, parseSetValue(`["a", "b"]`))
+	assert.Equal(t, "8443/tcp", parseSetValue("8443/tcp"))
+}
+
+func TestEditBlueprintFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blueprint.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+name = "edge"
+
+[[customizations.user]]
+name = "admin"
+
+[customizations.timezone]
+timezone = "UTC"
+`), 0600))
+
+	err := editBlueprintFile(path, nil, func(doc map[string]interface{}) error {
+		for _, expr := range []string{
+			"customizations.hostname=edge-01",
+			"customizations.firewall.ports+=22/tcp",
+			"customizations.firewall.ports+=8443/tcp",
+			"customizations.user.0.uid=1001",
+			"customizations.user.0.groups+=wheel",
+			"packages[+].name=vim",
+			"customizations.user[-1].shell=/bin/zsh",
+		} {
+			if err := applySetExpression(doc, expr); err != nil {
+				return err
+			}
+		}
+		return deleteDocumentKey(doc, "customizations.timezone")
+	})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	got, err := decodeDocument(data, "toml")
+	require.NoError(t, err)
+	want, err := decodeDocument([]byte(`
+name = "edge"
+
+[customizations]
+hostname = "edge-01"
+
+[[customizations.user]]
+name = "admin"
+uid = 1001
+groups = ["wheel"]
+shell = "/bin/zsh"
+
+[[packages]]
+name = "vim"
+
+[customizations.firewall]
+ports = ["22/tcp", "8443/tcp"]
+`), "toml")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Invalid results leave the blueprint alone
+	for expr, msg := range map[string]string{
+		"customizations.hostnme=x":        "unknown keys in blueprint: customizations.hostnme",
+		"customizations.user.3.uid=1":     "customizations.user has no entry 3",
+		"customizations.user[x].uid=1":    `invalid key "user[x]"`,
+		"customizations.hostname+=x":      "customizations.hostname: cannot append to a field that is not a list",
+		"customizations.user.0.uid=1001x": "incompatible types: TOML value has type string; destination has type integer",
+		"customizations":                  `invalid expression "customizations", must be KEY=VALUE or KEY+=VALUE`,
+	} {
+		err := editBlueprintFile(path, nil, func(doc map[string]interface{}) error {
+			return applySetExpression(doc, expr)
+		})
+		assert.ErrorContains(t, err, msg, expr)
+	}
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, data, after)
+
+	err = editBlueprintFile(path, nil, func(doc map[string]interface{}) error {
+		return deleteDocumentKey(doc, "customizations.user.0")
+	})
+	require.NoError(t, err)
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "admin")
+}
+
+func TestEditBlueprintFileOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blueprint.toml")
+	original := "# The edge blueprint\nname = \"edge\"\n"
+	require.NoError(t, os.WriteFile(path, []byte(original), 0644))
+
+	// Without --in-place, the result is printed and the file is kept with its comments
+	var out bytes.Buffer
+	err := editBlueprintFile(path, &out, func(doc map[string]interface{}) error {
+		return applySetExpression(doc, "customizations.hostname=edge-01")
+	})
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), `hostname = "edge-01"`)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, original, string(data))
+}
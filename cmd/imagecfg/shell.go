@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// liveSystemCheck is a test that succeeds when systemd is running, i.e. on a
+// booted system rather than in a container or image build.
+const liveSystemCheck = "[ -d /run/systemd/system ]"
+
+// shellQuote quotes s so that the shell treats it as a single literal word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// regexpEscape escapes s for use as a literal inside a basic regular
+// expression, as understood by grep and sed.
+func regexpEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\.*[]^$`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sedEscape escapes s for use inside a basic sed regular expression
+// delimited by slashes.
+func sedEscape(s string) string {
+	return strings.ReplaceAll(regexpEscape(s), "/", `\/`)
+}
+
+// writeFileCmd generates a command that creates (or overwrites) a file with
+// the given content and mode, creating the parent directory if needed.
+func writeFileCmd(path, content string, mode os.FileMode) string {
+	return fmt.Sprintf("mkdir -p %s && printf '%%s' %s > %s && chmod %04o %s",
+		shellQuote(filepath.Dir(path)), shellQuote(content), shellQuote(path), mode, shellQuote(path))
+}
+
+// replaceLineCmd generates a command that removes all lines of file starting
+// with prefix and appends line instead. The file is created when missing.
+func replaceLineCmd(file, prefix, line string) string {
+	return fmt.Sprintf("touch %s && sed -i %s %s && printf '%%s\\n' %s >> %s",
+		shellQuote(file), shellQuote("/^"+sedEscape(prefix)+"/d"), shellQuote(file), shellQuote(line), shellQuote(file))
+}
+
+// replaceMatchingLineCmd generates a command that removes all lines of file matching
+// the extended regular expression and appends line instead. The file is created when
+// missing.
+func replaceMatchingLineCmd(file, pattern, line string) string {
+	return fmt.Sprintf("touch %s && sed -i -E %s %s && printf '%%s\\n' %s >> %s",
+		shellQuote(file), shellQuote("/"+strings.ReplaceAll(pattern, "/", `\/`)+"/d"), shellQuote(file), shellQuote(line), shellQuote(file))
+}
+
+// appendLineCmd returns the command appending line to file unless the file has it,
+// creating the file if it is missing.
+func appendLineCmd(file, line string) string {
+	return fmt.Sprintf("(grep -qxF %s %s 2>/dev/null || printf '%%s\\n' %s >> %s)",
+		shellQuote(line), shellQuote(file), shellQuote(line), shellQuote(file))
+}
+
+// inGroupCheck returns the check whether the user is a member of the group.
+func inGroupCheck(user, group string) string {
+	return fmt.Sprintf("id -nG %s | tr ' ' '\\n' | grep -qxF %s", user, group)
+}
+
+// passwordCheck returns the check whether the password hash of the user is hash,
+// which is a quoted shell word.
+func passwordCheck(user, hash string) string {
+	return fmt.Sprintf(`[ "$(getent shadow %s | cut -d: -f2)" = %s ]`, user, hash)
+}
+
+// systemdQuote quotes s as a single argument of a systemd Exec*= line.
+// Specifiers and environment variable expansion are escaped as well.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "%", "%%")
+	s = strings.ReplaceAll(s, "$", "$$")
+	return `"` + s + `"`
+}
+
+// systemdEscapePath escapes an absolute path the way "systemd-escape --path"
+// does, e.g. for naming mount units.
+func systemdEscapePath(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && i == 0,
+			!(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == ':' || c == '_' || c == '.'):
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
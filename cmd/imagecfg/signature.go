@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// blueprintVerifySignature, blueprintSignature, blueprintSignatureKeys,
+// blueprintSignatureIdentity and blueprintSignatureIssuer are set by
+// --verify-signature, --signature, --signature-key, --signature-identity and
+// --signature-issuer: whether blueprints must have a valid detached signature, where
+// it is, and the GPG or cosign public keys, or the identity and OIDC issuer of keyless
+// cosign signatures, that are trusted
+var (
+	blueprintVerifySignature   bool
+	blueprintSignature         string
+	blueprintSignatureKeys     []string
+	blueprintSignatureIdentity string
+	blueprintSignatureIssuer   string
+)
+
+// signatureRunner runs gpg, gpgv and cosign, a var so tests can replace it
+var signatureRunner commandRunner = runCommand
+
+// isGPGKey returns whether the public key is a GPG key rather than a cosign one, which
+// is PEM encoded.
+func isGPGKey(key []byte) bool {
+	return !bytes.HasPrefix(bytes.TrimSpace(key), []byte("-----BEGIN PUBLIC KEY-----"))
+}
+
+// signaturePath returns where the detached signature of the blueprint at path is by
+// default: next to it, in a .sig file for signatures made with a key and in a
+// .sigstore.json bundle for keyless ones.
+func signaturePath(path string) string {
+	if blueprintSignatureIdentity != "" {
+		return path + ".sigstore.json"
+	}
+	return path + ".sig"
+}
+
+// verifyBlueprintSignature fails with --verify-signature unless the detached signature
+// at sigPath of the blueprint read from path verifies with one of the trusted keys or
+// the trusted identity, so that a blueprint fetched over the network is only applied
+// if it was signed. The signature is read and fetched like the blueprint.
+func verifyBlueprintSignature(path, sigPath string, data []byte) error {
+	if !blueprintVerifySignature {
+		return nil
+	}
+	if len(blueprintSignatureKeys) == 0 && blueprintSignatureIdentity == "" {
+		return fmt.Errorf("--verify-signature needs --signature-key or --signature-identity")
+	}
+	if len(blueprintSignatureKeys) > 0 && blueprintSignatureIdentity != "" {
+		return fmt.Errorf("--signature-key and --signature-identity cannot be combined")
+	}
+	if (blueprintSignatureIdentity == "") != (blueprintSignatureIssuer == "") {
+		return fmt.Errorf("--signature-identity and --signature-issuer must be given together")
+	}
+	if isOCIBlueprint(path) && sigPath == signaturePath(path) {
+		return fmt.Errorf("blueprint %s has no signature next to it, give it with --signature", path)
+	}
+	signature, err := readBlueprintSource(sigPath, false)
+	if err != nil {
+		return fmt.Errorf("error reading signature of blueprint %s: %w", path, err)
+	}
+
+	// The tools verify files, the blueprint may have been fetched
+	dir, err := os.MkdirTemp("", "imagecfg-signature-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	dataFile, sigFile := filepath.Join(dir, "blueprint"), filepath.Join(dir, "signature")
+	if err := os.WriteFile(dataFile, data, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(sigFile, signature, 0600); err != nil {
+		return err
+	}
+
+	if blueprintSignatureIdentity != "" {
+		_, err := signatureRunner("cosign", "verify-blob", "--bundle", sigFile,
+			"--certificate-identity", blueprintSignatureIdentity, "--certificate-oidc-issuer", blueprintSignatureIssuer, dataFile)
+		if err != nil {
+			return fmt.Errorf("signature %s of blueprint %s does not verify: %w", sigPath, path, toolError(err))
+		}
+		return nil
+	}
+	var gpgKeys []string
+	for _, key := range blueprintSignatureKeys {
+		pem, err := os.ReadFile(key)
+		if err != nil {
+			return fmt.Errorf("error reading signature key: %w", err)
+		}
+		if isGPGKey(pem) {
+			gpgKeys = append(gpgKeys, key)
+			continue
+		}
+		if _, err = signatureRunner("cosign", "verify-blob", "--key", key, "--signature", sigFile, dataFile); err == nil {
+			return nil
+		}
+	}
+	if len(gpgKeys) > 0 {
+		// gpgv only trusts the keys of the keyring it is given
+		keyring := filepath.Join(dir, "trusted.gpg")
+		args := append([]string{"--batch", "--no-default-keyring", "--homedir", dir, "--keyring", keyring, "--import"}, gpgKeys...)
+		if _, err := signatureRunner("gpg", args...); err != nil {
+			return fmt.Errorf("error importing signature keys: %w", toolError(err))
+		}
+		if _, err := signatureRunner("gpgv", "--homedir", dir, "--keyring", keyring, sigFile, dataFile); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature %s of blueprint %s does not verify with any of the trusted keys", sigPath, path)
+}
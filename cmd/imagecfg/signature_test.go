@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setSignatureFlags sets the signature flags for the test, with the commands it runs
+// recorded and verifying if verify returns true for them.
+func setSignatureFlags(t *testing.T, keys []string, identity, issuer string, verify func(name string, args []string) bool) *[][]string {
+	oldVerify, oldSig, oldKeys, oldIdentity, oldIssuer, oldRunner := blueprintVerifySignature, blueprintSignature, blueprintSignatureKeys, blueprintSignatureIdentity, blueprintSignatureIssuer, signatureRunner
+	t.Cleanup(func() {
+		blueprintVerifySignature, blueprintSignature, blueprintSignatureKeys, blueprintSignatureIdentity, blueprintSignatureIssuer, signatureRunner = oldVerify, oldSig, oldKeys, oldIdentity, oldIssuer, oldRunner
+	})
+	blueprintVerifySignature, blueprintSignature, blueprintSignatureKeys, blueprintSignatureIdentity, blueprintSignatureIssuer = true, "", keys, identity, issuer
+	var calls [][]string
+	signatureRunner = func(name string, args ...string) ([]byte, error) {
+		calls = append(calls, append([]string{name}, args...))
+		if name == "gpg" || verify(name, args) {
+			return nil, nil
+		}
+		return nil, errors.New("exit status 1")
+	}
+	return &calls
+}
+
+func TestVerifySignatureCosignKey(t *testing.T) {
+	dir := t.TempDir()
+	path, key := filepath.Join(dir, "config.toml"), filepath.Join(dir, "cosign.pub")
+	require.NoError(t, os.WriteFile(path, []byte("name = \"web\"\n"), 0644))
+	require.NoError(t, os.WriteFile(key, []byte("-----BEGIN PUBLIC KEY-----\nMFkw\n-----END PUBLIC KEY-----\n"), 0644))
+
+	valid := true
+	calls := setSignatureFlags(t, []string{key}, "", "", func(name string, args []string) bool { return valid })
+	_, err := loadBlueprint([]string{path})
+	assert.ErrorContains(t, err, "error reading signature of blueprint "+path)
+
+	require.NoError(t, os.WriteFile(path+".sig", []byte("c2ln"), 0644))
+	_, err = loadBlueprint([]string{path})
+	require.NoError(t, err)
+	require.NotEmpty(t, *calls)
+	assert.Equal(t, []string{"cosign", "verify-blob", "--key", key, "--signature"}, (*calls)[0][:5])
+
+	valid = false
+	_, err = loadBlueprint([]string{path})
+	assert.EqualError(t, err, "error opening blueprint file "+path+": signature "+path+".sig of blueprint "+path+" does not verify with any of the trusted keys")
+}
+
+func TestVerifySignatureGPG(t *testing.T) {
+	dir := t.TempDir()
+	path, key := filepath.Join(dir, "config.toml"), filepath.Join(dir, "release.asc")
+	require.NoError(t, os.WriteFile(path, []byte("name = \"web\"\n"), 0644))
+	require.NoError(t, os.WriteFile(path+".asc", []byte("-----BEGIN PGP SIGNATURE-----\n"), 0644))
+	require.NoError(t, os.WriteFile(key, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----\n"), 0644))
+
+	calls := setSignatureFlags(t, []string{key}, "", "", func(name string, args []string) bool { return name == "gpgv" })
+	blueprintSignature = path + ".asc"
+	_, err := loadBlueprint([]string{path})
+	require.NoError(t, err)
+	require.Len(t, *calls, 2)
+	assert.Equal(t, "gpg", (*calls)[0][0])
+	assert.Equal(t, key, (*calls)[0][len((*calls)[0])-1])
+	assert.Equal(t, "gpgv", (*calls)[1][0])
+}
+
+func TestVerifySignatureKeyless(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte("include = [\"users.toml\"]\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "users.toml"), []byte("[[customizations.user]]\nname = \"admin\"\n"), 0644))
+	require.NoError(t, os.WriteFile(path+".sigstore.json", []byte("{}"), 0644))
+
+	calls := setSignatureFlags(t, nil, "ci@example.com", "https://token.actions.githubusercontent.com", func(name string, args []string) bool { return true })
+	// Included blueprints are verified as well
+	_, err := loadBlueprint([]string{path})
+	assert.ErrorContains(t, err, "error reading signature of blueprint "+filepath.Join(dir, "users.toml"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "users.toml.sigstore.json"), []byte("{}"), 0644))
+	_, err = loadBlueprint([]string{path})
+	require.NoError(t, err)
+	assert.Contains(t, (*calls)[0], "--certificate-identity")
+	assert.Contains(t, (*calls)[0], "ci@example.com")
+
+	blueprintSignatureIssuer = ""
+	_, err = loadBlueprint([]string{path})
+	assert.ErrorContains(t, err, "--signature-identity and --signature-issuer must be given together")
+}
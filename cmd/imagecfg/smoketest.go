@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// smokeTestOptions are the settings of a container smoke test
+type smokeTestOptions struct {
+	BaseImage string
+	Engine    string
+	Keep      bool
+}
+
+// smokeTestStep is the result of a step of a smoke test
+type smokeTestStep struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Output is the output of a failed step
+	Output string `json:"output,omitempty"`
+}
+
+// smokeTestReport is the result of a container smoke test
+type smokeTestReport struct {
+	BaseImage string `json:"base_image"`
+	// Image is the tested image, if it was kept
+	Image  string          `json:"image,omitempty"`
+	Passed bool            `json:"passed"`
+	Steps  []smokeTestStep `json:"steps"`
+	Drift  []systemChange  `json:"drift,omitempty"`
+}
+
+var (
+	smokeTestOpts   smokeTestOptions
+	smokeTestFormat string
+)
+
+var smokeTestCmd = &cobra.Command{
+	Use:   "test [blueprint.toml...]",
+	Short: "Apply an OSBuild blueprint in a throwaway container and verify it",
+	Long: `Tests an OSBuild blueprint (TOML format) in a throwaway container: builds an
+image from --base-image with this imagecfg binary and the blueprint, running
+'imagecfg apply' like an image build would, then runs 'imagecfg verify' in a
+container of the image and reports whether both passed.
+
+podman is used unless --engine says otherwise. The image is removed
+afterwards unless --keep is given. imagecfg has to be a Linux binary that runs
+in the base image, like the static release builds.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+Supported formats:
+- text: a line per step, followed by the drifted settings
+- json: an object with "passed", the list of "steps" and the "drift" items`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if smokeTestFormat != "text" && smokeTestFormat != "json" {
+			return fmt.Errorf("unknown test format %q, must be text or json", smokeTestFormat)
+		}
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("the test runs this imagecfg binary in a container, it has to be built for linux")
+		}
+		blueprintPath := blueprintName(args)
+		// Problems with the blueprint itself are reported without building anything
+		if _, err := loadBlueprint(args); err != nil {
+			return err // Cobra will print this and exit
+		}
+		binary, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("error finding the imagecfg binary: %w", err)
+		}
+
+		report, err := smokeTest(smokeTestOpts, binary, blueprintPaths(args), runCommand)
+		if err != nil {
+			return err
+		}
+		if smokeTestFormat == "json" {
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return fmt.Errorf("error encoding test report: %w", err)
+			}
+			fmt.Println(string(data))
+		} else {
+			fmt.Print(formatSmokeTestReport(report))
+		}
+		if !report.Passed {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("%s: test in %s failed", blueprintPath, report.BaseImage)
+		}
+		return nil
+	},
+}
+
+func init() {
+	smokeTestCmd.Flags().StringVar(&smokeTestOpts.BaseImage, "base-image", "quay.io/fedora/fedora-bootc:42", "image to apply the blueprint on")
+	smokeTestCmd.Flags().StringVar(&smokeTestOpts.Engine, "engine", "podman", "container engine building and running the image")
+	smokeTestCmd.Flags().BoolVar(&smokeTestOpts.Keep, "keep", false, "keep the tested image")
+	smokeTestCmd.Flags().StringVar(&smokeTestFormat, "format", "text", "output format, text or json")
+	rootCmd.AddCommand(smokeTestCmd)
+}
+
+// smokeTestContainerfile returns the Containerfile of the image testing a blueprint.
+func smokeTestContainerfile(baseImage string) string {
+	return fmt.Sprintf(`FROM %s
+COPY imagecfg /usr/local/bin/imagecfg
+COPY config.toml %s
+RUN imagecfg apply
+`, baseImage, defaultBlueprintPath)
+}
+
+// failureOutput returns the output of a failed command, including its standard error.
+func failureOutput(out []byte, err error) string {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		out = append(out, exitErr.Stderr...)
+	}
+	if s := strings.TrimSpace(string(out)); s != "" {
+		return s
+	}
+	if err == nil {
+		return "no output"
+	}
+	return err.Error()
+}
+
+// copyIntoContext copies the file at src into the build context at dst.
+func copyIntoContext(src, dst string, perm os.FileMode) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, perm)
+}
+
+// smokeTest builds the image testing the blueprints at blueprintPaths, merged, with the
+// imagecfg binary and verifies a container of it, running the engine with run.
+func smokeTest(opts smokeTestOptions, binary string, blueprintPaths []string, run commandRunner) (*smokeTestReport, error) {
+	dir, err := os.MkdirTemp("", "imagecfg-test-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating build context: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := copyIntoContext(binary, filepath.Join(dir, "imagecfg"), 0755); err != nil {
+		return nil, fmt.Errorf("error copying imagecfg: %w", err)
+	}
+	data, _, _, err := readBlueprints(blueprintPaths)
+	if err != nil {
+		return nil, fmt.Errorf("error copying blueprint: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.toml"), data, 0644); err != nil {
+		return nil, fmt.Errorf("error copying blueprint: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Containerfile"), []byte(smokeTestContainerfile(opts.BaseImage)), 0644); err != nil {
+		return nil, fmt.Errorf("error writing Containerfile: %w", err)
+	}
+
+	report := &smokeTestReport{BaseImage: opts.BaseImage}
+	tag := "localhost/" + strings.ToLower(filepath.Base(dir))
+	out, err := run(opts.Engine, "build", "-f", filepath.Join(dir, "Containerfile"), "-t", tag, dir)
+	if err != nil {
+		report.Steps = append(report.Steps, smokeTestStep{Name: "apply", Output: failureOutput(out, err)})
+		return report, nil
+	}
+	report.Steps = append(report.Steps, smokeTestStep{Name: "apply", Passed: true})
+	if opts.Keep {
+		report.Image = tag
+	} else {
+		defer func() { _, _ = run(opts.Engine, "rmi", tag) }()
+	}
+
+	// verify fails with a report if the system drifted
+	out, err = run(opts.Engine, "run", "--rm", tag, "imagecfg", "verify", "--format", "json")
+	var drift driftReport
+	if jsonErr := json.Unmarshal(out, &drift); jsonErr != nil {
+		report.Steps = append(report.Steps, smokeTestStep{Name: "verify", Output: failureOutput(out, err)})
+		return report, nil
+	}
+	step := smokeTestStep{Name: "verify", Passed: !drift.Drifted && err == nil}
+	if err != nil && !drift.Drifted {
+		step.Output = failureOutput(nil, err)
+	}
+	report.Steps = append(report.Steps, step)
+	report.Drift = drift.Drift
+	report.Passed = step.Passed
+	return report, nil
+}
+
+// formatSmokeTestReport formats the report as text.
+func formatSmokeTestReport(report *smokeTestReport) string {
+	var out strings.Builder
+	for _, step := range report.Steps {
+		result := "PASS"
+		if !step.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(&out, "%s %s\n", result, step.Name)
+		if step.Output != "" {
+			fmt.Fprintf(&out, "  %s\n", strings.ReplaceAll(step.Output, "\n", "\n  "))
+		}
+	}
+	for _, change := range report.Drift {
+		fmt.Fprintf(&out, "  %s: %s\n", change.Block, change.Message)
+	}
+	if report.Image != "" {
+		fmt.Fprintf(&out, "Image: %s\n", report.Image)
+	}
+	return out.String()
+}
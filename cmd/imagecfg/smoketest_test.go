@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEngine records the container engine calls and answers them from results, keyed
+// by the subcommand
+type fakeEngine struct {
+	calls   []string
+	results map[string]func(args []string) ([]byte, error)
+}
+
+func (e *fakeEngine) run(name string, args ...string) ([]byte, error) {
+	e.calls = append(e.calls, name+" "+args[0])
+	if result, ok := e.results[args[0]]; ok {
+		return result(args)
+	}
+	return nil, nil
+}
+
+func smokeTestFiles(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "imagecfg")
+	blueprintPath := filepath.Join(dir, "blueprint.toml")
+	require.NoError(t, os.WriteFile(binary, []byte("binary"), 0755))
+	require.NoError(t, os.WriteFile(blueprintPath, []byte("[customizations]\nhostname = \"test\"\n"), 0644))
+	return binary, blueprintPath
+}
+
+func TestSmokeTest(t *testing.T) {
+	binary, blueprintPath := smokeTestFiles(t)
+	engine := &fakeEngine{results: map[string]func([]string) ([]byte, error){
+		"build": func(args []string) ([]byte, error) {
+			context := args[len(args)-1]
+			containerfile, err := os.ReadFile(filepath.Join(context, "Containerfile"))
+			require.NoError(t, err)
+			assert.Equal(t, smokeTestContainerfile("example.com/base:1"), string(containerfile))
+			blueprint, err := os.ReadFile(filepath.Join(context, "config.toml"))
+			require.NoError(t, err)
+			assert.Contains(t, string(blueprint), "hostname")
+			info, err := os.Stat(filepath.Join(context, "imagecfg"))
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+			return []byte("built"), nil
+		},
+		"run": func(args []string) ([]byte, error) {
+			assert.Equal(t, []string{"imagecfg", "verify", "--format", "json"}, args[len(args)-4:])
+			return []byte(`{"blueprint": "/usr/lib/bootc-image-builder/config.toml", "drifted": false, "drift": []}`), nil
+		},
+	}}
+
+	report, err := smokeTest(smokeTestOptions{BaseImage: "example.com/base:1", Engine: "podman"}, binary, []string{blueprintPath}, engine.run)
+	require.NoError(t, err)
+	assert.True(t, report.Passed)
+	assert.Equal(t, []smokeTestStep{{Name: "apply", Passed: true}, {Name: "verify", Passed: true}}, report.Steps)
+	assert.Equal(t, []string{"podman build", "podman run", "podman rmi"}, engine.calls)
+	assert.Empty(t, report.Image)
+}
+
+func TestSmokeTestDrift(t *testing.T) {
+	binary, blueprintPath := smokeTestFiles(t)
+	engine := &fakeEngine{results: map[string]func([]string) ([]byte, error){
+		"run": func(args []string) ([]byte, error) {
+			return []byte(`{"drifted": true, "drift": [{"block": "Hostname", "message": "hostname is other, the blueprint sets test"}]}`), errors.New("exit status 2")
+		},
+	}}
+
+	report, err := smokeTest(smokeTestOptions{BaseImage: "base", Engine: "docker", Keep: true}, binary, []string{blueprintPath}, engine.run)
+	require.NoError(t, err)
+	assert.False(t, report.Passed)
+	assert.Equal(t, []systemChange{{Block: "Hostname", Message: "hostname is other, the blueprint sets test"}}, report.Drift)
+	assert.Equal(t, []string{"docker build", "docker run"}, engine.calls)
+	assert.True(t, strings.HasPrefix(report.Image, "localhost/imagecfg-test-"))
+	assert.Equal(t, "PASS apply\nFAIL verify\n  Hostname: hostname is other, the blueprint sets test\nImage: "+report.Image+"\n", formatSmokeTestReport(report))
+}
+
+func TestSmokeTestApplyFails(t *testing.T) {
+	binary, blueprintPath := smokeTestFiles(t)
+	engine := &fakeEngine{results: map[string]func([]string) ([]byte, error){
+		"build": func(args []string) ([]byte, error) {
+			return []byte("STEP 4/4: RUN imagecfg apply\nexecution failed for block 'Users'\n"), errors.New("exit status 1")
+		},
+	}}
+
+	report, err := smokeTest(smokeTestOptions{BaseImage: "base", Engine: "podman"}, binary, []string{blueprintPath}, engine.run)
+	require.NoError(t, err)
+	assert.False(t, report.Passed)
+	assert.Equal(t, []smokeTestStep{{Name: "apply", Output: "STEP 4/4: RUN imagecfg apply\nexecution failed for block 'Users'"}}, report.Steps)
+	assert.Equal(t, []string{"podman build"}, engine.calls)
+}
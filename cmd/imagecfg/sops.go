@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"gopkg.in/yaml.v3"
+)
+
+// blueprintAgeKey is set by --age-key, the file with the age identity SOPS-encrypted
+// blueprints are decrypted with
+var blueprintAgeKey string
+
+// sopsRunner runs sops with the input on its standard input and the variables in env
+// added to its environment, a var so tests can replace it
+var sopsRunner = func(input []byte, env []string, args ...string) ([]byte, error) {
+	cmd := exec.Command("sops", args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(), env...)
+	return cmd.Output()
+}
+
+// sopsInputType returns the sops input type of the blueprint if it is encrypted by
+// SOPS: yaml or json for encrypted YAML and JSON blueprints, whose values are encrypted
+// in place, and binary for other formats like TOML, which SOPS encrypts as a whole
+// into the data of a JSON document. It returns "" for blueprints that are not
+// encrypted.
+func sopsInputType(data []byte) string {
+	var doc map[string]interface{}
+	// JSON is YAML as well
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return ""
+	}
+	metadata, ok := doc["sops"].(map[string]interface{})
+	if !ok || metadata["mac"] == nil {
+		return ""
+	}
+	if _, ok := doc["data"].(string); ok && len(doc) == 2 {
+		return "binary"
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return "json"
+	}
+	return "yaml"
+}
+
+// decryptBlueprint decrypts the blueprint read from path in memory with sops if it is
+// encrypted, see sopsInputType, so that passwords and activation keys can be kept
+// encrypted in git and are only decrypted on the host applying them. Blueprints that
+// are not encrypted are returned unchanged.
+func decryptBlueprint(path string, data []byte) ([]byte, error) {
+	inputType := sopsInputType(data)
+	if inputType == "" {
+		return data, nil
+	}
+	var env []string
+	if blueprintAgeKey != "" {
+		env = append(env, "SOPS_AGE_KEY_FILE="+blueprintAgeKey)
+	}
+	out, err := sopsRunner(data, env, "--decrypt", "--input-type", inputType, "--output-type", inputType, "/dev/stdin")
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting blueprint %s: %w", path, toolError(err))
+	}
+	return out, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encryptedTOML is a TOML blueprint encrypted by SOPS as a binary file
+const encryptedTOML = `{
+	"data": "ENC[AES256_GCM,data:c2VjcmV0,iv:aXY=,tag:dGFn,type:str]",
+	"sops": {"age": [{"recipient": "age1example"}], "mac": "ENC[AES256_GCM,data:bWFj,type:str]", "version": "3.9.0"}
+}`
+
+func TestSOPSInputType(t *testing.T) {
+	assert.Equal(t, "binary", sopsInputType([]byte(encryptedTOML)))
+	assert.Equal(t, "json", sopsInputType([]byte(`{"name": "ENC[...]", "sops": {"mac": "ENC[...]"}}`)))
+	assert.Equal(t, "yaml", sopsInputType([]byte("name: ENC[...]\nsops:\n  mac: ENC[...]\n")))
+	assert.Equal(t, "", sopsInputType([]byte("name = \"web\"\n")))
+	assert.Equal(t, "", sopsInputType([]byte(`{"name": "web"}`)))
+	// A key that happens to be called sops is no encryption metadata
+	assert.Equal(t, "", sopsInputType([]byte("sops: true\n")))
+}
+
+func TestLoadBlueprintSOPS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(encryptedTOML), 0644))
+
+	oldRunner, oldKey := sopsRunner, blueprintAgeKey
+	t.Cleanup(func() { sopsRunner, blueprintAgeKey = oldRunner, oldKey })
+	var gotEnv, gotArgs []string
+	sopsRunner = func(input []byte, env []string, args ...string) ([]byte, error) {
+		assert.Equal(t, encryptedTOML, string(input))
+		gotEnv, gotArgs = env, args
+		return []byte("[customizations]\nhostname = \"secret\"\n"), nil
+	}
+	blueprintAgeKey = "/etc/imagecfg/age.key"
+
+	bp, err := loadBlueprint([]string{path})
+	require.NoError(t, err)
+	assert.Equal(t, "secret", *bp.Customizations.GetHostname())
+	assert.Equal(t, []string{"SOPS_AGE_KEY_FILE=/etc/imagecfg/age.key"}, gotEnv)
+	assert.Equal(t, []string{"--decrypt", "--input-type", "binary", "--output-type", "binary", "/dev/stdin"}, gotArgs)
+
+	sopsRunner = func(input []byte, env []string, args ...string) ([]byte, error) {
+		return nil, &exec.ExitError{Stderr: []byte("Failed to get the data key\n")}
+	}
+	_, err = loadBlueprint([]string{path})
+	assert.ErrorContains(t, err, "error decrypting blueprint "+path)
+	assert.ErrorContains(t, err, "Failed to get the data key")
+}
+
+func TestLoadBlueprintsDecryptOnce(t *testing.T) {
+	dir := t.TempDir()
+	base, secret := filepath.Join(dir, "base.toml"), filepath.Join(dir, "secret.toml")
+	require.NoError(t, os.WriteFile(base, []byte("name = \"web\"\n"), 0644))
+	require.NoError(t, os.WriteFile(secret, []byte(encryptedTOML), 0644))
+
+	oldRunner := sopsRunner
+	t.Cleanup(func() { sopsRunner = oldRunner })
+	decrypted := "[customizations]\nhostname = \"secret\"\n"
+	calls := 0
+	sopsRunner = func(input []byte, env []string, args ...string) ([]byte, error) {
+		calls++
+		return []byte(decrypted), nil
+	}
+
+	bp, err := loadBlueprint([]string{base, secret})
+	require.NoError(t, err)
+	assert.Equal(t, "secret", *bp.Customizations.GetHostname())
+	assert.Equal(t, 1, calls)
+
+	// Unknown keys are reported with the file they are in, from the same pass
+	calls = 0
+	decrypted = "[customizations]\nhostnme = \"secret\"\n"
+	_, err = loadBlueprint([]string{base, secret})
+	assert.EqualError(t, err, "unknown configuration keys in "+secret+": customizations.hostnme")
+	assert.Equal(t, 1, calls)
+}
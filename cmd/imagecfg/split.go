@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// splitRunnerName is the name of the script running all block scripts in order
+const splitRunnerName = "run.sh"
+
+// splitScript is one of the scripts of the split output
+type splitScript struct {
+	Name    string
+	Content string
+}
+
+// blockSlug turns a block name into a lower case name for files and IDs, e.g. "cleanup-dnf-cache".
+func blockSlug(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
+
+// splitScripts returns a numbered script per block, followed by the runner script.
+func splitScripts(header string, namedBlocks []NamedCommandBlock) []splitScript {
+	var scripts []splitScript
+	var runner strings.Builder
+	runner.WriteString(header)
+	runner.WriteString("cd \"$(dirname \"$0\")\"\n")
+	for i, block := range namedBlocks {
+		name := fmt.Sprintf("%02d-%s.sh", i+1, blockSlug(block.Name))
+		scripts = append(scripts, splitScript{Name: name, Content: header + "# " + block.Name + "\n" + block.Commands + "\n"})
+		runner.WriteString("./" + name + "\n")
+	}
+	return append(scripts, splitScript{Name: splitRunnerName, Content: runner.String()})
+}
+
+// writeSplitOutput writes the scripts to dir, which is created if missing.
+func writeSplitOutput(scripts []splitScript, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, script := range scripts {
+		path := filepath.Join(dir, script.Name)
+		if err := os.WriteFile(path, []byte(script.Content), 0755); err != nil {
+			return err
+		}
+		// WriteFile only applies the mode to new files
+		if err := os.Chmod(path, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSplitArchive writes the scripts to a tar archive at path.
+func writeSplitArchive(scripts []splitScript, path string) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	tw := tar.NewWriter(f)
+	for _, script := range scripts {
+		hdr := &tar.Header{
+			Name: script.Name,
+			Mode: 0755,
+			Size: int64(len(script.Content)),
+			// A fixed time keeps the archive reproducible
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(script.Content)); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
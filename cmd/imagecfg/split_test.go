@@ -0,0 +1,54 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitScripts(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations]
+hostname = "box"
+`)
+	header, blocks, err := generateBashScript(bp)
+	require.NoError(t, err)
+	scripts := splitScripts(header, blocks)
+
+	var names []string
+	for _, script := range scripts {
+		names = append(names, script.Name)
+	}
+	assert.Equal(t, []string{"01-packages.sh", "02-hostname.sh", "03-cleanup-dnf-cache.sh", "run.sh"}, names)
+	assert.Equal(t, "#!/bin/bash\nset -euf -o pipefail\n\n# Hostname\necho 'box' > /etc/hostname\n", scripts[1].Content)
+	assert.Equal(t, "#!/bin/bash\nset -euf -o pipefail\n\ncd \"$(dirname \"$0\")\"\n./01-packages.sh\n./02-hostname.sh\n./03-cleanup-dnf-cache.sh\n", scripts[3].Content)
+
+	dir := t.TempDir()
+	require.NoError(t, writeSplitOutput(scripts, filepath.Join(dir, "blocks")))
+	info, err := os.Stat(filepath.Join(dir, "blocks", "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	archive := filepath.Join(dir, "blocks.tar")
+	require.NoError(t, writeSplitArchive(scripts, archive))
+	f, err := os.Open(archive)
+	require.NoError(t, err)
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for _, script := range scripts {
+		hdr, err := tr.Next()
+		require.NoError(t, err)
+		assert.Equal(t, script.Name, hdr.Name)
+		assert.Equal(t, int64(0755), hdr.Mode)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		assert.Equal(t, script.Content, string(data))
+	}
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// defaultStatePath is where apply records what it applied
+const defaultStatePath = "/var/lib/imagecfg/state.json"
+
+// applyStatePath and applyForce are set by --state and --force. With --force, apply
+// runs the blocks that did not change since they were applied as well.
+var (
+	applyStatePath string
+	applyForce     bool
+)
+
+// applyState is what apply applied to a system
+type applyState struct {
+	// Blueprint is the SHA-256 of the last applied blueprint file
+	Blueprint string `json:"blueprint_sha256"`
+	// AppliedAt is when the blueprint was last applied
+	AppliedAt time.Time `json:"applied_at"`
+	// Blocks are the blocks applied successfully, by their name
+	Blocks map[string]blockState `json:"blocks"`
+}
+
+// blockState is a block as it was last applied successfully
+type blockState struct {
+	// SHA256 is the hash of the commands of the block and the script header
+	SHA256    string    `json:"sha256"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// hashBytes returns the hex SHA-256 of data.
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// blockHash returns the hash of what a block runs, its commands with the header.
+func blockHash(header string, block NamedCommandBlock) string {
+	return hashBytes([]byte(header + "\n" + block.Commands))
+}
+
+// loadApplyState reads the state file at path, an empty state if it does not exist.
+func loadApplyState(path string) (*applyState, error) {
+	state := &applyState{Blocks: map[string]blockState{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading state file: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error reading state file %s: %w", path, err)
+	}
+	if state.Blocks == nil {
+		state.Blocks = map[string]blockState{}
+	}
+	return state, nil
+}
+
+// changedBlocks returns the blocks to apply and the names of the ones left out: the
+// blocks that were applied with the same commands before are left out, unless a block
+// they depend on, see blockDependencies, is applied again.
+func (s *applyState) changedBlocks(header string, blocks []NamedCommandBlock) (changed []NamedCommandBlock, unchanged []string) {
+	for _, block := range blocks {
+		prev, ok := s.Blocks[block.Name]
+		rerun := !ok || prev.SHA256 != blockHash(header, block)
+		for _, c := range changed {
+			rerun = rerun || dependsOn(block.Name, c.Name)
+		}
+		if rerun {
+			changed = append(changed, block)
+		} else {
+			unchanged = append(unchanged, block.Name)
+		}
+	}
+	return changed, unchanged
+}
+
+// record records the applied blocks and the blueprint with the hash blueprintHash.
+// Failed blocks are forgotten, so that they are applied again by the next run, and the
+// other blocks are kept as they were.
+func (s *applyState) record(blueprintHash, header string, blocks []NamedCommandBlock, applied, failed []string, now time.Time) {
+	s.Blueprint = blueprintHash
+	s.AppliedAt = now
+	for _, block := range blocks {
+		switch {
+		case slices.Contains(applied, block.Name):
+			s.Blocks[block.Name] = blockState{SHA256: blockHash(header, block), AppliedAt: now}
+		case slices.Contains(failed, block.Name):
+			delete(s.Blocks, block.Name)
+		}
+	}
+}
+
+// Write writes the state file to path, creating its directory, with sudo if it is set.
+func (s *applyState) Write(path string, sudo bool) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	if sudo {
+		if err := sudoWriteFile(path, append(data, '\n')); err != nil {
+			return fmt.Errorf("error writing state file: %w", err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".state-*")
+	if err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	return nil
+}
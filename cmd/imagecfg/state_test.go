@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "var/lib/imagecfg/state.json")
+	header := "#!/bin/bash\nset -euo pipefail"
+	blocks := []NamedCommandBlock{
+		{Name: "Packages", Commands: "dnf install -y nginx"},
+		{Name: "SSHD", Commands: "echo 'Port 22' > /etc/ssh/sshd_config.d/50-imagecfg.conf"},
+		{Name: "Hostname", Commands: "hostnamectl set-hostname web"},
+		{Name: "Timezone", Commands: "timedatectl set-timezone UTC"},
+	}
+	names := func(blocks []NamedCommandBlock) []string {
+		var names []string
+		for _, block := range blocks {
+			names = append(names, block.Name)
+		}
+		return names
+	}
+
+	// Without a state file, everything is applied
+	state, err := loadApplyState(path)
+	require.NoError(t, err)
+	changed, unchanged := state.changedBlocks(header, blocks)
+	assert.Equal(t, blocks, changed)
+	assert.Empty(t, unchanged)
+
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	state.record("abc", header, blocks, []string{"Packages", "SSHD", "Hostname"}, []string{"Timezone"}, now)
+	require.NoError(t, state.Write(path, false))
+
+	state, err = loadApplyState(path)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", state.Blueprint)
+	assert.True(t, now.Equal(state.AppliedAt))
+	assert.Equal(t, blockHash(header, blocks[0]), state.Blocks["Packages"].SHA256)
+	assert.NotContains(t, state.Blocks, "Timezone")
+
+	// The failed block runs again
+	changed, unchanged = state.changedBlocks(header, blocks)
+	assert.Equal(t, []string{"Timezone"}, names(changed))
+	assert.Equal(t, []string{"Packages", "SSHD", "Hostname"}, unchanged)
+
+	// Blocks depending on a changed block run again
+	changedPackages := append([]NamedCommandBlock{{Name: "Packages", Commands: "dnf install -y nginx httpd"}}, blocks[1:]...)
+	changed, unchanged = state.changedBlocks(header, changedPackages)
+	assert.Equal(t, []string{"Packages", "SSHD", "Timezone"}, names(changed))
+	assert.Equal(t, []string{"Hostname"}, unchanged)
+
+	// Blocks not applied or failed are kept as they were
+	state.record("def", header, changedPackages[:1], []string{"Packages"}, nil, now.Add(time.Hour))
+	assert.Equal(t, blockHash(header, blocks[1]), state.Blocks["SSHD"].SHA256)
+	assert.Equal(t, blockHash(header, changedPackages[0]), state.Blocks["Packages"].SHA256)
+	assert.True(t, now.Equal(state.Blocks["SSHD"].AppliedAt))
+}
+
+func TestLoadApplyStateInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0644))
+	_, err := loadApplyState(path)
+	assert.ErrorContains(t, err, "error reading state file "+path)
+}
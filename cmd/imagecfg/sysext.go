@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// extensionType describes a kind of systemd extension image
+type extensionType struct {
+	// Kind is the name systemd uses, "sysext" or "confext"
+	Kind string
+	// Dirs are the top level directories the extension may contain
+	Dirs []string
+	// ReleaseDir is the directory of the extension-release file
+	ReleaseDir string
+}
+
+var sysextType = extensionType{
+	Kind:       "sysext",
+	Dirs:       []string{"/usr", "/opt"},
+	ReleaseDir: "/usr/lib/extension-release.d",
+}
+
+// extensionIgnoredPaths are package manager state and scratch space, which are left
+// out of extension images. The rpm database in particular must not shadow the host one.
+var extensionIgnoredPaths = []string{
+	"/dev", "/proc", "/sys", "/run", "/tmp", "/var/tmp",
+	"/var/cache", "/var/log", "/var/lib/dnf", "/var/lib/rpm",
+	"/usr/lib/sysimage", "/etc/ld.so.cache",
+}
+
+// extensionOptions are the options shared by the extension image commands
+type extensionOptions struct {
+	Name      string
+	Output    string
+	Format    string
+	OSID      string
+	VersionID string
+}
+
+var sysextOptions extensionOptions
+
+var sysextCmd = &cobra.Command{
+	Use:   "sysext --name NAME --output FILE [blueprint.toml...]",
+	Short: "Build a systemd system extension from an OSBuild blueprint",
+	Long: `Applies an OSBuild blueprint (TOML format) into a directory tree and packages
+it as a systemd system extension image, so that packages and files can be
+layered onto immutable hosts with systemd-sysext without rebuilding the base.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+The blocks of the 'bash' command are run in a chroot on top of an overlay of
+the running system, the changes they make end up in the image. Only /usr and
+/opt can be extended, customizations changing other paths are refused with
+a report of the fields they come from.
+
+This command requires root privileges, and mkfs.erofs or mksquashfs.`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+		if err := buildExtensionImage(bp, sysextType, sysextOptions); err != nil {
+			return fmt.Errorf("error building system extension: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	addExtensionFlags(sysextCmd, &sysextOptions)
+	rootCmd.AddCommand(sysextCmd)
+}
+
+// addExtensionFlags registers the flags shared by the extension image commands.
+func addExtensionFlags(cmd *cobra.Command, opts *extensionOptions) {
+	cmd.Flags().StringVar(&opts.Name, "name", "", "name of the extension")
+	cmd.Flags().StringVar(&opts.Output, "output", "", "path of the image to write")
+	cmd.Flags().StringVar(&opts.Format, "format", "erofs", "file system of the image, erofs or squashfs")
+	cmd.Flags().StringVar(&opts.OSID, "os-id", "", "ID of the os-release the extension is for, _any for all (default: the ID of this system)")
+	cmd.Flags().StringVar(&opts.VersionID, "version-id", "", "VERSION_ID of the os-release the extension is for (default: the VERSION_ID of this system)")
+	_ = cmd.MarkFlagRequired("name")
+	_ = cmd.MarkFlagRequired("output")
+}
+
+// extensionNameRegexp matches the names systemd accepts for extension images.
+var extensionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// osReleaseField returns the value of key in the os-release content, unquoted.
+func osReleaseField(content, key string) string {
+	for _, line := range strings.Split(content, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), key+"="); ok {
+			return strings.Trim(value, `"'`)
+		}
+	}
+	return ""
+}
+
+// extensionRelease returns the content of the extension-release file, which ties
+// the extension to the os-release of the host.
+func extensionRelease(opts extensionOptions) (string, error) {
+	osID, versionID := opts.OSID, opts.VersionID
+	if osID == "" || (versionID == "" && osID != "_any") {
+		data, err := os.ReadFile("/etc/os-release")
+		if err != nil {
+			return "", fmt.Errorf("cannot determine the os-release of the extension, use --os-id: %w", err)
+		}
+		if osID == "" {
+			osID = osReleaseField(string(data), "ID")
+		}
+		if versionID == "" && osID != "_any" {
+			versionID = osReleaseField(string(data), "VERSION_ID")
+		}
+	}
+	if osID == "" {
+		return "", fmt.Errorf("cannot determine the os-release ID of the extension, use --os-id")
+	}
+
+	release := "ID=" + osID + "\n"
+	if versionID != "" {
+		release += "VERSION_ID=" + versionID + "\n"
+	}
+	return release, nil
+}
+
+// pathWithin reports whether path is dir or inside of it.
+func pathWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// extensionViolations returns the changed paths that neither belong to the
+// extension nor are ignored. The parents of those, e.g. /var for /var/cache,
+// are fine as well.
+func extensionViolations(ext extensionType, changes []string) []string {
+	var violations []string
+	for _, path := range changes {
+		allowed := false
+		for _, dir := range slices.Concat(ext.Dirs, extensionIgnoredPaths) {
+			if pathWithin(path, dir) || pathWithin(dir, strings.TrimSuffix(path, "/")) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violations = append(violations, path)
+		}
+	}
+	return violations
+}
+
+// extensionFileViolations reports the files and directories of the blueprint that are
+// outside of the extension directories, which is known without applying the blueprint.
+func extensionFileViolations(bp *Blueprint, ext extensionType) []string {
+	var dirs, files []string
+	for _, dir := range bp.Customizations.GetDirectories() {
+		dirs = append(dirs, dir.Path)
+	}
+	for _, file := range bp.Customizations.GetFiles() {
+		files = append(files, file.Path)
+	}
+
+	var report []string
+	if violations := extensionViolations(ext, dirs); len(violations) > 0 {
+		report = append(report, "  customizations.directories: "+strings.Join(violations, " "))
+	}
+	if violations := extensionViolations(ext, files); len(violations) > 0 {
+		report = append(report, "  customizations.files: "+strings.Join(violations, " "))
+	}
+	return report
+}
+
+// extensionViolationError returns the error listing the customizations that change
+// paths outside of the extension directories, one report line per customization.
+func extensionViolationError(ext extensionType, report []string) error {
+	return fmt.Errorf("a %s can only contain %s, these customizations change other paths:\n%s",
+		ext.Kind, strings.Join(ext.Dirs, " and "), strings.Join(report, "\n"))
+}
+
+// treePaths returns the paths in the tree at root, relative to it.
+func treePaths(root string) (map[string]bool, error) {
+	paths := make(map[string]bool)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		paths[filepath.Join("/", rel)] = true
+		return nil
+	})
+	return paths, err
+}
+
+// overlayChrootCmd returns a command running script in a chroot on top of an overlay
+// of the root file system, which records the changes in upper.
+func overlayChrootCmd(upper, work, merged, script string) *exec.Cmd {
+	mountAndRun := `mount -t overlay overlay -o "lowerdir=/,upperdir=$1,workdir=$2" "$3" && ` +
+		`mount --rbind /dev "$3/dev" && mount -t proc proc "$3/proc" && mount --rbind /sys "$3/sys" && ` +
+		`exec chroot "$3" /bin/bash -c "$4"`
+	cmd := exec.Command("unshare", "--mount", "--propagation", "private", "/bin/sh", "-c", mountAndRun, "sh", upper, work, merged, script)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// mkfsCmd returns the command packing the tree into an image of the given format.
+func mkfsCmd(format, tree, output string) (*exec.Cmd, error) {
+	var cmd *exec.Cmd
+	switch format {
+	case "erofs":
+		cmd = exec.Command("mkfs.erofs", "--all-root", output, tree)
+	case "squashfs":
+		cmd = exec.Command("mksquashfs", tree, output, "-all-root", "-noappend", "-quiet")
+	default:
+		return nil, fmt.Errorf("unknown image format %q, must be erofs or squashfs", format)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// buildExtensionImage applies the blueprint block by block on top of an overlay of the
+// running system and packs the changes into an extension image. Customizations that
+// change paths outside of the extension directories are reported by their fields.
+func buildExtensionImage(bp *Blueprint, ext extensionType, opts extensionOptions) error {
+	if !extensionNameRegexp.MatchString(opts.Name) {
+		return fmt.Errorf("invalid extension name %q", opts.Name)
+	}
+	release, err := extensionRelease(opts)
+	if err != nil {
+		return err
+	}
+	// Fail before the blueprint is applied
+	if _, err := mkfsCmd(opts.Format, "", ""); err != nil {
+		return err
+	}
+	if report := extensionFileViolations(bp, ext); len(report) > 0 {
+		return extensionViolationError(ext, report)
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("building a %s requires root privileges", ext.Kind)
+	}
+
+	header, namedBlocks, err := generateBashScript(bp)
+	if err != nil {
+		return fmt.Errorf("error generating command blocks: %w", err)
+	}
+
+	staging, err := os.MkdirTemp("", "imagecfg-"+ext.Kind+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	// The upper directory must not be on the file system of the lower one
+	if err := exec.Command("mount", "-t", "tmpfs", "tmpfs", staging).Run(); err != nil {
+		return fmt.Errorf("error mounting the staging tmpfs: %w", err)
+	}
+	defer func() {
+		if err := exec.Command("umount", staging).Run(); err != nil {
+			logger.Warn("failed to unmount the staging tmpfs", "path", staging, "error", err)
+		}
+	}()
+	upper, work, merged := filepath.Join(staging, "upper"), filepath.Join(staging, "work"), filepath.Join(staging, "merged")
+	for _, dir := range []string{upper, work, merged} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	seen := map[string]bool{}
+	var report []string
+	for _, block := range namedBlocks {
+		logger.Info("applying block", "block", block.Name)
+		if err := overlayChrootCmd(upper, work, merged, header+block.Commands).Run(); err != nil {
+			return fmt.Errorf("execution failed for block '%s': %w", block.Name, err)
+		}
+
+		paths, err := treePaths(upper)
+		if err != nil {
+			return err
+		}
+		var changes []string
+		for path := range paths {
+			if !seen[path] {
+				changes = append(changes, path)
+				seen[path] = true
+			}
+		}
+		slices.Sort(changes)
+		if violations := extensionViolations(ext, changes); len(violations) > 0 {
+			fields := block.Name
+			if len(block.Fields) > 0 {
+				fields = strings.Join(block.Fields, ", ") + " (" + block.Name + ")"
+			}
+			report = append(report, fmt.Sprintf("  %s: %s", fields, strings.Join(violations, " ")))
+		}
+	}
+	if len(report) > 0 {
+		return extensionViolationError(ext, report)
+	}
+
+	// Everything outside of the extension directories is ignored or a parent of it
+	entries, err := os.ReadDir(upper)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !slices.Contains(ext.Dirs, "/"+entry.Name()) {
+			if err := os.RemoveAll(filepath.Join(upper, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	for _, dir := range extensionIgnoredPaths {
+		if err := os.RemoveAll(filepath.Join(upper, dir)); err != nil {
+			return err
+		}
+	}
+	releaseDir := filepath.Join(upper, ext.ReleaseDir)
+	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(releaseDir, "extension-release."+opts.Name), []byte(release), 0644); err != nil {
+		return err
+	}
+
+	mkfs, err := mkfsCmd(opts.Format, upper, opts.Output)
+	if err != nil {
+		return err
+	}
+	if err := mkfs.Run(); err != nil {
+		return fmt.Errorf("error packing the %s image: %w", ext.Kind, err)
+	}
+	fmt.Printf("Wrote %s\n", opts.Output)
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtensionViolations(t *testing.T) {
+	changes := []string{
+		"/", "/usr", "/usr/bin/htop", "/opt/app",
+		"/var", "/var/lib", "/var/lib/dnf/history.sqlite", "/usr/lib/sysimage/rpm/rpmdb.sqlite",
+		"/etc", "/etc/htoprc", "/var/lib/app",
+	}
+	assert.Equal(t, []string{"/etc/htoprc", "/var/lib/app"}, extensionViolations(sysextType, changes))
+}
+
+func TestExtensionRelease(t *testing.T) {
+	release, err := extensionRelease(extensionOptions{OSID: "fedora", VersionID: "41"})
+	require.NoError(t, err)
+	assert.Equal(t, "ID=fedora\nVERSION_ID=41\n", release)
+
+	release, err = extensionRelease(extensionOptions{OSID: "_any"})
+	require.NoError(t, err)
+	assert.Equal(t, "ID=_any\n", release)
+}
+
+func TestOsReleaseField(t *testing.T) {
+	osRelease := "NAME=\"Fedora Linux\"\nID=fedora\nVERSION_ID=41\nVERSION_CODENAME=\"\"\n"
+	assert.Equal(t, "fedora", osReleaseField(osRelease, "ID"))
+	assert.Equal(t, "41", osReleaseField(osRelease, "VERSION_ID"))
+	assert.Equal(t, "Fedora Linux", osReleaseField(osRelease, "NAME"))
+	assert.Equal(t, "", osReleaseField(osRelease, "VARIANT_ID"))
+}
+
+func TestBuildExtensionImageInvalidOptions(t *testing.T) {
+	bp := mustParseBlueprint(t, "")
+	err := buildExtensionImage(bp, sysextType, extensionOptions{Name: "../app", Output: "app.raw", Format: "erofs", OSID: "_any"})
+	assert.ErrorContains(t, err, `invalid extension name "../app"`)
+	err = buildExtensionImage(bp, sysextType, extensionOptions{Name: "app", Output: "app.raw", Format: "ext4", OSID: "_any"})
+	assert.ErrorContains(t, err, `unknown image format "ext4"`)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// blueprintTemplate and blueprintValues are set by --template and --values: whether
+// blueprints are rendered with text/template before they are parsed, and the YAML
+// files with the values they are rendered with
+var (
+	blueprintTemplate bool
+	blueprintValues   []string
+)
+
+// templateFuncs are the functions of blueprint templates besides the builtin ones
+var templateFuncs = template.FuncMap{
+	// quote returns the value as a quoted string, which TOML, JSON and YAML all read
+	"quote": func(v interface{}) (string, error) {
+		data, err := json.Marshal(fmt.Sprint(v))
+		return string(data), err
+	},
+	// default returns the value, or def if it is empty
+	"default": func(def, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+	"join": func(sep string, v []interface{}) string {
+		s := make([]string, len(v))
+		for i, e := range v {
+			s[i] = fmt.Sprint(e)
+		}
+		return strings.Join(s, sep)
+	},
+}
+
+// renderBlueprint renders the blueprint read from path with --template, with the values
+// of the --values files as the dot. The data is returned unchanged without --template.
+func renderBlueprint(path string, data []byte) ([]byte, error) {
+	if !blueprintTemplate {
+		if len(blueprintValues) > 0 {
+			return nil, fmt.Errorf("--values needs --template")
+		}
+		return data, nil
+	}
+	values, err := templateValues(blueprintValues)
+	if err != nil {
+		return nil, err
+	}
+	// A value missing from the values files is an error, not an empty string
+	tmpl, err := template.New(filepath.Base(path)).Option("missingkey=error").Funcs(templateFuncs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing blueprint template %s: %w", path, err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, values); err != nil {
+		return nil, fmt.Errorf("error rendering blueprint template %s: %w", path, err)
+	}
+	return out.Bytes(), nil
+}
+
+// templateValues reads the values files, merging the tables of later files into the
+// ones of earlier files and replacing everything else.
+func templateValues(files []string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading values: %w", err)
+		}
+		doc, err := decodeDocument(data, "yaml")
+		if err != nil {
+			return nil, fmt.Errorf("error parsing values %s: %w", file, err)
+		}
+		mergeValues(values, doc)
+	}
+	return values, nil
+}
+
+// mergeValues merges the values of src into dst.
+func mergeValues(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcTable, ok := value.(map[string]interface{})
+		dstTable, dstOk := dst[key].(map[string]interface{})
+		if ok && dstOk {
+			mergeValues(dstTable, srcTable)
+		} else {
+			dst[key] = value
+		}
+	}
+}
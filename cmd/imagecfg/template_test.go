@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadBlueprintTemplate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+[customizations]
+hostname = {{ .hostname | quote }}
+{{ range .users }}
+[[customizations.user]]
+name = {{ .name | quote }}
+groups = [{{ range $i, $g := .groups }}{{ if $i }}, {{ end }}{{ quote $g }}{{ end }}]
+{{ end }}
+{{- if .firewall }}
+[customizations.firewall]
+ports = [{{ range $i, $p := .ports }}{{ if $i }}, {{ end }}"{{ $p }}:tcp"{{ end }}]
+{{- end }}
+`), 0644))
+	values := filepath.Join(dir, "values.yaml")
+	require.NoError(t, os.WriteFile(values, []byte(`
+hostname: web1
+firewall: false
+ports: [80, 443]
+users:
+  - name: alice
+    groups: [wheel]
+  - name: bob
+    groups: [wheel, users]
+`), 0644))
+	site := filepath.Join(dir, "site.yaml")
+	require.NoError(t, os.WriteFile(site, []byte("hostname: web2\nfirewall: true\n"), 0644))
+
+	oldTemplate, oldValues := blueprintTemplate, blueprintValues
+	t.Cleanup(func() { blueprintTemplate, blueprintValues = oldTemplate, oldValues })
+
+	blueprintValues = []string{values}
+	_, err := loadBlueprint([]string{path})
+	assert.EqualError(t, err, "--values needs --template")
+
+	blueprintTemplate = true
+	bp, err := loadBlueprint([]string{path})
+	require.NoError(t, err)
+	assert.Equal(t, "web1", *bp.Customizations.GetHostname())
+	require.Len(t, bp.Customizations.User, 2)
+	assert.Equal(t, "bob", bp.Customizations.User[1].Name)
+	assert.Equal(t, []string{"wheel", "users"}, bp.Customizations.User[1].Groups)
+	assert.Nil(t, bp.Customizations.Firewall)
+
+	// Later values files override earlier ones
+	blueprintValues = []string{values, site}
+	bp, err = loadBlueprint([]string{path})
+	require.NoError(t, err)
+	assert.Equal(t, "web2", *bp.Customizations.GetHostname())
+	require.NotNil(t, bp.Customizations.Firewall)
+	assert.Equal(t, []string{"80:tcp", "443:tcp"}, bp.Customizations.Firewall.Ports)
+
+	blueprintValues = nil
+	_, err = loadBlueprint([]string{path})
+	assert.ErrorContains(t, err, "error rendering blueprint template "+path)
+	assert.ErrorContains(t, err, `map has no entry for key "hostname"`)
+}
+
+func TestMergeValues(t *testing.T) {
+	values := map[string]interface{}{"site": map[string]interface{}{"name": "prg", "region": "eu"}, "ports": []interface{}{80}}
+	mergeValues(values, map[string]interface{}{"site": map[string]interface{}{"name": "brq"}, "ports": []interface{}{443}})
+	assert.Equal(t, map[string]interface{}{"site": map[string]interface{}{"name": "brq", "region": "eu"}, "ports": []interface{}{443}}, values)
+}
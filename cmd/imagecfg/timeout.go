@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// applyTimeout and applyBlockTimeouts are set by --timeout and --block-timeout, the
+// longest blocks may run for, all of them and single ones
+var (
+	applyTimeout       time.Duration
+	applyBlockTimeouts []string
+)
+
+// timeoutKillDelay is how long a block that timed out has to exit after it was
+// terminated, before it is killed: dnf then still cleans up its transaction
+var timeoutKillDelay = 10 * time.Second
+
+// parseBlockTimeouts parses the timeouts of single blocks given as NAME=DURATION, with
+// the blocks named by their slugs or names like in --only, into a map by slug. A
+// duration of 0 runs the block without a timeout.
+func parseBlockTimeouts(timeouts []string) (map[string]time.Duration, error) {
+	known := blockNames()
+	parsed := make(map[string]time.Duration)
+	for _, timeout := range timeouts {
+		name, value, found := strings.Cut(timeout, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid block timeout %q, must be NAME=DURATION, e.g. packages=1h", timeout)
+		}
+		slug := blockSlug(name)
+		if !slices.Contains(known, slug) {
+			return nil, fmt.Errorf("unknown block %q, must be one of: %s", name, strings.Join(known, ", "))
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid timeout %q for block %s, must be a duration like 90s or 1h", value, name)
+		}
+		parsed[slug] = d
+	}
+	return parsed, nil
+}
+
+// runWithTimeout runs the command and returns whether it timed out. When the timeout
+// is over, the command and everything it started get SIGTERM, and SIGKILL if they did
+// not exit after timeoutKillDelay. No timeout is set if it is 0.
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) (bool, error) {
+	if timeout <= 0 {
+		return false, cmd.Run()
+	}
+	// The script gets its own process group, so that dnf and the other commands it
+	// started are signaled with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// Commands left in the background must not keep the output open forever
+	cmd.WaitDelay = timeoutKillDelay
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	done := make(chan struct{})
+	timedOut := make(chan bool, 1)
+	go func() {
+		select {
+		case <-done:
+			timedOut <- false
+			return
+		case <-time.After(timeout):
+		}
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		timedOut <- true
+		select {
+		case <-done:
+		case <-time.After(timeoutKillDelay):
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	return <-timedOut, err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBlockTimeouts(t *testing.T) {
+	timeouts, err := parseBlockTimeouts([]string{"packages=1h", "Domain Join=90s", "firewall=0"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{"packages": time.Hour, "domain-join": 90 * time.Second, "firewall": 0}, timeouts)
+
+	opts := applyOptions{Timeout: time.Minute, BlockTimeouts: timeouts}
+	assert.Equal(t, time.Hour, opts.blockTimeout("Packages"))
+	assert.Equal(t, time.Duration(0), opts.blockTimeout("Firewall"))
+	assert.Equal(t, time.Minute, opts.blockTimeout("Users"))
+
+	_, err = parseBlockTimeouts([]string{"packages"})
+	assert.ErrorContains(t, err, `invalid block timeout "packages", must be NAME=DURATION`)
+	_, err = parseBlockTimeouts([]string{"nonexistent=1m"})
+	assert.ErrorContains(t, err, `unknown block "nonexistent"`)
+	_, err = parseBlockTimeouts([]string{"packages=soon"})
+	assert.ErrorContains(t, err, `invalid timeout "soon" for block packages`)
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	timedOut, err := runWithTimeout(exec.Command("true"), time.Minute)
+	assert.False(t, timedOut)
+	assert.NoError(t, err)
+
+	// Commands started by the script are terminated with it
+	start := time.Now()
+	cmd := exec.Command("sh", "-c", "sleep 60 & sleep 60")
+	timedOut, err = runWithTimeout(cmd, 100*time.Millisecond)
+	assert.True(t, timedOut)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Scripts ignoring SIGTERM are killed
+	old := timeoutKillDelay
+	timeoutKillDelay = 200 * time.Millisecond
+	t.Cleanup(func() { timeoutKillDelay = old })
+	start = time.Now()
+	cmd = exec.Command("sh", "-c", "trap '' TERM; sleep 60")
+	timedOut, err = runWithTimeout(cmd, 100*time.Millisecond)
+	assert.True(t, timedOut)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestApplyBlocksTimeout(t *testing.T) {
+	discardLogs(t)
+	blocks := []NamedCommandBlock{
+		{Name: "Packages", Commands: "sleep 60"},
+		{Name: "Users", Commands: "sleep 0.2"},
+	}
+	applied, failed, err := applyBlocks("#!/bin/sh\nset -eu\n", blocks, applyOptions{
+		ContinueOnError: true,
+		Timeout:         100 * time.Millisecond,
+		BlockTimeouts:   map[string]time.Duration{"users": time.Minute},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Users"}, applied)
+	assert.Equal(t, []string{"Packages"}, failed)
+
+	_, _, err = applyBlocks("#!/bin/sh\nset -eu\n", blocks[:1], applyOptions{Timeout: 100 * time.Millisecond})
+	assert.EqualError(t, err, "block 'Packages' timed out after 100ms")
+}
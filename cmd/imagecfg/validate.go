@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	// Timezones are checked without relying on the zoneinfo of the system
+	_ "time/tzdata"
+
+	"github.com/spf13/cobra"
+)
+
+// validationIssue is a problem found in a blueprint
+type validationIssue struct {
+	// Field is the blueprint key the problem is in
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationResult is the machine-readable result of validating a blueprint
+type validationResult struct {
+	Valid  bool              `json:"valid"`
+	Issues []validationIssue `json:"issues"`
+}
+
+var validateFormat string
+
+var validateCmd = &cobra.Command{
+	Use:   "validate [blueprint.toml]",
+	Short: "Check an OSBuild blueprint for problems",
+	Long: `Parses and checks an OSBuild blueprint (TOML format) without generating
+anything. Unknown keys, invalid timezones and locales, malformed firewall
+ports, conflicting UIDs and GIDs, users in undefined groups and all values
+that the 'bash' command would reject are reported.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+Groups are defined if the blueprint creates them, they are base groups of
+Fedora and RHEL, such as wheel, or they exist in /etc/group.
+The command fails if any problem is found.
+
+Supported formats:
+- text: a line per problem
+- json: an object with "valid" and the list of "issues"`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if validateFormat != "text" && validateFormat != "json" {
+			return fmt.Errorf("unknown validate format %q, must be text or json", validateFormat)
+		}
+		blueprintPath := defaultBlueprintPath
+		if len(args) > 0 {
+			blueprintPath = args[0]
+		}
+		bp, unknownKeys, err := decodeBlueprint(blueprintPath)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+
+		var issues []validationIssue
+		for _, key := range unknownKeys {
+			issues = append(issues, validationIssue{Field: key, Message: "unknown key"})
+		}
+		issues = append(issues, validateBlueprint(bp, systemGroups())...)
+
+		if validateFormat == "json" {
+			data, err := json.MarshalIndent(validationResult{Valid: len(issues) == 0, Issues: append([]validationIssue{}, issues...)}, "", "  ")
+			if err != nil {
+				return fmt.Errorf("error encoding validation result: %w", err)
+			}
+			fmt.Println(string(data))
+		} else {
+			for _, issue := range issues {
+				fmt.Printf("%s: %s\n", issue.Field, issue.Message)
+			}
+		}
+		if len(issues) > 0 {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("%s: %d problem(s) found", blueprintPath, len(issues))
+		}
+		if validateFormat == "text" {
+			fmt.Printf("%s is valid\n", blueprintPath)
+		}
+		return nil
+	},
+}
+
+func init() {
+	validateCmd.Flags().StringVar(&validateFormat, "format", "text", "output format, text or json")
+	rootCmd.AddCommand(validateCmd)
+}
+
+// baseGroups are created by the setup package of Fedora and RHEL, they are defined
+// even if the blueprint is validated on another system
+var baseGroups = []string{
+	"root", "bin", "daemon", "sys", "adm", "tty", "disk", "lp", "mem", "kmem", "wheel",
+	"cdrom", "mail", "man", "dialout", "floppy", "games", "tape", "video", "ftp", "lock",
+	"audio", "users", "nobody", "input", "kvm", "render", "utmp", "systemd-journal",
+}
+
+// systemGroups returns the base groups and the names of the groups in /etc/group.
+func systemGroups() map[string]bool {
+	groups := make(map[string]bool)
+	for _, name := range baseGroups {
+		groups[name] = true
+	}
+	f, err := os.Open("/etc/group")
+	if err != nil {
+		return groups
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name, _, ok := strings.Cut(scanner.Text(), ":"); ok && name != "" {
+			groups[name] = true
+		}
+	}
+	return groups
+}
+
+// portRegexp matches firewall ports such as 22/tcp, 8000-8080:udp or imap:tcp.
+var portRegexp = regexp.MustCompile(`^(?:([0-9]+)(?:-([0-9]+))?|[a-z][a-z0-9-]*)[:/](tcp|udp|sctp|dccp)$`)
+
+// validatePort checks a firewall port specification.
+func validatePort(port string) error {
+	m := portRegexp.FindStringSubmatch(port)
+	if m == nil {
+		return fmt.Errorf("malformed port %q, must be PORT[-PORT]/PROTOCOL or SERVICE/PROTOCOL", port)
+	}
+	if m[1] == "" {
+		return nil // Service name
+	}
+	start, _ := strconv.Atoi(m[1])
+	end := start
+	if m[2] != "" {
+		end, _ = strconv.Atoi(m[2])
+	}
+	if start < 1 || end > 65535 || start > end {
+		return fmt.Errorf("invalid port range in %q", port)
+	}
+	return nil
+}
+
+// validateBlueprint checks the semantics of the blueprint. The groups in systemGroups
+// exist on the target system already.
+func validateBlueprint(bp *Blueprint, systemGroups map[string]bool) []validationIssue {
+	var issues []validationIssue
+	report := func(field, format string, args ...interface{}) {
+		issues = append(issues, validationIssue{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// Everything the blocks reject, e.g. invalid locales, attributed to the fields they come from
+	for _, blk := range slices.Concat(blockGenerators, []blockGen{machineIDResetBlock}) {
+		if _, err := blk.generator(bp); err != nil {
+			field := strings.Join(blueprintFields(bp, blk.fields), ", ")
+			if field == "" {
+				field = blk.name
+			}
+			report(field, "%v", err)
+		}
+	}
+
+	if timezone, _ := bp.Customizations.GetTimezoneSettings(); timezone != nil && *timezone != "" {
+		if _, err := time.LoadLocation(*timezone); err != nil {
+			report("customizations.timezone.timezone", "unknown timezone %q", *timezone)
+		}
+	}
+
+	if fw := bp.Customizations.GetFirewall(); fw != nil {
+		for _, port := range fw.Ports {
+			if err := validatePort(port); err != nil {
+				report("customizations.firewall.ports", "%v", err)
+			}
+		}
+	}
+
+	groupNames := make(map[string]bool)
+	groupGIDs := make(map[int]string)
+	for _, group := range bp.Customizations.GetGroups() {
+		if groupNames[group.Name] {
+			report("customizations.group", "group %s is defined more than once", group.Name)
+		}
+		groupNames[group.Name] = true
+		if group.GID != nil {
+			if other, ok := groupGIDs[*group.GID]; ok && other != group.Name {
+				report("customizations.group.gid", "groups %s and %s have the same GID %d", other, group.Name, *group.GID)
+			}
+			groupGIDs[*group.GID] = group.Name
+		}
+	}
+
+	userNames := make(map[string]bool)
+	userUIDs := make(map[int]string)
+	for _, user := range bp.Customizations.GetUsers() {
+		if userNames[user.Name] {
+			report("customizations.user", "user %s is defined more than once", user.Name)
+		}
+		userNames[user.Name] = true
+		if user.UID != nil {
+			if other, ok := userUIDs[*user.UID]; ok && other != user.Name {
+				report("customizations.user.uid", "users %s and %s have the same UID %d", other, user.Name, *user.UID)
+			}
+			userUIDs[*user.UID] = user.Name
+		}
+		for _, group := range user.Groups {
+			if !groupNames[group] && !systemGroups[group] {
+				report("customizations.user.groups", "user %s is in group %s, which is not defined", user.Name, group)
+			}
+		}
+	}
+
+	return issues
+}
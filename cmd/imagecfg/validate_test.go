@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateBlueprint(t *testing.T) {
+	bp := mustParseBlueprint(t, `
+[customizations.timezone]
+timezone = "Mars/Olympus_Mons"
+
+[customizations.locale]
+languages = ["en_US.UTF-8", "C.UTF-8", "english"]
+
+[customizations.firewall]
+ports = ["22/tcp", "8000-8080:udp", "imap:tcp", "80", "70000/tcp", "90-80/tcp"]
+
+[[customizations.group]]
+name = "app"
+gid = 2000
+
+[[customizations.group]]
+name = "web"
+gid = 2000
+
+[[customizations.user]]
+name = "admin"
+uid = 1000
+groups = ["wheel", "app", "missing"]
+
+[[customizations.user]]
+name = "deploy"
+uid = 1000
+
+[customizations.journald]
+storage = "nowhere"
+`)
+	issues := validateBlueprint(bp, map[string]bool{"wheel": true})
+	assert.Equal(t, []validationIssue{
+		{Field: "customizations.locale", Message: `invalid locale "english": expected something like en_US.UTF-8`},
+		{Field: "customizations.journald", Message: `invalid journald storage "nowhere": must be volatile, persistent, auto or none`},
+		{Field: "customizations.timezone.timezone", Message: `unknown timezone "Mars/Olympus_Mons"`},
+		{Field: "customizations.firewall.ports", Message: `malformed port "80", must be PORT[-PORT]/PROTOCOL or SERVICE/PROTOCOL`},
+		{Field: "customizations.firewall.ports", Message: `invalid port range in "70000/tcp"`},
+		{Field: "customizations.firewall.ports", Message: `invalid port range in "90-80/tcp"`},
+		{Field: "customizations.group.gid", Message: "groups app and web have the same GID 2000"},
+		{Field: "customizations.user.groups", Message: "user admin is in group missing, which is not defined"},
+		{Field: "customizations.user.uid", Message: "users admin and deploy have the same UID 1000"},
+	}, issues)
+
+	assert.Empty(t, validateBlueprint(mustParseBlueprint(t, `
+[customizations]
+hostname = "ok"
+`), nil))
+}
+
+func TestDecodeBlueprintUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte("[customizations]\nhostname = \"ok\"\nhostnme = \"typo\"\n"), 0644))
+
+	bp, unknownKeys, err := decodeBlueprint(path)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", *bp.Customizations.GetHostname())
+	assert.Equal(t, []string{"customizations.hostnme"}, unknownKeys)
+
+	_, err = parseBlueprint(path)
+	assert.ErrorContains(t, err, "unknown configuration keys")
+}
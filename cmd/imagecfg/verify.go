@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// verifyDriftExitCode is the exit code of verify if the system drifted from the blueprint
+const verifyDriftExitCode = 2
+
+// driftReport is the machine-readable result of verifying the system against a blueprint
+type driftReport struct {
+	Blueprint string `json:"blueprint"`
+	Drifted   bool   `json:"drifted"`
+	// Drift lists the changes re-applying the blueprint would make
+	Drift []systemChange `json:"drift"`
+}
+
+var verifyFormat string
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [blueprint.toml...]",
+	Short: "Check that the system still matches an OSBuild blueprint",
+	Long: `Checks whether the running system still matches an OSBuild blueprint (TOML
+format), after 'apply' or at any later time, e.g. as a greenboot health check
+or from monitoring. The same settings as in the 'diff' command are compared.
+
+If no blueprint path is provided, the default path (/usr/lib/bootc-image-builder/config.toml) will be used.
+
+Exit codes:
+- 0: the system matches the blueprint
+- 1: the blueprint or the system state could not be read
+- 2: the system drifted from the blueprint
+
+Supported formats:
+- text: a line per drifted setting
+- json: an object with "drifted" and the list of "drift" items`,
+	Args: cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if verifyFormat != "text" && verifyFormat != "json" {
+			return fmt.Errorf("unknown verify format %q, must be text or json", verifyFormat)
+		}
+		blueprintPath := blueprintName(args)
+		bp, err := loadBlueprint(args)
+		if err != nil {
+			return err // Cobra will print this and exit
+		}
+		state, err := readSystemState(bp)
+		if err != nil {
+			return fmt.Errorf("error reading system state: %w", err)
+		}
+
+		drift := diffSystem(bp, state)
+		if verifyFormat == "json" {
+			report := driftReport{Blueprint: blueprintPath, Drifted: len(drift) > 0, Drift: append([]systemChange{}, drift...)}
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return fmt.Errorf("error encoding drift report: %w", err)
+			}
+			fmt.Println(string(data))
+		} else {
+			for _, change := range drift {
+				fmt.Printf("%s: %s\n", change.Block, change.Message)
+			}
+		}
+		if len(drift) > 0 {
+			cmd.SilenceUsage = true
+			return &exitCodeError{Code: verifyDriftExitCode, Err: fmt.Errorf("%s: %d setting(s) drifted", blueprintPath, len(drift))}
+		}
+		if verifyFormat == "text" {
+			fmt.Printf("System matches %s\n", blueprintPath)
+		}
+		return nil
+	},
+}
+
+func init() {
+	verifyCmd.Flags().StringVar(&verifyFormat, "format", "text", "output format, text or json")
+	rootCmd.AddCommand(verifyCmd)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDriftReport(t *testing.T) {
+	data, err := json.Marshal(driftReport{Blueprint: "config.toml", Drift: []systemChange{}})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"blueprint": "config.toml", "drifted": false, "drift": []}`, string(data))
+
+	data, err = json.Marshal(driftReport{Blueprint: "config.toml", Drifted: true, Drift: []systemChange{{Block: "Hostname", Message: "set hostname to box"}}})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"blueprint": "config.toml", "drifted": true, "drift": [{"block": "Hostname", "message": "set hostname to box"}]}`, string(data))
+}
+
+func TestExitCodeError(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &exitCodeError{Code: verifyDriftExitCode, Err: errors.New("drifted")})
+	var exitErr *exitCodeError
+	require.True(t, errors.As(err, &exitErr))
+	assert.Equal(t, 2, exitErr.Code)
+	assert.EqualError(t, err, "wrapped: drifted")
+}
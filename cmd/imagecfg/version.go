@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Build metadata, injected with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// blueprintModule is the module of the blueprint library
+const blueprintModule = "github.com/osbuild/blueprint"
+
+// buildInfo is the version information of the binary
+type buildInfo struct {
+	Version          string
+	Commit           string
+	BuildDate        string
+	BlueprintVersion string
+	GoVersion        string
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version of imagecfg",
+	Long: `Prints the version, git commit and build date of imagecfg and the version of
+the blueprint library it was built against, for bug reports.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Print(currentBuildInfo().String())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(versionCmd)
+	rootCmd.Version = version
+	rootCmd.SetVersionTemplate(currentBuildInfo().String())
+}
+
+// currentBuildInfo returns the version information of the running binary. The commit
+// and build date default to what the Go toolchain recorded from git.
+func currentBuildInfo() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, BlueprintVersion: "unknown", GoVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == blueprintModule {
+			info.BlueprintVersion = dep.Version
+			if dep.Replace != nil {
+				info.BlueprintVersion = dep.Replace.Version
+			}
+		}
+	}
+	for _, setting := range bi.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && info.Commit == "":
+			info.Commit = setting.Value
+		case setting.Key == "vcs.time" && info.BuildDate == "":
+			info.BuildDate = setting.Value
+		}
+	}
+	return info
+}
+
+func (info buildInfo) String() string {
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	var out strings.Builder
+	fmt.Fprintf(&out, "imagecfg %s\n", info.Version)
+	fmt.Fprintf(&out, "commit: %s\n", unknown(info.Commit))
+	fmt.Fprintf(&out, "build date: %s\n", unknown(info.BuildDate))
+	fmt.Fprintf(&out, "blueprint library: %s\n", info.BlueprintVersion)
+	fmt.Fprintf(&out, "go: %s\n", info.GoVersion)
+	return out.String()
+}
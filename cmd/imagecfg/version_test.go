@@ -0,0 +1,13 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildInfoString(t *testing.T) {
+	info := buildInfo{Version: "1.2.0", Commit: "0018bb8", BlueprintVersion: "v1.8.0", GoVersion: "go1.23.4"}
+	assert.Equal(t, "imagecfg 1.2.0\ncommit: 0018bb8\nbuild date: unknown\nblueprint library: v1.8.0\ngo: go1.23.4\n", info.String())
+	assert.Equal(t, version, currentBuildInfo().Version)
+}